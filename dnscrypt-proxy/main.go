@@ -7,23 +7,25 @@
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 
 	"github.com/jedisct1/dlog"
 	"github.com/kardianos/service"
+
+	"github.com/dnscrypt/dnscrypt-proxy/proxy"
 )
 
 const (
-	AppVersion            = "2.1.5"
 	DefaultConfigFileName = "dnscrypt-proxy.toml"
 )
 
 type App struct {
 	wg    sync.WaitGroup
 	quit  chan struct{}
-	proxy *Proxy
-	flags *ConfigFlags
+	proxy *proxy.Proxy
+	flags *proxy.ConfigFlags
 }
 
 func main() {
@@ -47,27 +49,57 @@ func main() {
 
 	svcFlag := flag.String("service", "", fmt.Sprintf("Control the system service: %q", service.ControlAction))
 	version := flag.Bool("version", false, "print current proxy version")
-	flags := ConfigFlags{}
+	flags := proxy.ConfigFlags{}
 	flags.Resolve = flag.String("resolve", "", "resolve a DNS name (string can be <name> or <name>,<resolver address>)")
 	flags.List = flag.Bool("list", false, "print the list of available resolvers for the enabled filters")
 	flags.ListAll = flag.Bool("list-all", false, "print the complete list of available resolvers, ignoring filters")
+	flags.ListSources = flag.Bool("list-sources", false, "print the state of the sources of servers: last update, signature, number of entries")
 	flags.IncludeRelays = flag.Bool("include-relays", false, "include the list of available relays in the output of -list and -list-all")
-	flags.JSONOutput = flag.Bool("json", false, "output list as JSON")
-	flags.Check = flag.Bool("check", false, "check the configuration file and exit")
+	flags.IncludeCertExpiry = flag.Bool("include-cert-expiry", false, "probe the servers, and include the number of days before their certificates expire in the output of -list and -list-all")
+	flags.JSONOutput = flag.Bool("json", false, "output list or resolution results as JSON")
+	flags.Check = flag.Bool("check", false, "check the configuration file and exit (with -json, print the problems that have been found as JSON)")
 	flags.ConfigFile = flag.String("config", DefaultConfigFileName, "Path to the configuration file")
+	flags.FallbackConfigFile = flag.String("fallback-config", "", "Path to a configuration file to use if the proxy cannot start with the main one")
 	flags.Child = flag.Bool("child", false, "Invokes program as a child process")
 	flags.NetprobeTimeoutOverride = flag.Int("netprobe-timeout", 60, "Override the netprobe timeout")
 	flags.ShowCerts = flag.Bool("show-certs", false, "print DoH certificate chain hashes")
+	flags.Control = flag.String("ctl", "", "send a command to the control socket of a running instance (use \"help\" to list them)")
+	flags.Trace = flag.String("trace", "", "show how a running instance resolves a name, step by step (string can be <name> or <name>,<type>)")
+	flags.DumpEffectiveConfig = flag.Bool("dump-effective-config", false, "print the configuration after defaults, credentials and overrides have been applied, with secrets masked, and exit")
+	setup := flag.Bool("setup", false, "interactively create a configuration file, using the fastest servers found on this network")
+	importTool := flag.String("import", "", "convert the configuration of another DNS tool (pihole, adguardhome or unbound) found at the path given as an argument")
+	fuzzCorpus := flag.String("fuzz-corpus", "", "add the seeds of the fuzzing harnesses to a corpus directory, and run the harnesses on all the inputs it contains")
 
 	flag.Parse()
 
 	if *version {
-		fmt.Println(AppVersion)
+		fmt.Println(proxy.AppVersion)
+		os.Exit(0)
+	}
+
+	if len(*fuzzCorpus) > 0 {
+		os.Exit(proxy.FuzzCorpus(*fuzzCorpus))
+	}
+
+	if *setup {
+		if err := proxy.Setup(*flags.ConfigFile, os.Stdin, os.Stdout); err != nil {
+			dlog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if len(*importTool) > 0 {
+		if flag.NArg() != 1 {
+			dlog.Fatal("Usage: -import <tool> <path>")
+		}
+		if err := proxy.Import(*importTool, flag.Arg(0), filepath.Dir(*flags.ConfigFile), os.Stdout); err != nil {
+			dlog.Fatal(err)
+		}
 		os.Exit(0)
 	}
 
 	if fullexecpath, err := os.Executable(); err == nil {
-		WarnIfMaybeWritableByOtherUsers(fullexecpath)
+		proxy.WarnIfMaybeWritableByOtherUsers(fullexecpath)
 	}
 
 	app := &App{
@@ -81,14 +113,17 @@ func main() {
 		WorkingDirectory: pwd,
 		Arguments:        []string{"-config", *flags.ConfigFile},
 	}
+	if len(*flags.FallbackConfigFile) > 0 {
+		svcConfig.Arguments = append(svcConfig.Arguments, "-fallback-config", *flags.FallbackConfigFile)
+	}
 	svc, err := service.New(app, svcConfig)
 	if err != nil {
 		svc = nil
 		dlog.Debug(err)
 	}
 
-	app.proxy = NewProxy()
-	_ = ServiceManagerStartNotify()
+	app.proxy = proxy.NewProxy()
+	_ = proxy.ServiceManagerStartNotify()
 	if len(*svcFlag) != 0 {
 		if svc == nil {
 			dlog.Fatal("Built-in service installation is not supported on this platform")
@@ -130,18 +165,18 @@ func (app *App) Start(service service.Service) error {
 }
 
 func (app *App) AppMain() {
-	if err := ConfigLoad(app.proxy, app.flags); err != nil {
-		dlog.Fatal(err)
-	}
-	if err := PidFileCreate(); err != nil {
-		dlog.Errorf("Unable to create the PID file: [%v]", err)
-	}
-	if err := app.proxy.InitPluginsGlobals(); err != nil {
+	loadedProxy, err := proxy.ConfigLoadWithFallback(app.proxy, app.flags, func() {
+		if err := PidFileCreate(); err != nil {
+			dlog.Errorf("Unable to create the PID file: [%v]", err)
+		}
+	})
+	app.proxy = loadedProxy
+	if err != nil {
 		dlog.Fatal(err)
 	}
 	app.quit = make(chan struct{})
 	app.wg.Add(1)
-	app.proxy.StartProxy()
+	app.proxy.Start()
 	runtime.GC()
 	<-app.quit
 	dlog.Notice("Quit signal received...")
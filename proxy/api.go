@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NewConfig returns a configuration with the default settings
+func NewConfig() Config {
+	return newConfig()
+}
+
+// LoadConfig reads a configuration file. Relative file names found in the configuration are
+// resolved from the current working directory.
+func LoadConfig(configFile string) (Config, error) {
+	config := newConfig()
+	md, err := decodeConfigFile(configFile, &config)
+	if err != nil {
+		return config, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return config, fmt.Errorf("Unsupported key in configuration file: [%s]", undecoded[0])
+	}
+	if err := config.loadCredentialsFile(); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func defaultConfigFlags() *ConfigFlags {
+	resolve, configFile, control, trace, fallbackConfigFile := "", "", "", "", ""
+	list, listAll, listSources, includeRelays, jsonOutput, check, child, showCerts := false, false, false, false, false, false, false, false
+	includeCertExpiry, dumpEffectiveConfig := false, false
+	netprobeTimeoutOverride := 0
+	return &ConfigFlags{
+		Resolve:                 &resolve,
+		List:                    &list,
+		ListAll:                 &listAll,
+		ListSources:             &listSources,
+		IncludeRelays:           &includeRelays,
+		IncludeCertExpiry:       &includeCertExpiry,
+		JSONOutput:              &jsonOutput,
+		Check:                   &check,
+		ConfigFile:              &configFile,
+		Child:                   &child,
+		NetprobeTimeoutOverride: &netprobeTimeoutOverride,
+		ShowCerts:               &showCerts,
+		Control:                 &control,
+		Trace:                   &trace,
+		FallbackConfigFile:      &fallbackConfigFile,
+		DumpEffectiveConfig:     &dumpEffectiveConfig,
+	}
+}
+
+// New creates a proxy from a configuration, binds the listening sockets and loads the plugins.
+// Sources are downloaded right away, but servers are only probed once Start() is called.
+// If the configuration doesn't include any listen addresses, the proxy can only be queried using Resolve().
+func New(config Config) (*Proxy, error) {
+	proxy := NewProxy()
+	if err := config.apply(proxy, defaultConfigFlags()); err != nil {
+		proxy.Stop()
+		return nil, err
+	}
+	if err := proxy.InitPluginsGlobals(); err != nil {
+		proxy.Stop()
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// Resolve sends a query through the plugins and the configured servers, as a local client would
+func (proxy *Proxy) Resolve(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if !proxy.clientsCountInc() {
+		return nil, errors.New("Too many concurrent queries")
+	}
+	responses := make(chan []byte, 1)
+	go func() {
+		defer proxy.clientsCountDec()
+		responses <- proxy.processIncomingQuery("trampoline", proxy.mainProto, packet, nil, nil, time.Now(), false)
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case responsePacket := <-responses:
+		if len(responsePacket) == 0 {
+			return nil, errors.New("No response")
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(responsePacket); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+}
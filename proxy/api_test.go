@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testAPIConfig() Config {
+	config := NewConfig()
+	config.ListenAddresses = nil
+	config.SourcesConfig = nil
+	config.NetprobeTimeout = 0
+	config.StaticsConfig = map[string]StaticConfig{
+		"example": {Stamp: "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5"},
+	}
+	return config
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	config := testAPIConfig()
+	config.MatcherEngine = "unknown"
+	if proxy, err := New(config); err == nil || proxy != nil {
+		t.Error("an invalid configuration should be rejected with an error")
+	}
+}
+
+func TestNewIndependentInstances(t *testing.T) {
+	dir := t.TempDir()
+	blockedNamesFile1, blockedNamesFile2 := filepath.Join(dir, "blocked-names-1.txt"), filepath.Join(dir, "blocked-names-2.txt")
+	if err := os.WriteFile(blockedNamesFile1, []byte("ads.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blockedNamesFile2, []byte("tracker.example.net\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config1 := testAPIConfig()
+	config1.MatcherEngine = MatcherEngineMap
+	config1.Deterministic = true
+	config1.RandomSeed = 42
+	config1.BlockName.File = blockedNamesFile1
+	config1.BlockName.CNAMETargets = true
+	proxy1, err := New(config1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy1.Stop()
+	config2 := testAPIConfig()
+	config2.BlockName.File = blockedNamesFile2
+	proxy2, err := New(config2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy2.Stop()
+
+	if proxy1.matcherEngine != MatcherEngineMap || proxy2.matcherEngine != MatcherEngineCritbit {
+		t.Errorf("matcher engines: [%s] and [%s]", proxy1.matcherEngine, proxy2.matcherEngine)
+	}
+	if proxy1.random == nil || proxy2.random != nil {
+		t.Error("only the deterministic instance should have a seeded generator")
+	}
+	probe1, probe2 := dns.Msg{}, dns.Msg{}
+	if err := probe1.Unpack(dohNXTestPacket(newLockedRand(42), 0xcafe)); err != nil {
+		t.Fatal(err)
+	}
+	if err := probe2.Unpack(dohNXTestPacket(newLockedRand(42), 0xcafe)); err != nil {
+		t.Fatal(err)
+	}
+	if probe1.Question[0].Name != probe2.Question[0].Name {
+		t.Error("probe names are not reproducible with a seeded generator")
+	}
+	var cacheKey [32]byte
+	proxy1.cachedResponses.store(cacheKey, CachedResponse{expiration: time.Now().Add(time.Minute)}, 10)
+	if _, found := proxy1.cachedResponses.lookup(cacheKey); !found {
+		t.Error("cached response not found")
+	}
+	if _, found := proxy2.cachedResponses.lookup(cacheKey); found {
+		t.Error("the cache is shared between instances")
+	}
+	for _, test := range []struct {
+		proxy   *Proxy
+		blocked string
+		allowed string
+	}{
+		{proxy1, "ads.example.com", "tracker.example.net"},
+		{proxy2, "tracker.example.net", "ads.example.com"},
+	} {
+		if test.proxy.blockedNames == nil {
+			t.Fatal("blocked names not loaded")
+		}
+		if reject, _, _ := test.proxy.blockedNames.patternMatcher.Eval(test.blocked); !reject {
+			t.Errorf("[%s] should be blocked", test.blocked)
+		}
+		if reject, _, _ := test.proxy.blockedNames.patternMatcher.Eval(test.allowed); reject {
+			t.Errorf("[%s] is blocked by the rules of another instance", test.allowed)
+		}
+	}
+	sharedRules := false
+	for _, plugin := range *proxy1.pluginsGlobals.responsePlugins {
+		if responsePlugin, ok := plugin.(*PluginBlockNameResponse); ok {
+			sharedRules = responsePlugin.blockedNames == proxy1.blockedNames
+		}
+	}
+	if !sharedRules {
+		t.Error("the response plugin doesn't share the rules of the query plugin")
+	}
+}
+
+func TestStop(t *testing.T) {
+	proxy, err := New(testAPIConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Stop()
+	proxy.Stop()
+	if !proxy.stopped() {
+		t.Error("the proxy should be stopped")
+	}
+	if proxy.sleepUnlessStopped(time.Hour) {
+		t.Error("background tasks should not wait after the proxy has been stopped")
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+const (
+	BeaconActionAlert  = "alert"
+	BeaconActionDemote = "demote"
+
+	BeaconMinInterval   = 5 * time.Minute
+	BeaconRetryInterval = time.Minute
+)
+
+// beaconName is a name whose addresses are known in advance
+type beaconName struct {
+	name     string
+	qTypes   []uint16
+	expected IPRangeSet
+}
+
+// BeaconAlert is the last check a server failed
+type BeaconAlert struct {
+	Server string    `json:"server"`
+	Name   string    `json:"name"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// Beacons periodically resolve known names with every live server, to detect servers
+// returning manipulated responses, such as censored or hijacked resolvers
+type Beacons struct {
+	sync.Mutex
+	interval    time.Duration
+	demote      bool
+	names       []beaconName
+	dnssecNames []string
+	alerts      map[string]BeaconAlert
+}
+
+func NewBeacons(interval time.Duration, action string, expected map[string][]string, dnssecNames []string) (*Beacons, error) {
+	beacons := Beacons{interval: interval, alerts: make(map[string]BeaconAlert)}
+	switch strings.ToLower(action) {
+	case "", BeaconActionAlert:
+	case BeaconActionDemote:
+		beacons.demote = true
+	default:
+		return nil, fmt.Errorf("Unsupported beacon action: [%s]", action)
+	}
+	if beacons.interval < BeaconMinInterval {
+		beacons.interval = BeaconMinInterval
+	}
+	for name, addresses := range expected {
+		beacon := beaconName{name: dns.Fqdn(strings.ToLower(name))}
+		hasIPv4, hasIPv6 := false, false
+		for _, address := range addresses {
+			expectedRange, err := parseIPRange(strings.TrimSpace(address))
+			if err != nil {
+				return nil, fmt.Errorf("[%s]: %v", name, err)
+			}
+			beacon.expected.add(expectedRange)
+			if net.IP(expectedRange.first[:]).To4() != nil {
+				hasIPv4 = true
+			} else {
+				hasIPv6 = true
+			}
+		}
+		if hasIPv4 {
+			beacon.qTypes = append(beacon.qTypes, dns.TypeA)
+		}
+		if hasIPv6 {
+			beacon.qTypes = append(beacon.qTypes, dns.TypeAAAA)
+		}
+		if len(beacon.qTypes) == 0 {
+			return nil, fmt.Errorf("[%s]: no expected addresses", name)
+		}
+		beacon.expected.build()
+		beacons.names = append(beacons.names, beacon)
+	}
+	sort.Slice(beacons.names, func(i, j int) bool { return beacons.names[i].name < beacons.names[j].name })
+	for _, name := range dnssecNames {
+		beacons.dnssecNames = append(beacons.dnssecNames, dns.Fqdn(strings.ToLower(name)))
+	}
+	return &beacons, nil
+}
+
+func beaconQuery(name string, qType uint16, dnssec bool) ([]byte, error) {
+	msg := dns.Msg{}
+	msg.SetQuestion(name, qType)
+	msg.AuthenticatedData = dnssec
+	msg.SetEdns0(uint16(MaxDNSPacketSize), dnssec)
+	return msg.Pack()
+}
+
+func (proxy *Proxy) exchangeBeaconQuery(serverInfo *ServerInfo, name string, qType uint16, dnssec bool) (*dns.Msg, error) {
+	query, err := beaconQuery(name, qType, dnssec)
+	if err != nil {
+		return nil, err
+	}
+	response, err := proxy.exchangeWithServer(serverInfo, query)
+	if err != nil {
+		return nil, err
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// checkBeacon returns the reason why a response for a beacon name cannot be trusted
+func checkBeacon(beacon *beaconName, qType uint16, msg *dns.Msg) string {
+	if msg.Rcode != dns.RcodeSuccess {
+		return fmt.Sprintf("unexpected response code: %s", dns.RcodeToString[msg.Rcode])
+	}
+	found := false
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype != qType {
+			continue
+		}
+		var ip net.IP
+		switch answer := rr.(type) {
+		case *dns.A:
+			ip = answer.A
+		case *dns.AAAA:
+			ip = answer.AAAA
+		default:
+			continue
+		}
+		if _, ok := beacon.expected.lookup(ip); !ok {
+			return fmt.Sprintf("unexpected address: %s", ip)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Sprintf("no %s records", dns.TypeToString[qType])
+	}
+	return ""
+}
+
+// checkServer returns the first beacon name a server failed to resolve correctly.
+// Network errors are not considered as manipulated responses.
+func (beacons *Beacons) checkServer(proxy *Proxy, serverInfo *ServerInfo, validatesDNSSEC bool) (string, string) {
+	for i := range beacons.names {
+		beacon := &beacons.names[i]
+		for _, qType := range beacon.qTypes {
+			msg, err := proxy.exchangeBeaconQuery(serverInfo, beacon.name, qType, false)
+			if err != nil {
+				dlog.Debugf("[%s] beacon [%s] not checked: %v", serverInfo.Name, beacon.name, err)
+				continue
+			}
+			if reason := checkBeacon(beacon, qType, msg); len(reason) > 0 {
+				return beacon.name, reason
+			}
+		}
+	}
+	if !validatesDNSSEC {
+		return "", ""
+	}
+	for _, name := range beacons.dnssecNames {
+		msg, err := proxy.exchangeBeaconQuery(serverInfo, name, dns.TypeSOA, true)
+		if err != nil {
+			dlog.Debugf("[%s] beacon [%s] not checked: %v", serverInfo.Name, name, err)
+			continue
+		}
+		if msg.Rcode != dns.RcodeSuccess || !msg.AuthenticatedData {
+			return name, "the response was not authenticated, but the server is supposed to validate DNSSEC signatures"
+		}
+	}
+	return "", ""
+}
+
+// check sends the beacon queries to all the live servers
+func (beacons *Beacons) check(proxy *Proxy) {
+	serversInfo := &proxy.serversInfo
+	serversInfo.RLock()
+	servers := append([]*ServerInfo{}, serversInfo.inner...)
+	validating := make(map[string]bool)
+	for _, registeredServer := range serversInfo.registeredServers {
+		validating[registeredServer.name] = registeredServer.stamp.Props&stamps.ServerInformalPropertyDNSSEC != 0
+	}
+	serversInfo.RUnlock()
+	var failed []string
+	for _, serverInfo := range servers {
+		name, reason := beacons.checkServer(proxy, serverInfo, validating[serverInfo.Name])
+		beacons.Lock()
+		if len(reason) == 0 {
+			delete(beacons.alerts, serverInfo.Name)
+			beacons.Unlock()
+			continue
+		}
+		beacons.alerts[serverInfo.Name] = BeaconAlert{Server: serverInfo.Name, Name: name, Reason: reason, Time: time.Now()}
+		beacons.Unlock()
+		dlog.Warnf("[%s] returned a manipulated response for the [%s] beacon: %s", serverInfo.Name, name, reason)
+		failed = append(failed, serverInfo.Name)
+	}
+	if !beacons.demote || len(failed) == 0 {
+		return
+	}
+	// If most servers disagree with the expected addresses, these are more likely to be outdated,
+	// or the network itself to be tampering with the responses
+	if len(failed)*2 > len(servers) {
+		dlog.Warnf("%d out of %d servers failed the beacon checks - Check the expected beacon addresses; no servers have been demoted",
+			len(failed), len(servers))
+		return
+	}
+	for _, name := range failed {
+		serversInfo.demote(name, "manipulated beacon response")
+	}
+}
+
+// currentAlerts returns the last check failed by each server, sorted by server name
+func (beacons *Beacons) currentAlerts() []BeaconAlert {
+	beacons.Lock()
+	defer beacons.Unlock()
+	alerts := make([]BeaconAlert, 0, len(beacons.alerts))
+	for _, alert := range beacons.alerts {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Server < alerts[j].Server })
+	return alerts
+}
+
+func (beacons *Beacons) run(proxy *Proxy) {
+	for {
+		delay := beacons.interval
+		if proxy.serversInfo.count() > 0 {
+			beacons.check(proxy)
+		} else {
+			delay = BeaconRetryInterval
+		}
+		select {
+		case <-proxy.quit:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
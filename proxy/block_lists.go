@@ -0,0 +1,434 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/jedisct1/dlog"
+	"github.com/jedisct1/go-minisign"
+)
+
+const (
+	DefaultBlockListRefreshDelay = 24 * time.Hour
+	MinimumBlockListRefreshDelay = time.Hour
+	BlockListFetchTimeout        = 60 * time.Second
+	BlockListMaxSize             = 64 * 1024 * 1024
+)
+
+var blockListNameRx = regexp.MustCompile(`^[a-z0-9_][a-z0-9_.-]*[.](xn--[a-z0-9-]+|[a-z]{2,})$`)
+
+// BlockList is a list of names to block, downloaded from a remote URL or read from a local file
+type BlockList struct {
+	name         string
+	category     string
+	urls         []*url.URL
+	minisignKey  *minisign.PublicKey
+	cacheFile    string
+	refreshDelay time.Duration
+	names        []string
+	refresh      time.Time
+	health       *sourceHealth
+	// A log-only list is evaluated, but the names it contains are not blocked
+	logOnly bool
+}
+
+// BlockLists merges subscribed lists into a single set of blocking rules
+type BlockLists struct {
+	sync.RWMutex
+	lists          []*BlockList
+	matcherEngine  string
+	matcher        *PatternMatcher
+	logOnlyMatcher *PatternMatcher
+}
+
+func NewBlockList(
+	name string,
+	category string,
+	urls []string,
+	minisignKeyStr string,
+	cacheFile string,
+	refreshDelay time.Duration,
+) (*BlockList, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("No URLs for the block list [%s]", name)
+	}
+	if refreshDelay < MinimumBlockListRefreshDelay {
+		refreshDelay = MinimumBlockListRefreshDelay
+	}
+	if len(cacheFile) == 0 {
+		cacheFile = "blocklist-" + name + ".txt"
+	}
+	blockList := &BlockList{
+		name:         name,
+		category:     category,
+		cacheFile:    cacheFile,
+		refreshDelay: refreshDelay,
+	}
+	for _, urlStr := range urls {
+		listURL, err := url.Parse(urlStr)
+		if err != nil {
+			return nil, fmt.Errorf("Block list [%s]: unable to parse URL [%s]", name, urlStr)
+		}
+		blockList.urls = append(blockList.urls, listURL)
+	}
+	if len(minisignKeyStr) > 0 {
+		minisignKey, err := minisign.NewPublicKey(minisignKeyStr)
+		if err != nil {
+			return nil, fmt.Errorf("Block list [%s]: %v", name, err)
+		}
+		blockList.minisignKey = &minisignKey
+	}
+	blockList.health = newSourceHealth("lists."+name, blockList.urls, cacheFile, 2*refreshDelay)
+	if blockList.minisignKey == nil {
+		blockList.health.update(func(status *SourceStatus) { status.Signature = SourceSignatureNone })
+	}
+	return blockList, nil
+}
+
+// signatureStatus returns the signature status of a list that was successfully verified
+func (blockList *BlockList) signatureStatus() string {
+	if blockList.minisignKey == nil {
+		return SourceSignatureNone
+	}
+	return SourceSignatureValid
+}
+
+func (blockList *BlockList) label() string {
+	if len(blockList.category) == 0 || blockList.category == blockList.name {
+		return blockList.name
+	}
+	return blockList.name + ", category: " + blockList.category
+}
+
+func (blockList *BlockList) checkSignature(bin, sig []byte) error {
+	if blockList.minisignKey == nil {
+		return nil
+	}
+	signature, err := minisign.DecodeSignature(string(sig))
+	if err == nil {
+		_, err = blockList.minisignKey.Verify(bin, signature)
+	}
+	return err
+}
+
+func (blockList *BlockList) loadFromCache() error {
+	bin, err := os.ReadFile(blockList.cacheFile)
+	if err != nil {
+		return err
+	}
+	var sig []byte
+	if blockList.minisignKey != nil {
+		if sig, err = os.ReadFile(blockList.cacheFile + ".minisig"); err != nil {
+			return err
+		}
+	}
+	if err := blockList.checkSignature(bin, sig); err != nil {
+		blockList.health.update(func(status *SourceStatus) { status.Signature = SourceSignatureInvalid })
+		return err
+	}
+	fi, err := os.Stat(blockList.cacheFile)
+	if err != nil {
+		return err
+	}
+	blockList.names = parseBlockList(string(bin))
+	blockList.refresh = fi.ModTime().Add(blockList.refreshDelay)
+	blockList.health.update(func(status *SourceStatus) {
+		status.LastUpdate = fi.ModTime()
+		status.Signature = blockList.signatureStatus()
+		status.Entries = len(blockList.names)
+	})
+	return nil
+}
+
+func (blockList *BlockList) download(xTransport *XTransport, listURL *url.URL) (bin, sig []byte, err error) {
+	if listURL.Scheme == "file" {
+		path := listURL.Path
+		if len(path) == 0 {
+			path = listURL.Opaque
+		}
+		bin, err = os.ReadFile(path)
+		return bin, nil, err
+	}
+	if bin, _, _, _, err = xTransport.GetLargeWithCompression(listURL, "", BlockListFetchTimeout, BlockListMaxSize); err != nil {
+		return nil, nil, err
+	}
+	if len(bin) >= BlockListMaxSize {
+		return nil, nil, errors.New("List too large")
+	}
+	if blockList.minisignKey != nil {
+		sigURL := *listURL
+		sigURL.Path += ".minisig"
+		if sig, _, _, _, err = xTransport.GetWithCompression(&sigURL, "", BlockListFetchTimeout); err != nil {
+			return nil, nil, err
+		}
+	}
+	return bin, sig, nil
+}
+
+// update downloads the list; the previous version is kept if the new one cannot be verified
+func (blockList *BlockList) update(xTransport *XTransport, now time.Time) error {
+	blockList.refresh = now.Add(MinimumPrefetchInterval)
+	var err error
+	for _, listURL := range blockList.urls {
+		dlog.Infof("Block list [%s] loading from URL [%s]", blockList.name, listURL)
+		var bin, sig []byte
+		if bin, sig, err = blockList.download(xTransport, listURL); err != nil {
+			continue
+		}
+		if err = blockList.checkSignature(bin, sig); err != nil {
+			blockList.health.update(func(status *SourceStatus) { status.Signature = SourceSignatureInvalid })
+			continue
+		}
+		names := parseBlockList(string(bin))
+		if len(names) == 0 {
+			err = errors.New("No names found")
+			continue
+		}
+		if listURL.Scheme != "file" {
+			if err := writeBlockList(blockList.cacheFile, bin, sig); err != nil {
+				dlog.Warnf("Couldn't write cache file [%s]: %s", blockList.cacheFile, err)
+			}
+		}
+		blockList.names = names
+		blockList.refresh = now.Add(blockList.refreshDelay)
+		blockList.health.update(func(status *SourceStatus) {
+			status.LastUpdate = now
+			status.Signature = blockList.signatureStatus()
+			status.Entries = len(names)
+			status.LastError = ""
+		})
+		return nil
+	}
+	blockList.health.update(func(status *SourceStatus) { status.LastError = err.Error() })
+	return err
+}
+
+func writeBlockList(file string, bin, sig []byte) error {
+	if sig != nil {
+		return writeSource(file, bin, sig)
+	}
+	f, err := safefile.Create(file, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(bin); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// parseBlockList extracts names from lists in the formats commonly used by blocklist
+// maintainers: plain names, hosts files, AdBlock rules (`||example.com^`) and dnsmasq rules
+func parseBlockList(content string) []string {
+	var names []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.ToLower(TrimAndStripInlineComments(line))
+		if len(line) == 0 || line[0] == '!' || line[0] == '[' || strings.HasPrefix(line, "@@") {
+			continue
+		}
+		var candidates []string
+		switch {
+		case strings.HasPrefix(line, "||"):
+			name, modifiers, _ := strings.Cut(line[2:], "$")
+			if len(modifiers) > 0 && modifiers != "third-party" && modifiers != "popup" {
+				continue
+			}
+			candidates = []string{strings.TrimSuffix(name, "^")}
+		case strings.HasPrefix(line, "address=/"):
+			if name, _, found := strings.Cut(line[len("address=/"):], "/"); found {
+				candidates = []string{name}
+			}
+		case strings.HasPrefix(line, "*."):
+			candidates = []string{line[2:]}
+		default:
+			fields := strings.Fields(line)
+			if len(fields) == 1 {
+				candidates = fields
+			} else if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+				candidates = fields[1:]
+			}
+		}
+		for _, name := range candidates {
+			if blockListNameRx.MatchString(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func NewBlockLists(lists []*BlockList, matcherEngine string) *BlockLists {
+	sort.Slice(lists, func(i, j int) bool { return lists[i].name < lists[j].name })
+	return &BlockLists{lists: lists, matcherEngine: matcherEngine}
+}
+
+// loadCached loads the lists from their cache files, so that names can be blocked before the lists are updated
+func (blockLists *BlockLists) loadCached() {
+	blockLists.loadCachedQuietly()
+	blockLists.rebuild()
+}
+
+// loadCachedQuietly loads the lists from their cache files, without building the matchers
+func (blockLists *BlockLists) loadCachedQuietly() {
+	now := timeNow()
+	for _, blockList := range blockLists.lists {
+		if err := blockList.loadFromCache(); err != nil {
+			dlog.Debugf("Block list [%s] cache file [%s] not loaded: %v", blockList.name, blockList.cacheFile, err)
+		}
+		blockList.health.checkStaleness(now)
+	}
+}
+
+// statuses returns the health of the lists
+func (blockLists *BlockLists) statuses() []SourceStatus {
+	now := timeNow()
+	statuses := make([]SourceStatus, 0, len(blockLists.lists))
+	for _, blockList := range blockLists.lists {
+		statuses = append(statuses, blockList.health.current(now))
+	}
+	return statuses
+}
+
+// rebuild merges all the lists, leaving out duplicates and names whose parent domain is also blocked.
+// Log-only lists are merged separately, without the names that are already blocked by other lists.
+func (blockLists *BlockLists) rebuild() {
+	labels, logOnlyLabels := make(map[string]string), make(map[string]string)
+	duplicates := 0
+	for _, logOnly := range []bool{false, true} {
+		for _, blockList := range blockLists.lists {
+			if blockList.logOnly != logOnly {
+				continue
+			}
+			label := blockList.label()
+			for _, name := range blockList.names {
+				if _, found := labels[name]; found {
+					duplicates++
+					continue
+				}
+				if !logOnly {
+					labels[name] = label
+				} else if _, found := logOnlyLabels[name]; found {
+					duplicates++
+				} else {
+					logOnlyLabels[name] = label
+				}
+			}
+		}
+	}
+	covered := 0
+	matcher, count := buildBlockListMatcher(blockLists.matcherEngine, labels, &covered)
+	var logOnlyMatcher *PatternMatcher
+	logOnlyCount := 0
+	if len(logOnlyLabels) > 0 {
+		logOnlyMatcher, logOnlyCount = buildBlockListMatcher(blockLists.matcherEngine, logOnlyLabels, &covered)
+	}
+	blockLists.Lock()
+	blockLists.matcher = matcher
+	blockLists.logOnlyMatcher = logOnlyMatcher
+	blockLists.Unlock()
+	dlog.Noticef(
+		"Block lists: %d names loaded (%d duplicates, %d names covered by a parent domain)",
+		count,
+		duplicates,
+		covered,
+	)
+	if logOnlyCount > 0 {
+		dlog.Noticef("Block lists: %d names loaded from log-only lists", logOnlyCount)
+	}
+}
+
+func buildBlockListMatcher(matcherEngine string, labels map[string]string, covered *int) (*PatternMatcher, int) {
+	matcher := NewPatternMatcherWithEngine(matcherEngine)
+	count := 0
+	for name, label := range labels {
+		if hasBlockedParent(labels, name) {
+			*covered++
+			continue
+		}
+		count++
+		if err := matcher.Add(name, label, count); err != nil {
+			dlog.Debug(err)
+		}
+	}
+	return matcher, count
+}
+
+func hasBlockedParent(names map[string]string, name string) bool {
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if _, found := names[name]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns whether a name is blocked, and if the only lists blocking it are log-only lists
+func (blockLists *BlockLists) check(qName string) (bool, string, bool) {
+	blockLists.RLock()
+	matcher, logOnlyMatcher := blockLists.matcher, blockLists.logOnlyMatcher
+	blockLists.RUnlock()
+	for _, xmatcher := range []*PatternMatcher{matcher, logOnlyMatcher} {
+		if xmatcher == nil {
+			continue
+		}
+		reject, reason, xlabel := xmatcher.Eval(qName)
+		if !reject {
+			continue
+		}
+		if label, ok := xlabel.(string); ok {
+			reason = reason + " (list: " + label + ")"
+		}
+		return true, reason, xmatcher == logOnlyMatcher
+	}
+	return false, "", false
+}
+
+// update downloads the lists that are due for a refresh, and returns the delay until the next update
+func (blockLists *BlockLists) update(xTransport *XTransport, now time.Time) time.Duration {
+	updated := false
+	next := now.Add(DefaultBlockListRefreshDelay)
+	for _, blockList := range blockLists.lists {
+		if !blockList.refresh.After(now) {
+			if err := blockList.update(xTransport, now); err != nil {
+				dlog.Warnf("Unable to update the block list [%s]: %v", blockList.name, err)
+			} else {
+				dlog.Noticef("Block list [%s] updated: %d names", blockList.name, len(blockList.names))
+				updated = true
+			}
+		}
+		blockList.health.checkStaleness(now)
+		if blockList.refresh.Before(next) {
+			next = blockList.refresh
+		}
+	}
+	if updated {
+		blockLists.rebuild()
+	}
+	return next.Sub(now)
+}
+
+func (blockLists *BlockLists) refreshLoop(xTransport *XTransport, quit chan struct{}, waitForWindow func() bool) {
+	for {
+		timer := time.NewTimer(blockLists.update(xTransport, time.Now()))
+		select {
+		case <-quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !waitForWindow() {
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DefaultCaptivePortalProbeURL = "http://connectivitycheck.gstatic.com/generate_204"
+	// DefaultCaptivePortalHTTPSProbeURL confirms that the network is behind a portal, since a plain HTTP
+	// probe can be answered by anyone on the path
+	DefaultCaptivePortalHTTPSProbeURL = "https://www.gstatic.com/generate_204"
+	CaptivePortalProbeInterval        = 30 * time.Second
+	CaptivePortalProbeTimeout         = 5 * time.Second
+)
+
+// CaptivePortalDetector probes a connectivity check URL when servers become unreachable.
+// While a captive portal is detected, queries for the names of the portal are sent in clear to the
+// resolvers of the local network, so that the portal can be used, until the URL can be reached
+// without being redirected.
+type CaptivePortalDetector struct {
+	sync.Mutex
+	probeURL      string
+	httpsProbeURL string
+	resolvers     []string
+	client        *http.Client
+	detected      atomic.Bool
+	failureCount  atomic.Uint32
+	names         []string
+	portalNames   []string
+}
+
+func NewCaptivePortalDetector(probeURL string, httpsProbeURL string, resolvers []string, names []string) *CaptivePortalDetector {
+	detector := &CaptivePortalDetector{probeURL: probeURL, httpsProbeURL: httpsProbeURL, resolvers: resolvers}
+	for _, name := range append([]string{hostOfURL(probeURL)}, names...) {
+		if name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), "."); len(name) > 0 {
+			detector.names = append(detector.names, name)
+		}
+	}
+	// The probe itself has to be resolved using the local network resolvers
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			var conn net.Conn
+			var err error
+			for _, resolverAddr := range detector.resolvers {
+				if conn, err = dialer.DialContext(ctx, network, resolverAddr); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+	dialer := &net.Dialer{Timeout: CaptivePortalProbeTimeout, Resolver: resolver}
+	detector.client = &http.Client{
+		Timeout: CaptivePortalProbeTimeout,
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return detector
+}
+
+func (detector *CaptivePortalDetector) noticeFailure() {
+	detector.failureCount.Add(1)
+}
+
+func hostOfURL(str string) string {
+	if parsed, err := url.Parse(str); err == nil {
+		return parsed.Hostname()
+	}
+	return ""
+}
+
+// isPortalName tells whether a name is, or belongs to, the probe host, a configured name, or a host
+// the probe has been redirected to
+func (detector *CaptivePortalDetector) isPortalName(qName string) bool {
+	detector.Lock()
+	defer detector.Unlock()
+	for _, names := range [][]string{detector.names, detector.portalNames} {
+		for _, name := range names {
+			if qName == name || strings.HasSuffix(qName, "."+name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// probe returns whether the network is behind a captive portal; ok is false if that cannot be known.
+// A portal is only assumed if the HTTPS probe URL cannot be reached either.
+func (detector *CaptivePortalDetector) probe() (behindPortal bool, ok bool) {
+	resp, err := detector.client.Get(detector.probeURL)
+	if err != nil {
+		dlog.Debugf("Captive portal probe failed: [%v]", err)
+		return false, false
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return false, true
+	}
+	if len(detector.httpsProbeURL) > 0 {
+		if resp, err := detector.client.Get(detector.httpsProbeURL); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusNoContent {
+				dlog.Warnf("The captive portal probe was answered, but [%s] can be reached - Ignoring", detector.httpsProbeURL)
+				return false, true
+			}
+		}
+	}
+	if location, err := resp.Location(); err == nil && len(location.Hostname()) > 0 {
+		portalName := strings.ToLower(location.Hostname())
+		detector.Lock()
+		if !includesName(detector.portalNames, portalName) {
+			detector.portalNames = append(detector.portalNames, portalName)
+		}
+		detector.Unlock()
+	}
+	return true, true
+}
+
+func (proxy *Proxy) runCaptivePortalDetector() {
+	detector := proxy.captivePortalDetector
+	for {
+		select {
+		case <-proxy.quit:
+			return
+		case <-time.After(CaptivePortalProbeInterval):
+		}
+		failures := detector.failureCount.Swap(0)
+		if !detector.detected.Load() && failures == 0 && proxy.serversInfo.count() > 0 {
+			continue
+		}
+		behindPortal, ok := detector.probe()
+		if !ok {
+			continue
+		}
+		if behindPortal && detector.detected.CompareAndSwap(false, true) {
+			dlog.Warnf(
+				"Captive portal detected - Queries are now forwarded in clear to %v until connectivity is restored",
+				detector.resolvers,
+			)
+		} else if !behindPortal && detector.detected.CompareAndSwap(true, false) {
+			detector.Lock()
+			detector.portalNames = nil
+			detector.Unlock()
+			dlog.Notice("Connectivity restored - Queries are encrypted again")
+			proxy.requestServersRefresh("leaving a captive portal")
+		}
+	}
+}
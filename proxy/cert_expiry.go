@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// certDaysLeft returns the number of full days before a certificate expires, or nil if the expiration is unknown
+func certDaysLeft(expiration time.Time) *int {
+	if expiration.IsZero() {
+		return nil
+	}
+	daysLeft := int(time.Until(expiration) / (24 * time.Hour))
+	return &daysLeft
+}
+
+// checkCertExpiration warns about a server certificate that is about to expire.
+// A pinned DoH certificate has to be replaced in the stamp, so the warning is logged days in advance.
+// DNSCrypt certificates are short-lived, and only a certificate expiring before the next refresh is a concern.
+func (proxy *Proxy) checkCertExpiration(serverInfo *ServerInfo) {
+	if serverInfo.certExpiration.IsZero() {
+		return
+	}
+	timeLeft := time.Until(serverInfo.certExpiration)
+	if serverInfo.certPinned {
+		if timeLeft < proxy.certExpiryWarning {
+			dlog.Warnf("[%s] the pinned certificate expires in %d days (%s) - The server will stop working unless its stamp is updated",
+				serverInfo.Name, *certDaysLeft(serverInfo.certExpiration), serverInfo.certExpiration.Format(time.RFC3339))
+		}
+	} else if timeLeft < proxy.certRefreshDelay {
+		dlog.Warnf("[%s] the certificate expires in %v, before the next refresh, and no newer certificate has been published",
+			serverInfo.Name, timeLeft.Round(time.Minute))
+	}
+}
+
+// certExpiration returns the expiration of the certificate used for a live server
+func (serversInfo *ServersInfo) certExpiration(name string) time.Time {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	for _, serverInfo := range serversInfo.inner {
+		if serverInfo.Name == name {
+			return serverInfo.certExpiration
+		}
+	}
+	return time.Time{}
+}
+
+// fetchCertExpirations retrieves the certificates of all the registered servers, for -list
+func (proxy *Proxy) fetchCertExpirations() map[string]time.Time {
+	expirations := make(map[string]time.Time)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, proxy.certRefreshConcurrency)
+	for _, registeredServer := range proxy.registeredServers {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(registeredServer RegisteredServer) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			serverInfo, err := fetchServerInfo(proxy, registeredServer.name, registeredServer.stamp, false)
+			if err != nil {
+				return
+			}
+			proxy.checkCertExpiration(&serverInfo)
+			mutex.Lock()
+			expirations[registeredServer.name] = serverInfo.certExpiration
+			mutex.Unlock()
+		}(registeredServer)
+	}
+	wg.Wait()
+	return expirations
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	ClockCheckInterval = 5 * time.Second
+	ClockStepThreshold = 30 * time.Second
+
+	ServersRefreshMinInterval = 30 * time.Second
+)
+
+// ClockSaneAfter is a date the wall clock is known to be past. Systems without a real-time clock
+// start with an earlier date until they get synchronized, which cannot be used to check certificates.
+var ClockSaneAfter = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func wallClockIsSane() bool {
+	return time.Now().After(ClockSaneAfter)
+}
+
+// monotonicExpiration converts an expiration date received from another process into a time that
+// includes a monotonic clock reading, so that comparing it with time.Now() isn't affected by wall clock steps
+func monotonicExpiration(expiration time.Time) time.Time {
+	return time.Now().Add(time.Until(expiration))
+}
+
+// watchClockSteps compares the wall clock with the monotonic clock, and requests a refresh
+// of the servers when the wall clock has been stepped (synchronization, resume after sleep)
+func (proxy *Proxy) watchClockSteps() {
+	last := time.Now()
+	lastSuspended, canDetectResume := suspendedTime()
+	for {
+		select {
+		case <-proxy.quit:
+			return
+		case <-time.After(ClockCheckInterval):
+		}
+		now := time.Now()
+		step := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		if canDetectResume {
+			suspended, _ := suspendedTime()
+			sleep := suspended - lastSuspended
+			lastSuspended = suspended
+			if sleep >= ClockCheckInterval {
+				// The wall clock kept running while the monotonic clock was stopped
+				step -= sleep
+				proxy.handleResume(sleep)
+			}
+		}
+		if step > -ClockStepThreshold && step < ClockStepThreshold {
+			continue
+		}
+		dlog.Noticef("The system clock has been stepped by %v", step.Round(time.Second))
+		if !canDetectResume && step > 0 {
+			proxy.handleResume(0)
+			continue
+		}
+		proxy.requestServersRefresh("a clock change")
+	}
+}
+
+// requestServersRefresh makes the refresh loop fetch the server certificates right away,
+// for example because certificates that were rejected or accepted before have to be checked again.
+// Requests are ignored for ServersRefreshMinInterval after the previous one, so that a flapping
+// network doesn't cause the servers to be constantly probed.
+func (proxy *Proxy) requestServersRefresh(reason string) {
+	proxy.refreshRequestsLock.Lock()
+	if !proxy.lastRefreshRequest.IsZero() && time.Since(proxy.lastRefreshRequest) < ServersRefreshMinInterval {
+		proxy.refreshRequestsLock.Unlock()
+		dlog.Debugf("Not refreshing the server certificates after %s, since they were just refreshed", reason)
+		return
+	}
+	proxy.lastRefreshRequest = time.Now()
+	proxy.refreshRequestsLock.Unlock()
+	select {
+	case proxy.refreshRequests <- reason:
+	default:
+	}
+}
+
+// sleepUntilRefresh waits for the given delay, or until a refresh is requested, and returns true in the latter case
+func (proxy *Proxy) sleepUntilRefresh(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case reason := <-proxy.refreshRequests:
+		dlog.Noticef("Refreshing the server certificates after %s", reason)
+		return true
+	case <-proxy.quit:
+	}
+	return false
+}
+
+// sleepUnlessStopped waits for the given delay, and returns false if the proxy was stopped in the meantime
+func (proxy *Proxy) sleepUnlessStopped(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-proxy.quit:
+		return false
+	}
+}
+
+// jitteredDelay randomly shortens or extends a delay by up to the given percentage
+func jitteredDelay(random *lockedRand, delay time.Duration, jitterPercent int) time.Duration {
+	maxJitter := int64(delay) * int64(jitterPercent) / 100
+	if maxJitter <= 0 {
+		return delay
+	}
+	return delay + time.Duration(random.Int63n(2*maxJitter+1)-maxJitter)
+}
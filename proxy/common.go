@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"bytes"
@@ -14,6 +14,10 @@
 	"github.com/jedisct1/dlog"
 )
 
+const (
+	AppVersion = "2.1.5"
+)
+
 type CryptoConstruction uint16
 
 const (
@@ -28,6 +32,8 @@ type CryptoConstruct
 
 const (
 	MaxHTTPBodyLength = 1000000
+	// Encrypted ODoH responses are slightly larger than the DNS messages they contain
+	MaxDoHBodyLength = 65535 + 1024
 )
 
 var (
@@ -35,6 +41,7 @@ type CryptoConstruct
 	ServerMagic             = [8]byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
 	MinDNSPacketSize        = 12 + 5
 	MaxDNSPacketSize        = 4096
+	MaxDNSMessageSize       = 65535
 	MaxDNSUDPPacketSize     = 4096
 	MaxDNSUDPSafePacketSize = 1252
 	InitialMinQuestionSize  = 512
@@ -0,0 +1,2071 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	netproxy "golang.org/x/net/proxy"
+)
+
+const (
+	MaxTimeout             = 3600
+	DefaultNetprobeAddress = "9.9.9.9:53"
+	JSONSchemaVersion      = 1
+)
+
+type Config struct {
+	LogLevel                 int            `toml:"log_level"`
+	LogFile                  *string        `toml:"log_file"`
+	LogFileLatest            bool           `toml:"log_file_latest"`
+	UseSyslog                bool           `toml:"use_syslog"`
+	ServerNames              []string       `toml:"server_names"`
+	DisabledServerNames      []string       `toml:"disabled_server_names"`
+	ServerCountries          []string       `toml:"server_countries"`
+	DisabledServerCountries  []string       `toml:"disabled_server_countries"`
+	ListenAddresses          []string       `toml:"listen_addresses"`
+	LocalDoH                 LocalDoHConfig `toml:"local_doh"`
+	UserName                 string         `toml:"user_name"`
+	SuperviseChild           bool           `toml:"supervise_child"`
+	ControlSocket            string         `toml:"control_socket"`
+	SighupReloadListeners    bool           `toml:"sighup_reload_listeners"`
+	FaultInjection           bool           `toml:"fault_injection"`
+	CredentialsFile          string         `toml:"credentials_file"`
+	FallbackConfigFile       string         `toml:"fallback_config_file"`
+	NodeName                 string         `toml:"node_name"`
+	ForceTCP                 bool           `toml:"force_tcp"`
+	TruncatedUDPResponses    string         `toml:"truncated_udp_responses"`
+	HTTP3                    bool           `toml:"http3"`
+	Timeout                  int            `toml:"timeout"`
+	KeepAlive                int            `toml:"keepalive"`
+	PlainTCPKeepAlive        int            `toml:"plain_tcp_keepalive"`
+	Proxy                    string         `toml:"proxy"`
+	CertRefreshConcurrency   int            `toml:"cert_refresh_concurrency"`
+	CertRefreshDelay         int            `toml:"cert_refresh_delay"`
+	CertRefreshJitter        int            `toml:"cert_refresh_jitter"`
+	CertRefreshSpread        int            `toml:"cert_refresh_spread"`
+	CertIgnoreTimestamp      bool           `toml:"cert_ignore_timestamp"`
+	CertExpiryWarning        int            `toml:"cert_expiry_warning"`
+	EphemeralKeys            bool           `toml:"dnscrypt_ephemeral_keys"`
+	EphemeralKeyReuse        int            `toml:"dnscrypt_ephemeral_key_reuse"`
+	CryptoImplementation     string         `toml:"dnscrypt_crypto_implementation"`
+	LBStrategy               string         `toml:"lb_strategy"`
+	LBEstimator              bool           `toml:"lb_estimator"`
+	LBMinProviders           int            `toml:"lb_min_providers"`
+	Deterministic            bool           `toml:"deterministic"`
+	RandomSeed               int64          `toml:"random_seed"`
+	BlockIPv6                bool           `toml:"block_ipv6"`
+	BlockLogOnly             bool           `toml:"block_log_only"`
+	BlockUnqualified         bool           `toml:"block_unqualified"`
+	BlockUndelegated         bool           `toml:"block_undelegated"`
+	ChromeProbes             string         `toml:"chrome_probes"`
+	ScrubResponses           bool           `toml:"scrub_responses"`
+	MaxResponseSize          int            `toml:"max_response_size"`
+	MaxResponseRecords       int            `toml:"max_response_records"`
+	ResponseLimitAction      string         `toml:"response_limit_action"`
+	SanitizeResponses        string         `toml:"sanitize_responses"`
+	SanitizeMaxTXTLength     int            `toml:"sanitize_max_txt_length"`
+	Cache                    bool
+	CacheSize                int                         `toml:"cache_size"`
+	CacheNegTTL              uint32                      `toml:"cache_neg_ttl"`
+	CacheNegMinTTL           uint32                      `toml:"cache_neg_min_ttl"`
+	CacheNegMaxTTL           uint32                      `toml:"cache_neg_max_ttl"`
+	CacheMinTTL              uint32                      `toml:"cache_min_ttl"`
+	CacheMaxTTL              uint32                      `toml:"cache_max_ttl"`
+	CacheBypass              []string                    `toml:"cache_bypass"`
+	MatcherEngine            string                      `toml:"matcher_engine"`
+	MatcherBenchmark         bool                        `toml:"matcher_benchmark"`
+	CacheLazy                bool                        `toml:"cache_lazy"`
+	CacheLazyGrace           uint32                      `toml:"cache_lazy_grace"`
+	SharedCache              SharedCacheConfig           `toml:"shared_cache"`
+	Warmup                   WarmupConfig                `toml:"warmup_domains"`
+	Priming                  PrimingConfig               `toml:"priming"`
+	Beacons                  BeaconsConfig               `toml:"beacons"`
+	HAPeering                HAPeeringConfig             `toml:"ha_peering"`
+	ResponseRateLimit        ResponseRateLimitConfig     `toml:"response_rate_limit"`
+	RelayService             RelayServiceConfig          `toml:"dnscrypt_relay"`
+	CanaryDomains            CanaryDomainsConfig         `toml:"canary_domains"`
+	RejectTTL                uint32                      `toml:"reject_ttl"`
+	CloakTTL                 uint32                      `toml:"cloak_ttl"`
+	ListenerOptions          map[string]ListenerOptions  `toml:"listener_options"`
+	QueryLog                 QueryLogConfig              `toml:"query_log"`
+	NxLog                    NxLogConfig                 `toml:"nx_log"`
+	HTTPAccessLog            HTTPAccessLogConfig         `toml:"http_access_log"`
+	Reports                  ReportsConfig               `toml:"reports"`
+	StatusPage               StatusPageConfig            `toml:"status_page"`
+	UpstreamRecording        UpstreamRecordingConfig     `toml:"upstream_recording"`
+	SocketLimits             SocketLimitsConfig          `toml:"socket_limits"`
+	Memory                   MemoryConfig                `toml:"memory"`
+	BlockName                BlockNameConfig             `toml:"blocked_names"`
+	BlockLists               map[string]BlockListConfig  `toml:"lists"`
+	AllowedName              AllowedNameConfig           `toml:"allowed_names"`
+	BlockIP                  BlockIPConfig               `toml:"blocked_ips"`
+	AllowIP                  AllowIPConfig               `toml:"allowed_ips"`
+	ForwardFile              string                      `toml:"forwarding_rules"`
+	ForwardFailover          bool                        `toml:"forwarding_failover"`
+	SpoofProtection          string                      `toml:"spoof_protection"`
+	CloakFile                string                      `toml:"cloaking_rules"`
+	CaptivePortals           CaptivePortalsConfig        `toml:"captive_portals"`
+	LANHosts                 LANHostsConfig              `toml:"lan_hosts"`
+	QueryRouting             QueryRoutingConfig          `toml:"query_routing"`
+	StaticsConfig            map[string]StaticConfig     `toml:"static"`
+	SourcesConfig            map[string]SourceConfig     `toml:"sources"`
+	BrokenImplementations    BrokenImplementationsConfig `toml:"broken_implementations"`
+	SourceRequireDNSSEC      bool                        `toml:"require_dnssec"`
+	SourceRequireNoLog       bool                        `toml:"require_nolog"`
+	SourceRequireNoFilter    bool                        `toml:"require_nofilter"`
+	SourceDNSCrypt           bool                        `toml:"dnscrypt_servers"`
+	SourceDoH                bool                        `toml:"doh_servers"`
+	SourceODoH               bool                        `toml:"odoh_servers"`
+	SourceIPv4               bool                        `toml:"ipv4_servers"`
+	SourceIPv6               bool                        `toml:"ipv6_servers"`
+	MaxClients               uint32                      `toml:"max_clients"`
+	UDPListenerSockets       int                         `toml:"udp_listener_sockets"`
+	BootstrapResolvers       []string                    `toml:"bootstrap_resolvers"`
+	IgnoreSystemDNS          bool                        `toml:"ignore_system_dns"`
+	AllWeeklyRanges          map[string]WeeklyRangesStr  `toml:"schedules"`
+	MaintenanceSchedule      string                      `toml:"maintenance_schedule"`
+	MaintenanceTasks         []string                    `toml:"maintenance_tasks"`
+	LogMaxSize               int                         `toml:"log_files_max_size"`
+	LogMaxAge                int                         `toml:"log_files_max_age"`
+	LogMaxBackups            int                         `toml:"log_files_max_backups"`
+	TLSDisableSessionTickets bool                        `toml:"tls_disable_session_tickets"`
+	TLSCipherSuite           []uint16                    `toml:"tls_cipher_suite"`
+	TLSKeyLogFile            string                      `toml:"tls_key_log_file"`
+	NetprobeAddress          string                      `toml:"netprobe_address"`
+	NetprobeAddresses        []string                    `toml:"netprobe_addresses"`
+	WaitForInterface         string                      `toml:"wait_for_interface"`
+	NetprobeTimeout          int                         `toml:"netprobe_timeout"`
+	OfflineMode              bool                        `toml:"offline_mode"`
+	QueryPluginsOrder        []string                    `toml:"query_plugins_order"`
+	PluginScopes             map[string]PluginScope      `toml:"plugin_scopes"`
+	ClientTags               map[string][]string         `toml:"client_tags"`
+	NetworkChangeRefresh     bool                        `toml:"network_change_refresh"`
+	HTTPProxyURL             string                      `toml:"http_proxy"`
+	BlockedQueryResponse     string                      `toml:"blocked_query_response"`
+	QueryMeta                []string                    `toml:"query_meta"`
+	CloakedPTR               bool                        `toml:"cloak_ptr"`
+	AnonymizedDNS            AnonymizedDNSConfig         `toml:"anonymized_dns"`
+	DoHClientX509Auth        DoHClientX509AuthConfig     `toml:"doh_client_x509_auth"`
+	ServerOptions            map[string]ServerOptions    `toml:"server_options"`
+	DNS64                    DNS64Config                 `toml:"dns64"`
+	EDNSClientSubnet         []string                    `toml:"edns_client_subnet"`
+
+	check *ConfigCheck
+}
+
+func newConfig() Config {
+	return Config{
+		LogLevel:                 int(dlog.LogLevel()),
+		LogFileLatest:            true,
+		ListenAddresses:          []string{"127.0.0.1:53"},
+		LocalDoH:                 LocalDoHConfig{Path: "/dns-query"},
+		QueryLog:                 QueryLogConfig{HashKeyRotation: 24},
+		BlockName:                BlockNameConfig{CNAMETargets: true},
+		LANHosts:                 LANHostsConfig{RefreshDelay: 1, TTL: 60},
+		Beacons:                  BeaconsConfig{Interval: 60, Action: BeaconActionAlert},
+		QueryRouting:             QueryRoutingConfig{OverrideOption: DefaultRouteOverrideOption},
+		SocketLimits:             SocketLimitsConfig{AutoTighten: true},
+		Memory:                   MemoryConfig{ShrinkCache: true},
+		Timeout:                  5000,
+		KeepAlive:                5,
+		CertRefreshConcurrency:   10,
+		CertRefreshJitter:        10,
+		CertRefreshDelay:         240,
+		HTTP3:                    false,
+		CertIgnoreTimestamp:      false,
+		CertExpiryWarning:        14,
+		EphemeralKeys:            false,
+		CryptoImplementation:     CryptoImplementationAuto,
+		Cache:                    true,
+		CacheSize:                512,
+		CacheNegTTL:              0,
+		CacheNegMinTTL:           60,
+		CacheNegMaxTTL:           600,
+		CacheMinTTL:              60,
+		CacheMaxTTL:              86400,
+		CacheLazyGrace:           3600,
+		MatcherEngine:            MatcherEngineCritbit,
+		RejectTTL:                600,
+		CloakTTL:                 600,
+		SourceRequireNoLog:       true,
+		SourceRequireNoFilter:    true,
+		SourceIPv4:               true,
+		SourceIPv6:               false,
+		SourceDNSCrypt:           true,
+		SourceDoH:                true,
+		SourceODoH:               false,
+		MaxClients:               250,
+		BootstrapResolvers:       []string{DefaultBootstrapResolver},
+		IgnoreSystemDNS:          false,
+		LogMaxSize:               10,
+		LogMaxAge:                7,
+		LogMaxBackups:            1,
+		TLSDisableSessionTickets: false,
+		TLSCipherSuite:           nil,
+		TLSKeyLogFile:            "",
+		NetprobeTimeout:          60,
+		OfflineMode:              false,
+		NetworkChangeRefresh:     false,
+		LBEstimator:              true,
+		BlockedQueryResponse:     "hinfo",
+		MaintenanceTasks:         DefaultMaintenanceTasks,
+		BrokenImplementations: BrokenImplementationsConfig{
+			FragmentsBlocked: []string{
+				"cisco", "cisco-ipv6", "cisco-familyshield", "cisco-familyshield-ipv6",
+				"cleanbrowsing-adult", "cleanbrowsing-adult-ipv6", "cleanbrowsing-family", "cleanbrowsing-family-ipv6", "cleanbrowsing-security", "cleanbrowsing-security-ipv6",
+			},
+		},
+		AnonymizedDNS: AnonymizedDNSConfig{
+			DirectCertFallback: true,
+		},
+		CloakedPTR: false,
+		ResponseRateLimit: ResponseRateLimitConfig{
+			Slip: 2,
+		},
+		CanaryDomains: CanaryDomainsConfig{
+			Mozilla:            CanaryPolicyNXDomain,
+			ICloudPrivateRelay: CanaryPolicyPass,
+		},
+	}
+}
+
+type StaticConfig struct {
+	Stamp string
+}
+
+type SourceConfig struct {
+	URL            string
+	URLs           []string
+	MinisignKeyStr string `toml:"minisign_key"`
+	CacheFile      string `toml:"cache_file"`
+	FormatStr      string `toml:"format"`
+	RefreshDelay   int    `toml:"refresh_delay"`
+	StaleAfter     int    `toml:"stale_after"`
+	Prefix         string
+}
+
+type QueryLogConfig struct {
+	File              string
+	Format            string
+	IgnoredQtypes     []string          `toml:"ignored_qtypes"`
+	AnonymizeClientIP string            `toml:"anonymize_client_ip"`
+	HashKeyRotation   int               `toml:"hash_key_rotation"`
+	IPTags            map[string]string `toml:"ip_tags"`
+	Bus               QueryLogBusConfig `toml:"bus"`
+	MaxAge            int               `toml:"max_age"`
+	MaxTotalSize      int               `toml:"max_total_size"`
+	Compress          *bool             `toml:"compress"`
+	Annotations       bool              `toml:"annotations"`
+}
+
+type QueryLogBusConfig struct {
+	Type          string `toml:"type"`
+	URL           string `toml:"url"`
+	Topic         string `toml:"topic"`
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval int    `toml:"flush_interval"`
+	QueueSize     int    `toml:"queue_size"`
+}
+
+type NxLogConfig struct {
+	File         string
+	Format       string
+	MaxAge       int   `toml:"max_age"`
+	MaxTotalSize int   `toml:"max_total_size"`
+	Compress     *bool `toml:"compress"`
+}
+
+type HTTPAccessLogConfig struct {
+	File   string `toml:"file"`
+	Format string `toml:"format"`
+}
+
+type ReportsConfig struct {
+	Period    string  `toml:"period"`
+	Directory string  `toml:"directory"`
+	Command   string  `toml:"command"`
+	Top       int     `toml:"top"`
+	Epsilon   float64 `toml:"privacy_epsilon"`
+	MinCount  int     `toml:"min_count"`
+}
+
+type StatusPageConfig struct {
+	ListenAddress string `toml:"listen_address"`
+}
+
+type UpstreamRecordingConfig struct {
+	Mode string `toml:"mode"`
+	File string `toml:"file"`
+}
+
+type SocketLimitsConfig struct {
+	MaxUpstreamConnections int  `toml:"max_upstream_connections"`
+	MaxClientConnections   int  `toml:"max_client_connections"`
+	AutoTighten            bool `toml:"auto_tighten"`
+}
+
+type MemoryConfig struct {
+	Limit       int  `toml:"limit"`
+	AutoLimit   bool `toml:"auto_limit"`
+	GCPercent   int  `toml:"gc_percent"`
+	ShrinkCache bool `toml:"shrink_cache"`
+}
+
+type BlockNameConfig struct {
+	File         string `toml:"blocked_names_file"`
+	LogFile      string `toml:"log_file"`
+	Format       string `toml:"log_format"`
+	CNAMETargets bool   `toml:"block_cname_targets"`
+	LogOnly      bool   `toml:"log_only"`
+}
+
+type BlockListConfig struct {
+	URLs         []string `toml:"urls"`
+	Category     string   `toml:"category"`
+	MinisignKey  string   `toml:"minisign_key"`
+	CacheFile    string   `toml:"cache_file"`
+	RefreshDelay int      `toml:"refresh_delay"`
+	StaleAfter   int      `toml:"stale_after"`
+	LogOnly      bool     `toml:"log_only"`
+}
+
+type AllowedNameConfig struct {
+	File               string   `toml:"allowed_names_file"`
+	LogFile            string   `toml:"log_file"`
+	Format             string   `toml:"log_format"`
+	DefaultDeny        bool     `toml:"default_deny"`
+	DefaultDenyClients []string `toml:"default_deny_clients"`
+}
+
+type BlockIPConfig struct {
+	File    string `toml:"blocked_ips_file"`
+	LogFile string `toml:"log_file"`
+	Format  string `toml:"log_format"`
+	LogOnly bool   `toml:"log_only"`
+}
+
+type AllowIPConfig struct {
+	File    string `toml:"allowed_ips_file"`
+	LogFile string `toml:"log_file"`
+	Format  string `toml:"log_format"`
+}
+
+type AnonymizedDNSRouteConfig struct {
+	ServerName string   `toml:"server_name"`
+	RelayNames []string `toml:"via"`
+}
+
+type AnonymizedDNSConfig struct {
+	Routes             []AnonymizedDNSRouteConfig `toml:"routes"`
+	SkipIncompatible   bool                       `toml:"skip_incompatible"`
+	DirectCertFallback bool                       `toml:"direct_cert_fallback"`
+}
+
+type BrokenImplementationsConfig struct {
+	BrokenQueryPadding []string `toml:"broken_query_padding"`
+	FragmentsBlocked   []string `toml:"fragments_blocked"`
+}
+
+type LocalDoHConfig struct {
+	ListenAddresses []string `toml:"listen_addresses"`
+	Path            string   `toml:"path"`
+	CertFile        string   `toml:"cert_file"`
+	CertKeyFile     string   `toml:"cert_key_file"`
+	DDR             bool     `toml:"ddr"`
+	DDRServerName   string   `toml:"ddr_server_name"`
+}
+
+type ListenerOptions struct {
+	EDNSPayloadSize int      `toml:"edns_payload_size"`
+	Label           string   `toml:"label"`
+	Protocols       []string `toml:"protocols"`
+}
+
+type ServerSummary struct {
+	Name        string   `json:"name"`
+	Proto       string   `json:"proto"`
+	IPv6        bool     `json:"ipv6"`
+	Address     string   `json:"address,omitempty"`
+	Addrs       []string `json:"addrs,omitempty"`
+	Ports       []int    `json:"ports"`
+	DNSSEC      *bool    `json:"dnssec,omitempty"`
+	NoLog       bool     `json:"nolog"`
+	NoFilter    bool     `json:"nofilter"`
+	Description string   `json:"description,omitempty"`
+	Stamp       string   `json:"stamp"`
+	CertDays    *int     `json:"cert_days_left,omitempty"`
+	Countries   []string `json:"countries,omitempty"`
+}
+
+type TLSClientAuthCredsConfig struct {
+	ServerName string `toml:"server_name"`
+	ClientCert string `toml:"client_cert"`
+	ClientKey  string `toml:"client_key"`
+	RootCA     string `toml:"root_ca"`
+}
+
+type DoHClientX509AuthConfig struct {
+	Creds []TLSClientAuthCredsConfig `toml:"creds"`
+}
+
+// ServerOptions are settings for a specific server
+type ServerOptions struct {
+	DoHMethod         string            `toml:"doh_method"`
+	HTTPHeaders       map[string]string `toml:"http_headers"`
+	RequireDNSSEC     bool              `toml:"require_dnssec"`
+	EphemeralKeys     *bool             `toml:"dnscrypt_ephemeral_keys"`
+	EphemeralKeyReuse *int              `toml:"dnscrypt_ephemeral_key_reuse"`
+	Provider          string            `toml:"provider"`
+	Countries         []string          `toml:"countries"`
+}
+
+type DNS64Config struct {
+	Prefixes  []string `toml:"prefix"`
+	Resolvers []string `toml:"resolver"`
+}
+
+type CanaryDomainsConfig struct {
+	Mozilla            string `toml:"mozilla"`
+	ICloudPrivateRelay string `toml:"icloud_private_relay"`
+	LogFile            string `toml:"log_file"`
+}
+
+type ResponseRateLimitConfig struct {
+	ResponsesPerSecond int `toml:"responses_per_second"`
+	Slip               int `toml:"slip"`
+	IPv4PrefixLength   int `toml:"ipv4_prefix_length"`
+	IPv6PrefixLength   int `toml:"ipv6_prefix_length"`
+}
+
+type RelayServiceConfig struct {
+	ListenAddresses  []string `toml:"listen_addresses"`
+	AllowedTargets   []string `toml:"allowed_targets"`
+	QueriesPerSecond int      `toml:"queries_per_second"`
+}
+
+type HAPeeringConfig struct {
+	ListenAddress string `toml:"listen_address"`
+	Peer          string `toml:"peer"`
+	SharedKey     string `toml:"shared_key"`
+	SyncInterval  int    `toml:"sync_interval"`
+	SyncCache     bool   `toml:"sync_cache"`
+}
+
+type WarmupConfig struct {
+	File            string `toml:"file"`
+	RefreshInterval int    `toml:"refresh_interval"`
+}
+
+type PrimingConfig struct {
+	ServerHosts bool     `toml:"server_hosts"`
+	Names       []string `toml:"names"`
+}
+
+type BeaconsConfig struct {
+	Interval    int                 `toml:"interval"`
+	Action      string              `toml:"action"`
+	DNSSECNames []string            `toml:"dnssec_names"`
+	Expected    map[string][]string `toml:"expected"`
+}
+
+type SharedCacheConfig struct {
+	Type      string `toml:"type"`
+	URL       string `toml:"url"`
+	KeyPrefix string `toml:"key_prefix"`
+	Timeout   int    `toml:"timeout"`
+	SharedKey string `toml:"shared_key"`
+}
+
+type CaptivePortalsConfig struct {
+	MapFile              string   `toml:"map_file"`
+	AutoDetect           bool     `toml:"auto_detect"`
+	ProbeURL             string   `toml:"probe_url"`
+	HTTPSProbeURL        *string  `toml:"https_probe_url"`
+	PassthroughResolvers []string `toml:"passthrough_resolvers"`
+	PassthroughNames     []string `toml:"passthrough_names"`
+}
+
+type LANHostsConfig struct {
+	LeasesFile     string `toml:"leases_file"`
+	URL            string `toml:"url"`
+	Domain         string `toml:"domain"`
+	RefreshDelay   int    `toml:"refresh_delay"`
+	TTL            uint32 `toml:"ttl"`
+	LogClientNames bool   `toml:"log_client_names"`
+}
+
+type QueryRoutingConfig struct {
+	RulesFile       string   `toml:"rules_file"`
+	DefaultRoute    string   `toml:"default_route"`
+	OverrideOption  uint16   `toml:"override_option"`
+	OverrideClients []string `toml:"override_clients"`
+}
+
+type ConfigFlags struct {
+	Resolve                 *string
+	List                    *bool
+	ListAll                 *bool
+	ListSources             *bool
+	IncludeRelays           *bool
+	IncludeCertExpiry       *bool
+	JSONOutput              *bool
+	Check                   *bool
+	ConfigFile              *string
+	Child                   *bool
+	NetprobeTimeoutOverride *int
+	ShowCerts               *bool
+	Control                 *string
+	Trace                   *string
+	FallbackConfigFile      *string
+	DumpEffectiveConfig     *bool
+}
+
+func findConfigFile(configFile *string) (string, error) {
+	if _, err := os.Stat(*configFile); os.IsNotExist(err) {
+		cdLocal()
+		if _, err := os.Stat(*configFile); err != nil {
+			return "", err
+		}
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(*configFile) {
+		return *configFile, nil
+	}
+	return path.Join(pwd, *configFile), nil
+}
+
+func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
+	if !*flags.Check {
+		return configLoad(proxy, flags, nil)
+	}
+	check := &ConfigCheck{}
+	if err := configLoad(proxy, flags, check); err != nil {
+		check.addError(err)
+	}
+	check.report(*flags.JSONOutput)
+	return nil
+}
+
+// ConfigLoadWithFallback loads the configuration and initializes the plugins. If this fails and a
+// fallback configuration file was set, a new proxy is configured from that file instead. It keeps
+// the DNS listening sockets that may have already been opened for the main configuration, and these
+// must then be the same in both configurations.
+// loaded, if not nil, is called after a configuration has been loaded, before the plugins are initialized.
+func ConfigLoadWithFallback(proxy *Proxy, flags *ConfigFlags, loaded func()) (*Proxy, error) {
+	fallbackConfigFile := ""
+	if flags.FallbackConfigFile != nil && len(*flags.FallbackConfigFile) > 0 {
+		fallbackConfigFile, _ = filepath.Abs(*flags.FallbackConfigFile)
+	}
+	err := ConfigLoad(proxy, flags)
+	if err == nil {
+		if loaded != nil {
+			loaded()
+		}
+		err = proxy.InitPluginsGlobals()
+	}
+	if err == nil {
+		return proxy, nil
+	}
+	if len(fallbackConfigFile) == 0 {
+		fallbackConfigFile = proxy.fallbackConfigFile
+	}
+	isCommandMode := *flags.Check || proxy.showCerts || *flags.List || *flags.ListAll || *flags.ListSources
+	if len(fallbackConfigFile) == 0 || isCommandMode {
+		return proxy, err
+	}
+	if *flags.Child {
+		dlog.Error("The fallback configuration cannot be used after privileges have been dropped")
+		return proxy, err
+	}
+	dlog.Criticalf("Unable to start with the configuration file [%s]: [%v]", *flags.ConfigFile, err)
+	dlog.Criticalf("*** USING THE FALLBACK CONFIGURATION FILE [%s] ***", fallbackConfigFile)
+	if len(proxy.udpListeners) > 0 || len(proxy.tcpListeners) > 0 {
+		fallbackConfig := newConfig()
+		if _, err := decodeConfigFile(fallbackConfigFile, &fallbackConfig); err != nil {
+			return proxy, fmt.Errorf("Fallback configuration: %v", err)
+		}
+		if !sameListenAddresses(fallbackConfig.ListenAddresses, proxy.listenAddresses) {
+			return proxy, fmt.Errorf("Fallback configuration: `listen_addresses` must be the same as in [%s]", *flags.ConfigFile)
+		}
+	}
+	fallback := NewProxy()
+	fallback.inheritDNSListeners(proxy)
+	// Stop the background tasks that may have been started by the failed configuration
+	proxy.Stop()
+	fallbackFlags := *flags
+	fallbackFlags.ConfigFile = &fallbackConfigFile
+	if err := ConfigLoad(fallback, &fallbackFlags); err != nil {
+		return fallback, fmt.Errorf("Fallback configuration: %v", err)
+	}
+	if loaded != nil {
+		loaded()
+	}
+	if err := fallback.InitPluginsGlobals(); err != nil {
+		return fallback, fmt.Errorf("Fallback configuration: %v", err)
+	}
+	dlog.Criticalf("Running with the fallback configuration - fix [%s] and restart the proxy", *flags.ConfigFile)
+	return fallback, nil
+}
+
+// sameListenAddresses tells whether two sets of listen addresses designate the same sockets
+func sameListenAddresses(a []string, b []string) bool {
+	normalized := func(addrs []string) map[string]bool {
+		set := make(map[string]bool, len(addrs))
+		for _, addr := range addrs {
+			if normalizedAddr, err := normalizeListenAddress(addr); err == nil {
+				set[normalizedAddr] = true
+			} else {
+				set[addr] = true
+			}
+		}
+		return set
+	}
+	setA, setB := normalized(a), normalized(b)
+	if len(setA) != len(setB) {
+		return false
+	}
+	for addr := range setA {
+		if !setB[addr] {
+			return false
+		}
+	}
+	return true
+}
+
+func configLoad(proxy *Proxy, flags *ConfigFlags, check *ConfigCheck) error {
+	foundConfigFile, err := findConfigFile(flags.ConfigFile)
+	if err != nil {
+		return &ConfigProblem{
+			Kind: ConfigProblemMissingFile,
+			Message: fmt.Sprintf(
+				"Unable to load the configuration file [%s] -- Maybe use the -config command-line switch?",
+				*flags.ConfigFile,
+			),
+		}
+	}
+	WarnIfMaybeWritableByOtherUsers(foundConfigFile)
+	config := newConfig()
+	if check != nil {
+		check.setConfigFile(foundConfigFile)
+	}
+	md, err := decodeConfigFile(foundConfigFile, &config)
+	if err != nil {
+		if check != nil {
+			check.addDecodeError(err)
+			return nil
+		}
+		return err
+	}
+
+	if flags.Resolve != nil && len(*flags.Resolve) > 0 {
+		addr := "127.0.0.1:53"
+		if len(config.ListenAddresses) > 0 {
+			addr = config.ListenAddresses[0]
+		}
+		Resolve(addr, *flags.Resolve, len(config.ServerNames) == 1, *flags.JSONOutput)
+		os.Exit(0)
+	}
+
+	if err := cdFileDir(foundConfigFile); err != nil {
+		return err
+	}
+	proxy.configFile = foundConfigFile
+	if flags.Control != nil && len(*flags.Control) > 0 {
+		os.Exit(ControlSocketClient(config.ControlSocket, *flags.Control))
+	}
+	if flags.Trace != nil && len(*flags.Trace) > 0 {
+		os.Exit(ControlSocketClient(config.ControlSocket, "trace "+strings.ReplaceAll(*flags.Trace, ",", " ")))
+	}
+	if config.LogLevel >= 0 && config.LogLevel < int(dlog.SeverityLast) {
+		dlog.SetLogLevel(dlog.Severity(config.LogLevel))
+	}
+	if dlog.LogLevel() <= dlog.SeverityDebug && os.Getenv("DEBUG") == "" {
+		dlog.SetLogLevel(dlog.SeverityInfo)
+	}
+	dlog.TruncateLogFile(config.LogFileLatest)
+	proxy.showCerts = *flags.ShowCerts || len(os.Getenv("SHOW_CERTS")) > 0
+	isCommandMode := *flags.Check || proxy.showCerts || *flags.List || *flags.ListAll || *flags.ListSources
+	if isCommandMode {
+	} else if config.UseSyslog {
+		dlog.UseSyslog(true)
+	} else if config.LogFile != nil {
+		dlog.UseLogFile(*config.LogFile)
+		if !*flags.Child {
+			FileDescriptors = append(FileDescriptors, dlog.GetFileDescriptor())
+		} else {
+			dlog.SetFileDescriptor(os.NewFile(uintptr(InheritedDescriptorsBase+FileDescriptorNum), "logFile"))
+			FileDescriptorNum++
+		}
+	}
+	if !*flags.Child {
+		dlog.Noticef("dnscrypt-proxy %s", AppVersion)
+	}
+	undecoded := md.Undecoded()
+	if len(undecoded) > 0 {
+		if check == nil {
+			return fmt.Errorf("Unsupported key in configuration file: [%s]", undecoded[0])
+		}
+		for _, key := range undecoded {
+			check.add(ConfigProblemUnknownKey, key, fmt.Sprintf("Unsupported key in configuration file: [%s]", key))
+		}
+	}
+	if err := config.loadCredentialsFile(); err != nil {
+		if check == nil {
+			return err
+		}
+		check.addError(err)
+	}
+	if check != nil {
+		check.checkFiles(&config)
+		config.check = check
+	}
+	if flags.DumpEffectiveConfig != nil && *flags.DumpEffectiveConfig {
+		if err := config.dumpEffectiveConfig(flags, os.Stdout); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	return config.apply(proxy, flags)
+}
+
+// invalid reports an invalid value. When the configuration is being checked, the error is recorded
+// and nil is returned, so that the remaining values are checked as well.
+func (config *Config) invalid(err error) error {
+	if err == nil || config.check == nil {
+		return err
+	}
+	config.check.addError(err)
+	return nil
+}
+
+// apply configures a proxy according to a decoded configuration
+func (config *Config) apply(proxy *Proxy, flags *ConfigFlags) error {
+	isCommandMode := *flags.Check || proxy.showCerts || *flags.List || *flags.ListAll || *flags.ListSources
+	proxy.logMaxSize = config.LogMaxSize
+	proxy.logMaxAge = config.LogMaxAge
+	proxy.logMaxBackups = config.LogMaxBackups
+
+	proxy.userName = config.UserName
+	proxy.superviseChild = config.SuperviseChild
+	proxy.controlSocket = config.ControlSocket
+	proxy.sighupReloadListeners = config.SighupReloadListeners
+	if config.FaultInjection {
+		if len(config.ControlSocket) == 0 {
+			dlog.Warn("Fault injection requires a control socket")
+		}
+		proxy.faultInjector = NewFaultInjector()
+	}
+	proxy.fallbackConfigFile = config.FallbackConfigFile
+	proxy.nodeName = config.NodeName
+	if strings.ContainsAny(proxy.nodeName, " \t\r\n") {
+		if err := config.invalid(fmt.Errorf("Invalid node name: [%s]", proxy.nodeName)); err != nil {
+			return err
+		}
+	}
+
+	matcherEngine, err := parsePatternMatcherEngine(config.MatcherEngine)
+	if err != nil {
+		if err := config.invalid(err); err != nil {
+			return err
+		}
+		matcherEngine = MatcherEngineCritbit
+	}
+	proxy.matcherEngine = matcherEngine
+	proxy.matcherBenchmark = config.MatcherBenchmark
+	proxy.child = *flags.Child
+	proxy.xTransport = NewXTransport()
+	proxy.xTransport.tlsDisableSessionTickets = config.TLSDisableSessionTickets
+	proxy.xTransport.tlsCipherSuite = config.TLSCipherSuite
+	proxy.xTransport.mainProto = proxy.mainProto
+	proxy.xTransport.http3 = config.HTTP3
+	var plainBootstrapResolvers, secureBootstrapResolvers []string
+	if len(config.BootstrapResolvers) > 0 {
+		for i, resolver := range config.BootstrapResolvers {
+			secure, err := parseBootstrapResolver(resolver)
+			if err != nil {
+				if err := config.invalid(fmt.Errorf("Bootstrap resolver [%v]: %v", resolver, err)); err != nil {
+					return err
+				}
+			}
+			if secure {
+				config.BootstrapResolvers[i] = normalizeSecureBootstrapResolver(resolver)
+				secureBootstrapResolvers = append(secureBootstrapResolvers, config.BootstrapResolvers[i])
+			} else {
+				plainBootstrapResolvers = append(plainBootstrapResolvers, resolver)
+			}
+		}
+		proxy.xTransport.ignoreSystemDNS = config.IgnoreSystemDNS
+	}
+	proxy.xTransport.bootstrapResolvers = plainBootstrapResolvers
+	proxy.xTransport.secureBootstrapResolvers = secureBootstrapResolvers
+	proxy.xTransport.useIPv4 = config.SourceIPv4
+	proxy.xTransport.useIPv6 = config.SourceIPv6
+	proxy.xTransport.keepAlive = time.Duration(config.KeepAlive) * time.Second
+	proxy.fdLimits = NewFDLimits(config.SocketLimits.MaxUpstreamConnections, config.SocketLimits.MaxClientConnections, config.SocketLimits.AutoTighten)
+	proxy.xTransport.fdLimits = proxy.fdLimits
+	if config.PlainTCPKeepAlive > 0 {
+		proxy.tcpPool = NewTCPPool(time.Duration(config.PlainTCPKeepAlive) * time.Second)
+		proxy.xTransport.tcpPool = proxy.tcpPool
+	}
+	if len(config.HTTPProxyURL) > 0 {
+		httpProxyURL, err := url.Parse(config.HTTPProxyURL)
+		if err != nil {
+			if err := config.invalid(fmt.Errorf("Unable to parse the HTTP proxy URL [%v]", config.HTTPProxyURL)); err != nil {
+				return err
+			}
+		}
+		proxy.xTransport.httpProxyFunction = http.ProxyURL(httpProxyURL)
+	}
+
+	if len(config.Proxy) > 0 {
+		proxyDialerURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return fmt.Errorf("Unable to parse the proxy URL [%v]", config.Proxy)
+		}
+		proxyDialer, err := netproxy.FromURL(proxyDialerURL, netproxy.Direct)
+		if err != nil {
+			return fmt.Errorf("Unable to use the proxy: [%v]", err)
+		}
+		proxy.xTransport.proxyDialer = &proxyDialer
+		proxy.mainProto = "tcp"
+	}
+
+	proxy.xTransport.rebuildTransport()
+
+	proxy.blockedQueryResponse = config.BlockedQueryResponse
+	proxy.timeout = time.Duration(config.Timeout) * time.Millisecond
+	proxy.maxClients = config.MaxClients
+	proxy.udpListenerSockets = 1
+	if udpReusePortSupported {
+		proxy.udpListenerSockets = config.UDPListenerSockets
+		if proxy.udpListenerSockets <= 0 {
+			proxy.udpListenerSockets = runtime.GOMAXPROCS(0)
+		}
+	} else if config.UDPListenerSockets > 1 {
+		dlog.Warn("Multiple UDP sockets per listen address are not supported on this platform")
+	}
+	proxy.mainProto = "udp"
+	if config.ForceTCP {
+		proxy.mainProto = "tcp"
+	}
+	switch strings.ToLower(config.TruncatedUDPResponses) {
+	case "", "retry_tcp":
+		proxy.truncatedUDPRetryTCP = true
+	case "pass":
+		proxy.truncatedUDPRetryTCP = false
+	default:
+		if err := config.invalid(fmt.Errorf("Unsupported value for truncated_udp_responses: [%s]", config.TruncatedUDPResponses)); err != nil {
+			return err
+		}
+	}
+	if len(config.ListenerOptions) > 0 {
+		proxy.listenerOptions = make(map[string]*ListenerOptions)
+		for listenAddrStr, options := range config.ListenerOptions {
+			addr, err := normalizeListenAddress(listenAddrStr)
+			if err != nil {
+				if err := config.invalid(fmt.Errorf("Invalid address in listener_options: [%s]", listenAddrStr)); err != nil {
+					return err
+				}
+			}
+			if options.EDNSPayloadSize != 0 && (options.EDNSPayloadSize < 512 || options.EDNSPayloadSize > MaxDNSUDPPacketSize) {
+				if err := config.invalid(fmt.Errorf("[%s]: edns_payload_size must be between 512 and %d", listenAddrStr, MaxDNSUDPPacketSize)); err != nil {
+					return err
+				}
+			}
+			for _, protocol := range options.Protocols {
+				if protocol = strings.ToLower(protocol); protocol != "udp" && protocol != "tcp" {
+					if err := config.invalid(fmt.Errorf("[%s]: unsupported protocol [%s] - Supported protocols are 'udp' and 'tcp'", listenAddrStr, protocol)); err != nil {
+						return err
+					}
+				}
+			}
+			options := options
+			proxy.listenerOptions[addr] = &options
+			if len(options.Label) > 0 {
+				proxy.listenerLabels = true
+			}
+		}
+	}
+	proxy.certRefreshConcurrency = Max(1, config.CertRefreshConcurrency)
+	proxy.certRefreshJitter = Min(50, Max(0, config.CertRefreshJitter))
+	proxy.certRefreshSpread = time.Duration(Max(0, config.CertRefreshSpread)) * time.Second
+	proxy.certRefreshDelay = time.Duration(Max(60, config.CertRefreshDelay)) * time.Minute
+	proxy.certRefreshDelayAfterFailure = time.Duration(10 * time.Second)
+	proxy.certIgnoreTimestamp = config.CertIgnoreTimestamp
+	proxy.certExpiryWarning = time.Duration(Max(0, config.CertExpiryWarning)) * 24 * time.Hour
+	proxy.ephemeralKeys = config.EphemeralKeys
+	proxy.ephemeralKeyReuse = time.Duration(Max(0, config.EphemeralKeyReuse)) * time.Second
+	preferredConstruction, err := selectCryptoConstruction(config.CryptoImplementation)
+	if err != nil {
+		return err
+	}
+	proxy.preferredConstruction = preferredConstruction
+	if len(config.ListenAddresses) == 0 && len(config.LocalDoH.ListenAddresses) == 0 {
+		dlog.Debug("No local IP/port configured")
+	}
+	lbStrategy := LBStrategy(DefaultLBStrategy)
+	switch lbStrategyStr := strings.ToLower(config.LBStrategy); lbStrategyStr {
+	case "":
+		// default
+	case "p2":
+		lbStrategy = LBStrategyP2{}
+	case "ph":
+		lbStrategy = LBStrategyPH{}
+	case "fastest":
+	case "first":
+		lbStrategy = LBStrategyFirst{}
+	case "random":
+		lbStrategy = LBStrategyRandom{}
+	default:
+		if strings.HasPrefix(lbStrategyStr, "p") {
+			n, err := strconv.ParseInt(strings.TrimPrefix(lbStrategyStr, "p"), 10, 32)
+			if err != nil || n <= 0 {
+				dlog.Warnf("Invalid load balancing strategy: [%s]", config.LBStrategy)
+			} else {
+				lbStrategy = LBStrategyPN{n: int(n)}
+			}
+		} else {
+			dlog.Warnf("Unknown load balancing strategy: [%s]", config.LBStrategy)
+		}
+	}
+	proxy.serversInfo.lbStrategy = lbStrategy
+	proxy.serversInfo.lbEstimator = config.LBEstimator
+	proxy.serversInfo.lbMinProviders = config.LBMinProviders
+	if config.Deterministic {
+		seed := config.RandomSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		proxy.random = newLockedRand(seed)
+		proxy.serversInfo.random = proxy.random
+		proxy.xTransport.random = proxy.random
+		if proxy.faultInjector != nil {
+			proxy.faultInjector.random = proxy.random
+		}
+		proxy.serversInfo.deterministic = true
+		if proxy.serversInfo.lbEstimator {
+			dlog.Notice("Deterministic mode - the load-balancing estimator is disabled")
+		}
+		proxy.serversInfo.lbEstimator = false
+		dlog.Noticef("Deterministic mode - random seed: %d", seed)
+	}
+
+	for _, listenAddrStr := range append(append([]string{}, config.ListenAddresses...), config.LocalDoH.ListenAddresses...) {
+		if err := config.invalid(checkListenAddressZone(listenAddrStr)); err != nil {
+			return err
+		}
+	}
+	proxy.listenAddresses = config.ListenAddresses
+	proxy.localDoHListenAddresses = config.LocalDoH.ListenAddresses
+	if len(config.LocalDoH.Path) > 0 && config.LocalDoH.Path[0] != '/' {
+		if err := config.invalid(fmt.Errorf("local DoH: [%s] cannot be a valid URL path. Read the documentation", config.LocalDoH.Path)); err != nil {
+			return err
+		}
+	}
+	proxy.localDoHPath = config.LocalDoH.Path
+	proxy.localDoHCertFile = config.LocalDoH.CertFile
+	proxy.localDoHCertKeyFile = config.LocalDoH.CertKeyFile
+	proxy.localDoHDDR = config.LocalDoH.DDR
+	proxy.localDoHDDRServerName = config.LocalDoH.DDRServerName
+	proxy.pluginBlockIPv6 = config.BlockIPv6
+	proxy.pluginBlockUnqualified = config.BlockUnqualified
+	proxy.pluginBlockUndelegated = config.BlockUndelegated
+	proxy.queryPluginsOrder = config.QueryPluginsOrder
+	if len(config.PluginScopes) > 0 {
+		proxy.pluginScopes = make(map[string]PluginScope)
+		for name, scope := range config.PluginScopes {
+			proxy.pluginScopes[strings.ToLower(name)] = scope
+		}
+	}
+	if len(config.ClientTags) > 0 {
+		if clientTags, err := NewClientTags(config.ClientTags); err != nil {
+			if err := config.invalid(err); err != nil {
+				return err
+			}
+		} else {
+			proxy.clientTags = clientTags
+		}
+	}
+	proxy.chromeProbes = strings.ToLower(config.ChromeProbes)
+	switch proxy.chromeProbes {
+	case "", ChromeProbesPass, ChromeProbesNXDomain:
+	default:
+		if err := config.invalid(fmt.Errorf("Unsupported value for chrome_probes: [%s]", config.ChromeProbes)); err != nil {
+			return err
+		}
+	}
+	proxy.scrubResponses = config.ScrubResponses
+	proxy.maxResponseSize = config.MaxResponseSize
+	proxy.maxResponseRecords = config.MaxResponseRecords
+	proxy.responseLimitAction = strings.ToLower(config.ResponseLimitAction)
+	switch proxy.responseLimitAction {
+	case "":
+		proxy.responseLimitAction = ResponseLimitServFail
+	case ResponseLimitServFail, ResponseLimitTruncate:
+	default:
+		if err := config.invalid(fmt.Errorf("Unsupported value for response_limit_action: [%s]", config.ResponseLimitAction)); err != nil {
+			return err
+		}
+	}
+	proxy.sanitizeResponses = strings.ToLower(config.SanitizeResponses)
+	switch proxy.sanitizeResponses {
+	case "", "strip", "replace":
+	default:
+		if err := config.invalid(fmt.Errorf("Unsupported value for sanitize_responses: [%s]", config.SanitizeResponses)); err != nil {
+			return err
+		}
+	}
+	proxy.sanitizeMaxTXTLength = config.SanitizeMaxTXTLength
+	proxy.cache = config.Cache
+	proxy.cacheSize = config.CacheSize
+	proxy.memoryLimiter = NewMemoryLimiter(config.Memory.Limit, config.Memory.AutoLimit, config.Memory.GCPercent,
+		config.Memory.ShrinkCache && config.Cache, &proxy.cachedResponses, config.CacheSize)
+
+	if config.CacheNegTTL > 0 {
+		proxy.cacheNegMinTTL = config.CacheNegTTL
+		proxy.cacheNegMaxTTL = config.CacheNegTTL
+	} else {
+		proxy.cacheNegMinTTL = config.CacheNegMinTTL
+		proxy.cacheNegMaxTTL = config.CacheNegMaxTTL
+	}
+
+	proxy.cacheMinTTL = config.CacheMinTTL
+	proxy.cacheMaxTTL = config.CacheMaxTTL
+	if len(config.CacheBypass) > 0 {
+		proxy.cacheBypass = NewPatternMatcherWithEngine(proxy.matcherEngine)
+		for i, pattern := range config.CacheBypass {
+			if err := proxy.cacheBypass.Add(strings.ToLower(pattern), nil, 1+i); err != nil {
+				if err := config.invalid(fmt.Errorf("Invalid pattern in `cache_bypass`: %v", err)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if config.CacheLazy {
+		proxy.cacheLazyGrace = time.Duration(config.CacheLazyGrace) * time.Second
+	}
+	if len(config.SharedCache.Type) > 0 {
+		if !config.Cache {
+			dlog.Warn("The shared cache requires the cache to be enabled")
+		} else {
+			if sharedCache, err := NewSharedCache(&config.SharedCache); err != nil {
+				if err := config.invalid(err); err != nil {
+					return err
+				}
+			} else {
+				proxy.sharedCache = sharedCache
+			}
+		}
+	}
+	if len(config.Warmup.File) > 0 {
+		if !config.Cache {
+			dlog.Warn("Warming up the cache requires the cache to be enabled")
+		} else {
+			proxy.warmup = NewWarmup(config.Warmup.File, time.Duration(config.Warmup.RefreshInterval)*time.Minute)
+		}
+	}
+	if config.Priming.ServerHosts || len(config.Priming.Names) > 0 {
+		if len(config.Priming.Names) > 0 && !config.Cache {
+			if err := config.invalid(errors.New("Priming names requires the cache to be enabled")); err != nil {
+				return err
+			}
+		}
+		priming, err := NewPriming(config.Priming.ServerHosts, config.Priming.Names)
+		if err != nil {
+			return fmt.Errorf("Invalid `priming` names: %v", err)
+		}
+		proxy.priming = priming
+	}
+	if len(config.Beacons.Expected) > 0 || len(config.Beacons.DNSSECNames) > 0 {
+		beacons, err := NewBeacons(
+			time.Duration(config.Beacons.Interval)*time.Minute,
+			config.Beacons.Action,
+			config.Beacons.Expected,
+			config.Beacons.DNSSECNames,
+		)
+		if err != nil {
+			return fmt.Errorf("Invalid `beacons` configuration: %v", err)
+		}
+		proxy.beacons = beacons
+	}
+	if len(config.HAPeering.Peer) > 0 || len(config.HAPeering.ListenAddress) > 0 {
+		if len(config.HAPeering.Peer) == 0 || len(config.HAPeering.ListenAddress) == 0 {
+			return errors.New("HA peering requires both `listen_address` and `peer` to be set")
+		}
+		if config.HAPeering.SyncCache && !config.Cache {
+			if err := config.invalid(errors.New("HA peering: `sync_cache` requires the cache to be enabled")); err != nil {
+				return err
+			}
+		}
+		haPeering, err := NewHAPeering(&config.HAPeering, config.CacheSize)
+		if err != nil {
+			return err
+		}
+		proxy.haPeering = haPeering
+	}
+	if config.ResponseRateLimit.ResponsesPerSecond > 0 {
+		if config.ResponseRateLimit.Slip < 0 {
+			if err := config.invalid(errors.New("Response rate limiting: `slip` cannot be negative")); err != nil {
+				return err
+			}
+		}
+		proxy.responseRateLimiter = NewResponseRateLimiter(&config.ResponseRateLimit)
+	}
+	if len(config.RelayService.ListenAddresses) > 0 {
+		relay, err := NewRelayService(&config.RelayService, proxy.timeout)
+		if err != nil {
+			return err
+		}
+		proxy.relayService = relay
+	}
+	proxy.canaryPolicies = make(map[string]string)
+	for canary, policy := range map[string]string{
+		"mozilla":              config.CanaryDomains.Mozilla,
+		"icloud_private_relay": config.CanaryDomains.ICloudPrivateRelay,
+	} {
+		policy = strings.ToLower(policy)
+		if policy != CanaryPolicyNXDomain && policy != CanaryPolicyPass {
+			if err := config.invalid(fmt.Errorf("Invalid policy for the [%s] canary domains: [%s] - Use '%s' or '%s'", canary, policy, CanaryPolicyNXDomain, CanaryPolicyPass)); err != nil {
+				return err
+			}
+		}
+		proxy.canaryPolicies[canary] = policy
+	}
+	proxy.canaryLogFile = config.CanaryDomains.LogFile
+	proxy.rejectTTL = config.RejectTTL
+	proxy.cloakTTL = config.CloakTTL
+	proxy.cloakedPTR = config.CloakedPTR
+
+	proxy.queryMeta = config.QueryMeta
+
+	if len(config.EDNSClientSubnet) != 0 {
+		proxy.ednsClientSubnets = make([]*net.IPNet, 0)
+		for _, cidr := range config.EDNSClientSubnet {
+			_, net, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("Invalid EDNS-client-subnet CIDR: [%v]", cidr)
+			}
+			proxy.ednsClientSubnets = append(proxy.ednsClientSubnets, net)
+		}
+	}
+
+	if len(config.QueryLog.Format) == 0 {
+		config.QueryLog.Format = "tsv"
+	} else {
+		config.QueryLog.Format = strings.ToLower(config.QueryLog.Format)
+	}
+	if config.QueryLog.Format != "tsv" && config.QueryLog.Format != "ltsv" {
+		if err := config.invalid(errors.New("Unsupported query log format")); err != nil {
+			return err
+		}
+	}
+	proxy.queryLogFile = config.QueryLog.File
+	proxy.queryLogRetention = NewLogRetention(config.QueryLog.MaxAge, config.QueryLog.MaxTotalSize, config.QueryLog.Compress, config.LogMaxAge)
+	proxy.queryLogFormat = config.QueryLog.Format
+	proxy.queryLogIgnoredQtypes = config.QueryLog.IgnoredQtypes
+	proxy.queryLogAnnotations = config.QueryLog.Annotations
+	if len(config.QueryLog.IPTags) > 0 {
+		ipTags, err := NewIPTags(config.QueryLog.IPTags)
+		if err != nil {
+			return fmt.Errorf("Unable to load the query log IP tags: %v", err)
+		}
+		proxy.queryLogIPTags = ipTags
+	}
+	queryLogAnonymizer, err := NewIPAnonymizer(
+		config.QueryLog.AnonymizeClientIP,
+		time.Duration(config.QueryLog.HashKeyRotation)*time.Hour,
+	)
+	if err != nil {
+		if err := config.invalid(err); err != nil {
+			return err
+		}
+	}
+	proxy.queryLogAnonymizer = queryLogAnonymizer
+	if len(config.QueryLog.Bus.Type) > 0 {
+		if proxy.queryLogBus, err = NewQueryLogBus(&config.QueryLog.Bus, proxy.xTransport); err != nil {
+			return err
+		}
+	}
+
+	if len(config.NxLog.Format) == 0 {
+		config.NxLog.Format = "tsv"
+	} else {
+		config.NxLog.Format = strings.ToLower(config.NxLog.Format)
+	}
+	if config.NxLog.Format != "tsv" && config.NxLog.Format != "ltsv" {
+		if err := config.invalid(errors.New("Unsupported NX log format")); err != nil {
+			return err
+		}
+	}
+	proxy.nxLogFile = config.NxLog.File
+	proxy.nxLogRetention = NewLogRetention(config.NxLog.MaxAge, config.NxLog.MaxTotalSize, config.NxLog.Compress, config.LogMaxAge)
+	proxy.nxLogFormat = config.NxLog.Format
+
+	if len(config.HTTPAccessLog.File) > 0 {
+		format := strings.ToLower(config.HTTPAccessLog.Format)
+		if len(format) == 0 {
+			format = "tsv"
+		}
+		if format != "tsv" && format != "ltsv" {
+			if err := config.invalid(errors.New("Unsupported HTTP access log format")); err != nil {
+				return err
+			}
+		}
+		proxy.httpAccessLog = NewHTTPAccessLog(
+			Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, config.HTTPAccessLog.File),
+			format,
+		)
+	}
+
+	if len(config.Reports.Directory) > 0 {
+		period := strings.ToLower(config.Reports.Period)
+		if len(period) == 0 {
+			period = ReportPeriodDaily
+		}
+		if period != ReportPeriodDaily && period != ReportPeriodWeekly {
+			if err := config.invalid(errors.New("Unsupported report period - Supported periods are 'daily' and 'weekly'")); err != nil {
+				return err
+			}
+		}
+		top := config.Reports.Top
+		if top <= 0 {
+			top = 10
+		}
+		if config.Reports.Epsilon < 0 {
+			if err := config.invalid(errors.New("`privacy_epsilon` must be positive")); err != nil {
+				return err
+			}
+		}
+		proxy.reporter = NewReporter(
+			period,
+			config.Reports.Directory,
+			config.Reports.Command,
+			top,
+			config.Reports.Epsilon,
+			config.Reports.MinCount,
+			proxy.queryLogAnonymizer,
+		)
+	}
+
+	if len(config.StatusPage.ListenAddress) > 0 {
+		proxy.statusPage = NewStatusPage(config.StatusPage.ListenAddress)
+	}
+
+	if len(config.UpstreamRecording.Mode) > 0 {
+		if len(config.UpstreamRecording.File) == 0 {
+			return errors.New("Upstream recording requires a file")
+		}
+		upstreamRecorder, err := NewUpstreamRecorder(strings.ToLower(config.UpstreamRecording.Mode), config.UpstreamRecording.File)
+		if err != nil {
+			return err
+		}
+		proxy.upstreamRecorder = upstreamRecorder
+		if upstreamRecorder.replaying() {
+			dlog.Noticef("Replaying the upstream responses recorded in [%s] - Queries will not be sent to any servers", config.UpstreamRecording.File)
+		} else {
+			dlog.Noticef("Recording the upstream responses to [%s]", config.UpstreamRecording.File)
+		}
+	}
+
+	if len(config.BlockName.Format) == 0 {
+		config.BlockName.Format = "tsv"
+	} else {
+		config.BlockName.Format = strings.ToLower(config.BlockName.Format)
+	}
+	if config.BlockName.Format != "tsv" && config.BlockName.Format != "ltsv" {
+		if err := config.invalid(errors.New("Unsupported block log format")); err != nil {
+			return err
+		}
+	}
+	proxy.blockNameFile = config.BlockName.File
+	proxy.blockNameFormat = config.BlockName.Format
+	proxy.blockNameCNAMETargets = config.BlockName.CNAMETargets
+	proxy.blockNameLogFile = config.BlockName.LogFile
+	proxy.blockNameLogOnly = config.BlockLogOnly || config.BlockName.LogOnly
+	proxy.queryLogWouldBlock = proxy.blockNameLogOnly || config.BlockIP.LogOnly
+	if len(config.BlockLists) > 0 {
+		lists := make([]*BlockList, 0, len(config.BlockLists))
+		for name, cfgList := range config.BlockLists {
+			refreshDelay := DefaultBlockListRefreshDelay
+			if cfgList.RefreshDelay > 0 {
+				refreshDelay = time.Duration(cfgList.RefreshDelay) * time.Hour
+			}
+			blockList, err := NewBlockList(
+				name,
+				cfgList.Category,
+				cfgList.URLs,
+				cfgList.MinisignKey,
+				cfgList.CacheFile,
+				refreshDelay,
+			)
+			if err != nil {
+				return err
+			}
+			if cfgList.StaleAfter > 0 {
+				blockList.health.setStaleAfter(time.Duration(cfgList.StaleAfter) * time.Hour)
+			}
+			blockList.logOnly = config.BlockLogOnly || cfgList.LogOnly
+			proxy.queryLogWouldBlock = proxy.queryLogWouldBlock || blockList.logOnly
+			lists = append(lists, blockList)
+		}
+		proxy.blockLists = NewBlockLists(lists, proxy.matcherEngine)
+	}
+
+	if len(config.AllowedName.Format) == 0 {
+		config.AllowedName.Format = "tsv"
+	} else {
+		config.AllowedName.Format = strings.ToLower(config.AllowedName.Format)
+	}
+	if config.AllowedName.Format != "tsv" && config.AllowedName.Format != "ltsv" {
+		if err := config.invalid(errors.New("Unsupported allowed_names log format")); err != nil {
+			return err
+		}
+	}
+	proxy.allowNameFile = config.AllowedName.File
+	proxy.allowNameFormat = config.AllowedName.Format
+	proxy.allowNameLogFile = config.AllowedName.LogFile
+	proxy.defaultDeny = config.AllowedName.DefaultDeny || len(config.AllowedName.DefaultDenyClients) > 0
+	if proxy.defaultDeny && len(proxy.allowNameFile) == 0 {
+		if err := config.invalid(errors.New("The default deny mode requires `allowed_names_file` to be set")); err != nil {
+			return err
+		}
+	}
+	defaultDenyClients, err := parseClientNetworks(config.AllowedName.DefaultDenyClients)
+	if err != nil {
+		if err := config.invalid(fmt.Errorf("Invalid network in `default_deny_clients`: %v", err)); err != nil {
+			return err
+		}
+	}
+	proxy.defaultDenyClients = defaultDenyClients
+
+	if len(config.BlockIP.Format) == 0 {
+		config.BlockIP.Format = "tsv"
+	} else {
+		config.BlockIP.Format = strings.ToLower(config.BlockIP.Format)
+	}
+	if config.BlockIP.Format != "tsv" && config.BlockIP.Format != "ltsv" {
+		if err := config.invalid(errors.New("Unsupported IP block log format")); err != nil {
+			return err
+		}
+	}
+	proxy.blockIPFile = config.BlockIP.File
+	proxy.blockIPFormat = config.BlockIP.Format
+	proxy.blockIPLogFile = config.BlockIP.LogFile
+	proxy.blockIPLogOnly = config.BlockLogOnly || config.BlockIP.LogOnly
+
+	if len(config.AllowIP.Format) == 0 {
+		config.AllowIP.Format = "tsv"
+	} else {
+		config.AllowIP.Format = strings.ToLower(config.AllowIP.Format)
+	}
+	if config.AllowIP.Format != "tsv" && config.AllowIP.Format != "ltsv" {
+		if err := config.invalid(errors.New("Unsupported allowed_ips log format")); err != nil {
+			return err
+		}
+	}
+	proxy.allowedIPFile = config.AllowIP.File
+	proxy.allowedIPFormat = config.AllowIP.Format
+	proxy.allowedIPLogFile = config.AllowIP.LogFile
+
+	proxy.forwardFile = config.ForwardFile
+	proxy.forwardFailover = config.ForwardFailover
+	switch spoofProtection := strings.ToLower(config.SpoofProtection); spoofProtection {
+	case "", "off":
+	case SpoofProtectionAudit, SpoofProtectionStrict:
+		proxy.spoofAudit = NewSpoofAudit(spoofProtection)
+	default:
+		if err := config.invalid(fmt.Errorf("Unsupported value for spoof_protection: [%s]", config.SpoofProtection)); err != nil {
+			return err
+		}
+	}
+	proxy.cloakFile = config.CloakFile
+	proxy.captivePortalMapFile = config.CaptivePortals.MapFile
+	if config.CaptivePortals.AutoDetect {
+		if len(config.CaptivePortals.PassthroughResolvers) == 0 {
+			if err := config.invalid(errors.New("Captive portal detection requires `passthrough_resolvers` to be set")); err != nil {
+				return err
+			}
+		}
+		probeURL := config.CaptivePortals.ProbeURL
+		if len(probeURL) == 0 {
+			probeURL = DefaultCaptivePortalProbeURL
+		}
+		httpsProbeURL := DefaultCaptivePortalHTTPSProbeURL
+		if config.CaptivePortals.HTTPSProbeURL != nil {
+			httpsProbeURL = *config.CaptivePortals.HTTPSProbeURL
+			if len(httpsProbeURL) > 0 && !strings.HasPrefix(httpsProbeURL, "https://") {
+				if err := config.invalid(fmt.Errorf("Captive portal detection: [%s] is not an HTTPS URL", httpsProbeURL)); err != nil {
+					return err
+				}
+			}
+		}
+		var resolvers []string
+		for _, resolver := range config.CaptivePortals.PassthroughResolvers {
+			if ip := ParseIP(resolver); ip != nil {
+				resolver = net.JoinHostPort(ip.String(), "53")
+			}
+			resolvers = append(resolvers, resolver)
+		}
+		proxy.captivePortalDetector = NewCaptivePortalDetector(probeURL, httpsProbeURL, resolvers,
+			config.CaptivePortals.PassthroughNames)
+	}
+
+	if len(config.LANHosts.LeasesFile) > 0 || len(config.LANHosts.URL) > 0 {
+		refreshDelay := time.Duration(Max(1, config.LANHosts.RefreshDelay)) * time.Minute
+		proxy.lanHosts = NewLANHosts(config.LANHosts.LeasesFile, config.LANHosts.URL, config.LANHosts.Domain, refreshDelay)
+		if err := proxy.lanHosts.load(); err != nil {
+			dlog.Warnf("Unable to load the LAN host names: [%v]", err)
+		}
+		proxy.lanHostsTTL = config.LANHosts.TTL
+		proxy.lanHostsLogClientNames = config.LANHosts.LogClientNames
+	}
+
+	if len(config.QueryRouting.RulesFile) > 0 || len(config.QueryRouting.DefaultRoute) > 0 {
+		queryRoutes, err := NewQueryRoutes(config.QueryRouting.RulesFile, config.QueryRouting.DefaultRoute, proxy.matcherEngine)
+		if err != nil {
+			if err := config.invalid(err); err != nil {
+				return err
+			}
+		} else {
+			proxy.queryRoutes = queryRoutes
+		}
+	}
+	if len(config.QueryRouting.OverrideClients) > 0 {
+		overrideClients, err := parseClientNetworks(config.QueryRouting.OverrideClients)
+		if err != nil {
+			if err := config.invalid(fmt.Errorf("Invalid network in `override_clients`: %v", err)); err != nil {
+				return err
+			}
+		}
+		proxy.routeOverrideClients = overrideClients
+		proxy.routeOverrideOption = config.QueryRouting.OverrideOption
+	}
+
+	allWeeklyRanges, err := ParseAllWeeklyRanges(config.AllWeeklyRanges)
+	if err != nil {
+		return err
+	}
+	proxy.allWeeklyRanges = allWeeklyRanges
+	if len(config.MaintenanceSchedule) > 0 {
+		maintenanceWindow, err := NewMaintenanceWindow(config.MaintenanceSchedule, *allWeeklyRanges, config.MaintenanceTasks)
+		if err != nil {
+			if err := config.invalid(err); err != nil {
+				return err
+			}
+		} else {
+			proxy.maintenanceWindow = maintenanceWindow
+		}
+	}
+
+	if configRoutes := config.AnonymizedDNS.Routes; configRoutes != nil {
+		routes := make(map[string][]string)
+		for _, configRoute := range configRoutes {
+			routes[configRoute.ServerName] = configRoute.RelayNames
+		}
+		proxy.routes = &routes
+	}
+	proxy.skipAnonIncompatibleResolvers = config.AnonymizedDNS.SkipIncompatible
+	proxy.anonDirectCertFallback = config.AnonymizedDNS.DirectCertFallback
+
+	if len(config.TLSKeyLogFile) > 0 {
+		f, err := os.OpenFile(config.TLSKeyLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("Unable to create key log file [%s]: [%s]", config.TLSKeyLogFile, err)
+		}
+		dlog.Warnf("TLS key log file [%s] enabled", config.TLSKeyLogFile)
+		proxy.xTransport.keyLogWriter = f
+		proxy.xTransport.rebuildTransport()
+	}
+
+	dohClientCreds := config.DoHClientX509Auth.Creds
+	if len(dohClientCreds) > 0 {
+		dlog.Noticef("Enabling TLS authentication")
+		configClientCred := dohClientCreds[0]
+		if len(dohClientCreds) > 1 {
+			if err := config.invalid(errors.New("Only one tls_client_auth entry is currently supported")); err != nil {
+				return err
+			}
+		}
+		proxy.xTransport.tlsClientCreds = DOHClientCreds{
+			clientCert: configClientCred.ClientCert,
+			clientKey:  configClientCred.ClientKey,
+			rootCA:     configClientCred.RootCA,
+		}
+		if err := config.invalid(proxy.xTransport.tlsClientCreds.check()); err != nil {
+			return err
+		}
+		proxy.xTransport.rebuildTransport()
+	}
+
+	proxy.serverOptions = make(map[string]ServerOptions, len(config.ServerOptions))
+	for name, options := range config.ServerOptions {
+		options.DoHMethod = strings.ToLower(options.DoHMethod)
+		switch options.DoHMethod {
+		case "", "auto", "get", "post":
+		default:
+			if err := config.invalid(fmt.Errorf("[%s]: unsupported DoH method [%s] - Use 'auto', 'get' or 'post'", name, options.DoHMethod)); err != nil {
+				return err
+			}
+		}
+		for key := range options.HTTPHeaders {
+			switch http.CanonicalHeaderKey(key) {
+			case "Accept", "Content-Type", "Content-Length", "Host":
+				if err := config.invalid(fmt.Errorf("[%s]: the [%s] HTTP header cannot be changed", name, key)); err != nil {
+					return err
+				}
+			}
+		}
+		options.Countries = upperCaseStrings(options.Countries)
+		proxy.serverOptions[name] = options
+	}
+
+	// Backwards compatibility
+	config.BrokenImplementations.FragmentsBlocked = append(
+		config.BrokenImplementations.FragmentsBlocked,
+		config.BrokenImplementations.BrokenQueryPadding...)
+
+	proxy.serversBlockingFragments = config.BrokenImplementations.FragmentsBlocked
+
+	proxy.dns64Prefixes = config.DNS64.Prefixes
+	proxy.dns64Resolvers = config.DNS64.Resolvers
+
+	if *flags.ListAll {
+		config.ServerNames = nil
+		config.DisabledServerNames = nil
+		config.ServerCountries = nil
+		config.DisabledServerCountries = nil
+		config.SourceRequireDNSSEC = false
+		config.SourceRequireNoFilter = false
+		config.SourceRequireNoLog = false
+		config.SourceIPv4 = true
+		config.SourceIPv6 = true
+		config.SourceDNSCrypt = true
+		config.SourceDoH = true
+		config.SourceODoH = true
+	}
+
+	var requiredProps stamps.ServerInformalProperties
+	if config.SourceRequireDNSSEC {
+		requiredProps |= stamps.ServerInformalPropertyDNSSEC
+	}
+	if config.SourceRequireNoLog {
+		requiredProps |= stamps.ServerInformalPropertyNoLog
+	}
+	if config.SourceRequireNoFilter {
+		requiredProps |= stamps.ServerInformalPropertyNoFilter
+	}
+	proxy.requiredProps = requiredProps
+	proxy.ServerNames = config.ServerNames
+	proxy.DisabledServerNames = config.DisabledServerNames
+	proxy.serverCountriesFilter = upperCaseStrings(config.ServerCountries)
+	proxy.disabledServerCountries = upperCaseStrings(config.DisabledServerCountries)
+	proxy.SourceIPv4 = config.SourceIPv4
+	proxy.SourceIPv6 = config.SourceIPv6
+	proxy.SourceDNSCrypt = config.SourceDNSCrypt
+	proxy.SourceDoH = config.SourceDoH
+	proxy.SourceODoH = config.SourceODoH
+
+	proxy.networkChangeRefresh = config.NetworkChangeRefresh
+	netprobeTimeout := config.NetprobeTimeout
+	flag.Visit(func(flag *flag.Flag) {
+		if flag.Name == "netprobe-timeout" && flags.NetprobeTimeoutOverride != nil {
+			netprobeTimeout = *flags.NetprobeTimeoutOverride
+		}
+	})
+	var netprobeAddresses []string
+	if len(config.NetprobeAddress) > 0 {
+		netprobeAddresses = append(netprobeAddresses, config.NetprobeAddress)
+	}
+	netprobeAddresses = append(netprobeAddresses, config.NetprobeAddresses...)
+	if len(netprobeAddresses) == 0 {
+		// Encrypted resolvers may not respond to the probes, that are sent over UDP
+		for _, resolver := range config.BootstrapResolvers {
+			if bootstrapResolverAddress(resolver) == resolver {
+				netprobeAddresses = append(netprobeAddresses, resolver)
+			}
+		}
+	}
+	if len(netprobeAddresses) == 0 {
+		netprobeAddresses = []string{DefaultNetprobeAddress}
+	}
+	proxy.netprobeAddresses = netprobeAddresses
+	if !isCommandMode {
+		if len(config.WaitForInterface) > 0 {
+			waitForInterface(config.WaitForInterface, netprobeTimeout)
+		}
+		if !proxy.upstreamRecorder.replaying() {
+			if err := NetProbe(proxy, netprobeAddresses, netprobeTimeout); err != nil {
+				return err
+			}
+		}
+		if len(proxy.udpListeners) == 0 && len(proxy.tcpListeners) == 0 {
+			for _, listenAddrStr := range proxy.listenAddresses {
+				if err := proxy.addDNSListener(listenAddrStr); err != nil {
+					return err
+				}
+			}
+		}
+		if len(proxy.localDoHListenAddresses) > 0 && (len(proxy.localDoHCertFile) == 0 || len(proxy.localDoHCertKeyFile) == 0) {
+			return errors.New("A certificate and a key are required to start a local DoH service")
+		}
+		for _, listenAddrStr := range proxy.localDoHListenAddresses {
+			if err := proxy.addLocalDoHListener(listenAddrStr); err != nil {
+				return err
+			}
+		}
+		if err := proxy.addSystemDListeners(); err != nil {
+			return err
+		}
+	}
+	// if 'userName' is set and we are the parent process drop privilege and exit
+	if len(proxy.userName) > 0 && !proxy.child {
+		proxy.dropPrivilege(proxy.userName, FileDescriptors)
+		return errors.New(
+			"Dropping privileges is not supporting on this operating system. Unset `user_name` in the configuration file",
+		)
+	}
+	if !config.OfflineMode && !proxy.upstreamRecorder.replaying() {
+		if err := config.loadSources(proxy); err != nil {
+			return err
+		}
+		if len(proxy.registeredServers) == 0 {
+			return errors.New("No servers configured")
+		}
+	}
+	if *flags.List || *flags.ListAll {
+		if err := config.printRegisteredServers(proxy, *flags.JSONOutput, *flags.IncludeRelays, *flags.IncludeCertExpiry); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	if *flags.ListSources {
+		if err := proxy.printSources(*flags.JSONOutput); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	if proxy.routes != nil && len(*proxy.routes) > 0 {
+		hasSpecificRoutes := false
+		for _, server := range proxy.registeredServers {
+			if via, ok := (*proxy.routes)[server.name]; ok {
+				if server.stamp.Proto != stamps.StampProtoTypeDNSCrypt &&
+					server.stamp.Proto != stamps.StampProtoTypeODoHTarget {
+					dlog.Errorf(
+						"DNS anonymization is only supported with the DNSCrypt and ODoH protocols - Connections to [%v] cannot be anonymized",
+						server.name,
+					)
+				} else {
+					dlog.Noticef("Anonymized DNS: routing [%v] via %v", server.name, via)
+				}
+				hasSpecificRoutes = true
+			}
+		}
+		if via, ok := (*proxy.routes)["*"]; ok {
+			if hasSpecificRoutes {
+				dlog.Noticef("Anonymized DNS: routing everything else via %v", via)
+			} else {
+				dlog.Noticef("Anonymized DNS: routing everything via %v", via)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, includeRelays bool, includeCertExpiry bool) error {
+	summary := make([]ServerSummary, 0)
+	var certExpirations map[string]time.Time
+	if includeCertExpiry {
+		certExpirations = proxy.fetchCertExpirations()
+	}
+	if includeRelays {
+		for _, registeredRelay := range proxy.registeredRelays {
+			addrStr, port := registeredRelay.stamp.ServerAddrStr, stamps.DefaultPort
+			var hostAddr string
+			hostAddr, port = ExtractHostAndPort(addrStr, port)
+			addrs := make([]string, 0)
+			if (registeredRelay.stamp.Proto == stamps.StampProtoTypeDoH || registeredRelay.stamp.Proto == stamps.StampProtoTypeODoHTarget) &&
+				len(registeredRelay.stamp.ProviderName) > 0 {
+				providerName := registeredRelay.stamp.ProviderName
+				var host string
+				host, port = ExtractHostAndPort(providerName, port)
+				addrs = append(addrs, host)
+			}
+			if len(addrStr) > 0 {
+				addrs = append(addrs, hostAddr)
+			}
+			nolog := true
+			nofilter := true
+			if registeredRelay.stamp.Proto == stamps.StampProtoTypeODoHRelay {
+				nolog = registeredRelay.stamp.Props&stamps.ServerInformalPropertyNoLog != 0
+			}
+			serverSummary := ServerSummary{
+				Name:        registeredRelay.name,
+				Proto:       registeredRelay.stamp.Proto.String(),
+				IPv6:        strings.HasPrefix(addrStr, "["),
+				Address:     serverSummaryAddress(addrs, port),
+				Ports:       []int{port},
+				Addrs:       addrs,
+				NoLog:       nolog,
+				NoFilter:    nofilter,
+				Description: registeredRelay.description,
+				Stamp:       registeredRelay.stamp.String(),
+			}
+			if jsonOutput {
+				summary = append(summary, serverSummary)
+			} else {
+				fmt.Println(serverSummary.Name)
+			}
+		}
+	}
+	for _, registeredServer := range proxy.registeredServers {
+		addrStr, port := registeredServer.stamp.ServerAddrStr, stamps.DefaultPort
+		var hostAddr string
+		hostAddr, port = ExtractHostAndPort(addrStr, port)
+		addrs := make([]string, 0)
+		if (registeredServer.stamp.Proto == stamps.StampProtoTypeDoH || registeredServer.stamp.Proto == stamps.StampProtoTypeODoHTarget) &&
+			len(registeredServer.stamp.ProviderName) > 0 {
+			providerName := registeredServer.stamp.ProviderName
+			var host string
+			host, port = ExtractHostAndPort(providerName, port)
+			addrs = append(addrs, host)
+		}
+		if len(addrStr) > 0 {
+			addrs = append(addrs, hostAddr)
+		}
+		dnssec := registeredServer.stamp.Props&stamps.ServerInformalPropertyDNSSEC != 0
+		serverSummary := ServerSummary{
+			Name:        registeredServer.name,
+			Proto:       registeredServer.stamp.Proto.String(),
+			IPv6:        strings.HasPrefix(addrStr, "["),
+			Address:     serverSummaryAddress(addrs, port),
+			Ports:       []int{port},
+			Addrs:       addrs,
+			DNSSEC:      &dnssec,
+			NoLog:       registeredServer.stamp.Props&stamps.ServerInformalPropertyNoLog != 0,
+			NoFilter:    registeredServer.stamp.Props&stamps.ServerInformalPropertyNoFilter != 0,
+			Description: registeredServer.description,
+			Stamp:       registeredServer.stamp.String(),
+			Countries:   proxy.serverCountries(&registeredServer),
+		}
+		if includeCertExpiry {
+			serverSummary.CertDays = certDaysLeft(certExpirations[registeredServer.name])
+		}
+		if jsonOutput {
+			summary = append(summary, serverSummary)
+		} else if serverSummary.CertDays != nil {
+			fmt.Printf("%s\t%d\n", serverSummary.Name, *serverSummary.CertDays)
+		} else {
+			fmt.Println(serverSummary.Name)
+		}
+	}
+	if jsonOutput {
+		jsonStr, err := json.MarshalIndent(summary, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(jsonStr))
+	}
+	return nil
+}
+
+func serverSummaryAddress(addrs []string, port int) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", addrs[0], port)
+}
+
+func (config *Config) loadSources(proxy *Proxy) error {
+	cfgSourceNames := make([]string, 0, len(config.SourcesConfig))
+	for cfgSourceName := range config.SourcesConfig {
+		cfgSourceNames = append(cfgSourceNames, cfgSourceName)
+	}
+	sort.Strings(cfgSourceNames)
+	sources := make([]*Source, len(cfgSourceNames))
+	errs := make([]error, len(cfgSourceNames))
+	var wg sync.WaitGroup
+	for i, cfgSourceName := range cfgSourceNames {
+		cfgSource := config.SourcesConfig[cfgSourceName]
+		proxy.random.Shuffle(len(cfgSource.URLs), func(i, j int) {
+			cfgSource.URLs[i], cfgSource.URLs[j] = cfgSource.URLs[j], cfgSource.URLs[i]
+		})
+		wg.Add(1)
+		go func(i int, cfgSourceName string, cfgSource SourceConfig) {
+			defer wg.Done()
+			sources[i], errs[i] = config.loadSourceWithTimeout(proxy, cfgSourceName, cfgSource, SourceLoadTimeout)
+		}(i, cfgSourceName, cfgSource)
+	}
+	wg.Wait()
+	var firstErr error
+	for i, cfgSourceName := range cfgSourceNames {
+		if errs[i] != nil {
+			dlog.Errorf("Source [%s] is not available, continuing without it: [%v]", cfgSourceName, errs[i])
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		proxy.sources = append(proxy.sources, sources[i])
+	}
+	if len(proxy.sources) == 0 && firstErr != nil && len(config.StaticsConfig) == 0 {
+		return firstErr
+	}
+	for name, config := range config.StaticsConfig {
+		if stamp, err := stamps.NewServerStampFromString(config.Stamp); err == nil {
+			if stamp.Proto == stamps.StampProtoTypeDNSCryptRelay || stamp.Proto == stamps.StampProtoTypeODoHRelay {
+				dlog.Debugf("Adding [%s] to the set of available static relays", name)
+				registeredServer := RegisteredServer{name: name, stamp: stamp, description: "static relay"}
+				proxy.registeredRelays = append(proxy.registeredRelays, registeredServer)
+			}
+		}
+	}
+	if len(config.ServerNames) == 0 {
+		for serverName := range config.StaticsConfig {
+			config.ServerNames = append(config.ServerNames, serverName)
+		}
+	}
+	for _, serverName := range config.ServerNames {
+		staticConfig, ok := config.StaticsConfig[serverName]
+		if !ok {
+			continue
+		}
+		if len(staticConfig.Stamp) == 0 {
+			return fmt.Errorf("Missing stamp for the static [%s] definition", serverName)
+		}
+		stamp, err := stamps.NewServerStampFromString(staticConfig.Stamp)
+		if err != nil {
+			return fmt.Errorf("Stamp error for the static [%s] definition: [%v]", serverName, err)
+		}
+		proxy.registeredServers = append(proxy.registeredServers, RegisteredServer{name: serverName, stamp: stamp})
+	}
+	if err := proxy.updateRegisteredServers(); err != nil {
+		return err
+	}
+	rs1 := proxy.registeredServers
+	rs2 := proxy.serversInfo.registeredServers
+	proxy.random.Shuffle(len(rs1), func(i, j int) {
+		rs1[i], rs1[j] = rs1[j], rs1[i]
+	})
+	proxy.random.Shuffle(len(rs2), func(i, j int) {
+		rs2[i], rs2[j] = rs2[j], rs2[i]
+	})
+	return nil
+}
+
+// loadSourceWithTimeout loads a source, and only uses its cache file if it cannot be downloaded within the timeout.
+// The download keeps going in the background, and the cache file is updated if it eventually succeeds.
+func (config *Config) loadSourceWithTimeout(
+	proxy *Proxy,
+	cfgSourceName string,
+	cfgSource SourceConfig,
+	timeout time.Duration,
+) (*Source, error) {
+	type loadedSource struct {
+		source *Source
+		err    error
+	}
+	loaded := make(chan loadedSource, 1)
+	go func() {
+		downloadCfgSource := cfgSource
+		source, err := config.loadSource(proxy, cfgSourceName, &downloadCfgSource)
+		loaded <- loadedSource{source: source, err: err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-loaded:
+		return result.source, result.err
+	case <-timer.C:
+	}
+	dlog.Warnf("Source [%s] could not be downloaded within %v, using the cache file", cfgSourceName, timeout)
+	cacheOnlyCfgSource := cfgSource
+	cacheOnlyCfgSource.URLs, cacheOnlyCfgSource.URL = nil, ""
+	source, err := config.loadSource(proxy, cfgSourceName, &cacheOnlyCfgSource)
+	if source != nil && err == nil {
+		urls := cfgSource.URLs
+		if len(urls) == 0 && len(cfgSource.URL) > 0 {
+			urls = []string{cfgSource.URL}
+		}
+		// The source will be downloaded again by the prefetch task
+		source.parseURLs(urls)
+		source.health.setURLs(source.urls)
+	}
+	return source, err
+}
+
+func (config *Config) loadSource(proxy *Proxy, cfgSourceName string, cfgSource *SourceConfig) (*Source, error) {
+	if len(cfgSource.URLs) == 0 {
+		if len(cfgSource.URL) == 0 {
+			dlog.Debugf("Missing URLs for source [%s]", cfgSourceName)
+		} else {
+			cfgSource.URLs = []string{cfgSource.URL}
+		}
+	}
+	if cfgSource.MinisignKeyStr == "" {
+		return nil, fmt.Errorf("Missing Minisign key for source [%s]", cfgSourceName)
+	}
+	if cfgSource.CacheFile == "" {
+		return nil, fmt.Errorf("Missing cache file for source [%s]", cfgSourceName)
+	}
+	if cfgSource.FormatStr == "" {
+		cfgSource.FormatStr = "v2"
+	}
+	if cfgSource.RefreshDelay <= 0 {
+		cfgSource.RefreshDelay = 72
+	}
+	cfgSource.RefreshDelay = Min(168, Max(24, cfgSource.RefreshDelay))
+	source, err := NewSource(
+		cfgSourceName,
+		proxy.xTransport,
+		cfgSource.URLs,
+		cfgSource.MinisignKeyStr,
+		cfgSource.CacheFile,
+		cfgSource.FormatStr,
+		time.Duration(cfgSource.RefreshDelay)*time.Hour,
+		cfgSource.Prefix,
+	)
+	if err != nil {
+		if len(source.bin) <= 0 {
+			dlog.Criticalf("Unable to retrieve source [%s]: [%s]", cfgSourceName, err)
+			return nil, err
+		}
+		if fi, statErr := os.Stat(source.cacheFile); statErr == nil {
+			dlog.Warnf(
+				"Downloading [%s] failed: %v, using a stale cache file updated %v ago to startup",
+				source.name,
+				err,
+				time.Since(fi.ModTime()).Round(time.Minute),
+			)
+		} else {
+			dlog.Warnf("Downloading [%s] failed: %v, using cache file to startup", source.name, err)
+		}
+	}
+	if cfgSource.StaleAfter > 0 {
+		source.health.setStaleAfter(time.Duration(cfgSource.StaleAfter) * time.Hour)
+	}
+	source.random = proxy.random
+	source.health.checkStaleness(timeNow())
+	return source, nil
+}
+
+// parseClientNetworks parses a list of networks, single IP addresses being accepted as well
+func parseClientNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func includesName(names []string, name string) bool {
+	for _, found := range names {
+		if strings.EqualFold(found, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func cdFileDir(fileName string) error {
+	return os.Chdir(filepath.Dir(fileName))
+}
+
+func cdLocal() {
+	exeFileName, err := os.Executable()
+	if err != nil {
+		dlog.Warnf(
+			"Unable to determine the executable directory: [%s] -- You will need to specify absolute paths in the configuration file",
+			err,
+		)
+	} else if err := os.Chdir(filepath.Dir(exeFileName)); err != nil {
+		dlog.Warnf("Unable to change working directory to [%s]: %s", exeFileName, err)
+	}
+}
+
+// parseBootstrapResolver checks a bootstrap resolver, that can be a plain DNS resolver (`ip:port`),
+// a DoT resolver (`tls://ip[:port]`) or a DoH resolver (`https://ip[:port]/path`)
+func parseBootstrapResolver(resolver string) (secure bool, err error) {
+	if strings.HasPrefix(resolver, "tls://") {
+		return true, isIPAndPort(strings.TrimPrefix(normalizeSecureBootstrapResolver(resolver), "tls://"))
+	}
+	if strings.HasPrefix(resolver, "https://") {
+		resolverURL, err := url.Parse(resolver)
+		if err != nil {
+			return true, err
+		}
+		if ParseIP(resolverURL.Hostname()) == nil {
+			return true, errors.New("DoH bootstrap resolvers must use an IP address")
+		}
+		return true, nil
+	}
+	return false, isIPAndPort(resolver)
+}
+
+// normalizeSecureBootstrapResolver adds the default port to DoT resolvers; IPv6 addresses must be bracketed
+func normalizeSecureBootstrapResolver(resolver string) string {
+	addr, isTLS := strings.CutPrefix(resolver, "tls://")
+	if !isTLS {
+		return resolver
+	}
+	if _, port := ExtractHostAndPort(addr, -1); port != -1 {
+		return resolver
+	}
+	return "tls://" + net.JoinHostPort(strings.Trim(addr, "[]"), "853")
+}
+
+// bootstrapResolverAddress returns the IP address and port of a bootstrap resolver
+func bootstrapResolverAddress(resolver string) string {
+	if addr, isTLS := strings.CutPrefix(resolver, "tls://"); isTLS {
+		return addr
+	}
+	if resolverURL, err := url.Parse(resolver); err == nil && resolverURL.Scheme == "https" {
+		port := resolverURL.Port()
+		if len(port) == 0 {
+			port = "443"
+		}
+		return net.JoinHostPort(resolverURL.Hostname(), port)
+	}
+	return resolver
+}
+
+func isIPAndPort(addrStr string) error {
+	host, port := ExtractHostAndPort(addrStr, -1)
+	if ip := ParseIP(host); ip == nil {
+		return fmt.Errorf("Host does not parse as IP '%s'", addrStr)
+	} else if port == -1 {
+		return fmt.Errorf("Port missing '%s'", addrStr)
+	} else if _, err := strconv.ParseUint(strconv.Itoa(port), 10, 16); err != nil {
+		return fmt.Errorf("Port does not parse '%s' [%v]", addrStr, err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jedisct1/dlog"
+)
+
+type ConfigProblemKind string
+
+const (
+	ConfigProblemSyntax       ConfigProblemKind = "syntax"
+	ConfigProblemUnknownKey   ConfigProblemKind = "unknown_key"
+	ConfigProblemInvalidValue ConfigProblemKind = "invalid_value"
+	ConfigProblemMissingFile  ConfigProblemKind = "missing_file"
+)
+
+// Exit codes of the -check command, by order of severity
+const (
+	CheckExitOK           = 0
+	CheckExitSyntax       = 2
+	CheckExitUnknownKey   = 3
+	CheckExitInvalidValue = 4
+	CheckExitMissingFile  = 5
+)
+
+var configProblemExitCodes = map[ConfigProblemKind]int{
+	ConfigProblemSyntax:       CheckExitSyntax,
+	ConfigProblemUnknownKey:   CheckExitUnknownKey,
+	ConfigProblemInvalidValue: CheckExitInvalidValue,
+	ConfigProblemMissingFile:  CheckExitMissingFile,
+}
+
+type ConfigProblem struct {
+	Kind    ConfigProblemKind `json:"kind"`
+	Key     string            `json:"key,omitempty"`
+	Line    int               `json:"line,omitempty"`
+	Message string            `json:"message"`
+}
+
+func (problem *ConfigProblem) Error() string {
+	return problem.Message
+}
+
+// ConfigCheckReport is the JSON document printed by -check -json
+type ConfigCheckReport struct {
+	SchemaVersion int             `json:"schema_version"`
+	ConfigFile    string          `json:"config_file,omitempty"`
+	Valid         bool            `json:"valid"`
+	Problems      []ConfigProblem `json:"problems"`
+}
+
+type ConfigCheck struct {
+	configFile string
+	lines      []string
+	problems   []ConfigProblem
+}
+
+func (check *ConfigCheck) setConfigFile(configFile string) {
+	check.configFile = configFile
+	if content, err := ReadTextFile(configFile); err == nil {
+		check.lines = strings.Split(content, "\n")
+	}
+}
+
+func (check *ConfigCheck) add(kind ConfigProblemKind, key toml.Key, message string) {
+	problem := ConfigProblem{Kind: kind, Message: message}
+	if len(key) > 0 {
+		problem.Key = key.String()
+		problem.Line = check.keyLine(key)
+	}
+	check.problems = append(check.problems, problem)
+}
+
+var tomlLineRx = regexp.MustCompile(`line (\d+)`)
+
+func (check *ConfigCheck) addDecodeError(err error) {
+	var parseErr toml.ParseError
+	if errors.As(err, &parseErr) {
+		problem := ConfigProblem{Kind: ConfigProblemSyntax, Line: parseErr.Position.Line, Message: parseErr.Message}
+		if len(problem.Message) == 0 {
+			problem.Message = parseErr.Error()
+		}
+		if len(parseErr.LastKey) > 0 {
+			problem.Key = parseErr.LastKey
+		}
+		check.problems = append(check.problems, problem)
+		return
+	}
+	problem := ConfigProblem{Kind: ConfigProblemInvalidValue, Message: err.Error()}
+	if match := tomlLineRx.FindStringSubmatch(err.Error()); match != nil {
+		problem.Line, _ = strconv.Atoi(match[1])
+	}
+	check.problems = append(check.problems, problem)
+}
+
+func (check *ConfigCheck) addError(err error) {
+	var problem *ConfigProblem
+	if errors.As(err, &problem) {
+		check.problems = append(check.problems, *problem)
+		return
+	}
+	check.problems = append(check.problems, ConfigProblem{Kind: ConfigProblemInvalidValue, Message: err.Error()})
+}
+
+// keyLine returns the line number a key is defined at, or 0 if it cannot be found
+func (check *ConfigCheck) keyLine(key toml.Key) int {
+	unquote := func(str string) string {
+		return strings.NewReplacer("'", "", "\"", "", " ", "", "\t", "").Replace(str)
+	}
+	table, name := strings.Join(key[:len(key)-1], "."), key[len(key)-1]
+	currentTable, fallback := "", 0
+	for i, line := range check.lines {
+		line = TrimAndStripInlineComments(line)
+		if strings.HasPrefix(line, "[") {
+			currentTable = unquote(strings.Trim(line, "[]"))
+			if currentTable == key.String() {
+				return i + 1
+			}
+			continue
+		}
+		idx := strings.Index(line, "=")
+		if idx <= 0 || unquote(line[:idx]) != name {
+			continue
+		}
+		if currentTable == table {
+			return i + 1
+		}
+		if fallback == 0 {
+			fallback = i + 1
+		}
+	}
+	return fallback
+}
+
+func (check *ConfigCheck) checkFile(key toml.Key, file string) {
+	if len(file) == 0 {
+		return
+	}
+	if _, err := os.Stat(file); err != nil {
+		check.add(ConfigProblemMissingFile, key, fmt.Sprintf("File [%s] referenced by [%s] cannot be opened: %v", file, key, err))
+	}
+}
+
+func (check *ConfigCheck) checkFiles(config *Config) {
+	check.checkFile(toml.Key{"blocked_names", "blocked_names_file"}, config.BlockName.File)
+	check.checkFile(toml.Key{"allowed_names", "allowed_names_file"}, config.AllowedName.File)
+	check.checkFile(toml.Key{"blocked_ips", "blocked_ips_file"}, config.BlockIP.File)
+	check.checkFile(toml.Key{"allowed_ips", "allowed_ips_file"}, config.AllowIP.File)
+	check.checkFile(toml.Key{"forwarding_rules"}, config.ForwardFile)
+	check.checkFile(toml.Key{"cloaking_rules"}, config.CloakFile)
+	check.checkFile(toml.Key{"captive_portals", "map_file"}, config.CaptivePortals.MapFile)
+	check.checkFile(toml.Key{"local_doh", "cert_file"}, config.LocalDoH.CertFile)
+	check.checkFile(toml.Key{"local_doh", "cert_key_file"}, config.LocalDoH.CertKeyFile)
+	for _, creds := range config.DoHClientX509Auth.Creds {
+		check.checkFile(toml.Key{"doh_client_x509_auth", "creds", "client_cert"}, creds.ClientCert)
+		check.checkFile(toml.Key{"doh_client_x509_auth", "creds", "client_key"}, creds.ClientKey)
+		check.checkFile(toml.Key{"doh_client_x509_auth", "creds", "root_ca"}, creds.RootCA)
+	}
+}
+
+func (check *ConfigCheck) exitCode() int {
+	exitCode := CheckExitOK
+	for _, problem := range check.problems {
+		if code := configProblemExitCodes[problem.Kind]; exitCode == CheckExitOK || code < exitCode {
+			exitCode = code
+		}
+	}
+	return exitCode
+}
+
+// report prints the problems that have been found and terminates the process
+func (check *ConfigCheck) report(jsonOutput bool) {
+	exitCode := check.exitCode()
+	if jsonOutput {
+		report := ConfigCheckReport{
+			SchemaVersion: JSONSchemaVersion,
+			ConfigFile:    check.configFile,
+			Valid:         len(check.problems) == 0,
+			Problems:      check.problems,
+		}
+		if report.Problems == nil {
+			report.Problems = []ConfigProblem{}
+		}
+		jsonStr, err := json.MarshalIndent(report, "", " ")
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		fmt.Println(string(jsonStr))
+		os.Exit(exitCode)
+	}
+	for _, problem := range check.problems {
+		if problem.Line > 0 {
+			dlog.Errorf("%s (line %d): %s", problem.Kind, problem.Line, problem.Message)
+		} else {
+			dlog.Errorf("%s: %s", problem.Kind, problem.Message)
+		}
+	}
+	if exitCode == CheckExitOK {
+		dlog.Notice("Configuration successfully checked")
+	}
+	os.Exit(exitCode)
+}
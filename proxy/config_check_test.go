@@ -0,0 +1,51 @@
+package proxy
+
+import "testing"
+
+func TestConfigCheckInvalidValues(t *testing.T) {
+	config := testAPIConfig()
+	config.ChromeProbes = "invalid"
+	config.SanitizeResponses = "invalid"
+	config.QueryLog.Format = "invalid"
+	if _, err := New(config); err == nil {
+		t.Error("an invalid value should be rejected")
+	}
+
+	check := &ConfigCheck{}
+	config.check = check
+	flags := defaultConfigFlags()
+	*flags.Check = true
+	proxy := NewProxy()
+	defer proxy.Stop()
+	if err := config.apply(proxy, flags); err != nil {
+		t.Fatal(err)
+	}
+	if len(check.problems) != 3 {
+		t.Errorf("%d problems reported instead of 3: %v", len(check.problems), check.problems)
+	}
+	if exitCode := check.exitCode(); exitCode != CheckExitInvalidValue {
+		t.Errorf("exit code %d instead of %d", exitCode, CheckExitInvalidValue)
+	}
+}
+
+func TestConfigCheckInvalidFeatures(t *testing.T) {
+	config := testAPIConfig()
+	config.MatcherEngine = "invalid"
+	config.QueryLog.AnonymizeClientIP = "invalid"
+	config.ChromeProbes = "invalid"
+	check := &ConfigCheck{}
+	config.check = check
+	flags := defaultConfigFlags()
+	*flags.Check = true
+	proxy := NewProxy()
+	defer proxy.Stop()
+	if err := config.apply(proxy, flags); err != nil {
+		t.Fatal(err)
+	}
+	if len(check.problems) != 3 {
+		t.Errorf("%d problems reported instead of 3: %v", len(check.problems), check.problems)
+	}
+	if proxy.matcherEngine != MatcherEngineCritbit {
+		t.Errorf("matcher engine [%s] used after an invalid value", proxy.matcherEngine)
+	}
+}
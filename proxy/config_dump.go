@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"flag"
+	"io"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const MaskedSecret = "********"
+
+// maskURLSecrets hides the password of a URL, such as a proxy or a Redis URL, and the values
+// of its query parameters, that frequently include API keys
+func maskURLSecrets(str string) string {
+	scheme, rest, found := strings.Cut(str, "://")
+	if !found {
+		return str
+	}
+	if userInfo, host, found := strings.Cut(rest, "@"); found && !strings.Contains(userInfo, "/") {
+		if user, password, found := strings.Cut(userInfo, ":"); found && len(password) > 0 {
+			rest = user + ":" + MaskedSecret + "@" + host
+		}
+	}
+	if location, query, found := strings.Cut(rest, "?"); found {
+		query, fragment, hasFragment := strings.Cut(query, "#")
+		params := strings.Split(query, "&")
+		for i, param := range params {
+			if key, value, found := strings.Cut(param, "="); found && len(value) > 0 {
+				params[i] = key + "=" + MaskedSecret
+			}
+		}
+		rest = location + "?" + strings.Join(params, "&")
+		if hasFragment {
+			rest += "#" + fragment
+		}
+	}
+	return scheme + "://" + rest
+}
+
+// maskSecrets replaces the values that shouldn't be displayed: server credentials, shared keys and passwords
+func (config *Config) maskSecrets() {
+	for _, str := range []*string{
+		&config.Proxy,
+		&config.HTTPProxyURL,
+		&config.QueryLog.Bus.URL,
+		&config.SharedCache.URL,
+		&config.LANHosts.URL,
+	} {
+		*str = maskURLSecrets(*str)
+	}
+	for name, source := range config.SourcesConfig {
+		source.URL = maskURLSecrets(source.URL)
+		source.URLs = maskURLsSecrets(source.URLs)
+		config.SourcesConfig[name] = source
+	}
+	for name, list := range config.BlockLists {
+		list.URLs = maskURLsSecrets(list.URLs)
+		config.BlockLists[name] = list
+	}
+	for _, key := range []*string{&config.HAPeering.SharedKey, &config.SharedCache.SharedKey} {
+		if len(*key) > 0 {
+			*key = MaskedSecret
+		}
+	}
+	for name, options := range config.ServerOptions {
+		headers := make(map[string]string, len(options.HTTPHeaders))
+		for key := range options.HTTPHeaders {
+			headers[key] = MaskedSecret
+		}
+		options.HTTPHeaders = headers
+		config.ServerOptions[name] = options
+	}
+	// Static servers are frequently private, and their stamps may include tokens
+	for name, static := range config.StaticsConfig {
+		if len(static.Stamp) > 0 {
+			static.Stamp = MaskedSecret
+		}
+		config.StaticsConfig[name] = static
+	}
+}
+
+func maskURLsSecrets(urls []string) []string {
+	if urls == nil {
+		return nil
+	}
+	masked := make([]string, len(urls))
+	for i, str := range urls {
+		masked[i] = maskURLSecrets(str)
+	}
+	return masked
+}
+
+// dumpEffectiveConfig prints the configuration the proxy would run with: the configuration file
+// with the defaults, the credentials file and the command-line overrides, in the TOML format
+func (config *Config) dumpEffectiveConfig(flags *ConfigFlags, out io.Writer) error {
+	flag.Visit(func(flag *flag.Flag) {
+		if flag.Name == "netprobe-timeout" && flags.NetprobeTimeoutOverride != nil {
+			config.NetprobeTimeout = *flags.NetprobeTimeoutOverride
+		}
+	})
+	config.maskSecrets()
+	return toml.NewEncoder(out).Encode(config)
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jedisct1/dlog"
+)
+
+// configMigration describes an option that was renamed, or whose value changed, in a previous version.
+// translate, if set, converts the value, and returns false if the value doesn't need to be migrated.
+// onConflict tells what to do if both options are defined.
+type configMigration struct {
+	key        toml.Key
+	newKey     toml.Key
+	version    string
+	translate  func(value interface{}) (interface{}, bool)
+	onConflict configConflictPolicy
+}
+
+// configConflictPolicy tells which option is kept when an option and the one it was renamed to are both defined
+type configConflictPolicy int
+
+const (
+	// configConflictFatal prevents the configuration from being loaded
+	configConflictFatal configConflictPolicy = iota
+	// configConflictKeepNew ignores the previous option
+	configConflictKeepNew
+	// configConflictKeepOld replaces the new option with the previous one
+	configConflictKeepOld
+)
+
+// configRemovedKey describes an option that is not supported any more, and is ignored
+type configRemovedKey struct {
+	key    toml.Key
+	reason string
+}
+
+// configMigrationNote describes a change made to a configuration while it was loaded.
+// Conflicts cannot be migrated automatically, and prevent the configuration from being loaded.
+type configMigrationNote struct {
+	key      toml.Key
+	message  string
+	conflict bool
+}
+
+// renameTableKeys returns a translation renaming keys within a table
+func renameTableKeys(names map[string]string) func(value interface{}) (interface{}, bool) {
+	return func(value interface{}) (interface{}, bool) {
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return value, true
+		}
+		for name, newName := range names {
+			if tableValue, found := table[name]; found {
+				delete(table, name)
+				table[newName] = tableValue
+			}
+		}
+		return table, true
+	}
+}
+
+var configMigrations = []configMigration{
+	{
+		key:     toml.Key{"fallback_resolver"},
+		newKey:  toml.Key{"bootstrap_resolvers"},
+		version: "2.0.38",
+		translate: func(value interface{}) (interface{}, bool) {
+			if resolver, ok := value.(string); ok {
+				return []interface{}{resolver}, true
+			}
+			return value, true
+		},
+		onConflict: configConflictKeepNew,
+	},
+	{
+		key:        toml.Key{"fallback_resolvers"},
+		newKey:     toml.Key{"bootstrap_resolvers"},
+		version:    "2.1.0",
+		onConflict: configConflictKeepNew,
+	},
+	{
+		key:     toml.Key{"refused_code_in_responses"},
+		newKey:  toml.Key{"blocked_query_response"},
+		version: "2.0.26",
+		translate: func(value interface{}) (interface{}, bool) {
+			if refused, ok := value.(bool); ok && refused {
+				return "refused", true
+			}
+			return "hinfo", true
+		},
+		onConflict: configConflictKeepOld,
+	},
+	{
+		key:     toml.Key{"lb_strategy"},
+		newKey:  toml.Key{"lb_strategy"},
+		version: "2.0.24",
+		translate: func(value interface{}) (interface{}, bool) {
+			// `fastest` has always been handled as the default strategy
+			return "p2", value == "fastest"
+		},
+	},
+	{
+		key:       toml.Key{"blacklist"},
+		newKey:    toml.Key{"blocked_names"},
+		version:   "2.0.45",
+		translate: renameTableKeys(map[string]string{"blacklist_file": "blocked_names_file"}),
+	},
+	{
+		key:       toml.Key{"whitelist"},
+		newKey:    toml.Key{"allowed_names"},
+		version:   "2.0.45",
+		translate: renameTableKeys(map[string]string{"whitelist_file": "allowed_names_file"}),
+	},
+	{
+		key:       toml.Key{"ip_blacklist"},
+		newKey:    toml.Key{"blocked_ips"},
+		version:   "2.0.45",
+		translate: renameTableKeys(map[string]string{"blacklist_file": "blocked_ips_file"}),
+	},
+	{key: toml.Key{"tls_client_auth"}, newKey: toml.Key{"doh_client_x509_auth"}, version: "2.0.44"},
+}
+
+var configRemovedKeys = []configRemovedKey{
+	{key: toml.Key{"daemonize"}, reason: "use a service manager, or `-service install`, to run in the background"},
+}
+
+// lookupRawKey returns the table containing a key, and the value of that key
+func lookupRawKey(raw map[string]interface{}, key toml.Key) (map[string]interface{}, interface{}, bool) {
+	table := raw
+	for _, name := range key[:len(key)-1] {
+		var ok bool
+		if table, ok = table[name].(map[string]interface{}); !ok {
+			return nil, nil, false
+		}
+	}
+	value, found := table[key[len(key)-1]]
+	return table, value, found
+}
+
+// migrateConfig translates the options of a decoded configuration that were renamed in previous versions,
+// and removes the ones that are not supported any more.
+// If the new name is already in use, the migration's conflict policy decides which option is kept.
+func migrateConfig(raw map[string]interface{}) []configMigrationNote {
+	var notes []configMigrationNote
+	for _, removed := range configRemovedKeys {
+		if table, _, found := lookupRawKey(raw, removed.key); found {
+			delete(table, removed.key[len(removed.key)-1])
+			notes = append(notes, configMigrationNote{
+				key:     removed.key,
+				message: fmt.Sprintf("`%s` is not supported any more and has been ignored (%s)", removed.key, removed.reason),
+			})
+		}
+	}
+	for _, migration := range configMigrations {
+		table, value, found := lookupRawKey(raw, migration.key)
+		if !found {
+			continue
+		}
+		name, newName := migration.key.String(), migration.newKey.String()
+		note := configMigrationNote{key: migration.key}
+		if emptyTable, ok := value.(map[string]interface{}); ok && len(emptyTable) == 0 {
+			delete(table, migration.key[len(migration.key)-1])
+			note.message = fmt.Sprintf("Empty section [%s] has been removed", name)
+			notes = append(notes, note)
+			continue
+		}
+		newValue := value
+		if migration.translate != nil {
+			var ok bool
+			if newValue, ok = migration.translate(value); !ok {
+				continue
+			}
+		}
+		if name == newName {
+			table[migration.key[len(migration.key)-1]] = newValue
+			note.message = fmt.Sprintf("The value of `%s` is obsolete since version %s, and has been replaced with [%v]",
+				name, migration.version, newValue)
+			notes = append(notes, note)
+			continue
+		}
+		note.message = fmt.Sprintf("`%s` was renamed to `%s` in version %s", name, newName, migration.version)
+		if _, _, exists := lookupRawKey(raw, migration.newKey); exists {
+			switch migration.onConflict {
+			case configConflictKeepNew:
+				delete(table, migration.key[len(migration.key)-1])
+				note.message = fmt.Sprintf("`%s` was renamed to `%s` in version %s, and has been ignored since both are defined",
+					name, newName, migration.version)
+				notes = append(notes, note)
+				continue
+			case configConflictKeepOld:
+				note.message = fmt.Sprintf("`%s` was renamed to `%s` in version %s, and replaces `%s` since both are defined",
+					name, newName, migration.version, newName)
+			default:
+				note.message = fmt.Sprintf("`%s` was renamed to `%s` in version %s, but both are defined", name, newName, migration.version)
+				note.conflict = true
+				notes = append(notes, note)
+				continue
+			}
+		}
+		newTable := raw
+		for _, tableName := range migration.newKey[:len(migration.newKey)-1] {
+			subTable, ok := newTable[tableName].(map[string]interface{})
+			if !ok {
+				subTable = make(map[string]interface{})
+				newTable[tableName] = subTable
+			}
+			newTable = subTable
+		}
+		delete(table, migration.key[len(migration.key)-1])
+		newTable[migration.newKey[len(migration.newKey)-1]] = newValue
+		notes = append(notes, note)
+	}
+	return notes
+}
+
+// decodeConfigFile decodes a configuration file, after having translated the options that were renamed.
+// Every translation is logged, so that the file can be updated.
+func decodeConfigFile(configFile string, config *Config) (toml.MetaData, error) {
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(configFile, &raw); err != nil {
+		return toml.MetaData{}, err
+	}
+	notes := migrateConfig(raw)
+	if len(notes) == 0 {
+		return toml.DecodeFile(configFile, config)
+	}
+	check := ConfigCheck{}
+	check.setConfigFile(configFile)
+	for _, note := range notes {
+		if note.conflict {
+			return toml.MetaData{}, fmt.Errorf("[%s]: %s - Update your configuration", configFile, note.message)
+		}
+	}
+	for _, note := range notes {
+		if line := check.keyLine(note.key); line > 0 {
+			dlog.Warnf("[%s] line %d: %s - Please update your configuration", configFile, line, note.message)
+		} else {
+			dlog.Warnf("[%s]: %s - Please update your configuration", configFile, note.message)
+		}
+	}
+	var migrated bytes.Buffer
+	if err := toml.NewEncoder(&migrated).Encode(raw); err != nil {
+		return toml.MetaData{}, err
+	}
+	return toml.Decode(migrated.String(), config)
+}
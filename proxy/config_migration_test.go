@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	for _, test := range []struct {
+		config   string
+		expected map[string]interface{}
+		notes    int
+		conflict bool
+	}{
+		{
+			config:   "fallback_resolver = '9.9.9.9:53'",
+			expected: map[string]interface{}{"bootstrap_resolvers": []interface{}{"9.9.9.9:53"}},
+			notes:    1,
+		},
+		{
+			config:   "refused_code_in_responses = true",
+			expected: map[string]interface{}{"blocked_query_response": "refused"},
+			notes:    1,
+		},
+		{
+			config:   "lb_strategy = 'fastest'",
+			expected: map[string]interface{}{"lb_strategy": "p2"},
+			notes:    1,
+		},
+		{
+			config:   "lb_strategy = 'p3'",
+			expected: map[string]interface{}{"lb_strategy": "p3"},
+		},
+		{
+			config: "[blacklist]\nblacklist_file = 'blocked.txt'\nlog_file = 'blocked.log'",
+			expected: map[string]interface{}{
+				"blocked_names": map[string]interface{}{"blocked_names_file": "blocked.txt", "log_file": "blocked.log"},
+			},
+			notes: 1,
+		},
+		{
+			config:   "[whitelist]",
+			expected: map[string]interface{}{},
+			notes:    1,
+		},
+		{
+			config:   "daemonize = true\nlog_level = 2",
+			expected: map[string]interface{}{"log_level": int64(2)},
+			notes:    1,
+		},
+		{
+			config:   "fallback_resolvers = ['9.9.9.9:53']\nbootstrap_resolvers = ['8.8.8.8:53']",
+			expected: map[string]interface{}{"bootstrap_resolvers": []interface{}{"8.8.8.8:53"}},
+			notes:    1,
+		},
+		{
+			config:   "refused_code_in_responses = true\nblocked_query_response = 'a:192.0.2.1'",
+			expected: map[string]interface{}{"blocked_query_response": "refused"},
+			notes:    1,
+		},
+		{
+			config: "[whitelist]\nwhitelist_file = 'a.txt'\n[allowed_names]\nallowed_names_file = 'b.txt'",
+			expected: map[string]interface{}{
+				"whitelist":     map[string]interface{}{"allowed_names_file": "a.txt"},
+				"allowed_names": map[string]interface{}{"allowed_names_file": "b.txt"},
+			},
+			notes:    1,
+			conflict: true,
+		},
+	} {
+		var raw map[string]interface{}
+		if _, err := toml.Decode(test.config, &raw); err != nil {
+			t.Fatal(err)
+		}
+		notes := migrateConfig(raw)
+		if len(notes) != test.notes {
+			t.Errorf("[%s]: %d notes instead of %d", test.config, len(notes), test.notes)
+		}
+		if len(notes) > 0 && notes[0].conflict != test.conflict {
+			t.Errorf("[%s]: conflict not reported", test.config)
+		}
+		if !reflect.DeepEqual(raw, test.expected) {
+			t.Errorf("[%s]: %v instead of %v", test.config, raw, test.expected)
+		}
+	}
+}
+
+func TestDecodeConfigFileConflict(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "dnscrypt-proxy.toml")
+	if err := os.WriteFile(configFile, []byte("[blacklist]\nblacklist_file = 'a.txt'\n[blocked_names]\nblocked_names_file = 'b.txt'\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := newConfig()
+	if _, err := decodeConfigFile(configFile, &config); err == nil {
+		t.Error("conflicting options accepted")
+	}
+	if err := os.WriteFile(configFile, []byte("[blacklist]\nblacklist_file = 'a.txt'\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config = newConfig()
+	if _, err := decodeConfigFile(configFile, &config); err != nil || config.BlockName.File != "a.txt" {
+		t.Errorf("renamed section not migrated: %v", err)
+	}
+	if err := os.WriteFile(configFile, []byte("fallback_resolvers = ['9.9.9.9:53']\nbootstrap_resolvers = ['8.8.8.8:53']\n"+
+		"refused_code_in_responses = false\nblocked_query_response = 'refused'\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config = newConfig()
+	if _, err := decodeConfigFile(configFile, &config); err != nil {
+		t.Fatalf("options accepted by previous versions rejected: %v", err)
+	}
+	if !reflect.DeepEqual(config.BootstrapResolvers, []string{"8.8.8.8:53"}) || config.BlockedQueryResponse != "hinfo" {
+		t.Errorf("unexpected precedence: %v, [%s]", config.BootstrapResolvers, config.BlockedQueryResponse)
+	}
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// The control socket accepts a single command per connection, as a line of space-separated words.
+// Every line of the response starts with "= ", and the response ends with "+OK" or "-ERR <reason>".
+
+const (
+	ControlCommandTimeout = 5 * time.Second
+	ControlMaxCommandLen  = 4096
+)
+
+type controlResponse struct {
+	writer *bufio.Writer
+}
+
+func (response *controlResponse) Printf(format string, args ...interface{}) {
+	for _, line := range strings.Split(fmt.Sprintf(format, args...), "\n") {
+		response.writer.WriteString("= " + line + "\n")
+	}
+	response.writer.Flush()
+}
+
+type controlCommand struct {
+	usage string
+	run   func(proxy *Proxy, args []string, response *controlResponse) error
+}
+
+var controlCommands = map[string]controlCommand{
+	"listeners": {
+		usage: "listeners",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			for _, key := range proxy.Listeners() {
+				response.Printf("%s", key)
+			}
+			return nil
+		},
+	},
+	"listener-add": {
+		usage: "listener-add <dns|doh> <address>",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			if len(args) != 2 {
+				return fmt.Errorf("Usage: listener-add <dns|doh> <address>")
+			}
+			return proxy.AddListener(args[0], args[1])
+		},
+	},
+	"listener-remove": {
+		usage: "listener-remove <dns|doh> <address>",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			if len(args) != 2 {
+				return fmt.Errorf("Usage: listener-remove <dns|doh> <address>")
+			}
+			return proxy.RemoveListener(args[0], args[1])
+		},
+	},
+	"sources": {
+		usage: "sources",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			for _, status := range proxy.sourcesStatus() {
+				response.Printf("%s", status.String())
+			}
+			return nil
+		},
+	},
+	"stats": {
+		usage: "stats",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			if len(proxy.nodeName) > 0 {
+				response.Printf("node %s", proxy.nodeName)
+			}
+			for _, line := range proxy.queryStats.Summary() {
+				response.Printf("%s", line)
+			}
+			if proxy.spoofAudit != nil {
+				response.Printf("%s", proxy.spoofAudit.Summary())
+			}
+			if proxy.fdLimits != nil {
+				response.Printf("%s", proxy.fdLimits.Summary())
+			}
+			return nil
+		},
+	},
+	"trace": {
+		usage: "trace <name> [<type>]",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			if len(args) < 1 || len(args) > 2 {
+				return fmt.Errorf("Usage: trace <name> [<type>]")
+			}
+			qType := dns.TypeA
+			if len(args) == 2 {
+				var found bool
+				if qType, found = dns.StringToType[strings.ToUpper(args[1])]; !found {
+					return fmt.Errorf("Unsupported record type: [%s]", args[1])
+				}
+			}
+			lines, err := proxy.Trace(args[0], qType)
+			for _, line := range lines {
+				response.Printf("%s", line)
+			}
+			return err
+		},
+	},
+	"fault": {
+		usage: "fault <server|*> [delay=<ms>] [drop=<percent>] [error=<percent>]",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			if proxy.faultInjector == nil {
+				return fmt.Errorf("Fault injection is disabled, set `fault_injection = true` in the configuration file")
+			}
+			if len(args) < 2 {
+				return fmt.Errorf("Usage: fault <server|*> [delay=<ms>] [drop=<percent>] [error=<percent>]")
+			}
+			fault, err := parseFault(args[1:])
+			if err != nil {
+				return err
+			}
+			proxy.faultInjector.set(args[0], fault)
+			dlog.Warnf("Fault injection enabled for [%s]: %s", args[0], fault)
+			return nil
+		},
+	},
+	"fault-clear": {
+		usage: "fault-clear [<server|*>]",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			if proxy.faultInjector == nil {
+				return fmt.Errorf("Fault injection is disabled, set `fault_injection = true` in the configuration file")
+			}
+			if len(args) > 1 {
+				return fmt.Errorf("Usage: fault-clear [<server|*>]")
+			}
+			serverName := ""
+			if len(args) == 1 {
+				serverName = args[0]
+			}
+			if !proxy.faultInjector.clear(serverName) {
+				return fmt.Errorf("No faults to clear")
+			}
+			dlog.Notice("Injected faults cleared")
+			return nil
+		},
+	},
+	"faults": {
+		usage: "faults",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			if proxy.faultInjector == nil {
+				return fmt.Errorf("Fault injection is disabled, set `fault_injection = true` in the configuration file")
+			}
+			for _, line := range proxy.faultInjector.list() {
+				response.Printf("%s", line)
+			}
+			return nil
+		},
+	},
+	"reload-listeners": {
+		usage: "reload-listeners",
+		run: func(proxy *Proxy, args []string, response *controlResponse) error {
+			added, removed, err := proxy.ReloadListeners()
+			for _, key := range added {
+				response.Printf("added %s", key)
+			}
+			for _, key := range removed {
+				response.Printf("removed %s", key)
+			}
+			return err
+		},
+	},
+}
+
+func (proxy *Proxy) controlSocketListen() error {
+	if len(proxy.controlSocket) == 0 {
+		return nil
+	}
+	listener, err := controlListen(proxy.controlSocket)
+	if err != nil {
+		return err
+	}
+	proxy.controlListener = listener
+	dlog.Noticef("Control socket listening to [%s]", proxy.controlSocket)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if proxy.stopped() {
+					return
+				}
+				dlog.Warnf("Control socket: [%v]", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go proxy.controlHandle(conn)
+		}
+	}()
+	return nil
+}
+
+func (proxy *Proxy) controlHandle(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(ControlCommandTimeout)); err != nil {
+		return
+	}
+	reader := bufio.NewReaderSize(io.LimitReader(conn, ControlMaxCommandLen), ControlMaxCommandLen)
+	line, err := reader.ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return
+	}
+	// Some commands, such as traces, can take longer than the time allowed to send them
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+	response := &controlResponse{writer: bufio.NewWriter(conn)}
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		words = []string{"help"}
+	}
+	name, args := strings.ToLower(words[0]), words[1:]
+	dlog.Debugf("Control command: %v", words)
+	if name == "help" {
+		names := make([]string, 0, len(controlCommands))
+		for name := range controlCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			response.Printf("%s", controlCommands[name].usage)
+		}
+		response.writer.WriteString("+OK\n")
+	} else if command, found := controlCommands[name]; !found {
+		response.writer.WriteString(fmt.Sprintf("-ERR Unknown command [%s], try `help`\n", name))
+	} else if err := command.run(proxy, args, response); err != nil {
+		response.writer.WriteString("-ERR " + strings.ReplaceAll(err.Error(), "\n", " ") + "\n")
+	} else {
+		response.writer.WriteString("+OK\n")
+	}
+	response.writer.Flush()
+}
+
+// ControlSocketClient sends a command to a running instance, prints the response and
+// returns the exit code to use
+func ControlSocketClient(controlSocket string, command string) int {
+	if len(controlSocket) == 0 {
+		fmt.Fprintln(os.Stderr, "No control socket configured, set `control_socket` in the configuration file")
+		return 1
+	}
+	conn, err := controlDial(controlSocket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to the control socket [%s]: %v\n", controlSocket, err)
+		return 1
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "= "):
+			fmt.Println(line[2:])
+		case line == "+OK":
+			return 0
+		case strings.HasPrefix(line, "-ERR"):
+			fmt.Fprintln(os.Stderr, strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+			return 1
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Incomplete response from the control socket")
+	return 1
+}
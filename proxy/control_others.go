@@ -0,0 +1,27 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"net"
+	"os"
+)
+
+func controlListen(controlSocket string) (net.Listener, error) {
+	if fileInfo, err := os.Lstat(controlSocket); err == nil && fileInfo.Mode()&os.ModeSocket != 0 {
+		os.Remove(controlSocket)
+	}
+	listener, err := net.Listen("unix", controlSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(controlSocket, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func controlDial(controlSocket string) (net.Conn, error) {
+	return net.DialTimeout("unix", controlSocket, ControlCommandTimeout)
+}
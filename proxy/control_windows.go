@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	controlPipePrefix = `\\.\pipe\`
+	// Only the Administrators group and the SYSTEM account can connect to the control pipe
+	controlPipeSDDL       = "D:P(A;;GA;;;BA)(A;;GA;;;SY)"
+	controlPipeBufferSize = 4096
+)
+
+// controlPipeName maps the `control_socket` setting to a named pipe; a path that is not
+// a pipe name is reduced to its file name, so that the same configuration works everywhere
+func controlPipeName(controlSocket string) string {
+	if strings.HasPrefix(controlSocket, controlPipePrefix) {
+		return controlSocket
+	}
+	return controlPipePrefix + filepath.Base(controlSocket)
+}
+
+type pipeAddr string
+
+func (addr pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (addr pipeAddr) String() string {
+	return string(addr)
+}
+
+type pipeListener struct {
+	name    string
+	sa      *windows.SecurityAttributes
+	lock    sync.Mutex
+	pending windows.Handle
+	closed  bool
+}
+
+func controlListen(controlSocket string) (net.Listener, error) {
+	sd, err := windows.SecurityDescriptorFromString(controlPipeSDDL)
+	if err != nil {
+		return nil, err
+	}
+	listener := &pipeListener{
+		name: controlPipeName(controlSocket),
+		sa: &windows.SecurityAttributes{
+			Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+			SecurityDescriptor: sd,
+		},
+	}
+	// Create the first instance right away, so that a pipe squatted by another process is reported now
+	handle, err := listener.createInstance(true)
+	if err != nil {
+		return nil, err
+	}
+	listener.pending = handle
+	return listener, nil
+}
+
+func (listener *pipeListener) createInstance(first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(listener.name)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	return windows.CreateNamedPipe(
+		name,
+		flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES,
+		controlPipeBufferSize,
+		controlPipeBufferSize,
+		0,
+		listener.sa,
+	)
+}
+
+func (listener *pipeListener) Accept() (net.Conn, error) {
+	listener.lock.Lock()
+	if listener.closed {
+		listener.lock.Unlock()
+		return nil, net.ErrClosed
+	}
+	handle := listener.pending
+	listener.pending = windows.InvalidHandle
+	listener.lock.Unlock()
+	if handle == windows.InvalidHandle {
+		var err error
+		if handle, err = listener.createInstance(false); err != nil {
+			return nil, err
+		}
+	}
+	err := windows.ConnectNamedPipe(handle, nil)
+	listener.lock.Lock()
+	closed := listener.closed
+	listener.lock.Unlock()
+	if closed {
+		windows.CloseHandle(handle)
+		return nil, net.ErrClosed
+	}
+	if err != nil && !errors.Is(err, windows.ERROR_PIPE_CONNECTED) {
+		windows.CloseHandle(handle)
+		return nil, err
+	}
+	return &pipeConn{handle: handle, addr: pipeAddr(listener.name), server: true}, nil
+}
+
+func (listener *pipeListener) Close() error {
+	listener.lock.Lock()
+	if listener.closed {
+		listener.lock.Unlock()
+		return nil
+	}
+	listener.closed = true
+	pending := listener.pending
+	listener.pending = windows.InvalidHandle
+	listener.lock.Unlock()
+	if pending != windows.InvalidHandle {
+		windows.CloseHandle(pending)
+	}
+	// A blocking ConnectNamedPipe() call can only be woken up by a client
+	if conn, err := controlDial(listener.name); err == nil {
+		conn.Close()
+	}
+	return nil
+}
+
+func (listener *pipeListener) Addr() net.Addr {
+	return pipeAddr(listener.name)
+}
+
+// pipeConn wraps a synchronous pipe handle; deadlines are enforced by closing the handle
+type pipeConn struct {
+	handle    windows.Handle
+	addr      pipeAddr
+	server    bool
+	lock      sync.Mutex
+	closed    bool
+	deadlines *time.Timer
+}
+
+func (conn *pipeConn) Read(b []byte) (int, error) {
+	n, err := windows.Read(conn.handle, b)
+	if err != nil {
+		if conn.isClosed() {
+			return n, net.ErrClosed
+		}
+		if errors.Is(err, windows.ERROR_PIPE_NOT_CONNECTED) || errors.Is(err, windows.ERROR_NO_DATA) {
+			return n, io.EOF
+		}
+		return n, err
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (conn *pipeConn) Write(b []byte) (int, error) {
+	n, err := windows.Write(conn.handle, b)
+	if err != nil && conn.isClosed() {
+		return n, net.ErrClosed
+	}
+	return n, err
+}
+
+func (conn *pipeConn) isClosed() bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.closed
+}
+
+func (conn *pipeConn) Close() error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.closed {
+		return nil
+	}
+	conn.closed = true
+	if conn.deadlines != nil {
+		conn.deadlines.Stop()
+	}
+	if conn.server {
+		// Let the client read the response before the pipe instance goes away
+		windows.FlushFileBuffers(conn.handle)
+		windows.DisconnectNamedPipe(conn.handle)
+	}
+	return windows.CloseHandle(conn.handle)
+}
+
+func (conn *pipeConn) LocalAddr() net.Addr {
+	return conn.addr
+}
+
+func (conn *pipeConn) RemoteAddr() net.Addr {
+	return conn.addr
+}
+
+func (conn *pipeConn) SetDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.deadlines != nil {
+		conn.deadlines.Stop()
+		conn.deadlines = nil
+	}
+	if !t.IsZero() {
+		conn.deadlines = time.AfterFunc(time.Until(t), func() { conn.Close() })
+	}
+	return nil
+}
+
+func (conn *pipeConn) SetReadDeadline(t time.Time) error {
+	return conn.SetDeadline(t)
+}
+
+func (conn *pipeConn) SetWriteDeadline(t time.Time) error {
+	return conn.SetDeadline(t)
+}
+
+func controlDial(controlSocket string) (net.Conn, error) {
+	name := controlPipeName(controlSocket)
+	namePtr, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(ControlCommandTimeout)
+	for {
+		handle, err := windows.CreateFile(
+			namePtr,
+			windows.GENERIC_READ|windows.GENERIC_WRITE,
+			0,
+			nil,
+			windows.OPEN_EXISTING,
+			windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION,
+			0,
+		)
+		if err == nil {
+			return &pipeConn{handle: handle, addr: pipeAddr(name)}, nil
+		}
+		if !errors.Is(err, windows.ERROR_PIPE_BUSY) || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+)
+
+// countryNames maps names that can be found in server descriptions to ISO 3166-1 country codes
+var countryNames = map[string]string{
+	"argentina":            "AR",
+	"armenia":              "AM",
+	"australia":            "AU",
+	"austria":              "AT",
+	"belgium":              "BE",
+	"brazil":               "BR",
+	"bulgaria":             "BG",
+	"canada":               "CA",
+	"chile":                "CL",
+	"china":                "CN",
+	"colombia":             "CO",
+	"croatia":              "HR",
+	"cyprus":               "CY",
+	"czech republic":       "CZ",
+	"czechia":              "CZ",
+	"denmark":              "DK",
+	"estonia":              "EE",
+	"finland":              "FI",
+	"france":               "FR",
+	"georgia":              "GE",
+	"germany":              "DE",
+	"greece":               "GR",
+	"hong kong":            "HK",
+	"hungary":              "HU",
+	"iceland":              "IS",
+	"india":                "IN",
+	"indonesia":            "ID",
+	"iran":                 "IR",
+	"ireland":              "IE",
+	"israel":               "IL",
+	"italy":                "IT",
+	"japan":                "JP",
+	"kazakhstan":           "KZ",
+	"latvia":               "LV",
+	"lithuania":            "LT",
+	"luxembourg":           "LU",
+	"malaysia":             "MY",
+	"mexico":               "MX",
+	"moldova":              "MD",
+	"netherlands":          "NL",
+	"new zealand":          "NZ",
+	"norway":               "NO",
+	"poland":               "PL",
+	"portugal":             "PT",
+	"romania":              "RO",
+	"russia":               "RU",
+	"serbia":               "RS",
+	"singapore":            "SG",
+	"slovakia":             "SK",
+	"slovenia":             "SI",
+	"south africa":         "ZA",
+	"south korea":          "KR",
+	"spain":                "ES",
+	"sweden":               "SE",
+	"switzerland":          "CH",
+	"taiwan":               "TW",
+	"thailand":             "TH",
+	"turkey":               "TR",
+	"ukraine":              "UA",
+	"united arab emirates": "AE",
+	"united kingdom":       "GB",
+	"united states":        "US",
+	"vietnam":              "VN",
+}
+
+// countryAbbreviations are only matched in uppercase, to avoid confusion with common words
+var countryAbbreviations = map[string]string{
+	"UK":  "GB",
+	"US":  "US",
+	"USA": "US",
+}
+
+// descriptionCountries returns the codes of the countries mentioned in a server description
+func descriptionCountries(description string) []string {
+	found := make(map[string]struct{})
+	isSeparator := func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z')
+	}
+	words := strings.FieldsFunc(description, isSeparator)
+	for _, word := range words {
+		if code, ok := countryAbbreviations[word]; ok {
+			found[code] = struct{}{}
+		}
+	}
+	normalized := " " + strings.ToLower(strings.Join(words, " ")) + " "
+	for name, code := range countryNames {
+		if strings.Contains(normalized, " "+name+" ") {
+			found[code] = struct{}{}
+		}
+	}
+	codes := make([]string, 0, len(found))
+	for code := range found {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// serverCountries returns the countries of a server: the ones set in its options, or the ones found in its description
+func (proxy *Proxy) serverCountries(registeredServer *RegisteredServer) []string {
+	if countries := proxy.serverOptions[registeredServer.name].Countries; len(countries) > 0 {
+		return countries
+	}
+	return descriptionCountries(registeredServer.description)
+}
+
+// acceptsServerCountries applies the `server_countries` and `disabled_server_countries` filters
+func (proxy *Proxy) acceptsServerCountries(registeredServer *RegisteredServer) bool {
+	if len(proxy.serverCountriesFilter) == 0 && len(proxy.disabledServerCountries) == 0 {
+		return true
+	}
+	countries := proxy.serverCountries(registeredServer)
+	for _, country := range countries {
+		if includesName(proxy.disabledServerCountries, country) {
+			return false
+		}
+	}
+	if len(proxy.serverCountriesFilter) == 0 {
+		return true
+	}
+	for _, country := range countries {
+		if includesName(proxy.serverCountriesFilter, country) {
+			return true
+		}
+	}
+	return false
+}
+
+func upperCaseStrings(strs []string) []string {
+	upper := make([]string, 0, len(strs))
+	for _, str := range strs {
+		if str = strings.ToUpper(strings.TrimSpace(str)); len(str) > 0 {
+			upper = append(upper, str)
+		}
+	}
+	return upper
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jedisct1/dlog"
+)
+
+// CredentialsConfig is the subset of the configuration that can be kept in a separate file,
+// with stricter permissions than the main configuration file
+type CredentialsConfig struct {
+	StaticsConfig     map[string]StaticConfig  `toml:"static"`
+	DoHClientX509Auth DoHClientX509AuthConfig  `toml:"doh_client_x509_auth"`
+	ServerOptions     map[string]ServerOptions `toml:"server_options"`
+}
+
+func (config *Config) loadCredentialsFile() error {
+	credentialsFile := config.CredentialsFile
+	if len(credentialsFile) == 0 {
+		return nil
+	}
+	if fileInfo, err := os.Stat(credentialsFile); err != nil {
+		return &ConfigProblem{
+			Kind:    ConfigProblemMissingFile,
+			Key:     "credentials_file",
+			Message: fmt.Sprintf("Unable to load the credentials file [%s]: %v", credentialsFile, err),
+		}
+	} else if runtime.GOOS != "windows" && fileInfo.Mode().Perm()&0o044 != 0 {
+		dlog.Warnf("[%s] is readable by other system users - It is recommended to restrict its access permissions", credentialsFile)
+	}
+	credentials := CredentialsConfig{}
+	md, err := toml.DecodeFile(credentialsFile, &credentials)
+	if err != nil {
+		return fmt.Errorf("[%s]: %v", credentialsFile, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("[%s]: unsupported key [%s]", credentialsFile, undecoded[0])
+	}
+	if len(credentials.StaticsConfig) > 0 && config.StaticsConfig == nil {
+		config.StaticsConfig = make(map[string]StaticConfig)
+	}
+	for name, static := range credentials.StaticsConfig {
+		if _, found := config.StaticsConfig[name]; found {
+			return fmt.Errorf("Static server [%s] is defined both in the configuration and in [%s]", name, credentialsFile)
+		}
+		config.StaticsConfig[name] = static
+	}
+	config.DoHClientX509Auth.Creds = append(config.DoHClientX509Auth.Creds, credentials.DoHClientX509Auth.Creds...)
+	if len(credentials.ServerOptions) > 0 && config.ServerOptions == nil {
+		config.ServerOptions = make(map[string]ServerOptions)
+	}
+	for name, credentialOptions := range credentials.ServerOptions {
+		options := config.ServerOptions[name]
+		if len(credentialOptions.DoHMethod) > 0 {
+			options.DoHMethod = credentialOptions.DoHMethod
+		}
+		if credentialOptions.RequireDNSSEC {
+			options.RequireDNSSEC = true
+		}
+		if len(credentialOptions.HTTPHeaders) > 0 && options.HTTPHeaders == nil {
+			options.HTTPHeaders = make(map[string]string)
+		}
+		for key, value := range credentialOptions.HTTPHeaders {
+			options.HTTPHeaders[key] = value
+		}
+		config.ServerOptions[name] = options
+	}
+	return nil
+}
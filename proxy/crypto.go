@@ -1,10 +1,12 @@
-package main
+package proxy
 
 import (
 	"bytes"
 	crypto_rand "crypto/rand"
 	"crypto/sha512"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/jedisct1/dlog"
 	"github.com/jedisct1/xsecretbox"
@@ -72,6 +74,57 @@ func ComputeSharedKey(
 	return
 }
 
+// ephemeralKeyCache keeps an ephemeral key for a server, when keys can be reused for some time
+type ephemeralKeyCache struct {
+	sync.Mutex
+	publicKey  [PublicKeySize]byte
+	sharedKey  [32]byte
+	expiration time.Time
+	reuse      time.Duration
+}
+
+// setEphemeralKeys applies the global and per-server ephemeral keys settings to a DNSCrypt server
+func (proxy *Proxy) setEphemeralKeys(serverInfo *ServerInfo) {
+	options := proxy.serverOptions[serverInfo.Name]
+	serverInfo.ephemeralKeys = proxy.ephemeralKeys
+	if options.EphemeralKeys != nil {
+		serverInfo.ephemeralKeys = *options.EphemeralKeys
+	}
+	reuse := proxy.ephemeralKeyReuse
+	if options.EphemeralKeyReuse != nil {
+		reuse = time.Duration(Max(0, *options.EphemeralKeyReuse)) * time.Second
+	}
+	if serverInfo.ephemeralKeys && reuse > 0 {
+		serverInfo.ephemeralKeyCache = &ephemeralKeyCache{reuse: reuse}
+	}
+}
+
+// ephemeralKey returns a key pair derived from the client nonce, or the last one if it can still be reused
+func (proxy *Proxy) ephemeralKey(serverInfo *ServerInfo, clientNonce []byte) (*[PublicKeySize]byte, *[32]byte) {
+	cache := serverInfo.ephemeralKeyCache
+	if cache != nil {
+		cache.Lock()
+		defer cache.Unlock()
+		if time.Now().Before(cache.expiration) {
+			publicKey, sharedKey := cache.publicKey, cache.sharedKey
+			return &publicKey, &sharedKey
+		}
+	}
+	h := sha512.New512_256()
+	h.Write(clientNonce)
+	h.Write(proxy.proxySecretKey[:])
+	var ephSk [32]byte
+	h.Sum(ephSk[:0])
+	var publicKey [PublicKeySize]byte
+	curve25519.ScalarBaseMult(&publicKey, &ephSk)
+	sharedKey := ComputeSharedKey(serverInfo.CryptoConstruction, &ephSk, &serverInfo.ServerPk, nil)
+	if cache != nil {
+		cache.publicKey, cache.sharedKey = publicKey, sharedKey
+		cache.expiration = time.Now().Add(cache.reuse)
+	}
+	return &publicKey, &sharedKey
+}
+
 func (proxy *Proxy) Encrypt(
 	serverInfo *ServerInfo,
 	packet []byte,
@@ -83,17 +136,8 @@ func (proxy *Proxy) Encrypt(
 	}
 	copy(nonce, clientNonce)
 	var publicKey *[PublicKeySize]byte
-	if proxy.ephemeralKeys {
-		h := sha512.New512_256()
-		h.Write(clientNonce)
-		h.Write(proxy.proxySecretKey[:])
-		var ephSk [32]byte
-		h.Sum(ephSk[:0])
-		var xPublicKey [PublicKeySize]byte
-		curve25519.ScalarBaseMult(&xPublicKey, &ephSk)
-		publicKey = &xPublicKey
-		xsharedKey := ComputeSharedKey(serverInfo.CryptoConstruction, &ephSk, &serverInfo.ServerPk, nil)
-		sharedKey = &xsharedKey
+	if serverInfo.ephemeralKeys {
+		publicKey, sharedKey = proxy.ephemeralKey(serverInfo, clientNonce)
 	} else {
 		sharedKey = &serverInfo.SharedKey
 		publicKey = &proxy.proxyPublicKey
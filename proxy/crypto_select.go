@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/jedisct1/xsecretbox"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	CryptoImplementationAuto      = "auto"
+	CryptoImplementationXChaCha20 = "xchacha20"
+	CryptoImplementationXSalsa20  = "xsalsa20"
+	CryptoImplementationBenchmark = "benchmark"
+
+	cryptoBenchmarkPacketSize = 512
+	cryptoBenchmarkDuration   = 20 * time.Millisecond
+	// XChaCha20 is kept unless XSalsa20 is faster by at least that percentage
+	cryptoBenchmarkMargin = 10
+)
+
+// Architectures with assembly code for the primitives the DNSCrypt constructions are built on.
+// Everywhere else, including MIPS and 32-bit ARM, the pure-Go versions are used.
+var (
+	cryptoChaCha20AsmArchs = []string{"arm64", "ppc64le", "s390x"}
+	cryptoSalsa20AsmArchs  = []string{"amd64"}
+	cryptoPoly1305AsmArchs = []string{"amd64", "ppc64le", "s390x"}
+)
+
+func (construction CryptoConstruction) String() string {
+	switch construction {
+	case XSalsa20Poly1305:
+		return "XSalsa20Poly1305"
+	case XChacha20Poly1305:
+		return "XChacha20Poly1305"
+	default:
+		return "undefined"
+	}
+}
+
+func cryptoPath(archs []string) string {
+	for _, arch := range archs {
+		if arch == runtime.GOARCH {
+			return "asm"
+		}
+	}
+	return "generic"
+}
+
+func cryptoAccelerated(archs []string) bool {
+	return cryptoPath(archs) == "asm"
+}
+
+// CryptoPaths describes the code paths used for the DNSCrypt primitives on this architecture
+func CryptoPaths() string {
+	return fmt.Sprintf("%s: chacha20=%s salsa20=%s poly1305=%s", runtime.GOARCH,
+		cryptoPath(cryptoChaCha20AsmArchs), cryptoPath(cryptoSalsa20AsmArchs), cryptoPath(cryptoPoly1305AsmArchs))
+}
+
+// benchmarkCryptoConstruction returns the average time to encrypt and decrypt a typical query
+func benchmarkCryptoConstruction(construction CryptoConstruction) time.Duration {
+	var key [32]byte
+	var nonce [NonceSize]byte
+	packet := make([]byte, cryptoBenchmarkPacketSize)
+	encrypted := make([]byte, 0, cryptoBenchmarkPacketSize+TagSize)
+	decrypted := make([]byte, 0, cryptoBenchmarkPacketSize)
+	iterations := 0
+	start := time.Now()
+	for time.Since(start) < cryptoBenchmarkDuration {
+		nonce[0] = byte(iterations)
+		if construction == XChacha20Poly1305 {
+			encrypted = xsecretbox.Seal(encrypted[:0], nonce[:], packet, key[:])
+			decrypted, _ = xsecretbox.Open(decrypted[:0], nonce[:], encrypted, key[:])
+		} else {
+			encrypted = secretbox.Seal(encrypted[:0], packet, &nonce, &key)
+			decrypted, _ = secretbox.Open(decrypted[:0], encrypted, &nonce, &key)
+		}
+		iterations++
+	}
+	return time.Since(start) / time.Duration(iterations)
+}
+
+func benchmarkCryptoConstructions() CryptoConstruction {
+	xchacha20 := benchmarkCryptoConstruction(XChacha20Poly1305)
+	xsalsa20 := benchmarkCryptoConstruction(XSalsa20Poly1305)
+	dlog.Noticef("Crypto benchmark: XChacha20Poly1305: %v/query, XSalsa20Poly1305: %v/query", xchacha20, xsalsa20)
+	if xsalsa20*(100+cryptoBenchmarkMargin)/100 < xchacha20 {
+		return XSalsa20Poly1305
+	}
+	return XChacha20Poly1305
+}
+
+// selectCryptoConstruction returns the construction to use when a server offers both, with the same serial.
+// In auto mode, the constructions are benchmarked if none of them can use an accelerated code path.
+func selectCryptoConstruction(implementation string) (CryptoConstruction, error) {
+	var construction CryptoConstruction
+	switch strings.ToLower(implementation) {
+	case "", CryptoImplementationAuto:
+		if cryptoAccelerated(cryptoChaCha20AsmArchs) || cryptoAccelerated(cryptoSalsa20AsmArchs) ||
+			cryptoAccelerated(cryptoPoly1305AsmArchs) {
+			construction = XChacha20Poly1305
+		} else {
+			construction = benchmarkCryptoConstructions()
+		}
+	case CryptoImplementationXChaCha20:
+		construction = XChacha20Poly1305
+	case CryptoImplementationXSalsa20:
+		construction = XSalsa20Poly1305
+	case CryptoImplementationBenchmark:
+		construction = benchmarkCryptoConstructions()
+	default:
+		return UndefinedConstruction, fmt.Errorf("Unsupported crypto implementation: [%s]", implementation)
+	}
+	dlog.Noticef("Crypto paths (%s) - preferred DNSCrypt construction: %v", CryptoPaths(), construction)
+	return construction, nil
+}
+
+// prefersConstruction returns true if a certificate using the given construction should replace
+// a certificate with the same serial using the current construction
+func (proxy *Proxy) prefersConstruction(construction CryptoConstruction, current CryptoConstruction) bool {
+	if current == UndefinedConstruction || construction == current {
+		return true
+	}
+	if proxy.preferredConstruction == UndefinedConstruction {
+		return construction > current
+	}
+	return construction == proxy.preferredConstruction
+}
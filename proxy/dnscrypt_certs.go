@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"bytes"
@@ -18,6 +18,7 @@ type CertInfo struct {
 	MagicQuery         [ClientMagicLen]byte
 	CryptoConstruction CryptoConstruction
 	ForwardSecurity    bool
+	Expiration         time.Time
 }
 
 func FetchCurrentDNSCryptCert(
@@ -139,7 +140,9 @@ func FetchCurrentDNSCryptCert(
 		} else {
 			certInfo.ForwardSecurity = true
 		}
-		if !proxy.certIgnoreTimestamp {
+		if !proxy.certIgnoreTimestamp && !wallClockIsSane() {
+			dlog.Debugf("[%v] The system clock is not set yet, ignoring the certificate validity period", *serverName)
+		} else if !proxy.certIgnoreTimestamp {
 			if now > tsEnd || now < tsBegin {
 				dlog.Debugf(
 					"[%v] Certificate not valid at the current date (now: %v is not in [%v..%v])",
@@ -156,7 +159,7 @@ func FetchCurrentDNSCryptCert(
 			continue
 		}
 		if serial == highestSerial {
-			if cryptoConstruction < certInfo.CryptoConstruction {
+			if !proxy.prefersConstruction(cryptoConstruction, certInfo.CryptoConstruction) {
 				dlog.Debugf("[%v] Keeping the previous, preferred crypto construction", *serverName)
 				continue
 			} else {
@@ -173,6 +176,7 @@ func FetchCurrentDNSCryptCert(
 		certInfo.SharedKey = sharedKey
 		highestSerial = serial
 		certInfo.CryptoConstruction = cryptoConstruction
+		certInfo.Expiration = time.Unix(int64(tsEnd), 0)
 		copy(certInfo.ServerPk[:], serverPk[:])
 		copy(certInfo.MagicQuery[:], binCert[104:112])
 		if isNew {
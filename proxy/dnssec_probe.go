@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+// dnssecProbePacket returns a query for a signed name that validating resolvers always flag as authenticated
+func dnssecProbePacket() ([]byte, error) {
+	msg := dns.Msg{}
+	msg.SetQuestion(".", dns.TypeSOA)
+	msg.AuthenticatedData = true
+	msg.SetEdns0(uint16(MaxDNSPacketSize), true)
+	return msg.Pack()
+}
+
+// exchangeWithServer sends a query to a server, outside of the processing of client queries
+func (proxy *Proxy) exchangeWithServer(serverInfo *ServerInfo, query []byte) ([]byte, error) {
+	switch serverInfo.Proto {
+	case stamps.StampProtoTypeDNSCrypt:
+		sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, "udp")
+		if err == nil {
+			var response []byte
+			if response, err = proxy.exchangeWithUDPServer(serverInfo, sharedKey, encryptedQuery, clientNonce); err == nil &&
+				!HasTCFlag(response) {
+				return response, nil
+			}
+		}
+		sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, "tcp")
+		if err != nil {
+			return nil, err
+		}
+		return proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
+	case stamps.StampProtoTypeDoH:
+		response, _, _, _, err := proxy.xTransport.DoHQuery(
+			serverInfo.useGet,
+			serverInfo.URL,
+			query,
+			proxy.timeout,
+			serverInfo.httpHeaders,
+		)
+		return response, err
+	case stamps.StampProtoTypeODoHTarget:
+		if len(serverInfo.odohTargetConfigs) == 0 {
+			return nil, errors.New("No ODoH target configuration")
+		}
+		odohQuery, err := serverInfo.odohTargetConfigs[0].encryptQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		targetURL := serverInfo.URL
+		if serverInfo.Relay != nil && serverInfo.Relay.ODoH != nil {
+			targetURL = serverInfo.Relay.ODoH.URL
+		}
+		responseBody, responseCode, _, _, err := proxy.xTransport.ObliviousDoHQuery(
+			serverInfo.useGet,
+			targetURL,
+			odohQuery.odohMessage,
+			proxy.timeout,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if responseCode != 200 {
+			return nil, fmt.Errorf("HTTP status code: %d", responseCode)
+		}
+		return odohQuery.decryptResponse(responseBody)
+	}
+	return nil, fmt.Errorf("Unsupported protocol: [%s]", serverInfo.Proto.String())
+}
+
+// probeDNSSEC checks that a server validates DNSSEC signatures
+func (proxy *Proxy) probeDNSSEC(serverInfo *ServerInfo) error {
+	query, err := dnssecProbePacket()
+	if err != nil {
+		return err
+	}
+	response, err := proxy.exchangeWithServer(serverInfo, query)
+	if err != nil {
+		return fmt.Errorf("[%s] DNSSEC probe failed: %v", serverInfo.Name, err)
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err != nil {
+		return fmt.Errorf("[%s] DNSSEC probe failed: %v", serverInfo.Name, err)
+	}
+	if msg.Rcode != dns.RcodeSuccess || !msg.AuthenticatedData {
+		return fmt.Errorf("[%s] doesn't validate DNSSEC signatures, but `require_dnssec` is set", serverInfo.Name)
+	}
+	dlog.Debugf("[%s] validates DNSSEC signatures", serverInfo.Name)
+	return nil
+}
+
+// checkDNSSECResponse returns false if a response includes signatures, but wasn't flagged as authenticated,
+// meaning that the server didn't validate it
+func checkDNSSECResponse(response []byte) bool {
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err != nil || msg.Rcode != dns.RcodeSuccess || msg.AuthenticatedData ||
+		msg.CheckingDisabled {
+		return true
+	}
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return false
+		}
+	}
+	return true
+}
+
+// demote removes a server from the set of live servers, until the next certificate refresh.
+// The last live server is never removed.
+func (serversInfo *ServersInfo) demote(name string, reason string) {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	for i, serverInfo := range serversInfo.inner {
+		if serverInfo.Name == name {
+			if len(serversInfo.inner) <= 1 {
+				dlog.Warnf("[%s] is the only live server, and is still used: %s", name, reason)
+				return
+			}
+			serversInfo.inner = append(serversInfo.inner[:i], serversInfo.inner[i+1:]...)
+			dlog.Warnf("[%s] is not used any more until the next certificates refresh: %s", name, reason)
+			return
+		}
+	}
+}
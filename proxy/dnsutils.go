@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"encoding/binary"
@@ -93,6 +93,20 @@ func RefusedResponseFromMessage(srcMsg *dns.Msg, refusedCode bool, ipv4 net.IP,
 	return dstMsg
 }
 
+func setEDNS0PayloadSize(packet []byte, size uint16) ([]byte, error) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return packet, err
+	}
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return packet, nil
+	}
+	edns0.SetUDPSize(size)
+	msg.Compress = true
+	return msg.Pack()
+}
+
 func HasTCFlag(packet []byte) bool {
 	return packet[2]&2 == 2
 }
@@ -0,0 +1,21 @@
+// Package proxy implements the dnscrypt-proxy resolver: configuration, server selection,
+// the DNSCrypt, DoH and ODoH protocols, and the query and response plugins.
+//
+// It can be embedded into other programs:
+//
+//	config, err := proxy.LoadConfig("dnscrypt-proxy.toml")
+//	if err != nil {
+//		return err
+//	}
+//	p, err := proxy.New(config)
+//	if err != nil {
+//		return err
+//	}
+//	p.Start()
+//	defer p.Stop()
+//	response, err := p.Resolve(ctx, query)
+//
+// Configuration errors are returned by New instead of terminating the program. Several proxies can
+// run in the same process, each with its own cache, matching engine and random generator. Stop
+// terminates the background tasks of a proxy.
+package proxy
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultInjectionAnyServer applies a fault to all the servers that don't have their own
+const FaultInjectionAnyServer = "*"
+
+// FaultInjector artificially delays, drops or fails a percentage of the upstream exchanges,
+// in order to check failover, serve-stale and alerting before relying on them.
+// Faults are set with the control socket, and are never saved.
+type FaultInjector struct {
+	sync.RWMutex
+	faults map[string]*fault
+	random *lockedRand
+}
+
+type fault struct {
+	delay        time.Duration
+	dropPercent  int
+	errorPercent int
+}
+
+// faultInjectedError is returned instead of sending a query; dropped queries look like timeouts
+type faultInjectedError struct {
+	dropped bool
+}
+
+func (err *faultInjectedError) Error() string {
+	if err.dropped {
+		return "Injected fault: query dropped"
+	}
+	return "Injected fault: network error"
+}
+
+func (err *faultInjectedError) Timeout() bool   { return err.dropped }
+func (err *faultInjectedError) Temporary() bool { return true }
+
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{faults: make(map[string]*fault)}
+}
+
+func (fault *fault) String() string {
+	return fmt.Sprintf("delay=%d drop=%d error=%d", fault.delay/time.Millisecond, fault.dropPercent, fault.errorPercent)
+}
+
+// parseFault parses a list of delay=<ms>, drop=<percent> and error=<percent> settings
+func parseFault(args []string) (*fault, error) {
+	fault := &fault{}
+	for _, arg := range args {
+		key, valueStr, found := strings.Cut(arg, "=")
+		if !found {
+			return nil, fmt.Errorf("Invalid setting: [%s]", arg)
+		}
+		value, err := strconv.Atoi(valueStr)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("Invalid value: [%s]", arg)
+		}
+		switch strings.ToLower(key) {
+		case "delay":
+			fault.delay = time.Duration(value) * time.Millisecond
+		case "drop":
+			fault.dropPercent = value
+		case "error":
+			fault.errorPercent = value
+		default:
+			return nil, fmt.Errorf("Unsupported setting: [%s]", key)
+		}
+	}
+	if fault.dropPercent+fault.errorPercent > 100 {
+		return nil, fmt.Errorf("The drop and error percentages add up to more than 100")
+	}
+	return fault, nil
+}
+
+func (injector *FaultInjector) set(serverName string, fault *fault) {
+	injector.Lock()
+	injector.faults[serverName] = fault
+	injector.Unlock()
+}
+
+// clear removes the fault of a server, or all the faults if serverName is empty
+func (injector *FaultInjector) clear(serverName string) bool {
+	injector.Lock()
+	defer injector.Unlock()
+	if len(serverName) == 0 {
+		found := len(injector.faults) > 0
+		injector.faults = make(map[string]*fault)
+		return found
+	}
+	_, found := injector.faults[serverName]
+	delete(injector.faults, serverName)
+	return found
+}
+
+func (injector *FaultInjector) list() []string {
+	injector.RLock()
+	defer injector.RUnlock()
+	lines := make([]string, 0, len(injector.faults))
+	for serverName, fault := range injector.faults {
+		lines = append(lines, serverName+" "+fault.String())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// inject applies the fault set for a server before an exchange, if there is one.
+// It returns an error if the exchange must not take place.
+func (injector *FaultInjector) inject(serverName string, timeout time.Duration) *faultInjectedError {
+	if injector == nil {
+		return nil
+	}
+	injector.RLock()
+	fault, found := injector.faults[serverName]
+	if !found {
+		fault, found = injector.faults[FaultInjectionAnyServer]
+	}
+	injector.RUnlock()
+	if !found {
+		return nil
+	}
+	if fault.delay > 0 {
+		time.Sleep(fault.delay)
+	}
+	draw := injector.random.Intn(100)
+	if draw < fault.dropPercent {
+		time.Sleep(timeout)
+		return &faultInjectedError{dropped: true}
+	}
+	if draw < fault.dropPercent+fault.errorPercent {
+		return &faultInjectedError{}
+	}
+	return nil
+}
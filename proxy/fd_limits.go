@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	FDLimitsCheckInterval   = 5 * time.Second
+	FDLimitsTightenPercent  = 90
+	FDLimitsRelaxPercent    = 75
+	FDLimitsAcceptErrorWait = 100 * time.Millisecond
+)
+
+var errTooManyUpstreamConnections = errors.New("Too many upstream connections")
+
+// FDLimits keeps track of the sockets opened for upstream servers and for TCP and DoH clients.
+// When the number of open file descriptors approaches the process limit, new sockets are
+// refused instead of failing with "too many open files" errors all over the place.
+type FDLimits struct {
+	upstream        atomic.Int64
+	clients         atomic.Int64
+	refusedUpstream atomic.Uint64
+	refusedClients  atomic.Uint64
+	maxUpstream     int64
+	maxClients      int64
+	autoTighten     bool
+	rlimit          uint64
+	openFDs         atomic.Int64
+	// When tightened, client connections are refused, and upstream connections cannot grow
+	// beyond the number that were open when the limit was approached
+	tightened         atomic.Bool
+	tightenedUpstream atomic.Int64
+	lastAcceptError   atomic.Int64
+}
+
+func NewFDLimits(maxUpstream int, maxClients int, autoTighten bool) *FDLimits {
+	return &FDLimits{
+		maxUpstream: int64(maxUpstream),
+		maxClients:  int64(maxClients),
+		autoTighten: autoTighten,
+		rlimit:      fdRlimit(),
+	}
+}
+
+func (fdLimits *FDLimits) acquireUpstream() bool {
+	if fdLimits == nil {
+		return true
+	}
+	count := fdLimits.upstream.Add(1)
+	if (fdLimits.maxUpstream > 0 && count > fdLimits.maxUpstream) ||
+		(fdLimits.tightened.Load() && count > fdLimits.tightenedUpstream.Load()) {
+		fdLimits.upstream.Add(-1)
+		fdLimits.refusedUpstream.Add(1)
+		return false
+	}
+	return true
+}
+
+func (fdLimits *FDLimits) releaseUpstream() {
+	if fdLimits != nil {
+		fdLimits.upstream.Add(-1)
+	}
+}
+
+func (fdLimits *FDLimits) acquireClient() bool {
+	if fdLimits == nil {
+		return true
+	}
+	count := fdLimits.clients.Add(1)
+	if (fdLimits.maxClients > 0 && count > fdLimits.maxClients) || fdLimits.tightened.Load() {
+		fdLimits.clients.Add(-1)
+		fdLimits.refusedClients.Add(1)
+		return false
+	}
+	return true
+}
+
+func (fdLimits *FDLimits) releaseClient() {
+	if fdLimits != nil {
+		fdLimits.clients.Add(-1)
+	}
+}
+
+// fdCountedConn releases its accounting slot when it gets closed
+type fdCountedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (conn *fdCountedConn) Close() error {
+	conn.once.Do(conn.release)
+	return conn.Conn.Close()
+}
+
+// countUpstream accounts for a connection to an upstream server, until it is closed
+func (fdLimits *FDLimits) countUpstream(conn net.Conn, err error) (net.Conn, error) {
+	if fdLimits == nil || err != nil {
+		return conn, err
+	}
+	if !fdLimits.acquireUpstream() {
+		conn.Close()
+		return nil, errTooManyUpstreamConnections
+	}
+	return &fdCountedConn{Conn: conn, release: fdLimits.releaseUpstream}, nil
+}
+
+type fdCountedListener struct {
+	net.Listener
+	fdLimits *FDLimits
+}
+
+func (listener *fdCountedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			if listener.fdLimits.noticeAcceptError(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !listener.fdLimits.acquireClient() {
+			conn.Close()
+			continue
+		}
+		return &fdCountedConn{Conn: conn, release: listener.fdLimits.releaseClient}, nil
+	}
+}
+
+// listener returns a listener whose connections are accounted for as client connections
+func (fdLimits *FDLimits) listener(listener net.Listener) net.Listener {
+	if fdLimits == nil {
+		return listener
+	}
+	return &fdCountedListener{Listener: listener, fdLimits: fdLimits}
+}
+
+// noticeAcceptError waits after a temporary error while accepting a connection, such as
+// a lack of file descriptors, and returns false if the listener cannot be used any more
+func (fdLimits *FDLimits) noticeAcceptError(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	if fdLimits != nil {
+		now := time.Now().Unix()
+		if last := fdLimits.lastAcceptError.Load(); now-last >= 60 && fdLimits.lastAcceptError.CompareAndSwap(last, now) {
+			dlog.Warnf("Unable to accept connections: %v", err)
+		}
+	}
+	time.Sleep(FDLimitsAcceptErrorWait)
+	return true
+}
+
+func (fdLimits *FDLimits) check() {
+	openFDs := countOpenFDs()
+	fdLimits.openFDs.Store(openFDs)
+	if !fdLimits.autoTighten || fdLimits.rlimit == 0 || openFDs < 0 {
+		return
+	}
+	usage := uint64(openFDs) * 100 / fdLimits.rlimit
+	if !fdLimits.tightened.Load() && usage >= FDLimitsTightenPercent {
+		fdLimits.tightenedUpstream.Store(fdLimits.upstream.Load())
+		fdLimits.tightened.Store(true)
+		dlog.Warnf("%d file descriptors open out of %d - Refusing new client connections until some are closed", openFDs, fdLimits.rlimit)
+	} else if fdLimits.tightened.Load() && usage < FDLimitsRelaxPercent {
+		fdLimits.tightened.Store(false)
+		dlog.Noticef("%d file descriptors open out of %d - Accepting new connections again", openFDs, fdLimits.rlimit)
+	}
+}
+
+func (fdLimits *FDLimits) run(quit chan struct{}) {
+	for {
+		fdLimits.check()
+		select {
+		case <-quit:
+			return
+		case <-time.After(FDLimitsCheckInterval):
+		}
+	}
+}
+
+// Summary returns the socket usage, for the stats command
+func (fdLimits *FDLimits) Summary() string {
+	line := fmt.Sprintf("sockets upstream=%d clients=%d refused_upstream=%d refused_clients=%d",
+		fdLimits.upstream.Load(), fdLimits.clients.Load(), fdLimits.refusedUpstream.Load(), fdLimits.refusedClients.Load())
+	if openFDs := fdLimits.openFDs.Load(); openFDs > 0 {
+		line += fmt.Sprintf(" open_fds=%d", openFDs)
+	}
+	if fdLimits.rlimit > 0 {
+		line += fmt.Sprintf(" fd_limit=%d", fdLimits.rlimit)
+	}
+	if fdLimits.tightened.Load() {
+		line += " tightened"
+	}
+	return line
+}
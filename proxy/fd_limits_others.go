@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"os"
+	"syscall"
+)
+
+func fdRlimit() uint64 {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0
+	}
+	return uint64(rlimit.Cur)
+}
+
+// countOpenFDs returns the number of open file descriptors, or -1 if it cannot be known
+func countOpenFDs() int64 {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			return int64(len(entries))
+		}
+	}
+	return -1
+}
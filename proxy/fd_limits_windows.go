@@ -0,0 +1,11 @@
+package proxy
+
+// Windows doesn't have a per-process limit on the number of sockets
+
+func fdRlimit() uint64 {
+	return 0
+}
+
+func countOpenFDs() int64 {
+	return -1
+}
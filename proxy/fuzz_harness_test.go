@@ -0,0 +1,34 @@
+//go:build fuzz
+
+package proxy
+
+import "testing"
+
+func fuzzWithTarget(f *testing.F, name string) {
+	target := fuzzTargetByName(name)
+	if target == nil {
+		f.Fatalf("Unknown fuzzing target: [%s]", name)
+	}
+	for _, seed := range target.seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		target.run(data)
+	})
+}
+
+func FuzzPacket(f *testing.F) {
+	fuzzWithTarget(f, "FuzzPacket")
+}
+
+func FuzzStamp(f *testing.F) {
+	fuzzWithTarget(f, "FuzzStamp")
+}
+
+func FuzzConfig(f *testing.F) {
+	fuzzWithTarget(f, "FuzzConfig")
+}
+
+func FuzzODoHTargetConfigs(f *testing.F) {
+	fuzzWithTarget(f, "FuzzODoHTargetConfigs")
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+// The fuzzing harnesses are part of the shipped code, so that the same code paths are fuzzed with
+// `go test -tags fuzz -fuzz <target>`, and corpora can be checked against a release binary with
+// `-fuzz-corpus <dir>`. Corpus directories use the same layout as `testdata/fuzz`.
+
+const fuzzCorpusHeader = "go test fuzz v1"
+
+type fuzzTarget struct {
+	name  string
+	seeds [][]byte
+	run   func(data []byte)
+}
+
+// fuzzPacket runs a DNS packet through the functions used on the queries and responses forwarded by the proxy
+func fuzzPacket(data []byte) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(data); err != nil {
+		return
+	}
+	_ = HasTCFlag(data)
+	_, _ = hasEDNS0Padding(data)
+	_, _ = setEDNS0PayloadSize(data, 1232)
+	_, _ = TruncatedResponse(data)
+	for _, question := range msg.Question {
+		_, _ = NormalizeQName(question.Name)
+	}
+	_ = getMinTTL(&msg, 0, 86400, 60, 600)
+	setMaxTTL(&msg, 3600)
+	removeEDNS0Options(&msg)
+	_, _ = msg.Pack()
+}
+
+func fuzzStamp(data []byte) {
+	stamp, err := stamps.NewServerStampFromString(string(data))
+	if err != nil {
+		return
+	}
+	_, _ = stamps.NewServerStampFromString(stamp.String())
+}
+
+func fuzzConfig(data []byte) {
+	config := newConfig()
+	_, _ = toml.Decode(string(data), &config)
+}
+
+func fuzzODoHTargetConfigs(data []byte) {
+	_, _ = parseODoHTargetConfigs(data)
+}
+
+func fuzzPacketSeeds() [][]byte {
+	var seeds [][]byte
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.Id = 0
+	query.SetEdns0(1232, true)
+	if packet, err := query.Pack(); err == nil {
+		seeds = append(seeds, packet)
+	}
+	response := new(dns.Msg)
+	response.SetReply(query)
+	if rr, err := dns.NewRR("example.com. 3600 IN A 192.0.2.1"); err == nil {
+		response.Answer = append(response.Answer, rr)
+	}
+	if rr, err := dns.NewRR("example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 3600"); err == nil {
+		response.Ns = append(response.Ns, rr)
+	}
+	if packet, err := response.Pack(); err == nil {
+		seeds = append(seeds, packet)
+	}
+	return seeds
+}
+
+var fuzzTargets = []fuzzTarget{
+	{name: "FuzzPacket", seeds: fuzzPacketSeeds(), run: fuzzPacket},
+	{
+		name: "FuzzStamp",
+		seeds: [][]byte{
+			[]byte("sdns://AgcAAAAAAAAACzEwNC4yMS42Ljc4AA1kb2guY3J5cHRvLnN4Ci9kbnMtcXVlcnk"),
+			[]byte("sdns://AQcAAAAAAAAADTUxLjE1LjEyMi4yNTAg6Q3ZfapcbHgiHKLF7QFoli0Ty1Vsz3RXs1RUbxUrwZAcMi5kbnNjcnlwdC1jZXJ0LnNjYWxld2F5LWFtcw"),
+			[]byte("sdns://gQ8xNjMuMTcyLjE4MC4xMjU"),
+			[]byte("sdns://BQcAAAAAAAAADm9kb2guY3J5cHRvLnN4Ci9kbnMtcXVlcnk"),
+		},
+		run: fuzzStamp,
+	},
+	{
+		name: "FuzzConfig",
+		seeds: [][]byte{
+			[]byte("listen_addresses = ['127.0.0.1:53']\nserver_names = ['example']\ncache = true\n\n[query_log]\nfile = 'query.log'\n"),
+			[]byte("[static]\n[static.'example']\nstamp = 'sdns://AgcAAAAAAAAACzEwNC4yMS42Ljc4AA1kb2guY3J5cHRvLnN4Ci9kbnMtcXVlcnk'\n"),
+		},
+		run: fuzzConfig,
+	},
+	{
+		name:  "FuzzODoHTargetConfigs",
+		seeds: [][]byte{mustDecodeHex("0020000100010020aacc53b3df0c6eb2d7d5ce4ddf399593376c9903ba6a52a52c3a2340f97bb764")},
+		run:   fuzzODoHTargetConfigs,
+	},
+}
+
+func mustDecodeHex(str string) []byte {
+	data, err := hex.DecodeString(str)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func fuzzTargetByName(name string) *fuzzTarget {
+	for i := range fuzzTargets {
+		if fuzzTargets[i].name == name {
+			return &fuzzTargets[i]
+		}
+	}
+	return nil
+}
+
+// encodeFuzzCorpusEntry encodes an input the same way as `go test -fuzz`
+func encodeFuzzCorpusEntry(data []byte) []byte {
+	return []byte(fuzzCorpusHeader + "\n[]byte(" + strconv.Quote(string(data)) + ")\n")
+}
+
+// decodeFuzzCorpusEntry decodes an entry saved by `go test -fuzz`.
+// Files without the corpus header are raw inputs, such as the ones produced by other fuzzers.
+func decodeFuzzCorpusEntry(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, []byte(fuzzCorpusHeader+"\n")) {
+		return content, nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		return nil, errors.New("Unexpected number of values")
+	}
+	value := strings.TrimSpace(lines[1])
+	for _, prefix := range []string{"[]byte(", "string("} {
+		if strings.HasPrefix(value, prefix) && strings.HasSuffix(value, ")") {
+			data, err := strconv.Unquote(value[len(prefix) : len(value)-1])
+			return []byte(data), err
+		}
+	}
+	return nil, fmt.Errorf("Unsupported value: [%s]", value)
+}
+
+func runFuzzInput(target *fuzzTarget, data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	target.run(data)
+	return nil
+}
+
+// FuzzCorpus adds the seeds of every harness to the corpus directory, runs the harnesses on all the
+// inputs found in that directory, and returns the exit code to use
+func FuzzCorpus(dir string) int {
+	failures := 0
+	for i := range fuzzTargets {
+		target := &fuzzTargets[i]
+		targetDir := filepath.Join(dir, target.name)
+		if err := os.MkdirAll(targetDir, 0o755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, seed := range target.seeds {
+			hash := sha256.Sum256(seed)
+			seedFile := filepath.Join(targetDir, "seed-"+hex.EncodeToString(hash[:8]))
+			if _, err := os.Stat(seedFile); os.IsNotExist(err) {
+				if err := os.WriteFile(seedFile, encodeFuzzCorpusEntry(seed), 0o644); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return 1
+				}
+			}
+		}
+		entries, err := os.ReadDir(targetDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		count := 0
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			file := filepath.Join(targetDir, entry.Name())
+			content, err := os.ReadFile(file)
+			if err == nil {
+				var data []byte
+				if data, err = decodeFuzzCorpusEntry(content); err == nil {
+					err = runFuzzInput(target, data)
+				}
+			}
+			if err != nil {
+				fmt.Printf("%s: [%s]: %v\n", target.name, file, err)
+				failures++
+			}
+			count++
+		}
+		fmt.Printf("%s: %d inputs\n", target.name, count)
+	}
+	if failures > 0 {
+		fmt.Printf("%d failures\n", failures)
+		return 1
+	}
+	return 0
+}
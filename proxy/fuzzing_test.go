@@ -1,7 +1,7 @@
 //go:build gofuzzbeta
 // +build gofuzzbeta
 
-package main
+package proxy
 
 import (
 	"encoding/hex"
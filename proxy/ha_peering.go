@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	HAPeeringPath                = "/ha/state"
+	DefaultHAPeeringSyncInterval = 10 * time.Second
+	HAPeeringMaxClockSkew        = 60 * time.Second
+	HAPeeringCacheJournalSize    = 4096
+	HAPeeringMaxStateSize        = 64 * 1024 * 1024
+	HAPeeringNonceLen            = 16
+)
+
+// HAPeering exchanges the state of two instances, typically a primary/standby pair, so that
+// the one that takes over starts with up-to-date server rankings and a warm cache.
+// Requests are authenticated, and the state is encrypted, bound to the request it answers.
+type HAPeering struct {
+	listenAddress string
+	peerURL       string
+	key           []byte
+	aead          cipher.AEAD
+	syncInterval  time.Duration
+	journal       *haCacheJournal
+	cacheSize     int
+	httpClient    *http.Client
+	peerSeq       uint64
+}
+
+type haServerState struct {
+	Name       string  `json:"name"`
+	RTT        float64 `json:"rtt"`
+	LastUsedMs int64   `json:"last_used_ms"`
+}
+
+type haCacheEntry struct {
+	Seq        uint64 `json:"seq"`
+	Key        []byte `json:"key"`
+	Expiration int64  `json:"expiration"`
+	Packet     []byte `json:"packet"`
+}
+
+type haState struct {
+	Node     string          `json:"node,omitempty"`
+	Servers  []haServerState `json:"servers"`
+	CacheSeq uint64          `json:"cache_seq"`
+	Cache    []haCacheEntry  `json:"cache,omitempty"`
+}
+
+// haCacheJournal keeps the most recent cache entries, so that a peer can fetch the ones it doesn't have yet
+type haCacheJournal struct {
+	sync.Mutex
+	entries []haCacheEntry
+	seq     uint64
+}
+
+func NewHAPeering(config *HAPeeringConfig, cacheSize int) (*HAPeering, error) {
+	if len(config.SharedKey) < 16 {
+		return nil, errors.New("HA peering: the shared key must be at least 16 characters long")
+	}
+	peerURL := config.Peer
+	if !strings.Contains(peerURL, "://") {
+		peerURL = "http://" + peerURL
+	}
+	haPeering := &HAPeering{
+		listenAddress: config.ListenAddress,
+		peerURL:       strings.TrimSuffix(peerURL, "/") + HAPeeringPath,
+		key:           []byte(config.SharedKey),
+		syncInterval:  time.Duration(config.SyncInterval) * time.Second,
+		cacheSize:     cacheSize,
+	}
+	stateKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, haPeering.key, nil, []byte("dnscrypt-proxy HA state")), stateKey); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(stateKey)
+	if err != nil {
+		return nil, err
+	}
+	haPeering.aead = aead
+	if haPeering.syncInterval <= 0 {
+		haPeering.syncInterval = DefaultHAPeeringSyncInterval
+	}
+	haPeering.httpClient = &http.Client{Timeout: haPeering.syncInterval}
+	if config.SyncCache {
+		haPeering.journal = &haCacheJournal{}
+	}
+	return haPeering, nil
+}
+
+func (journal *haCacheJournal) add(cacheKey [32]byte, cachedResponse *CachedResponse) {
+	packet, err := cachedResponse.msg.Pack()
+	if err != nil {
+		return
+	}
+	journal.Lock()
+	defer journal.Unlock()
+	journal.seq++
+	entry := haCacheEntry{
+		Seq:        journal.seq,
+		Key:        cacheKey[:],
+		Expiration: cachedResponse.expiration.UnixNano(),
+		Packet:     packet,
+	}
+	if len(journal.entries) < HAPeeringCacheJournalSize {
+		journal.entries = append(journal.entries, entry)
+	} else {
+		journal.entries[(journal.seq-1)%HAPeeringCacheJournalSize] = entry
+	}
+}
+
+func (journal *haCacheJournal) since(seq uint64) ([]haCacheEntry, uint64) {
+	journal.Lock()
+	defer journal.Unlock()
+	if seq > journal.seq {
+		// The peer was restarted
+		seq = 0
+	}
+	entries := make([]haCacheEntry, 0)
+	now := time.Now().UnixNano()
+	for _, entry := range journal.entries {
+		if entry.Seq > seq && entry.Expiration > now {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, journal.seq
+}
+
+func (haPeering *HAPeering) sign(data []byte) string {
+	mac := hmac.New(sha256.New, haPeering.key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (haPeering *HAPeering) verify(data []byte, signature string) bool {
+	return hmac.Equal([]byte(haPeering.sign(data)), []byte(signature))
+}
+
+// seal encrypts a state; the request parameters are authenticated, so that it cannot be replayed
+// in response to another request
+func (haPeering *HAPeering) seal(state []byte, request string) ([]byte, error) {
+	nonce := make([]byte, haPeering.aead.NonceSize(), haPeering.aead.NonceSize()+len(state)+haPeering.aead.Overhead())
+	if _, err := crypto_rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return haPeering.aead.Seal(nonce, nonce, state, []byte(request)), nil
+}
+
+func (haPeering *HAPeering) open(sealed []byte, request string) ([]byte, error) {
+	if len(sealed) < haPeering.aead.NonceSize() {
+		return nil, errors.New("State too short")
+	}
+	nonce, ciphertext := sealed[:haPeering.aead.NonceSize()], sealed[haPeering.aead.NonceSize():]
+	return haPeering.aead.Open(nil, nonce, ciphertext, []byte(request))
+}
+
+func (haPeering *HAPeering) localState(proxy *Proxy, cacheSeq uint64) *haState {
+	state := &haState{Node: proxy.nodeName}
+	now := time.Now()
+	proxy.serversInfo.RLock()
+	for _, serverInfo := range proxy.serversInfo.inner {
+		state.Servers = append(state.Servers, haServerState{
+			Name:       serverInfo.Name,
+			RTT:        serverInfo.rtt.Value(),
+			LastUsedMs: now.Sub(serverInfo.lastActionTS).Milliseconds(),
+		})
+	}
+	proxy.serversInfo.RUnlock()
+	if haPeering.journal != nil {
+		state.Cache, state.CacheSeq = haPeering.journal.since(cacheSeq)
+	}
+	return state
+}
+
+func (haPeering *HAPeering) handle(proxy *Proxy, writer http.ResponseWriter, request *http.Request) {
+	ts := request.URL.Query().Get("ts")
+	since := request.URL.Query().Get("since")
+	nonce := request.URL.Query().Get("nonce")
+	signed := ts + "|" + since + "|" + nonce
+	tsValue, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(nonce) != HAPeeringNonceLen*2 || !haPeering.verify([]byte(signed), request.Header.Get("X-HA-Signature")) {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if skew := time.Since(time.Unix(tsValue, 0)); skew > HAPeeringMaxClockSkew || skew < -HAPeeringMaxClockSkew {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+	seq, _ := strconv.ParseUint(since, 10, 64)
+	body, err := json.Marshal(haPeering.localState(proxy, seq))
+	if err == nil {
+		body, err = haPeering.seal(body, signed)
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Write(body)
+}
+
+func (haPeering *HAPeering) fetchPeerState() (*haState, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	since := strconv.FormatUint(haPeering.peerSeq, 10)
+	nonceBin := make([]byte, HAPeeringNonceLen)
+	if _, err := crypto_rand.Read(nonceBin); err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(nonceBin)
+	signed := ts + "|" + since + "|" + nonce
+	request, err := http.NewRequest("GET", haPeering.peerURL+"?ts="+ts+"&since="+since+"&nonce="+nonce, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-HA-Signature", haPeering.sign([]byte(signed)))
+	response, err := haPeering.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Peer returned status code %d", response.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, HAPeeringMaxStateSize))
+	if err != nil {
+		return nil, err
+	}
+	if body, err = haPeering.open(body, signed); err != nil {
+		return nil, errors.New("Unable to decrypt the state - Check that both instances use the same shared key")
+	}
+	state := &haState{}
+	if err := json.Unmarshal(body, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// applyPeerState adopts the RTTs measured by the peer for the servers that haven't been used locally
+// during the last sync interval, and adds the entries recently cached by the peer to the local cache
+func (haPeering *HAPeering) applyPeerState(proxy *Proxy, state *haState) {
+	peerServers := make(map[string]haServerState, len(state.Servers))
+	for _, server := range state.Servers {
+		peerServers[server.Name] = server
+	}
+	updated := 0
+	now := time.Now()
+	proxy.serversInfo.Lock()
+	for _, serverInfo := range proxy.serversInfo.inner {
+		peerServer, found := peerServers[serverInfo.Name]
+		if !found || peerServer.RTT <= 0 || now.Sub(serverInfo.lastActionTS) < haPeering.syncInterval ||
+			time.Duration(peerServer.LastUsedMs)*time.Millisecond >= haPeering.syncInterval {
+			continue
+		}
+		serverInfo.rtt.Set(peerServer.RTT)
+		updated++
+	}
+	if updated > 0 && !proxy.serversInfo.deterministic {
+		sort.SliceStable(proxy.serversInfo.inner, func(i, j int) bool {
+			return proxy.serversInfo.inner[i].rtt.Value() < proxy.serversInfo.inner[j].rtt.Value()
+		})
+	}
+	proxy.serversInfo.Unlock()
+	imported := 0
+	for _, entry := range state.Cache {
+		if len(entry.Key) != 32 {
+			continue
+		}
+		cachedResponse := CachedResponse{expiration: monotonicExpiration(time.Unix(0, entry.Expiration))}
+		if cachedResponse.expiration.Before(now) || cachedResponse.msg.Unpack(entry.Packet) != nil {
+			continue
+		}
+		var cacheKey [32]byte
+		copy(cacheKey[:], entry.Key)
+		proxy.cachedResponses.store(cacheKey, cachedResponse, haPeering.cacheSize)
+		imported++
+	}
+	haPeering.peerSeq = state.CacheSeq
+	if updated > 0 || imported > 0 {
+		dlog.Debugf("HA peering: %d server rankings and %d cache entries received from [%s]", updated, imported, haPeering.peerLabel(state))
+	}
+}
+
+func (haPeering *HAPeering) peerLabel(state *haState) string {
+	if len(state.Node) > 0 {
+		return state.Node
+	}
+	return haPeering.peerURL
+}
+
+func (haPeering *HAPeering) syncLoop(proxy *Proxy) {
+	reachable := true
+	for {
+		select {
+		case <-proxy.quit:
+			return
+		case <-time.After(haPeering.syncInterval):
+		}
+		state, err := haPeering.fetchPeerState()
+		if err != nil {
+			if reachable {
+				dlog.Warnf("HA peering: unable to fetch the state of the peer: %v", err)
+				reachable = false
+			}
+			continue
+		}
+		if !reachable {
+			dlog.Notice("HA peering: the peer is reachable again")
+			reachable = true
+		}
+		haPeering.applyPeerState(proxy, state)
+	}
+}
+
+func (haPeering *HAPeering) start(proxy *Proxy) error {
+	listener, err := net.Listen("tcp", haPeering.listenAddress)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(HAPeeringPath, func(writer http.ResponseWriter, request *http.Request) {
+		haPeering.handle(proxy, writer, request)
+	})
+	server := &http.Server{Handler: proxy.httpAccessLog.wrap("ha_peering", mux), ReadTimeout: 10 * time.Second, WriteTimeout: 30 * time.Second}
+	go server.Serve(listener)
+	go func() {
+		<-proxy.quit
+		server.Close()
+	}()
+	go haPeering.syncLoop(proxy)
+	dlog.Noticef("HA peering: listening on [%s], peer: [%s]", haPeering.listenAddress, haPeering.peerURL)
+	return nil
+}
+
+// noticeCached records a response that has just been cached, so that it can be sent to the peer
+func (haPeering *HAPeering) noticeCached(cacheKey [32]byte, cachedResponse *CachedResponse) {
+	if haPeering.journal != nil {
+		haPeering.journal.add(cacheKey, cachedResponse)
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPAccessLog records the requests received by the HTTP endpoints, such as the local DoH server.
+// DNS queries are logged by the query log; this is about the HTTP requests themselves.
+type HTTPAccessLog struct {
+	logger io.Writer
+	format string
+}
+
+func NewHTTPAccessLog(logger io.Writer, format string) *HTTPAccessLog {
+	return &HTTPAccessLog{logger: logger, format: format}
+}
+
+type httpStatusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (recorder *httpStatusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *httpStatusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(data)
+	recorder.size += n
+	return n, err
+}
+
+// wrap returns a handler that logs the requests served by the given handler
+func (accessLog *HTTPAccessLog) wrap(endpoint string, handler http.Handler) http.Handler {
+	if accessLog == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &httpStatusRecorder{ResponseWriter: writer}
+		handler.ServeHTTP(recorder, request)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		accessLog.log(endpoint, request, recorder.status, recorder.size, time.Since(start))
+	})
+}
+
+func (accessLog *HTTPAccessLog) log(endpoint string, request *http.Request, status int, size int, duration time.Duration) {
+	client := request.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	var line string
+	if accessLog.format == "ltsv" {
+		line = fmt.Sprintf("time:%d\tendpoint:%s\thost:%s\tmethod:%s\tpath:%s\tproto:%s\tstatus:%d\tsize:%d\tduration:%d\n",
+			time.Now().Unix(), endpoint, client, request.Method, StringQuote(request.URL.Path), request.Proto, status, size, duration/time.Millisecond)
+	} else {
+		now := time.Now()
+		year, month, day := now.Date()
+		hour, minute, second := now.Clock()
+		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+		line = fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%dms\n",
+			tsStr, endpoint, client, request.Method, StringQuote(request.URL.Path), request.Proto, status, size, duration/time.Millisecond)
+	}
+	_, _ = accessLog.logger.Write([]byte(line))
+}
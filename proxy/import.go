@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+// importedSettings are the settings that could be extracted from the configuration of another DNS tool
+type importedSettings struct {
+	blockedNames       []string
+	allowedNames       []string
+	cloakingRules      []string
+	forwardingRules    []string
+	blockLists         []string
+	servers            []importedServer
+	bootstrapResolvers []string
+	notes              []string
+}
+
+type importedServer struct {
+	name  string
+	stamp string
+}
+
+// importers convert the configuration found at a path (a file or a directory, depending on the tool)
+var importers = map[string]func(path string, settings *importedSettings) error{
+	"pihole":      importPihole,
+	"adguardhome": importAdGuardHome,
+	"unbound":     importUnbound,
+}
+
+const (
+	importedBlockedNamesFile    = "imported-blocked-names.txt"
+	importedAllowedNamesFile    = "imported-allowed-names.txt"
+	importedCloakingRulesFile   = "imported-cloaking-rules.txt"
+	importedForwardingRulesFile = "imported-forwarding-rules.txt"
+)
+
+func (settings *importedSettings) note(format string, args ...interface{}) {
+	settings.notes = append(settings.notes, fmt.Sprintf(format, args...))
+}
+
+// importPlainResolver normalizes a plain DNS resolver address, as used in forwarding rules.
+// Addresses can include a port, as `ip:port`, `[ipv6]:port`, `ip#port` or `ip@port`.
+func importPlainResolver(address string) (string, bool) {
+	address = strings.TrimPrefix(strings.TrimPrefix(address, "udp://"), "tcp://")
+	port := ""
+	if i := strings.LastIndexAny(address, "#@"); i > 0 {
+		address, port = address[:i], address[i+1:]
+	} else if host, xport, err := net.SplitHostPort(address); err == nil {
+		address, port = host, xport
+	}
+	ip := ParseIP(strings.Trim(address, "[]"))
+	if ip == nil {
+		return "", false
+	}
+	if len(port) > 0 {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", false
+		}
+	} else {
+		port = "53"
+	}
+	return net.JoinHostPort(ip.String(), port), true
+}
+
+// importUpstream adds a default upstream server. Encrypted servers are added as static servers,
+// plain DNS resolvers can only be used as bootstrap resolvers.
+func (settings *importedSettings) importUpstream(upstream string) {
+	upstream = strings.TrimSpace(upstream)
+	if len(upstream) == 0 {
+		return
+	}
+	if strings.HasPrefix(upstream, "sdns://") {
+		if _, err := stamps.NewServerStampFromString(upstream); err != nil {
+			settings.note("Invalid stamp for the upstream server [%s]: %v", upstream, err)
+			return
+		}
+		settings.addServer(upstream)
+		return
+	}
+	if strings.HasPrefix(upstream, "https://") {
+		upstreamURL, err := url.Parse(upstream)
+		if err != nil || len(upstreamURL.Host) == 0 {
+			settings.note("Invalid URL for the upstream server [%s]", upstream)
+			return
+		}
+		path := upstreamURL.Path
+		if len(path) == 0 {
+			path = "/dns-query"
+		}
+		stamp := stamps.ServerStamp{
+			Proto:        stamps.StampProtoTypeDoH,
+			ProviderName: upstreamURL.Host,
+			Path:         path,
+		}
+		settings.addServer(stamp.String())
+		return
+	}
+	if resolver, ok := importPlainResolver(upstream); ok {
+		if !includesName(settings.bootstrapResolvers, resolver) {
+			settings.bootstrapResolvers = append(settings.bootstrapResolvers, resolver)
+		}
+		settings.note("The plain DNS upstream [%s] was added as a bootstrap resolver, not as a server", upstream)
+		return
+	}
+	settings.note("Unsupported upstream server: [%s]", upstream)
+}
+
+func (settings *importedSettings) addServer(stamp string) {
+	for _, server := range settings.servers {
+		if server.stamp == stamp {
+			return
+		}
+	}
+	name := fmt.Sprintf("imported-%d", len(settings.servers)+1)
+	settings.servers = append(settings.servers, importedServer{name: name, stamp: stamp})
+}
+
+// importForwarding adds a forwarding rule for a domain, with plain DNS resolvers only
+func (settings *importedSettings) importForwarding(domain string, upstreams []string) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if len(domain) == 0 {
+		return
+	}
+	var resolvers []string
+	for _, upstream := range upstreams {
+		if resolver, ok := importPlainResolver(upstream); ok {
+			resolvers = append(resolvers, resolver)
+		} else {
+			settings.note("Only plain DNS resolvers can be used to forward [%s], [%s] was ignored", domain, upstream)
+		}
+	}
+	if len(resolvers) > 0 {
+		settings.forwardingRules = append(settings.forwardingRules, domain+" "+strings.Join(resolvers, ","))
+	}
+}
+
+// importCloaking adds a cloaking rule for an exact name
+func (settings *importedSettings) importCloaking(name string, target string) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	target = strings.TrimSuffix(strings.TrimSpace(target), ".")
+	if len(name) == 0 || len(target) == 0 {
+		return
+	}
+	if !strings.HasPrefix(name, "*.") {
+		name = "=" + name
+	}
+	settings.cloakingRules = append(settings.cloakingRules, name+" "+target)
+}
+
+type importedRulesFile struct {
+	file    string
+	content string
+}
+
+func newImportedRulesFile(file string, tool string, title string, rules []string) importedRulesFile {
+	rules = uniqueStrings(rules)
+	content := fmt.Sprintf("# %s, imported from %s\n\n%s\n", title, tool, strings.Join(rules, "\n"))
+	return importedRulesFile{file: file, content: content}
+}
+
+// writeImportedRules writes all the rule files, or none of them: existing files are never replaced,
+// and the files already written are removed if one of them cannot be written
+func writeImportedRules(rulesFiles []importedRulesFile) error {
+	for _, rulesFile := range rulesFiles {
+		if _, err := os.Stat(rulesFile.file); err == nil {
+			return fmt.Errorf("[%s] already exists", rulesFile.file)
+		}
+	}
+	for i, rulesFile := range rulesFiles {
+		if err := os.WriteFile(rulesFile.file, []byte(rulesFile.content), 0o644); err != nil {
+			for _, written := range rulesFiles[:i] {
+				os.Remove(written.file)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func uniqueStrings(strs []string) []string {
+	seen := make(map[string]bool, len(strs))
+	unique := make([]string, 0, len(strs))
+	for _, str := range strs {
+		if !seen[str] {
+			seen[str] = true
+			unique = append(unique, str)
+		}
+	}
+	return unique
+}
+
+// Import converts the configuration of another DNS tool: rule files are written to outputDir,
+// and the settings to add to the configuration file are printed
+func Import(tool string, path string, outputDir string, out io.Writer) error {
+	tool = strings.ToLower(tool)
+	importer, found := importers[tool]
+	if !found {
+		supported := make([]string, 0, len(importers))
+		for name := range importers {
+			supported = append(supported, name)
+		}
+		sort.Strings(supported)
+		return fmt.Errorf("Unsupported tool: [%s] - Supported tools: %s", tool, strings.Join(supported, ", "))
+	}
+	settings := &importedSettings{}
+	if err := importer(path, settings); err != nil {
+		return err
+	}
+
+	var config strings.Builder
+	var rulesFiles []importedRulesFile
+	fmt.Fprintf(&config, "## Settings imported from %s [%s]\n\n", tool, path)
+	if len(settings.servers) > 0 {
+		names := make([]string, len(settings.servers))
+		for i, server := range settings.servers {
+			names[i] = strconv.Quote(server.name)
+		}
+		fmt.Fprintf(&config, "server_names = [%s]\n", strings.Join(names, ", "))
+	}
+	if len(settings.bootstrapResolvers) > 0 {
+		fmt.Fprintf(&config, "bootstrap_resolvers = ['%s']\n", strings.Join(settings.bootstrapResolvers, "', '"))
+	}
+	for _, rules := range []struct {
+		rules []string
+		file  string
+		title string
+		key   string
+	}{
+		{settings.cloakingRules, importedCloakingRulesFile, "Cloaking rules", "cloaking_rules"},
+		{settings.forwardingRules, importedForwardingRulesFile, "Forwarding rules", "forwarding_rules"},
+	} {
+		if len(rules.rules) == 0 {
+			continue
+		}
+		file := filepath.Join(outputDir, rules.file)
+		rulesFiles = append(rulesFiles, newImportedRulesFile(file, tool, rules.title, rules.rules))
+		fmt.Fprintf(&config, "%s = '%s'\n", rules.key, file)
+	}
+	if len(settings.blockedNames) > 0 {
+		file := filepath.Join(outputDir, importedBlockedNamesFile)
+		rulesFiles = append(rulesFiles, newImportedRulesFile(file, tool, "Blocked names", settings.blockedNames))
+		fmt.Fprintf(&config, "\n[blocked_names]\n  blocked_names_file = '%s'\n", file)
+	}
+	if len(settings.allowedNames) > 0 {
+		file := filepath.Join(outputDir, importedAllowedNamesFile)
+		rulesFiles = append(rulesFiles, newImportedRulesFile(file, tool, "Allowed names", settings.allowedNames))
+		fmt.Fprintf(&config, "\n[allowed_names]\n  allowed_names_file = '%s'\n", file)
+	}
+	if blockLists := uniqueStrings(settings.blockLists); len(blockLists) > 0 {
+		fmt.Fprintf(&config, "\n[lists]\n")
+		for i, blockList := range blockLists {
+			fmt.Fprintf(&config, "  [lists.imported-%d]\n    urls = [%s]\n", i+1, strconv.Quote(blockList))
+		}
+	}
+	if len(settings.servers) > 0 {
+		fmt.Fprintf(&config, "\n[static]\n")
+		for _, server := range settings.servers {
+			fmt.Fprintf(&config, "  [static.%s]\n    stamp = '%s'\n", strconv.Quote(server.name), server.stamp)
+		}
+	}
+	if err := writeImportedRules(rulesFiles); err != nil {
+		return err
+	}
+	fmt.Fprint(out, config.String())
+	if len(settings.notes) > 0 {
+		fmt.Fprintf(out, "\n## Notes:\n")
+		for _, note := range uniqueStrings(settings.notes) {
+			fmt.Fprintf(out, "## - %s\n", note)
+		}
+	}
+	return nil
+}
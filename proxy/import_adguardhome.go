@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// importAdGuardHome reads an AdGuardHome.yaml configuration file
+func importAdGuardHome(file string, settings *importedSettings) error {
+	if info, err := os.Stat(file); err == nil && info.IsDir() {
+		file = file + string(os.PathSeparator) + "AdGuardHome.yaml"
+	}
+	content, err := ReadTextFile(file)
+	if err != nil {
+		return err
+	}
+	config, err := parseYAMLSubset(content)
+	if err != nil {
+		return fmt.Errorf("[%s]: %v", file, err)
+	}
+	dnsConfig := yamlMap(config["dns"])
+	for _, upstream := range yamlStrings(dnsConfig["upstream_dns"]) {
+		importAdGuardHomeUpstream(upstream, settings)
+	}
+	if upstreamFile, ok := dnsConfig["upstream_dns_file"].(string); ok && len(upstreamFile) > 0 {
+		if content, err := ReadTextFile(upstreamFile); err == nil {
+			for _, line := range strings.Split(content, "\n") {
+				importAdGuardHomeUpstream(TrimAndStripInlineComments(line), settings)
+			}
+		} else {
+			settings.note("The upstream servers file [%s] could not be read: %v", upstreamFile, err)
+		}
+	}
+	for _, bootstrap := range yamlStrings(dnsConfig["bootstrap_dns"]) {
+		if resolver, ok := importPlainResolver(bootstrap); ok && !includesName(settings.bootstrapResolvers, resolver) {
+			settings.bootstrapResolvers = append(settings.bootstrapResolvers, resolver)
+		}
+	}
+	for _, filter := range yamlList(config["filters"]) {
+		filter := yamlMap(filter)
+		url, _ := filter["url"].(string)
+		if filter["enabled"] != "true" || len(url) == 0 {
+			continue
+		}
+		if strings.HasPrefix(url, "/") {
+			url = "file:" + url
+		}
+		settings.blockLists = append(settings.blockLists, url)
+	}
+	for _, filter := range yamlList(config["whitelist_filters"]) {
+		if url, _ := yamlMap(filter)["url"].(string); len(url) > 0 {
+			settings.note("The allowlist [%s] cannot be subscribed to - Download it and add its content to the allowed names", url)
+		}
+	}
+	unsupportedRules := 0
+	for _, rule := range yamlStrings(config["user_rules"]) {
+		rule = strings.TrimSpace(rule)
+		if len(rule) == 0 || rule[0] == '!' || rule[0] == '#' {
+			continue
+		}
+		if allowed, found := strings.CutPrefix(rule, "@@"); found {
+			if names := parseBlockList(allowed); len(names) > 0 {
+				settings.allowedNames = append(settings.allowedNames, names...)
+				continue
+			}
+		} else if names := parseBlockList(rule); len(names) > 0 {
+			settings.blockedNames = append(settings.blockedNames, names...)
+			continue
+		}
+		unsupportedRules++
+	}
+	if unsupportedRules > 0 {
+		settings.note("%d user rules use a syntax that is not supported, and have not been imported", unsupportedRules)
+	}
+	// Rewrites were moved from the dns section to the filtering section in recent versions
+	rewrites := yamlList(dnsConfig["rewrites"])
+	rewrites = append(rewrites, yamlList(yamlMap(config["filtering"])["rewrites"])...)
+	for _, rewrite := range rewrites {
+		rewrite := yamlMap(rewrite)
+		domain, _ := rewrite["domain"].(string)
+		answer, _ := rewrite["answer"].(string)
+		if answer == "A" || answer == "AAAA" {
+			continue
+		}
+		settings.importCloaking(domain, answer)
+	}
+	return nil
+}
+
+// importAdGuardHomeUpstream imports an upstream server, optionally restricted to some domains: `[/example.com/]<upstream>`
+func importAdGuardHomeUpstream(upstream string, settings *importedSettings) {
+	if !strings.HasPrefix(upstream, "[/") {
+		settings.importUpstream(upstream)
+		return
+	}
+	domains, upstreams, found := strings.Cut(upstream[2:], "/]")
+	if !found {
+		settings.note("Unsupported upstream server: [%s]", upstream)
+		return
+	}
+	if upstreams == "#" {
+		return
+	}
+	for _, domain := range strings.Split(domains, "/") {
+		settings.importForwarding(domain, strings.Fields(upstreams))
+	}
+}
+
+// A minimal YAML parser, for the subset used by AdGuard Home: block mappings and sequences,
+// plain and quoted scalars, and empty or single-line flow sequences.
+// Values are returned as map[string]interface{}, []interface{} and string.
+
+type yamlLine struct {
+	indent int
+	text   string
+	lineNo int
+}
+
+func parseYAMLSubset(content string) (map[string]interface{}, error) {
+	var lines []yamlLine
+	for lineNo, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(yamlStripComment(line), " \t\r")
+		text := strings.TrimLeft(line, " ")
+		if len(text) == 0 || text == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{indent: len(line) - len(text), text: text, lineNo: lineNo + 1})
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	node, next, err := yamlParseBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(lines) {
+		return nil, fmt.Errorf("Unexpected indentation at line %d", lines[next].lineNo)
+	}
+	config, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("The document is not a mapping")
+	}
+	return config, nil
+}
+
+func yamlStripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func yamlIsSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func yamlParseBlock(lines []yamlLine, i int, indent int) (interface{}, int, error) {
+	if yamlIsSequenceItem(lines[i].text) {
+		return yamlParseSequence(lines, i, indent)
+	}
+	return yamlParseMapping(lines, i, indent)
+}
+
+func yamlParseSequence(lines []yamlLine, i int, indent int) (interface{}, int, error) {
+	sequence := []interface{}{}
+	for i < len(lines) && lines[i].indent == indent && yamlIsSequenceItem(lines[i].text) {
+		item := strings.TrimLeft(strings.TrimPrefix(lines[i].text, "-"), " ")
+		if len(item) == 0 {
+			if i+1 < len(lines) && lines[i+1].indent > indent {
+				node, next, err := yamlParseBlock(lines, i+1, lines[i+1].indent)
+				if err != nil {
+					return nil, i, err
+				}
+				sequence = append(sequence, node)
+				i = next
+			} else {
+				sequence = append(sequence, "")
+				i++
+			}
+			continue
+		}
+		if _, _, isKey := yamlSplitKey(item); isKey {
+			// A mapping starting on the same line as the dash
+			itemIndent := indent + len(lines[i].text) - len(item)
+			lines[i] = yamlLine{indent: itemIndent, text: item, lineNo: lines[i].lineNo}
+			node, next, err := yamlParseMapping(lines, i, itemIndent)
+			if err != nil {
+				return nil, i, err
+			}
+			sequence = append(sequence, node)
+			i = next
+			continue
+		}
+		sequence = append(sequence, yamlScalar(item))
+		i++
+	}
+	return sequence, i, nil
+}
+
+func yamlParseMapping(lines []yamlLine, i int, indent int) (interface{}, int, error) {
+	mapping := map[string]interface{}{}
+	for i < len(lines) && lines[i].indent == indent && !yamlIsSequenceItem(lines[i].text) {
+		key, value, isKey := yamlSplitKey(lines[i].text)
+		if !isKey {
+			return nil, i, fmt.Errorf("Unsupported syntax at line %d", lines[i].lineNo)
+		}
+		i++
+		if len(value) > 0 {
+			mapping[key] = yamlScalar(value)
+			continue
+		}
+		if i < len(lines) && (lines[i].indent > indent || (lines[i].indent == indent && yamlIsSequenceItem(lines[i].text))) {
+			node, next, err := yamlParseBlock(lines, i, lines[i].indent)
+			if err != nil {
+				return nil, i, err
+			}
+			mapping[key] = node
+			i = next
+		} else {
+			mapping[key] = ""
+		}
+	}
+	return mapping, i, nil
+}
+
+func yamlSplitKey(text string) (string, string, bool) {
+	if len(text) == 0 || text[0] == '\'' || text[0] == '"' || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	if key, found := strings.CutSuffix(text, ":"); found && !strings.Contains(key, ": ") {
+		return key, "", true
+	}
+	key, value, found := strings.Cut(text, ": ")
+	return key, strings.TrimSpace(value), found
+}
+
+func yamlScalar(value interface{}) interface{} {
+	str, ok := value.(string)
+	if !ok {
+		return value
+	}
+	if len(str) >= 2 && str[0] == '[' && str[len(str)-1] == ']' {
+		sequence := []interface{}{}
+		for _, item := range strings.Split(str[1:len(str)-1], ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				sequence = append(sequence, yamlScalar(item))
+			}
+		}
+		return sequence
+	}
+	if len(str) >= 2 && str[0] == '\'' && str[len(str)-1] == '\'' {
+		return strings.ReplaceAll(str[1:len(str)-1], "''", "'")
+	}
+	if len(str) >= 2 && str[0] == '"' && str[len(str)-1] == '"' {
+		if unquoted, err := strconv.Unquote(str); err == nil {
+			return unquoted
+		}
+		return str[1 : len(str)-1]
+	}
+	return str
+}
+
+func yamlMap(node interface{}) map[string]interface{} {
+	mapping, _ := node.(map[string]interface{})
+	return mapping
+}
+
+func yamlList(node interface{}) []interface{} {
+	sequence, _ := node.([]interface{})
+	return sequence
+}
+
+func yamlStrings(node interface{}) []string {
+	var strs []string
+	for _, item := range yamlList(node) {
+		if str, ok := item.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
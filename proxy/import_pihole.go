@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// importPihole reads a Pi-hole configuration directory, usually /etc/pihole.
+// Pi-hole 6 keeps its settings in pihole.toml; older versions use setupVars.conf and plain lists.
+func importPihole(dir string, settings *importedSettings) error {
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	found := false
+	if content, err := ReadTextFile(filepath.Join(dir, "pihole.toml")); err == nil {
+		if err := importPiholeTOML(content, settings); err != nil {
+			return err
+		}
+		found = true
+	}
+	if content, err := ReadTextFile(filepath.Join(dir, "setupVars.conf")); err == nil {
+		importPiholeSetupVars(content, settings)
+		found = true
+	}
+	if content, err := ReadTextFile(filepath.Join(dir, "custom.list")); err == nil {
+		for _, line := range strings.Split(content, "\n") {
+			importPiholeHost(TrimAndStripInlineComments(line), settings)
+		}
+		found = true
+	}
+	for _, cnameFile := range []string{
+		filepath.Join(dir, "..", "dnsmasq.d", "05-pihole-custom-cname.conf"),
+		filepath.Join(dir, "05-pihole-custom-cname.conf"),
+	} {
+		if content, err := ReadTextFile(cnameFile); err == nil {
+			for _, line := range strings.Split(content, "\n") {
+				if cname, found := strings.CutPrefix(TrimAndStripInlineComments(line), "cname="); found {
+					importPiholeCNAME(cname, settings)
+				}
+			}
+			found = true
+			break
+		}
+	}
+	if content, err := ReadTextFile(filepath.Join(dir, "adlists.list")); err == nil {
+		for _, line := range strings.Split(content, "\n") {
+			if line = TrimAndStripInlineComments(line); strings.Contains(line, "://") {
+				settings.blockLists = append(settings.blockLists, line)
+			}
+		}
+		found = true
+	}
+	for _, list := range []struct {
+		file  string
+		names *[]string
+	}{
+		{"blacklist.txt", &settings.blockedNames},
+		{"whitelist.txt", &settings.allowedNames},
+	} {
+		if content, err := ReadTextFile(filepath.Join(dir, list.file)); err == nil {
+			for _, line := range strings.Split(content, "\n") {
+				if line = strings.ToLower(TrimAndStripInlineComments(line)); len(line) > 0 {
+					*list.names = append(*list.names, "="+line)
+				}
+			}
+			found = true
+		}
+	}
+	for _, regexFile := range []string{"regex.list", "whitelist.regex"} {
+		if _, err := os.Stat(filepath.Join(dir, regexFile)); err == nil {
+			settings.note("Regular expressions from [%s] are not supported and have not been imported", regexFile)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gravity.db")); err == nil {
+		settings.note("Lists and domains stored in gravity.db cannot be imported - Add the lists to the [lists] section")
+	}
+	if !found {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func importPiholeTOML(content string, settings *importedSettings) error {
+	var config struct {
+		DNS struct {
+			Upstreams    []string `toml:"upstreams"`
+			Hosts        []string `toml:"hosts"`
+			CNAMERecords []string `toml:"cnameRecords"`
+			RevServers   []string `toml:"revServers"`
+		} `toml:"dns"`
+	}
+	if _, err := toml.Decode(content, &config); err != nil {
+		return err
+	}
+	for _, upstream := range config.DNS.Upstreams {
+		settings.importUpstream(upstream)
+	}
+	for _, host := range config.DNS.Hosts {
+		importPiholeHost(host, settings)
+	}
+	for _, cname := range config.DNS.CNAMERecords {
+		importPiholeCNAME(cname, settings)
+	}
+	// Conditional forwarding: "<enabled>,<network>,<resolver>,<domain>"
+	for _, revServer := range config.DNS.RevServers {
+		parts := strings.Split(revServer, ",")
+		if len(parts) == 4 && parts[0] == "true" {
+			settings.importForwarding(parts[3], []string{parts[2]})
+		}
+	}
+	return nil
+}
+
+func importPiholeSetupVars(content string, settings *importedSettings) {
+	vars := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		if key, value, found := strings.Cut(strings.TrimSpace(line), "="); found {
+			vars[key] = strings.Trim(value, `"'`)
+		}
+	}
+	for i := 1; ; i++ {
+		upstream, found := vars["PIHOLE_DNS_"+strconv.Itoa(i)]
+		if !found {
+			break
+		}
+		settings.importUpstream(upstream)
+	}
+	if vars["REV_SERVER"] == "true" && len(vars["REV_SERVER_DOMAIN"]) > 0 {
+		settings.importForwarding(vars["REV_SERVER_DOMAIN"], []string{vars["REV_SERVER_TARGET"]})
+	}
+}
+
+// importPiholeHost imports a local DNS record, in the hosts file format
+func importPiholeHost(line string, settings *importedSettings) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || ParseIP(fields[0]) == nil {
+		return
+	}
+	for _, name := range fields[1:] {
+		settings.importCloaking(name, fields[0])
+	}
+}
+
+// importPiholeCNAME imports a local CNAME record: "<alias>[,<alias>...],<target>[,<ttl>]"
+func importPiholeCNAME(line string, settings *importedSettings) {
+	parts := strings.Split(line, ",")
+	if last := parts[len(parts)-1]; len(parts) > 2 && len(last) > 0 && isDigit(last[0]) {
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) < 2 {
+		return
+	}
+	for _, alias := range parts[:len(parts)-1] {
+		settings.importCloaking(alias, parts[len(parts)-1])
+	}
+}
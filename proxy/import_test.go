@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAMLSubset(t *testing.T) {
+	for _, test := range []struct {
+		yaml     string
+		expected map[string]interface{}
+		err      bool
+	}{
+		{yaml: "", expected: map[string]interface{}{}},
+		{yaml: "---\n# comment\n", expected: map[string]interface{}{}},
+		{
+			yaml:     "a: 1\nb: 'x # y'\nc: \"q\\tz\" # comment\nd:\n",
+			expected: map[string]interface{}{"a": "1", "b": "x # y", "c": "q\tz", "d": ""},
+		},
+		{
+			yaml: "dns:\n  port: 53\n  upstream_dns:\n    - 9.9.9.9\n    - '[/lan/]192.168.1.1'\n  empty: []\n",
+			expected: map[string]interface{}{"dns": map[string]interface{}{
+				"port":         "53",
+				"upstream_dns": []interface{}{"9.9.9.9", "[/lan/]192.168.1.1"},
+				"empty":        []interface{}{},
+			}},
+		},
+		{
+			yaml: "list:\n- a\n- b\nflow: [x, 'y', \"z\"]\n",
+			expected: map[string]interface{}{
+				"list": []interface{}{"a", "b"},
+				"flow": []interface{}{"x", "y", "z"},
+			},
+		},
+		{
+			yaml: "filters:\n  - enabled: true\n    url: https://example.com/list.txt\n  - enabled: false\n    url: 'it''s'\n",
+			expected: map[string]interface{}{"filters": []interface{}{
+				map[string]interface{}{"enabled": "true", "url": "https://example.com/list.txt"},
+				map[string]interface{}{"enabled": "false", "url": "it's"},
+			}},
+		},
+		{yaml: "- a\n- b\n", err: true},
+		{yaml: "a: 1\n  b: 2\n", err: true},
+		{yaml: "a: 1\njust text\n", err: true},
+	} {
+		parsed, err := parseYAMLSubset(test.yaml)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: error expected", test.yaml)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.yaml, err)
+		} else if !reflect.DeepEqual(parsed, test.expected) {
+			t.Errorf("%q: got %#v, expected %#v", test.yaml, parsed, test.expected)
+		}
+	}
+}
+
+func TestImporters(t *testing.T) {
+	for _, test := range []struct {
+		tool     string
+		path     string
+		expected importedSettings
+		notes    int
+	}{
+		{
+			tool: "pihole",
+			path: "pihole5",
+			expected: importedSettings{
+				blockedNames: []string{"=ads.example.com", "=tracker.example.net"},
+				allowedNames: []string{"=s.youtube.com"},
+				cloakingRules: []string{
+					"=nas.lan 192.168.1.10", "=printer.lan 192.168.1.11", "=printer 192.168.1.11", "=nas.lan fd00::10",
+					"=media.lan nas.lan", "=www.lan nas.lan", "=intranet.lan nas.lan",
+				},
+				forwardingRules: []string{"lan 192.168.1.1:53"},
+				blockLists: []string{
+					"https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts",
+					"https://v.firebog.net/hosts/AdguardDNS.txt",
+				},
+				bootstrapResolvers: []string{"9.9.9.9:53", "149.112.112.112:53", "127.0.0.1:5335"},
+			},
+			notes: 4,
+		},
+		{
+			tool: "pihole",
+			path: "pihole6",
+			expected: importedSettings{
+				cloakingRules: []string{
+					"=nas.lan 192.168.1.10", "=media.lan 192.168.1.20", "=jellyfin.lan 192.168.1.20", "=photos.lan nas.lan",
+				},
+				forwardingRules:    []string{"lan 192.168.1.1:53"},
+				bootstrapResolvers: []string{"1.1.1.1:53", "[2606:4700:4700::1111]:53", "127.0.0.1:5335"},
+			},
+			notes: 3,
+		},
+		{
+			tool: "adguardhome",
+			path: "AdGuardHome.yaml",
+			expected: importedSettings{
+				blockedNames:    []string{"doubleclick.example", "tracker.example"},
+				allowedNames:    []string{"safe.example"},
+				cloakingRules:   []string{"=nas.lan 192.168.1.10", "*.dev.lan 192.168.1.30", "=www.lan nas.lan"},
+				forwardingRules: []string{"lan 192.168.1.1:53", "corp.example 10.0.0.53:5353,10.0.0.54:53"},
+				blockLists: []string{
+					"https://adguardteam.github.io/HostlistsRegistry/assets/filter_1.txt",
+					"file:/opt/adguardhome/lists/local.txt",
+				},
+				servers: []importedServer{
+					{name: "imported-1", stamp: "sdns://AgAAAAAAAAAAAAAPZG5zMTAucXVhZDkubmV0Ci9kbnMtcXVlcnk"},
+				},
+				bootstrapResolvers: []string{"8.8.8.8:53", "9.9.9.10:53", "149.112.112.10:53", "[2620:fe::10]:53"},
+			},
+			notes: 4,
+		},
+		{
+			tool: "unbound",
+			path: "unbound.conf",
+			expected: importedSettings{
+				blockedNames:       []string{"doubleclick.example", "ads.example"},
+				cloakingRules:      []string{"=nas.lan 192.168.1.10", "=nas.lan fd00::10", "=www.lan nas.lan"},
+				forwardingRules:    []string{"corp.example 10.0.0.53:5353", "home.arpa 192.168.1.1:53"},
+				bootstrapResolvers: []string{"9.9.9.9:53", "[2620:fe::fe]:53"},
+			},
+			notes: 6,
+		},
+	} {
+		settings := importedSettings{}
+		if err := importers[test.tool](filepath.Join("testdata", "import", test.path), &settings); err != nil {
+			t.Errorf("%s [%s]: %v", test.tool, test.path, err)
+			continue
+		}
+		if len(settings.notes) != test.notes {
+			t.Errorf("%s [%s]: %d notes instead of %d: %v", test.tool, test.path, len(settings.notes), test.notes, settings.notes)
+		}
+		settings.notes = nil
+		if !reflect.DeepEqual(settings, test.expected) {
+			t.Errorf("%s [%s]: got %#v, expected %#v", test.tool, test.path, settings, test.expected)
+		}
+	}
+}
+
+func TestImportPlainResolver(t *testing.T) {
+	for address, expected := range map[string]string{
+		"9.9.9.9":             "9.9.9.9:53",
+		"udp://9.9.9.9:5353":  "9.9.9.9:5353",
+		"127.0.0.1#5335":      "127.0.0.1:5335",
+		"10.0.0.53@5353":      "10.0.0.53:5353",
+		"[2620:fe::fe]:53":    "[2620:fe::fe]:53",
+		"2620:fe::fe":         "[2620:fe::fe]:53",
+		"dns.example":         "",
+		"9.9.9.9#dns.example": "",
+	} {
+		resolver, ok := importPlainResolver(address)
+		if ok != (len(expected) > 0) || resolver != expected {
+			t.Errorf("[%s]: got [%s], expected [%s]", address, resolver, expected)
+		}
+	}
+}
+
+func TestWriteImportedRules(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.txt")
+	rulesFiles := []importedRulesFile{
+		newImportedRulesFile(first, "test", "First", []string{"a", "b", "a"}),
+		newImportedRulesFile(filepath.Join(dir, "missing", "second.txt"), "test", "Second", []string{"c"}),
+	}
+	if err := writeImportedRules(rulesFiles); err == nil {
+		t.Fatal("writing to a missing directory should fail")
+	}
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Error("the files written before the failure should be removed")
+	}
+
+	if err := writeImportedRules(rulesFiles[:1]); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(content), "\na\nb\n") {
+		t.Errorf("unexpected content: %q", content)
+	}
+	if err := writeImportedRules(rulesFiles[:1]); err == nil {
+		t.Error("existing files should not be replaced")
+	}
+}
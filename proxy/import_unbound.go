@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// importUnbound reads an unbound.conf configuration file
+func importUnbound(file string, settings *importedSettings) error {
+	content, err := ReadTextFile(file)
+	if err != nil {
+		return err
+	}
+	var zone *unboundForwardZone
+	for _, line := range strings.Split(content, "\n") {
+		key, value, found := strings.Cut(TrimAndStripInlineComments(line), ":")
+		if !found {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.Trim(strings.TrimSpace(value), `"`)
+		switch key {
+		case "server", "remote-control", "python", "dynlib", "cachedb", "dnstap", "auth-zone", "view", "rpz":
+			zone.importTo(settings)
+			zone = nil
+		case "forward-zone", "stub-zone":
+			zone.importTo(settings)
+			zone = &unboundForwardZone{}
+		case "name":
+			if zone != nil {
+				zone.name = value
+			}
+		case "forward-addr", "stub-addr":
+			if zone != nil {
+				// "<ip>[@<port>][#<tls name>]"
+				addr, _, _ := strings.Cut(value, "#")
+				zone.addrs = append(zone.addrs, addr)
+			}
+		case "forward-host", "stub-host":
+			if zone != nil {
+				settings.note("Forwarding to host names is not supported, [%s] was ignored - Use an IP address instead", value)
+			}
+		case "forward-tls-upstream":
+			if zone != nil {
+				zone.tls = value == "yes"
+			}
+		case "local-data":
+			importUnboundLocalData(strings.Trim(value, "'"), settings)
+		case "local-zone":
+			importUnboundLocalZone(value, settings)
+		case "include", "include-toplevel":
+			settings.note("The included file [%s] has not been imported - Import it separately", value)
+		}
+	}
+	zone.importTo(settings)
+	return nil
+}
+
+type unboundForwardZone struct {
+	name  string
+	addrs []string
+	tls   bool
+}
+
+// importTo adds the zone as the default upstream servers for the root zone, or as a forwarding rule
+func (zone *unboundForwardZone) importTo(settings *importedSettings) {
+	if zone == nil || len(zone.name) == 0 {
+		return
+	}
+	if zone.tls {
+		settings.note("DNS-over-TLS is not supported, the resolvers for [%s] have not been imported", zone.name)
+		return
+	}
+	if zone.name == "." {
+		for _, addr := range zone.addrs {
+			settings.importUpstream(addr)
+		}
+		return
+	}
+	settings.importForwarding(zone.name, zone.addrs)
+}
+
+// importUnboundLocalData imports a local record: "<name> [<ttl>] [IN] <type> <value>"
+func importUnboundLocalData(record string, settings *importedSettings) {
+	fields := strings.Fields(record)
+	if len(fields) < 3 {
+		return
+	}
+	name, fields := fields[0], fields[1:]
+	if len(fields) > 2 && isDigit(fields[0][0]) {
+		fields = fields[1:]
+	}
+	if len(fields) > 2 && strings.EqualFold(fields[0], "IN") {
+		fields = fields[1:]
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "A", "AAAA", "CNAME":
+		if len(fields) == 2 {
+			settings.importCloaking(name, fields[1])
+		}
+	case "PTR":
+	default:
+		settings.note("Local %s records are not supported, [%s] was ignored", strings.ToUpper(fields[0]), record)
+	}
+}
+
+// importUnboundLocalZone imports a blocked zone: "<zone> <type>"
+func importUnboundLocalZone(localZone string, settings *importedSettings) {
+	fields := strings.Fields(localZone)
+	if len(fields) != 2 {
+		return
+	}
+	switch strings.Trim(fields[1], `"`) {
+	case "deny", "refuse", "always_refuse", "always_nxdomain", "always_null", "always_deny", "inform_deny":
+		if name := strings.TrimSuffix(strings.ToLower(strings.Trim(fields[0], `"`)), "."); len(name) > 0 {
+			settings.blockedNames = append(settings.blockedNames, name)
+		}
+	}
+}
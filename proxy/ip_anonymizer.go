@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IPAnonymizationNone     = "none"
+	IPAnonymizationTruncate = "truncate"
+	IPAnonymizationHash     = "hash"
+	IPAnonymizationOmit     = "omit"
+
+	IPAnonymizationIPv4Prefix = 24
+	IPAnonymizationIPv6Prefix = 56
+)
+
+type IPAnonymizer struct {
+	sync.Mutex
+	mode        string
+	keyRotation time.Duration
+	key         []byte
+	keyCreated  time.Time
+}
+
+func NewIPAnonymizer(mode string, keyRotation time.Duration) (*IPAnonymizer, error) {
+	mode = strings.ToLower(mode)
+	switch mode {
+	case "":
+		mode = IPAnonymizationNone
+	case IPAnonymizationNone, IPAnonymizationTruncate, IPAnonymizationHash, IPAnonymizationOmit:
+	default:
+		return nil, fmt.Errorf("Unsupported client IP anonymization mode: [%s]", mode)
+	}
+	return &IPAnonymizer{mode: mode, keyRotation: keyRotation}, nil
+}
+
+func (anonymizer *IPAnonymizer) Anonymize(ip net.IP) string {
+	switch anonymizer.mode {
+	case IPAnonymizationTruncate:
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(IPAnonymizationIPv4Prefix, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(IPAnonymizationIPv6Prefix, 128)).String()
+	case IPAnonymizationHash:
+		mac := hmac.New(sha256.New, anonymizer.currentKey())
+		mac.Write(ip.To16())
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	case IPAnonymizationOmit:
+		return "-"
+	default:
+		return ip.String()
+	}
+}
+
+// currentKey returns the HMAC key, replacing it once it gets older than the rotation delay,
+// so that hashed addresses can only be correlated within a rotation period
+func (anonymizer *IPAnonymizer) currentKey() []byte {
+	anonymizer.Lock()
+	defer anonymizer.Unlock()
+	now := time.Now()
+	if anonymizer.key == nil || (anonymizer.keyRotation > 0 && now.Sub(anonymizer.keyCreated) >= anonymizer.keyRotation) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		anonymizer.key, anonymizer.keyCreated = key, now
+	}
+	return anonymizer.key
+}
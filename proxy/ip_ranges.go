@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ipRange is an interval of addresses, IPv4 addresses being represented as IPv4-mapped IPv6 addresses
+type ipRange struct {
+	first [16]byte
+	last  [16]byte
+}
+
+// IPRangeSet is a set of addresses, networks and ranges. After build(), they are merged into
+// sorted, non-overlapping intervals, so that lookups are a binary search.
+type IPRangeSet struct {
+	ranges []ipRange
+	sorted bool
+}
+
+// parseIPRange parses an address, a network (`192.168.0.0/16`) or a range (`10.0.0.1-10.0.0.9`)
+func parseIPRange(rule string) (ipRange, error) {
+	var r ipRange
+	if first, last, found := strings.Cut(rule, "-"); found {
+		firstIP, lastIP := net.ParseIP(strings.TrimSpace(first)), net.ParseIP(strings.TrimSpace(last))
+		if firstIP == nil || lastIP == nil || (firstIP.To4() == nil) != (lastIP.To4() == nil) {
+			return r, fmt.Errorf("Invalid address range: [%s]", rule)
+		}
+		copy(r.first[:], firstIP.To16())
+		copy(r.last[:], lastIP.To16())
+		if bytes.Compare(r.first[:], r.last[:]) > 0 {
+			return r, fmt.Errorf("Invalid address range: [%s]", rule)
+		}
+		return r, nil
+	}
+	if !strings.Contains(rule, "/") {
+		ip := net.ParseIP(rule)
+		if ip == nil {
+			return r, fmt.Errorf("Invalid address: [%s]", rule)
+		}
+		copy(r.first[:], ip.To16())
+		r.last = r.first
+		return r, nil
+	}
+	_, network, err := net.ParseCIDR(rule)
+	if err != nil {
+		return r, fmt.Errorf("Invalid network: [%s]", rule)
+	}
+	first, mask := network.IP.To16(), network.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12:12], mask...)
+	}
+	copy(r.first[:], first)
+	r.last = lastAddress(r.first, mask)
+	return r, nil
+}
+
+// lastAddress returns the last address of the network that starts at first
+func lastAddress(first [16]byte, mask net.IPMask) [16]byte {
+	var last [16]byte
+	for i := range last {
+		last[i] = first[i] | ^mask[i]
+	}
+	return last
+}
+
+func (set *IPRangeSet) add(r ipRange) {
+	set.ranges = append(set.ranges, r)
+	set.sorted = false
+}
+
+// isNext returns true if b immediately follows a
+func isNext(a [16]byte, b [16]byte) bool {
+	for i := 15; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			break
+		}
+	}
+	return a == b
+}
+
+// build sorts the ranges, and merges the ones that overlap or are adjacent
+func (set *IPRangeSet) build() {
+	if set.sorted {
+		return
+	}
+	sort.Slice(set.ranges, func(i, j int) bool {
+		return bytes.Compare(set.ranges[i].first[:], set.ranges[j].first[:]) < 0
+	})
+	merged := set.ranges[:0]
+	for _, r := range set.ranges {
+		if n := len(merged); n > 0 {
+			previous := &merged[n-1]
+			if bytes.Compare(r.first[:], previous.last[:]) <= 0 || isNext(previous.last, r.first) {
+				if bytes.Compare(r.last[:], previous.last[:]) > 0 {
+					previous.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	set.ranges = merged
+	set.sorted = true
+}
+
+func (set *IPRangeSet) count() int {
+	return len(set.ranges)
+}
+
+// lookup returns the range an address belongs to
+func (set *IPRangeSet) lookup(ip net.IP) (ipRange, bool) {
+	var key [16]byte
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ipRange{}, false
+	}
+	copy(key[:], ip16)
+	i := sort.Search(len(set.ranges), func(i int) bool {
+		return bytes.Compare(set.ranges[i].last[:], key[:]) >= 0
+	})
+	if i < len(set.ranges) && bytes.Compare(set.ranges[i].first[:], key[:]) <= 0 {
+		return set.ranges[i], true
+	}
+	return ipRange{}, false
+}
+
+// String returns the range as an address, a network if it is one, or as `first-last`
+func (r ipRange) String() string {
+	first, last := net.IP(r.first[:]), net.IP(r.last[:])
+	if r.first == r.last {
+		return first.String()
+	}
+	ones := 0
+	for ones < 128 && r.first[ones/8]&(0x80>>(ones%8)) == r.last[ones/8]&(0x80>>(ones%8)) {
+		ones++
+	}
+	if mask := net.CIDRMask(ones, 128); first.Mask(mask).Equal(first) && lastAddress(r.first, mask) == r.last {
+		if first.To4() != nil && ones >= 96 {
+			return fmt.Sprintf("%s/%d", first, ones-96)
+		}
+		return fmt.Sprintf("%s/%d", first, ones)
+	}
+	return first.String() + "-" + last.String()
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPRangeSet(t *testing.T) {
+	var set IPRangeSet
+	for _, rule := range []string{
+		"10.0.0.0/9",
+		"10.128.0.0/9",
+		"10.1.2.3",
+		"192.168.1.10-192.168.1.20",
+		"192.168.1.15-192.168.1.30",
+		"192.168.1.31",
+		"2001:db8::/32",
+		"203.0.113.7",
+	} {
+		r, err := parseIPRange(rule)
+		if err != nil {
+			t.Fatalf("%s: %v", rule, err)
+		}
+		set.add(r)
+	}
+	set.build()
+	if set.count() != 4 {
+		t.Errorf("expected 4 ranges, got %d", set.count())
+	}
+	for ip, expected := range map[string]string{
+		"10.200.1.1":   "10.0.0.0/8",
+		"192.168.1.31": "192.168.1.10-192.168.1.31",
+		"2001:db8::1":  "2001:db8::/32",
+		"203.0.113.7":  "203.0.113.7",
+		"192.168.1.9":  "",
+		"192.168.1.32": "",
+		"2001:db9::":   "",
+		"11.0.0.0":     "",
+		"::ffff:a00:1": "10.0.0.0/8",
+		"203.0.113.6":  "",
+	} {
+		r, found := set.lookup(net.ParseIP(ip))
+		if found != (expected != "") || (found && r.String() != expected) {
+			t.Errorf("%s: expected [%s], got [%s] (%v)", ip, expected, r, found)
+		}
+	}
+	for _, rule := range []string{"10.0.0.0/33", "10.0.0.9-10.0.0.1", "10.0.0.1-::1", "example"} {
+		if _, err := parseIPRange(rule); err == nil {
+			t.Errorf("%s: expected an error", rule)
+		}
+	}
+}
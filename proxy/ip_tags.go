@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// IPTags maps sets of networks, such as known sinkholes or cloud providers, to tags, so that
+// the query log can show which responses contain addresses from these sets
+type IPTags struct {
+	// networks maps a prefix length (+1000 for IPv6) to the masked networks of that length, and to their tags
+	networks    map[int]map[string][]string
+	prefixLens4 []int
+	prefixLens6 []int
+}
+
+func NewIPTags(files map[string]string) (*IPTags, error) {
+	ipTags := &IPTags{networks: make(map[int]map[string][]string)}
+	tags := make([]string, 0, len(files))
+	for tag := range files {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		content, err := ReadTextFile(files[tag])
+		if err != nil {
+			return nil, err
+		}
+		if err := ipTags.load(tag, content); err != nil {
+			return nil, fmt.Errorf("[%s]: %v", files[tag], err)
+		}
+	}
+	return ipTags, nil
+}
+
+func (ipTags *IPTags) load(tag string, content string) error {
+	for lineNo, line := range strings.Split(content, "\n") {
+		line = TrimAndStripInlineComments(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			if ip := net.ParseIP(line); ip != nil && ip.To4() != nil {
+				line += "/32"
+			} else {
+				line += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(line)
+		if err != nil {
+			return fmt.Errorf("Invalid network at line %d: [%s]", 1+lineNo, line)
+		}
+		ones, bits := network.Mask.Size()
+		prefixLen := ones
+		if bits == 128 {
+			prefixLen += 1000
+		}
+		masked, found := ipTags.networks[prefixLen]
+		if !found {
+			masked = make(map[string][]string)
+			ipTags.networks[prefixLen] = masked
+			if bits == 128 {
+				ipTags.prefixLens6 = append(ipTags.prefixLens6, ones)
+			} else {
+				ipTags.prefixLens4 = append(ipTags.prefixLens4, ones)
+			}
+		}
+		key := string(network.IP)
+		if !includesName(masked[key], tag) {
+			masked[key] = append(masked[key], tag)
+		}
+	}
+	return nil
+}
+
+// tagsForIP returns the tags of the sets an address belongs to
+func (ipTags *IPTags) tagsForIP(ip net.IP, tags []string) []string {
+	prefixLens, bits, offset := ipTags.prefixLens6, 128, 1000
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip, prefixLens, bits, offset = ipv4, ipTags.prefixLens4, 32, 0
+	}
+	for _, prefixLen := range prefixLens {
+		masked := ip.Mask(net.CIDRMask(prefixLen, bits))
+		for _, tag := range ipTags.networks[prefixLen+offset][string(masked)] {
+			if !includesName(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// tagsForResponse returns the tags of the addresses found in the answer section of a response
+func (ipTags *IPTags) tagsForResponse(response []byte) []string {
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err != nil {
+		return nil
+	}
+	var tags []string
+	for _, rr := range msg.Answer {
+		switch answer := rr.(type) {
+		case *dns.A:
+			tags = ipTags.tagsForIP(answer.A, tags)
+		case *dns.AAAA:
+			tags = ipTags.tagsForIP(answer.AAAA, tags)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	LANHostsFetchTimeout = 10 * time.Second
+	LANHostsMaxBodySize  = 1 << 20
+)
+
+// LANHosts keeps track of the names of the devices of the local network, from a DHCP
+// leases file or from a list fetched from a URL
+type LANHosts struct {
+	sync.RWMutex
+	leasesFile   string
+	url          string
+	domain       string
+	refreshDelay time.Duration
+	addrsByName  map[string][]net.IP
+	nameByAddr   map[string]string
+}
+
+func NewLANHosts(leasesFile string, url string, domain string, refreshDelay time.Duration) *LANHosts {
+	return &LANHosts{
+		leasesFile:   leasesFile,
+		url:          url,
+		domain:       strings.Trim(strings.ToLower(domain), "."),
+		refreshDelay: refreshDelay,
+	}
+}
+
+type lanHost struct {
+	name string
+	ip   net.IP
+}
+
+func (lanHosts *LANHosts) load() error {
+	var hosts []lanHost
+	if len(lanHosts.leasesFile) > 0 {
+		content, err := ReadTextFile(lanHosts.leasesFile)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, parseLeases(content)...)
+	}
+	if len(lanHosts.url) > 0 {
+		fetched, err := lanHosts.fetch()
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, fetched...)
+	}
+	addrsByName := make(map[string][]net.IP)
+	nameByAddr := make(map[string]string)
+	for _, host := range hosts {
+		name := strings.Trim(strings.ToLower(host.name), ".")
+		if len(name) == 0 || name == "*" {
+			continue
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			continue
+		}
+		fqdn := name
+		if len(lanHosts.domain) > 0 && !strings.HasSuffix(name, "."+lanHosts.domain) {
+			fqdn = name + "." + lanHosts.domain
+			addrsByName[name] = append(addrsByName[name], host.ip)
+		}
+		addrsByName[fqdn] = append(addrsByName[fqdn], host.ip)
+		if reverse, err := dns.ReverseAddr(host.ip.String()); err == nil {
+			nameByAddr[strings.TrimSuffix(reverse, ".")] = fqdn
+		}
+	}
+	lanHosts.Lock()
+	lanHosts.addrsByName = addrsByName
+	lanHosts.nameByAddr = nameByAddr
+	lanHosts.Unlock()
+	dlog.Infof("%d LAN host names loaded", len(nameByAddr))
+	return nil
+}
+
+// parseLeases reads dnsmasq leases ("<expiry> <mac> <ip> <name> <client id>") as well as
+// lines in the hosts file format ("<ip> <name>")
+func parseLeases(content string) []lanHost {
+	var hosts []lanHost
+	now := time.Now().Unix()
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(TrimAndStripInlineComments(line))
+		switch {
+		case len(fields) >= 4:
+			if expiry, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+				if expiry != 0 && expiry < now {
+					continue
+				}
+				if ip := net.ParseIP(fields[2]); ip != nil {
+					hosts = append(hosts, lanHost{name: fields[3], ip: ip})
+				}
+				continue
+			}
+			fallthrough
+		case len(fields) >= 2:
+			if ip := net.ParseIP(fields[0]); ip != nil {
+				for _, name := range fields[1:] {
+					hosts = append(hosts, lanHost{name: name, ip: ip})
+				}
+			}
+		}
+	}
+	return hosts
+}
+
+// fetch downloads a JSON list of objects with a name and an IP address, or a CSV file with
+// a name and an address on each line
+func (lanHosts *LANHosts) fetch() ([]lanHost, error) {
+	client := http.Client{Timeout: LANHostsFetchTimeout}
+	resp, err := client.Get(lanHosts.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to fetch [%s]: %s", lanHosts.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, LANHostsMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	body = []byte(strings.TrimSpace(string(body)))
+	if len(body) > 0 && body[0] == '[' {
+		return parseLANHostsJSON(body)
+	}
+	return parseLANHostsCSV(string(body))
+}
+
+func parseLANHostsJSON(body []byte) ([]lanHost, error) {
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, err
+	}
+	var hosts []lanHost
+	for _, entry := range entries {
+		var name, addr string
+		for _, key := range []string{"name", "hostname", "host"} {
+			if value, ok := entry[key].(string); ok && len(value) > 0 {
+				name = value
+				break
+			}
+		}
+		for _, key := range []string{"ip", "address", "addr", "ipaddr"} {
+			if value, ok := entry[key].(string); ok && len(value) > 0 {
+				addr = value
+				break
+			}
+		}
+		if ip := net.ParseIP(addr); ip != nil && len(name) > 0 {
+			hosts = append(hosts, lanHost{name: name, ip: ip})
+		}
+	}
+	return hosts, nil
+}
+
+func parseLANHostsCSV(body string) ([]lanHost, error) {
+	reader := csv.NewReader(strings.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var hosts []lanHost
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+		// The columns can be in any order; header lines don't include any addresses
+		if ip := net.ParseIP(record[1]); ip != nil {
+			hosts = append(hosts, lanHost{name: record[0], ip: ip})
+		} else if ip := net.ParseIP(record[0]); ip != nil {
+			hosts = append(hosts, lanHost{name: record[1], ip: ip})
+		}
+	}
+	if len(hosts) == 0 && len(records) > 1 {
+		return nil, errors.New("No host names found")
+	}
+	return hosts, nil
+}
+
+func (lanHosts *LANHosts) addrs(name string) []net.IP {
+	lanHosts.RLock()
+	defer lanHosts.RUnlock()
+	return lanHosts.addrsByName[name]
+}
+
+// nameForReverse returns the name of a device from a name in the in-addr.arpa/ip6.arpa zones
+func (lanHosts *LANHosts) nameForReverse(reverse string) (string, bool) {
+	lanHosts.RLock()
+	defer lanHosts.RUnlock()
+	name, found := lanHosts.nameByAddr[reverse]
+	return name, found
+}
+
+func (lanHosts *LANHosts) nameForIP(ip net.IP) (string, bool) {
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return "", false
+	}
+	return lanHosts.nameForReverse(strings.TrimSuffix(reverse, "."))
+}
+
+func (lanHosts *LANHosts) refreshLoop(quit chan struct{}) {
+	ticker := time.NewTicker(lanHosts.refreshDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		if err := lanHosts.load(); err != nil {
+			dlog.Warnf("Unable to update the LAN host names: [%v]", err)
+		}
+	}
+}
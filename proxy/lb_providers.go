@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"golang.org/x/net/publicsuffix"
+)
+
+// serverProvider returns an identifier for the operator of a server, derived from its stamp:
+// the registrable domain of the provider name (the DNSCrypt certificate provider or the DoH host name),
+// according to the public suffix list, or the server address if the provider name is not a domain name
+func serverProvider(stamp stamps.ServerStamp) string {
+	providerName := strings.TrimSuffix(strings.ToLower(stamp.ProviderName), ".")
+	providerName = strings.TrimPrefix(providerName, "2.dnscrypt-cert.")
+	if host, _, err := net.SplitHostPort(providerName); err == nil {
+		providerName = host
+	}
+	if len(providerName) == 0 || ParseIP(strings.Trim(providerName, "[]")) != nil {
+		host, _ := ExtractHostAndPort(stamp.ServerAddrStr, 0)
+		return strings.Trim(host, "[]")
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(providerName); err == nil {
+		return domain
+	}
+	return providerName
+}
+
+// enforceProviderDiversity reorders the live servers so that the active ones, those the load-balancing
+// strategy picks from, are run by at least lbMinProviders distinct providers, replacing the slowest
+// servers of an over-represented provider with the fastest servers of the other providers.
+func (serversInfo *ServersInfo) enforceProviderDiversity() {
+	// serversInfo.RWMutex is assumed to be Locked
+	serversCount := len(serversInfo.inner)
+	if serversInfo.lbMinProviders < 2 || serversCount < 2 {
+		return
+	}
+	activeCount := serversInfo.lbStrategy.getActiveCount(serversCount)
+	counts := make(map[string]int)
+	for _, serverInfo := range serversInfo.inner[:activeCount] {
+		counts[serverInfo.provider]++
+	}
+	for len(counts) < Min(serversInfo.lbMinProviders, activeCount) {
+		replacement := -1
+		for i := activeCount; i < serversCount; i++ {
+			if counts[serversInfo.inner[i].provider] == 0 {
+				replacement = i
+				break
+			}
+		}
+		if replacement < 0 {
+			return
+		}
+		replaced := -1
+		for i := activeCount - 1; i >= 0; i-- {
+			if counts[serversInfo.inner[i].provider] > 1 {
+				replaced = i
+				break
+			}
+		}
+		if replaced < 0 {
+			return
+		}
+		dlog.Debugf(
+			"Provider diversity: using [%s] (%s) instead of [%s] (%s)",
+			serversInfo.inner[replacement].Name,
+			serversInfo.inner[replacement].provider,
+			serversInfo.inner[replaced].Name,
+			serversInfo.inner[replaced].provider,
+		)
+		counts[serversInfo.inner[replaced].provider]--
+		counts[serversInfo.inner[replacement].provider]++
+		serversInfo.inner[replaced], serversInfo.inner[replacement] = serversInfo.inner[replacement], serversInfo.inner[replaced]
+	}
+}
+
+// activeProviders returns the number of distinct providers among the active servers
+func (serversInfo *ServersInfo) activeProviders() int {
+	// serversInfo.RWMutex is assumed to be Locked
+	serversCount := len(serversInfo.inner)
+	if serversCount == 0 {
+		return 0
+	}
+	providers := make(map[string]struct{})
+	for _, serverInfo := range serversInfo.inner[:serversInfo.lbStrategy.getActiveCount(serversCount)] {
+		providers[serverInfo.provider] = struct{}{}
+	}
+	return len(providers)
+}
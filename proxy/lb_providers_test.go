@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"testing"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+func TestServerProvider(t *testing.T) {
+	tests := []struct {
+		stamp    stamps.ServerStamp
+		provider string
+	}{
+		{stamps.ServerStamp{ProviderName: "2.dnscrypt-cert.example.com", ServerAddrStr: "198.51.100.1:443"}, "example.com"},
+		{stamps.ServerStamp{ProviderName: "2.dnscrypt-cert.ns1.example.co.uk.", ServerAddrStr: "198.51.100.1:443"}, "example.co.uk"},
+		{stamps.ServerStamp{ProviderName: "doh.Example.NET:443", ServerAddrStr: "198.51.100.1"}, "example.net"},
+		{stamps.ServerStamp{ProviderName: "dns.user.github.io"}, "user.github.io"},
+		{stamps.ServerStamp{ProviderName: "co.uk"}, "co.uk"},
+		{stamps.ServerStamp{ProviderName: "198.51.100.2", ServerAddrStr: "198.51.100.1:443"}, "198.51.100.1"},
+		{stamps.ServerStamp{ServerAddrStr: "[2001:db8::1]:443"}, "2001:db8::1"},
+	}
+	for _, test := range tests {
+		if provider := serverProvider(test.stamp); provider != test.provider {
+			t.Errorf("provider of %q: got %q, expected %q", test.stamp.ProviderName, provider, test.provider)
+		}
+	}
+}
+
+func diversityServers(providers ...string) *ServersInfo {
+	serversInfo := &ServersInfo{lbStrategy: LBStrategyP2{}, lbMinProviders: 2}
+	for i, provider := range providers {
+		serversInfo.inner = append(serversInfo.inner, &ServerInfo{Name: provider + "-" + string(rune('a'+i)), provider: provider})
+	}
+	return serversInfo
+}
+
+func serverNames(serversInfo *ServersInfo) []string {
+	names := make([]string, len(serversInfo.inner))
+	for i, serverInfo := range serversInfo.inner {
+		names[i] = serverInfo.Name
+	}
+	return names
+}
+
+func TestEnforceProviderDiversity(t *testing.T) {
+	tests := []struct {
+		providers      []string
+		lbMinProviders int
+		expected       []string
+	}{
+		{[]string{"x", "x", "x", "y"}, 2, []string{"x-a", "y-d", "x-c", "x-b"}},
+		{[]string{"x", "y", "x", "z"}, 2, []string{"x-a", "y-b", "x-c", "z-d"}},
+		{[]string{"x", "x", "x"}, 2, []string{"x-a", "x-b", "x-c"}},
+		{[]string{"x", "x", "y"}, 0, []string{"x-a", "x-b", "y-c"}},
+		{[]string{"x", "x", "y", "z"}, 3, []string{"x-a", "y-c", "x-b", "z-d"}},
+	}
+	for _, test := range tests {
+		serversInfo := diversityServers(test.providers...)
+		serversInfo.lbMinProviders = test.lbMinProviders
+		serversInfo.enforceProviderDiversity()
+		names := serverNames(serversInfo)
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("%v with at least %d providers: got %v, expected %v", test.providers, test.lbMinProviders, names, test.expected)
+				break
+			}
+		}
+	}
+
+	serversInfo := diversityServers("x", "x", "y", "y", "z")
+	serversInfo.lbStrategy = LBStrategyPN{n: 3}
+	serversInfo.lbMinProviders = 3
+	serversInfo.enforceProviderDiversity()
+	if providers := serversInfo.activeProviders(); providers != 3 {
+		t.Errorf("%d active providers, expected 3: %v", providers, serverNames(serversInfo))
+	}
+}
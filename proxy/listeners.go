@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	ListenerKindDNS = "dns"
+	ListenerKindDoH = "doh"
+)
+
+func listenerKey(kind string, addr string) string {
+	return kind + " " + addr
+}
+
+// normalizeListenAddress returns an address in the form used by the sockets themselves
+func normalizeListenAddress(listenAddrStr string) (string, error) {
+	if len(listenAddrStr) == 0 {
+		return "", errors.New("Empty listen address")
+	}
+	network := "tcp"
+	if isDigit(listenAddrStr[0]) {
+		network = "tcp4"
+	}
+	listenAddr, err := net.ResolveTCPAddr(network, listenAddrStr)
+	if err != nil {
+		return "", err
+	}
+	return listenAddr.String(), nil
+}
+
+// checkListenAddressZone ensures that IPv6 link-local addresses include a zone, since they can
+// only be bound to a specific interface
+func checkListenAddressZone(listenAddrStr string) error {
+	host, _, err := net.SplitHostPort(listenAddrStr)
+	if err != nil {
+		return nil
+	}
+	ipStr, zone, _ := strings.Cut(host, "%")
+	if ip := net.ParseIP(ipStr); ip != nil && ip.To4() == nil && ip.IsLinkLocalUnicast() && len(zone) == 0 {
+		return fmt.Errorf("The link-local address [%s] requires a zone, such as [%s%%eth0]:53", listenAddrStr, ipStr)
+	}
+	return nil
+}
+
+// Listeners returns the kind and the address of the sockets accepting client queries
+func (proxy *Proxy) Listeners() []string {
+	proxy.listenersLock.Lock()
+	defer proxy.listenersLock.Unlock()
+	keys := make([]string, 0, len(proxy.activeListeners))
+	for key := range proxy.activeListeners {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// currentLocalDoHListenAddresses returns a copy of the local DoH listen addresses, that can change at runtime
+func (proxy *Proxy) currentLocalDoHListenAddresses() []string {
+	proxy.listenersLock.Lock()
+	defer proxy.listenersLock.Unlock()
+	return append([]string{}, proxy.localDoHListenAddresses...)
+}
+
+// AddListener starts accepting queries on a new address, without affecting the other listeners.
+// The kind is either "dns" (UDP and TCP) or "doh" (local DoH server).
+func (proxy *Proxy) AddListener(kind string, listenAddrStr string) error {
+	if err := checkListenAddressZone(listenAddrStr); err != nil {
+		return err
+	}
+	addr, err := normalizeListenAddress(listenAddrStr)
+	if err != nil {
+		return err
+	}
+	proxy.listenersLock.Lock()
+	defer proxy.listenersLock.Unlock()
+	key := listenerKey(kind, addr)
+	if _, found := proxy.activeListeners[key]; found {
+		return fmt.Errorf("Already listening to [%s]", key)
+	}
+	switch kind {
+	case ListenerKindDNS:
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return err
+		}
+		withUDP, withTCP := proxy.listenerProtocols(addr)
+		if withUDP {
+			if err := proxy.udpListenerFromAddr(udpAddr); err != nil {
+				return err
+			}
+		}
+		if withTCP {
+			if err := proxy.tcpListenerFromAddr(tcpAddr); err != nil {
+				for _, clientPc := range proxy.udpListeners {
+					clientPc.Close()
+				}
+				proxy.udpListeners = nil
+				return err
+			}
+		}
+		proxy.listenAddresses = appendUniqueAddress(proxy.listenAddresses, addr)
+	case ListenerKindDoH:
+		if len(proxy.localDoHCertFile) == 0 || len(proxy.localDoHCertKeyFile) == 0 {
+			return errors.New("A certificate and a key are required to start a local DoH service")
+		}
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return err
+		}
+		if err := proxy.localDoHListenerFromAddr(tcpAddr); err != nil {
+			return err
+		}
+		proxy.localDoHListenAddresses = appendUniqueAddress(proxy.localDoHListenAddresses, addr)
+	default:
+		return fmt.Errorf("Unsupported listener kind: [%s]", kind)
+	}
+	proxy.startAcceptingClientsLocked()
+	return nil
+}
+
+// RemoveListener closes the sockets bound to an address; queries being processed are still answered
+func (proxy *Proxy) RemoveListener(kind string, listenAddrStr string) error {
+	addr, err := normalizeListenAddress(listenAddrStr)
+	if err != nil {
+		return err
+	}
+	proxy.listenersLock.Lock()
+	defer proxy.listenersLock.Unlock()
+	key := listenerKey(kind, addr)
+	listeners, found := proxy.activeListeners[key]
+	if !found {
+		return fmt.Errorf("Not listening to [%s]", key)
+	}
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	delete(proxy.activeListeners, key)
+	switch kind {
+	case ListenerKindDNS:
+		proxy.listenAddresses = removeAddress(proxy.listenAddresses, addr)
+	case ListenerKindDoH:
+		proxy.localDoHListenAddresses = removeAddress(proxy.localDoHListenAddresses, addr)
+	}
+	dlog.Noticef("Stopped listening to [%s]", key)
+	return nil
+}
+
+// ReloadListeners reads the listen addresses from the configuration file again, and adds or
+// removes listeners so that they match
+func (proxy *Proxy) ReloadListeners() (added []string, removed []string, err error) {
+	if len(proxy.configFile) == 0 {
+		return nil, nil, errors.New("No configuration file to reload")
+	}
+	config, err := LoadConfig(proxy.configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, listenAddrStr := range config.ListenAddresses {
+		addr, err := normalizeListenAddress(listenAddrStr)
+		if err != nil {
+			return nil, nil, err
+		}
+		wanted[listenerKey(ListenerKindDNS, addr)] = true
+	}
+	for _, listenAddrStr := range config.LocalDoH.ListenAddresses {
+		addr, err := normalizeListenAddress(listenAddrStr)
+		if err != nil {
+			return nil, nil, err
+		}
+		wanted[listenerKey(ListenerKindDoH, addr)] = true
+	}
+	current := make(map[string]bool)
+	for _, key := range proxy.Listeners() {
+		current[key] = true
+		if !wanted[key] {
+			kind, addr, _ := strings.Cut(key, " ")
+			if err := proxy.RemoveListener(kind, addr); err != nil {
+				return added, removed, err
+			}
+			removed = append(removed, key)
+		}
+	}
+	wantedKeys := make([]string, 0, len(wanted))
+	for key := range wanted {
+		wantedKeys = append(wantedKeys, key)
+	}
+	sort.Strings(wantedKeys)
+	for _, key := range wantedKeys {
+		if current[key] {
+			continue
+		}
+		kind, addr, _ := strings.Cut(key, " ")
+		if err := proxy.AddListener(kind, addr); err != nil {
+			return added, removed, err
+		}
+		added = append(added, key)
+	}
+	return added, removed, nil
+}
+
+func appendUniqueAddress(addrs []string, addr string) []string {
+	for _, existing := range addrs {
+		if existing == addr {
+			return addrs
+		}
+	}
+	return append(addrs, addr)
+}
+
+func removeAddress(addrs []string, addr string) []string {
+	kept := make([]string, 0, len(addrs))
+	for _, existing := range addrs {
+		if normalized, err := normalizeListenAddress(existing); err == nil && normalized == addr {
+			continue
+		}
+		kept = append(kept, existing)
+	}
+	return kept
+}
+
+// listenerProtocols tells whether UDP and TCP sockets should be bound to a DNS listen address
+func (proxy *Proxy) listenerProtocols(addr string) (udp bool, tcp bool) {
+	options, found := proxy.listenerOptions[addr]
+	if !found || len(options.Protocols) == 0 {
+		return true, true
+	}
+	for _, protocol := range options.Protocols {
+		switch strings.ToLower(protocol) {
+		case "udp":
+			udp = true
+		case "tcp":
+			tcp = true
+		}
+	}
+	return udp, tcp
+}
+
+// listenerOptionsFor returns the options of the listener a query has been received from
+func (proxy *Proxy) listenerOptionsFor(localAddr net.Addr) *ListenerOptions {
+	if len(proxy.listenerOptions) == 0 || localAddr == nil {
+		return nil
+	}
+	if options, found := proxy.listenerOptions[localAddr.String()]; found {
+		return options
+	}
+	// Accepted TCP connections have a specific local address, even on a wildcard listener
+	_, port, err := net.SplitHostPort(localAddr.String())
+	if err != nil {
+		return nil
+	}
+	for _, wildcard := range []string{"0.0.0.0", "::"} {
+		if options, found := proxy.listenerOptions[net.JoinHostPort(wildcard, port)]; found {
+			return options
+		}
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const LocalDoHWellKnownPath = "/.well-known/doh"
+
+type localDoHHandler struct {
+	proxy *Proxy
+}
+
+// DoHProblem is a problem details object (RFC 9457), returned along with error statuses
+type DoHProblem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func writeDoHProblem(writer http.ResponseWriter, status int, detail string) {
+	body, _ := json.Marshal(DoHProblem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+	writer.Header().Set("Content-Type", "application/problem+json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	writer.Write(body)
+}
+
+type LocalDoHMetadata struct {
+	DoHPath   string   `json:"dohpath"`
+	ALPN      []string `json:"alpn"`
+	Ports     []int    `json:"ports"`
+	Endpoints []string `json:"endpoints"`
+}
+
+func (handler localDoHHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	proxy := handler.proxy
+	if !proxy.clientsCountInc() {
+		dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+		writer.Header().Set("Retry-After", "1")
+		writeDoHProblem(writer, http.StatusTooManyRequests, "Too many concurrent queries")
+		return
+	}
+	defer proxy.clientsCountDec()
+	dataType := "application/dns-message"
+	writer.Header().Set("Server", "dnscrypt-proxy")
+	if proxy.localDoHDDR && request.URL.Path == LocalDoHWellKnownPath {
+		handler.serveWellKnown(writer, request)
+		return
+	}
+	if request.URL.Path != proxy.localDoHPath {
+		writeDoHProblem(writer, http.StatusNotFound, "")
+		return
+	}
+	packet := []byte{}
+	var err error
+	start := time.Now()
+	switch request.Method {
+	case "POST":
+		if contentType, _, _ := strings.Cut(request.Header.Get("Content-Type"), ";"); strings.TrimSpace(contentType) != dataType {
+			writeDoHProblem(writer, http.StatusUnsupportedMediaType, "The content type must be "+dataType)
+			return
+		}
+		var body io.Reader = request.Body
+		if strings.EqualFold(request.Header.Get("Content-Encoding"), "gzip") {
+			gzipReader, err := gzip.NewReader(io.LimitReader(request.Body, int64(MaxDNSPacketSize)))
+			if err != nil {
+				writeDoHProblem(writer, http.StatusBadRequest, "Invalid gzip-compressed body")
+				return
+			}
+			defer gzipReader.Close()
+			body = gzipReader
+		}
+		packet, err = io.ReadAll(io.LimitReader(body, int64(MaxDNSPacketSize)+1))
+		if err != nil {
+			dlog.Warnf("No body in a local DoH query")
+			writeDoHProblem(writer, http.StatusBadRequest, "Unable to read the body")
+			return
+		}
+		if len(packet) > MaxDNSPacketSize {
+			writeDoHProblem(writer, http.StatusRequestEntityTooLarge, fmt.Sprintf("Queries must not exceed %d bytes", MaxDNSPacketSize))
+			return
+		}
+	case "GET":
+		encodedPacket := request.URL.Query().Get("dns")
+		if len(encodedPacket) == 0 {
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(400)
+			writer.Write([]byte("dnscrypt-proxy local DoH server\n"))
+			return
+		}
+		if accept := request.Header.Get("Accept"); len(accept) > 0 && !strings.Contains(accept, dataType) &&
+			!strings.Contains(accept, "*/*") {
+			writeDoHProblem(writer, http.StatusNotAcceptable, "Responses are only available as "+dataType)
+			return
+		}
+		if len(encodedPacket) > MaxDNSPacketSize*4/3 {
+			writeDoHProblem(writer, http.StatusRequestURITooLong, fmt.Sprintf("Queries must not exceed %d bytes", MaxDNSPacketSize))
+			return
+		}
+		packet, err = base64.RawURLEncoding.DecodeString(encodedPacket)
+		if err != nil {
+			dlog.Warnf("Invalid base64 in a local DoH query")
+			writeDoHProblem(writer, http.StatusBadRequest, "The dns parameter must be encoded using base64url without padding")
+			return
+		}
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writeDoHProblem(writer, http.StatusMethodNotAllowed, "Queries must be sent using GET or POST")
+		return
+	}
+	if len(packet) < MinDNSPacketSize {
+		writeDoHProblem(writer, http.StatusBadRequest, "The query is too short")
+		return
+	}
+	clientAddr, err := net.ResolveTCPAddr("tcp", request.RemoteAddr)
+	if err != nil {
+		dlog.Errorf("Unable to get the client address: [%v]", err)
+		return
+	}
+	xClientAddr := net.Addr(clientAddr)
+	hasEDNS0Padding, err := hasEDNS0Padding(packet)
+	if err != nil {
+		writeDoHProblem(writer, http.StatusBadRequest, "The query is not a valid DNS message")
+		return
+	}
+	localAddr, _ := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	var cacheAge time.Duration
+	response := proxy.processQuery(
+		"local_doh",
+		proxy.mainProto,
+		packet,
+		&xClientAddr,
+		nil,
+		start,
+		false,
+		proxy.listenerOptionsFor(localAddr),
+		nil,
+		&cacheAge,
+	)
+	if len(response) == 0 {
+		writeDoHProblem(writer, http.StatusBadGateway, "No response could be obtained for this query")
+		return
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		writeDoHProblem(writer, http.StatusBadRequest, "The query is not a valid DNS message")
+		return
+	}
+	responseMsg := dns.Msg{}
+	if err := responseMsg.Unpack(response); err != nil {
+		writeDoHProblem(writer, http.StatusInternalServerError, "Unable to parse the response")
+		return
+	}
+	if maxAge, cacheable := dohCacheMaxAge(&responseMsg); cacheable {
+		// The TTLs of cached responses have already been decreased by their age
+		age := uint32(cacheAge / time.Second)
+		writer.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge+age))
+		writer.Header().Set("Age", fmt.Sprint(age))
+	} else {
+		writer.Header().Set("Cache-Control", "no-store")
+	}
+	responseLen := len(response)
+	paddedLen := dohPaddedLen(responseLen)
+	padLen := paddedLen - responseLen
+	if hasEDNS0Padding {
+		response, err = addEDNS0PaddingIfNoneFound(&msg, response, padLen)
+		if err != nil {
+			dlog.Critical(err)
+			return
+		}
+	} else {
+		pad := strings.Repeat("X", padLen)
+		writer.Header().Set("X-Pad", pad)
+	}
+	writer.Header().Set("Content-Type", dataType)
+	if request.Method == "GET" {
+		etag := dohETag(&responseMsg)
+		writer.Header().Set("ETag", etag)
+		if etagMatches(request.Header.Get("If-None-Match"), etag) {
+			writer.WriteHeader(304)
+			return
+		}
+	}
+	// Only large responses are compressed, so that compression doesn't defeat padding
+	writer.Header().Set("Vary", "Accept-Encoding")
+	if len(response) > MaxDNSPacketSize && acceptsGzip(request.Header.Get("Accept-Encoding")) {
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		gzipWriter.Write(response)
+		if gzipWriter.Close() == nil {
+			writer.Header().Set("Content-Encoding", "gzip")
+			response = compressed.Bytes()
+		}
+	}
+	writer.Header().Set("Content-Length", fmt.Sprint(len(response)))
+	writer.WriteHeader(200)
+	writer.Write(response)
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(coding, ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// dohCacheMaxAge returns the freshness lifetime of a response, which is the
+// smallest TTL it contains, as required by RFC 8484 section 5.1
+func dohCacheMaxAge(msg *dns.Msg) (uint32, bool) {
+	if msg.Truncated || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+	var minTTL uint32
+	found := false
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if ttl := rr.Header().Ttl; !found || ttl < minTTL {
+				minTTL, found = ttl, true
+			}
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	return minTTL, true
+}
+
+// dohETag is computed over the response without its identifier, TTLs and padding,
+// so that it doesn't change while the same response is served from the cache
+func dohETag(msg *dns.Msg) string {
+	msg = msg.Copy()
+	msg.Id = 0
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if opt, ok := rr.(*dns.OPT); ok {
+				options := opt.Option[:0]
+				for _, option := range opt.Option {
+					if option.Option() != dns.EDNS0PADDING {
+						options = append(options, option)
+					}
+				}
+				opt.Option = options
+				continue
+			}
+			rr.Header().Ttl = 0
+		}
+	}
+	h := fnv.New64a()
+	if packet, err := msg.Pack(); err == nil {
+		h.Write(packet)
+	}
+	return fmt.Sprintf("W/\"%016x\"", h.Sum64())
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if len(ifNoneMatch) == 0 {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *Proxy) localDoHListener(acceptPc *net.TCPListener) {
+	defer acceptPc.Close()
+	httpServer := &http.Server{
+		ReadTimeout:  proxy.timeout,
+		WriteTimeout: proxy.timeout,
+		Handler:      proxy.httpAccessLog.wrap("local_doh", localDoHHandler{proxy: proxy}),
+	}
+	httpServer.SetKeepAlivesEnabled(true)
+	if err := httpServer.ServeTLS(proxy.fdLimits.listener(acceptPc), proxy.localDoHCertFile, proxy.localDoHCertKeyFile); err != nil &&
+		!errors.Is(err, net.ErrClosed) {
+		dlog.Errorf("Local DoH service: [%v]", err)
+	}
+}
+
+func dohPaddedLen(unpaddedLen int) int {
+	boundaries := [...]int{
+		64,
+		128,
+		192,
+		256,
+		320,
+		384,
+		512,
+		704,
+		768,
+		896,
+		960,
+		1024,
+		1088,
+		1152,
+		2688,
+		4080,
+		MaxDNSPacketSize,
+	}
+	for _, boundary := range boundaries {
+		if boundary >= unpaddedLen {
+			return boundary
+		}
+	}
+	return unpaddedLen
+}
+
+func (handler localDoHHandler) serveWellKnown(writer http.ResponseWriter, request *http.Request) {
+	proxy := handler.proxy
+	if request.Method != "GET" && request.Method != "HEAD" {
+		writer.Header().Set("Allow", "GET, HEAD")
+		writeDoHProblem(writer, http.StatusMethodNotAllowed, "The metadata can only be retrieved using GET")
+		return
+	}
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.Contains(host, ":") {
+		// Zones must be percent-encoded in URLs (RFC 6874)
+		host = "[" + strings.Replace(strings.Replace(host, "%25", "%", 1), "%", "%25", 1) + "]"
+	}
+	metadata := LocalDoHMetadata{
+		DoHPath:   proxy.localDoHPath + "{?dns}",
+		ALPN:      []string{"h2", "http/1.1"},
+		Ports:     make([]int, 0),
+		Endpoints: make([]string, 0),
+	}
+	for _, listenAddrStr := range proxy.currentLocalDoHListenAddresses() {
+		listenAddr, err := net.ResolveTCPAddr("tcp", listenAddrStr)
+		if err != nil {
+			continue
+		}
+		metadata.Ports = append(metadata.Ports, listenAddr.Port)
+		metadata.Endpoints = append(metadata.Endpoints, fmt.Sprintf("https://%s:%d%s", host, listenAddr.Port, proxy.localDoHPath))
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		writer.WriteHeader(500)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", DDRTTL))
+	writer.WriteHeader(200)
+	if request.Method == "GET" {
+		writer.Write(body)
+	}
+}
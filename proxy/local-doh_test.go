@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLocalDoHNotFound(t *testing.T) {
+	proxy := &Proxy{maxClients: 1, localDoHPath: "/secret-dns-query"}
+	recorder := httptest.NewRecorder()
+	localDoHHandler{proxy: proxy}.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/dns-query", nil))
+	response := recorder.Result()
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", response.StatusCode)
+	}
+	body, _ := io.ReadAll(response.Body)
+	if strings.Contains(string(body), proxy.localDoHPath) {
+		t.Errorf("the DoH path is disclosed: %s", body)
+	}
+}
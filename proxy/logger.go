@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	LogPurgeInterval = time.Minute
+	// LogBackupTimeFormat is the format of the timestamps lumberjack adds to the names of rotated files
+	LogBackupTimeFormat = "2006-01-02T15-04-05.000"
+)
+
+// LogRetention defines how long rotated log files are kept, and how much space all the files of a log can use
+type LogRetention struct {
+	maxAge       int
+	maxTotalSize int64
+	compress     bool
+}
+
+func NewLogRetention(maxAge int, maxTotalSizeMB int, compress *bool, defaultMaxAge int) LogRetention {
+	retention := LogRetention{maxAge: maxAge, maxTotalSize: int64(maxTotalSizeMB) * 1024 * 1024, compress: true}
+	if retention.maxAge <= 0 {
+		retention.maxAge = defaultMaxAge
+	}
+	if compress != nil {
+		retention.compress = *compress
+	}
+	return retention
+}
+
+func Logger(logMaxSize int, logMaxAge int, logMaxBackups int, fileName string) io.Writer {
+	return RetainedLogger(logMaxSize, logMaxBackups, fileName, LogRetention{maxAge: logMaxAge, compress: true})
+}
+
+// RetainedLogger is Logger, with retention settings specific to a log
+func RetainedLogger(logMaxSize int, logMaxBackups int, fileName string, retention LogRetention) io.Writer {
+	if fileName == "/dev/stdout" {
+		return os.Stdout
+	}
+	if st, _ := os.Stat(fileName); st != nil && !st.Mode().IsRegular() {
+		if st.Mode().IsDir() {
+			dlog.Fatalf("[%v] is a directory", fileName)
+		}
+		fp, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			dlog.Fatalf("Unable to access [%v]: [%v]", fileName, err)
+		}
+		return fp
+	}
+	if fp, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err == nil {
+		fp.Close()
+	} else {
+		dlog.Errorf("Unable to create [%v]: [%v]", fileName, err)
+	}
+	logger := &lumberjack.Logger{
+		LocalTime:  true,
+		MaxSize:    logMaxSize,
+		MaxAge:     retention.maxAge,
+		MaxBackups: logMaxBackups,
+		Filename:   fileName,
+		Compress:   retention.compress,
+	}
+	if retention.maxTotalSize <= 0 {
+		return logger
+	}
+	sizeLimitedLogger := &sizeLimitedLogger{Logger: logger, maxTotalSize: retention.maxTotalSize}
+	go sizeLimitedLogger.purge()
+	return sizeLimitedLogger
+}
+
+// sizeLimitedLogger removes the oldest rotated files when all the files of a log use more than maxTotalSize bytes
+type sizeLimitedLogger struct {
+	*lumberjack.Logger
+	maxTotalSize int64
+	mutex        sync.Mutex
+	lastPurge    time.Time
+	purging      bool
+}
+
+func (logger *sizeLimitedLogger) Write(p []byte) (int, error) {
+	n, err := logger.Logger.Write(p)
+	logger.mutex.Lock()
+	if !logger.purging && time.Since(logger.lastPurge) >= LogPurgeInterval {
+		logger.purging = true
+		go logger.purge()
+	}
+	logger.mutex.Unlock()
+	return n, err
+}
+
+func (logger *sizeLimitedLogger) purge() {
+	defer func() {
+		logger.mutex.Lock()
+		logger.purging = false
+		logger.lastPurge = time.Now()
+		logger.mutex.Unlock()
+	}()
+	dir := filepath.Dir(logger.Filename)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type backup struct {
+		name string
+		ts   time.Time
+		size int64
+	}
+	var backups []backup
+	var totalSize int64
+	for _, entry := range entries {
+		name := entry.Name()
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if name == filepath.Base(logger.Filename) {
+			totalSize += info.Size()
+		} else if ts, ok := logBackupTime(logger.Filename, name); ok {
+			totalSize += info.Size()
+			backups = append(backups, backup{name: name, ts: ts, size: info.Size()})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ts.Before(backups[j].ts) })
+	for _, backup := range backups {
+		if totalSize <= logger.maxTotalSize {
+			break
+		}
+		path := filepath.Join(dir, backup.name)
+		if err := os.Remove(path); err != nil {
+			dlog.Warnf("Unable to remove [%s]: %v", path, err)
+			continue
+		}
+		dlog.Infof("Removed [%s] to keep the size of the log files below %d MB", path, logger.maxTotalSize/(1024*1024))
+		totalSize -= backup.size
+	}
+}
+
+// logBackupTime returns the timestamp of a file rotated by lumberjack, named <name>-<timestamp><ext>,
+// optionally followed by .gz
+func logBackupTime(fileName string, name string) (time.Time, bool) {
+	ext := filepath.Ext(fileName)
+	prefix := strings.TrimSuffix(filepath.Base(fileName), ext) + "-"
+	ts, found := strings.CutPrefix(strings.TrimSuffix(name, ".gz"), prefix)
+	if !found {
+		return time.Time{}, false
+	}
+	if ts, found = strings.CutSuffix(ts, ext); !found {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(LogBackupTimeFormat, ts, time.Local)
+	return t, err == nil
+}
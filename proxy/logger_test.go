@@ -0,0 +1,19 @@
+package proxy
+
+import "testing"
+
+func TestLogBackupTime(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"query-2024-05-01T10-20-30.123.log":    true,
+		"query-2024-05-01T10-20-30.123.log.gz": true,
+		"query-old.log":                        false,
+		"query-2024-05-01.log":                 false,
+		"query-2024-05-01T10-20-30.123.txt":    false,
+		"nx-2024-05-01T10-20-30.123.log":       false,
+		"query.log":                            false,
+	} {
+		if _, ok := logBackupTime("/var/log/query.log", name); ok != expected {
+			t.Errorf("[%s]: %v instead of %v", name, ok, expected)
+		}
+	}
+}
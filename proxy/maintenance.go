@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	MaintenanceTaskSources   = "sources"
+	MaintenanceTaskLists     = "lists"
+	MaintenanceTaskBenchmark = "benchmark"
+	MaintenanceTaskWarmup    = "warmup"
+
+	MaintenanceCheckInterval = time.Minute
+)
+
+var DefaultMaintenanceTasks = []string{
+	MaintenanceTaskSources,
+	MaintenanceTaskLists,
+	MaintenanceTaskBenchmark,
+	MaintenanceTaskWarmup,
+}
+
+// MaintenanceWindow restricts bandwidth-heavy background tasks to the times of a schedule
+type MaintenanceWindow struct {
+	schedule     string
+	weeklyRanges WeeklyRanges
+	tasks        map[string]bool
+}
+
+func NewMaintenanceWindow(schedule string, allWeeklyRanges map[string]WeeklyRanges, tasks []string) (*MaintenanceWindow, error) {
+	weeklyRanges, found := allWeeklyRanges[schedule]
+	if !found {
+		return nil, fmt.Errorf("Maintenance schedule [%s] not found", schedule)
+	}
+	window := &MaintenanceWindow{schedule: schedule, weeklyRanges: weeklyRanges, tasks: make(map[string]bool)}
+	for _, task := range tasks {
+		task = strings.ToLower(task)
+		switch task {
+		case MaintenanceTaskSources, MaintenanceTaskLists, MaintenanceTaskBenchmark, MaintenanceTaskWarmup:
+			window.tasks[task] = true
+		default:
+			return nil, fmt.Errorf("Unsupported maintenance task: [%s]", task)
+		}
+	}
+	return window, nil
+}
+
+// waitForMaintenanceWindow delays a task until the maintenance window opens, or until the deadline, if not zero.
+// It returns false if the proxy was stopped while waiting.
+func (proxy *Proxy) waitForMaintenanceWindow(task string, deadline time.Time) bool {
+	window := proxy.maintenanceWindow
+	if window == nil || !window.tasks[task] || window.weeklyRanges.Match() {
+		return !proxy.stopped()
+	}
+	dlog.Infof("Deferring the [%s] task until the [%s] maintenance window", task, window.schedule)
+	// Refreshes requested after a clock or network change are not deferred
+	var refreshRequests chan string
+	if task == MaintenanceTaskBenchmark {
+		refreshRequests = proxy.refreshRequests
+	}
+	for !window.weeklyRanges.Match() {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			dlog.Noticef("Running the [%s] task outside the maintenance window, since it cannot be deferred any longer", task)
+			break
+		}
+		select {
+		case <-proxy.quit:
+			return false
+		case reason := <-refreshRequests:
+			dlog.Noticef("Refreshing the server certificates after %s", reason)
+			return true
+		case <-time.After(MaintenanceCheckInterval):
+		}
+	}
+	return true
+}
+
+// earliestCertExpiration returns the first expiration among the certificates of the live servers
+func (serversInfo *ServersInfo) earliestCertExpiration() time.Time {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	var earliest time.Time
+	for _, serverInfo := range serversInfo.inner {
+		if !serverInfo.certExpiration.IsZero() && (earliest.IsZero() || serverInfo.certExpiration.Before(earliest)) {
+			earliest = serverInfo.certExpiration
+		}
+	}
+	return earliest
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	sieve "github.com/opencoff/go-sieve"
+)
+
+const (
+	MemoryCheckInterval     = 10 * time.Second
+	MemoryPressurePercent   = 90
+	MemoryRelievedPercent   = 70
+	MemoryCacheMinEntries   = 64
+	MemorySmallSystemMemory = 256 << 20
+	MemorySmallGCPercent    = 50
+)
+
+// MemoryLimiter sets a soft memory limit for the Go runtime, and shrinks the cache
+// when the memory usage gets close to that limit, until it goes down again
+type MemoryLimiter struct {
+	limit           int64
+	shrinkCache     bool
+	cacheSize       int
+	cachedResponses *CachedResponses
+}
+
+// NewMemoryLimiter applies the memory settings. With autoLimit, the limit is derived from the
+// system memory, unless GOMEMLIMIT has been set, and the GC target is lowered on systems with
+// little memory, unless GOGC has been set. It returns nil if nothing has been configured.
+func NewMemoryLimiter(
+	limitMB int,
+	autoLimit bool,
+	gcPercent int,
+	shrinkCache bool,
+	cachedResponses *CachedResponses,
+	cacheSize int,
+) *MemoryLimiter {
+	if limitMB <= 0 && !autoLimit && gcPercent == 0 {
+		return nil
+	}
+	systemMemory := systemMemory()
+	limit := int64(Max(limitMB, 0)) << 20
+	if limitMB <= 0 && autoLimit {
+		if len(os.Getenv("GOMEMLIMIT")) > 0 {
+			limit = debug.SetMemoryLimit(-1)
+		} else if systemMemory > 0 {
+			limit = int64(systemMemory / 4)
+		}
+	}
+	if limit > 0 && limit < math.MaxInt64 {
+		debug.SetMemoryLimit(limit)
+		dlog.Noticef("Memory limit: %d MB", limit>>20)
+	} else {
+		limit = 0
+	}
+	if gcPercent == 0 && autoLimit && len(os.Getenv("GOGC")) == 0 && systemMemory > 0 &&
+		systemMemory <= MemorySmallSystemMemory {
+		gcPercent = MemorySmallGCPercent
+	}
+	if gcPercent != 0 {
+		debug.SetGCPercent(gcPercent)
+		dlog.Noticef("GC target: %d%%", gcPercent)
+	}
+	return &MemoryLimiter{limit: limit, shrinkCache: shrinkCache, cacheSize: cacheSize, cachedResponses: cachedResponses}
+}
+
+// memoryInUse returns the memory mapped by the Go runtime, minus what has been returned to the system
+func memoryInUse() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindUint64 || samples[1].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// resize changes the capacity of the cache. The entries of the previous cache are
+// moved to the new one when they are used, and the ones left are dropped at the next check.
+func (cachedResponses *CachedResponses) resize(capacity int) bool {
+	cachedResponses.Lock()
+	defer cachedResponses.Unlock()
+	if cachedResponses.cache == nil || cachedResponses.cache.Cap() == capacity {
+		return false
+	}
+	cachedResponses.previous = cachedResponses.cache
+	cachedResponses.cache = sieve.New[[32]byte, CachedResponse](capacity)
+	return true
+}
+
+func (cachedResponses *CachedResponses) dropPrevious() {
+	cachedResponses.Lock()
+	cachedResponses.previous = nil
+	cachedResponses.Unlock()
+}
+
+func (cachedResponses *CachedResponses) capacity() int {
+	cachedResponses.RLock()
+	defer cachedResponses.RUnlock()
+	if cachedResponses.cache == nil {
+		return 0
+	}
+	return cachedResponses.cache.Cap()
+}
+
+func (memoryLimiter *MemoryLimiter) check() {
+	memoryLimiter.cachedResponses.dropPrevious()
+	usage := memoryInUse()
+	capacity := memoryLimiter.cachedResponses.capacity()
+	if usage < uint64(memoryLimiter.limit)*MemoryRelievedPercent/100 {
+		if memoryLimiter.shrinkCache && capacity > 0 && capacity < memoryLimiter.cacheSize {
+			capacity = Min(memoryLimiter.cacheSize, capacity*2)
+			if memoryLimiter.cachedResponses.resize(capacity) {
+				dlog.Noticef("Memory usage: %d MB out of %d MB - Cache size restored to %d entries", usage>>20, memoryLimiter.limit>>20, capacity)
+			}
+		}
+		return
+	}
+	if usage < uint64(memoryLimiter.limit)*MemoryPressurePercent/100 {
+		return
+	}
+	if memoryLimiter.shrinkCache && capacity > MemoryCacheMinEntries {
+		capacity = Max(MemoryCacheMinEntries, capacity/2)
+		if memoryLimiter.cachedResponses.resize(capacity) {
+			dlog.Warnf("Memory usage: %d MB out of %d MB - Cache size reduced to %d entries", usage>>20, memoryLimiter.limit>>20, capacity)
+		}
+	}
+	debug.FreeOSMemory()
+}
+
+func (memoryLimiter *MemoryLimiter) run(quit chan struct{}) {
+	if memoryLimiter.limit <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(MemoryCheckInterval):
+		}
+		memoryLimiter.check()
+	}
+}
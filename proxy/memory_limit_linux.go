@@ -0,0 +1,12 @@
+package proxy
+
+import "syscall"
+
+// systemMemory returns the total amount of memory, or 0 if it cannot be known
+func systemMemory() uint64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+	return uint64(info.Totalram) * uint64(info.Unit)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+func systemMemory() uint64 {
+	return 0
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const NetprobeQueryTimeout = time.Second
+
+// netprobeQuery sends a DNS query, and waits for a response
+func netprobeQuery(pc *net.UDPConn) error {
+	msg := dns.Msg{}
+	msg.SetQuestion(".", dns.TypeNS)
+	query, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if err := pc.SetDeadline(time.Now().Add(NetprobeQueryTimeout)); err != nil {
+		return err
+	}
+	if _, err := pc.Write(query); err != nil {
+		return err
+	}
+	response := make([]byte, MaxDNSUDPPacketSize)
+	_, err = pc.Read(response)
+	return err
+}
+
+// netprobeAny tries the addresses in turn, and returns true as soon as one of them is reachable.
+// The reachable address is moved to the front of the slice, which must not be shared, so that
+// it is tried first next time. With a single address, only the route to it is checked;
+// with multiple addresses, they have to respond, since a route is usually available to all of them.
+func netprobeAny(addresses []string) bool {
+	var err error
+	probe := len(addresses) > 1
+	for i, address := range addresses {
+		var remoteUDPAddr *net.UDPAddr
+		if remoteUDPAddr, err = net.ResolveUDPAddr("udp", address); err != nil {
+			continue
+		}
+		if err = netprobeDial(remoteUDPAddr, probe); err == nil {
+			if i > 0 {
+				dlog.Debugf("Network connectivity detected using [%s]", address)
+				addresses[0], addresses[i] = addresses[i], addresses[0]
+			}
+			return true
+		}
+	}
+	if err != nil {
+		dlog.Debug(err)
+	}
+	return false
+}
+
+func NetProbe(proxy *Proxy, addresses []string, timeout int) error {
+	if len(addresses) <= 0 || timeout == 0 {
+		return nil
+	}
+	if captivePortalHandler, err := ColdStart(proxy); err == nil {
+		if captivePortalHandler != nil {
+			defer captivePortalHandler.Stop()
+		}
+	} else {
+		dlog.Critical(err)
+	}
+	for _, address := range addresses {
+		if _, err := net.ResolveUDPAddr("udp", address); err != nil {
+			return err
+		}
+	}
+	addresses = append([]string{}, addresses...)
+	retried := false
+	if timeout < 0 {
+		timeout = MaxTimeout
+	} else {
+		timeout = Min(MaxTimeout, timeout)
+	}
+	for tries := timeout; tries > 0; tries-- {
+		if !netprobeAny(addresses) {
+			if !retried {
+				retried = true
+				dlog.Notice("Network not available yet -- waiting...")
+			}
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		dlog.Notice("Network connectivity detected")
+		return nil
+	}
+	dlog.Error("Timeout while waiting for network connectivity")
+	return nil
+}
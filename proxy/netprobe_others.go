@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// netprobeDial checks that a route to the address is available. Nothing is sent unless a probe is
+// required, in which case the address has to respond to a DNS query.
+func netprobeDial(remoteUDPAddr *net.UDPAddr, probe bool) error {
+	pc, err := net.DialUDP("udp", nil, remoteUDPAddr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	if !probe {
+		return nil
+	}
+	err = netprobeQuery(pc)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		// The host itself responded
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+package proxy
+
+import "net"
+
+func netprobeDial(remoteUDPAddr *net.UDPAddr, probe bool) error {
+	pc, err := net.DialUDP("udp", nil, remoteUDPAddr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	if probe {
+		return netprobeQuery(pc)
+	}
+	// Write at least 1 byte. This ensures that sockets are ready to use for writing.
+	// Windows specific: during the system startup, sockets can be created but the underlying buffers may not be
+	// setup yet. If this is the case Write fails with WSAENOBUFS: "An operation on a socket could not be
+	// performed because the system lacked sufficient buffer space or because a queue was full"
+	_, err = pc.Write([]byte{0})
+	return err
+}
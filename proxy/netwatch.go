@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	NetworkChangeSettleDelay  = 2 * time.Second
+	NetworkChangePollInterval = 5 * time.Second
+)
+
+// watchNetworkChanges refreshes the servers when interfaces, addresses or routes change,
+// so that the first queries sent after switching networks don't fail
+func (proxy *Proxy) watchNetworkChanges() {
+	events, err := networkChangeEvents(proxy.quit)
+	if err != nil {
+		dlog.Warnf("Unable to watch network changes: [%v] - Interface addresses will be polled", err)
+		events = pollNetworkChanges(proxy.quit)
+	}
+	for {
+		select {
+		case <-proxy.quit:
+			return
+		case <-events:
+		}
+		// Changes usually come in bursts; wait until the new configuration settles down
+		settle := time.NewTimer(NetworkChangeSettleDelay)
+	settling:
+		for {
+			select {
+			case <-proxy.quit:
+				settle.Stop()
+				return
+			case <-events:
+				settle.Reset(NetworkChangeSettleDelay)
+			case <-settle.C:
+				break settling
+			}
+		}
+		dlog.Notice("Network configuration changed")
+		proxy.resetUpstreamConnections()
+		proxy.requestServersRefresh("a network change")
+	}
+}
+
+// resetUpstreamConnections closes the connections to upstream servers, that may not be usable any more
+func (proxy *Proxy) resetUpstreamConnections() {
+	proxy.xTransport.rebuildTransport()
+	if proxy.tcpPool != nil {
+		proxy.tcpPool.closeAll()
+	}
+}
+
+// interfacesFingerprint returns a string that changes whenever an interface address is added or removed
+func interfacesFingerprint() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, ",")
+}
+
+// pollNetworkChanges is used on platforms without change notifications
+func pollNetworkChanges(quit chan struct{}) <-chan struct{} {
+	events := make(chan struct{}, 1)
+	go func() {
+		last := interfacesFingerprint()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-time.After(NetworkChangePollInterval):
+			}
+			if current := interfacesFingerprint(); current != last {
+				last = current
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return events
+}
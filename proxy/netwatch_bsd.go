@@ -0,0 +1,53 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package proxy
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// networkChangeEvents reads the routing socket, that reports address and interface changes
+func networkChangeEvents(quit chan struct{}) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	unix.CloseOnExec(fd)
+	// Reads time out, so that the socket can be closed when the proxy stops
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 65536)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			n, err := unix.Read(fd, buf)
+			if err == unix.EAGAIN || err == unix.EINTR || err == unix.ENOBUFS {
+				continue
+			}
+			if err != nil || n <= 0 {
+				return
+			}
+			// Messages start with their length (2 bytes), a version and a type
+			if n < 4 {
+				continue
+			}
+			switch int(buf[3]) {
+			case unix.RTM_NEWADDR, unix.RTM_DELADDR, unix.RTM_IFINFO:
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+)
+
+// networkChangeEvents subscribes to link, address and route changes using a netlink socket
+func networkChangeEvents(quit chan struct{}) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	groups := uint32(unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+		unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Reads time out, so that the socket can be closed when the proxy stops
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 65536)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err == unix.EAGAIN || err == unix.EINTR || err == unix.ENOBUFS {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			// Each message starts with its length (4 bytes) and type (2 bytes)
+			for msg := buf[:n]; len(msg) >= unix.NLMSG_HDRLEN; {
+				msgLen := int(binary.NativeEndian.Uint32(msg[0:4]))
+				if msgLen < unix.NLMSG_HDRLEN || msgLen > len(msg) {
+					break
+				}
+				switch binary.NativeEndian.Uint16(msg[4:6]) {
+				case unix.RTM_NEWLINK, unix.RTM_DELLINK, unix.RTM_NEWADDR, unix.RTM_DELADDR,
+					unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+					select {
+					case events <- struct{}{}:
+					default:
+					}
+				}
+				msg = msg[min((msgLen+unix.NLMSG_ALIGNTO-1)&^(unix.NLMSG_ALIGNTO-1), len(msg)):]
+			}
+		}
+	}()
+	return events, nil
+}
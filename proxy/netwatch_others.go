@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package proxy
+
+func networkChangeEvents(quit chan struct{}) (<-chan struct{}, error) {
+	return pollNetworkChanges(quit), nil
+}
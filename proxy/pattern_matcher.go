@@ -1,9 +1,11 @@
-package main
+package proxy
 
 import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/k-sone/critbitgo"
 
@@ -22,24 +24,43 @@
 )
 
 type PatternMatcher struct {
-	blockedPrefixes   *critbitgo.Trie
-	blockedSuffixes   *critbitgo.Trie
-	blockedSubstrings []string
-	blockedPatterns   []string
-	blockedExact      map[string]interface{}
-	indirectVals      map[string]interface{}
+	blockedPrefixes *critbitgo.Trie
+	blockedNames    nameIndex
+	blockedPatterns []string
+	blockedExact    map[string]interface{}
+	indirectVals    map[string]interface{}
+	prepared        atomic.Bool
+	prepareLock     sync.Mutex
 }
 
 func NewPatternMatcher() *PatternMatcher {
+	return NewPatternMatcherWithEngine(MatcherEngineCritbit)
+}
+
+// NewPatternMatcherWithEngine creates a pattern matcher that uses one of the MatcherEngines
+func NewPatternMatcherWithEngine(engine string) *PatternMatcher {
 	patternMatcher := PatternMatcher{
 		blockedPrefixes: critbitgo.NewTrie(),
-		blockedSuffixes: critbitgo.NewTrie(),
+		blockedNames:    newNameIndex(engine),
 		blockedExact:    make(map[string]interface{}),
 		indirectVals:    make(map[string]interface{}),
 	}
 	return &patternMatcher
 }
 
+// prepare builds the lookup structures of the engine, once all the rules have been added
+func (patternMatcher *PatternMatcher) prepare() {
+	if patternMatcher.prepared.Load() {
+		return
+	}
+	patternMatcher.prepareLock.Lock()
+	if !patternMatcher.prepared.Load() {
+		patternMatcher.blockedNames.prepare()
+		patternMatcher.prepared.Store(true)
+	}
+	patternMatcher.prepareLock.Unlock()
+}
+
 func isGlobCandidate(str string) bool {
 	for i, c := range str {
 		if c == '?' || c == '[' {
@@ -92,9 +113,10 @@ func (patternMatcher *PatternMatcher) Add(pattern string, val interface{}, posit
 	}
 
 	pattern = strings.ToLower(pattern)
+	patternMatcher.prepared.Store(false)
 	switch patternType {
 	case PatternTypeSubstring:
-		patternMatcher.blockedSubstrings = append(patternMatcher.blockedSubstrings, pattern)
+		patternMatcher.blockedNames.addSubstring(pattern)
 		if val != nil {
 			patternMatcher.indirectVals[pattern] = val
 		}
@@ -106,7 +128,7 @@ func (patternMatcher *PatternMatcher) Add(pattern string, val interface{}, posit
 	case PatternTypePrefix:
 		patternMatcher.blockedPrefixes.Insert([]byte(pattern), val)
 	case PatternTypeSuffix:
-		patternMatcher.blockedSuffixes.Insert([]byte(StringReverse(pattern)), val)
+		patternMatcher.blockedNames.addSuffix(pattern, val)
 	case PatternTypeExact:
 		patternMatcher.blockedExact[pattern] = val
 	default:
@@ -124,31 +146,27 @@ func (patternMatcher *PatternMatcher) Eval(qName string) (reject bool, reason st
 		return true, qName, xval
 	}
 
-	revQname := StringReverse(qName)
-	if match, xval, found := patternMatcher.blockedSuffixes.LongestPrefix([]byte(revQname)); found {
-		if len(match) == len(revQname) || revQname[len(match)] == '.' {
-			return true, "*." + StringReverse(string(match)), xval
-		}
-		if len(match) < len(revQname) && len(revQname) > 0 {
-			if i := strings.LastIndex(revQname, "."); i > 0 {
-				pName := revQname[:i]
-				if match, _, found := patternMatcher.blockedSuffixes.LongestPrefix([]byte(pName)); found {
-					if len(match) == len(pName) || pName[len(match)] == '.' {
-						return true, "*." + StringReverse(string(match)), xval
-					}
-				}
-			}
-		}
+	patternMatcher.prepare()
+	var nameMatch nameMatch
+	singlePass, isSinglePass := patternMatcher.blockedNames.(singlePassNameIndex)
+	if isSinglePass {
+		nameMatch = singlePass.lookup(qName)
+	} else {
+		nameMatch.suffix, nameMatch.suffixVal, nameMatch.hasSuffix = patternMatcher.blockedNames.longestSuffix(qName)
+	}
+	if nameMatch.hasSuffix {
+		return true, "*." + nameMatch.suffix, nameMatch.suffixVal
 	}
 
 	if match, xval, found := patternMatcher.blockedPrefixes.LongestPrefix([]byte(qName)); found {
 		return true, string(match) + "*", xval
 	}
 
-	for _, substring := range patternMatcher.blockedSubstrings {
-		if strings.Contains(qName, substring) {
-			return true, "*" + substring + "*", patternMatcher.indirectVals[substring]
-		}
+	if !isSinglePass {
+		nameMatch.substring, nameMatch.hasSubstring = patternMatcher.blockedNames.firstSubstring(qName)
+	}
+	if nameMatch.hasSubstring {
+		return true, "*" + nameMatch.substring + "*", patternMatcher.indirectVals[nameMatch.substring]
 	}
 
 	for _, pattern := range patternMatcher.blockedPatterns {
@@ -0,0 +1,398 @@
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+	"github.com/jedisct1/dlog"
+	"github.com/k-sone/critbitgo"
+)
+
+const (
+	MatcherEngineCritbit     = "critbit"
+	MatcherEngineMap         = "map"
+	MatcherEngineRadix       = "radix"
+	MatcherEngineAhoCorasick = "aho-corasick"
+)
+
+var MatcherEngines = []string{MatcherEngineCritbit, MatcherEngineMap, MatcherEngineRadix, MatcherEngineAhoCorasick}
+
+// parsePatternMatcherEngine checks the name of a matching engine, the default being critbit
+func parsePatternMatcherEngine(engine string) (string, error) {
+	engine = strings.ToLower(engine)
+	if len(engine) == 0 {
+		engine = MatcherEngineCritbit
+	}
+	if !includesName(MatcherEngines, engine) {
+		return "", fmt.Errorf("Unsupported name matching engine: [%s]", engine)
+	}
+	return engine, nil
+}
+
+// nameIndex stores the suffix and substring rules of a pattern matcher.
+// When a rule is added more than once, the first value is kept.
+type nameIndex interface {
+	addSuffix(suffix string, val interface{})
+	addSubstring(substring string)
+	// prepare is called after all the rules have been added, before the first lookup
+	prepare()
+	// longestSuffix returns the longest suffix rule matching a name at a label boundary
+	longestSuffix(qName string) (string, interface{}, bool)
+	// firstSubstring returns the first substring rule, in insertion order, found in a name
+	firstSubstring(qName string) (string, bool)
+}
+
+// singlePassNameIndex is implemented by the indexes that find the suffix and the substring rules
+// matching a name in the same pass, so that Eval doesn't scan the name twice
+type singlePassNameIndex interface {
+	nameIndex
+	lookup(qName string) nameMatch
+}
+
+// nameMatch holds the longest suffix rule and the first substring rule matching a name
+type nameMatch struct {
+	suffix       string
+	suffixVal    interface{}
+	hasSuffix    bool
+	substring    string
+	hasSubstring bool
+}
+
+func newNameIndex(engine string) nameIndex {
+	switch engine {
+	case MatcherEngineMap:
+		return &mapNameIndex{suffixes: make(map[string]interface{})}
+	case MatcherEngineRadix:
+		return &radixNameIndex{txn: iradix.New().Txn()}
+	case MatcherEngineAhoCorasick:
+		return newAhoCorasickNameIndex()
+	default:
+		return &critbitNameIndex{suffixes: critbitgo.NewTrie()}
+	}
+}
+
+// linearSubstrings checks substring rules one after the other
+type linearSubstrings struct {
+	substrings []string
+}
+
+func (index *linearSubstrings) addSubstring(substring string) {
+	index.substrings = append(index.substrings, substring)
+}
+
+func (index *linearSubstrings) firstSubstring(qName string) (string, bool) {
+	for _, substring := range index.substrings {
+		if strings.Contains(qName, substring) {
+			return substring, true
+		}
+	}
+	return "", false
+}
+
+// critbitNameIndex stores reversed suffixes in a crit-bit tree
+type critbitNameIndex struct {
+	linearSubstrings
+	suffixes *critbitgo.Trie
+}
+
+func (index *critbitNameIndex) addSuffix(suffix string, val interface{}) {
+	index.suffixes.Insert([]byte(StringReverse(suffix)), val)
+}
+
+func (index *critbitNameIndex) prepare() {}
+
+func (index *critbitNameIndex) longestSuffix(qName string) (string, interface{}, bool) {
+	revQname := StringReverse(qName)
+	for {
+		match, xval, found := index.suffixes.LongestPrefix([]byte(revQname))
+		if !found {
+			return "", nil, false
+		}
+		if len(match) == len(revQname) || revQname[len(match)] == '.' {
+			return StringReverse(string(match)), xval, true
+		}
+		i := strings.LastIndex(revQname[:len(match)], ".")
+		if i <= 0 {
+			return "", nil, false
+		}
+		revQname = revQname[:i]
+	}
+}
+
+// mapNameIndex looks up every parent name of a name in a map
+type mapNameIndex struct {
+	linearSubstrings
+	suffixes map[string]interface{}
+}
+
+func (index *mapNameIndex) addSuffix(suffix string, val interface{}) {
+	if _, found := index.suffixes[suffix]; !found {
+		index.suffixes[suffix] = val
+	}
+}
+
+func (index *mapNameIndex) prepare() {}
+
+func (index *mapNameIndex) longestSuffix(qName string) (string, interface{}, bool) {
+	for name := qName; len(name) > 0; {
+		if xval, found := index.suffixes[name]; found {
+			return name, xval, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return "", nil, false
+}
+
+// radixNameIndex stores reversed suffixes in a compressed radix tree
+type radixNameIndex struct {
+	linearSubstrings
+	txn  *iradix.Txn
+	tree *iradix.Tree
+}
+
+func (index *radixNameIndex) addSuffix(suffix string, val interface{}) {
+	if index.txn == nil {
+		index.txn = index.tree.Txn()
+	}
+	key := []byte(StringReverse(suffix))
+	if _, found := index.txn.Get(key); !found {
+		index.txn.Insert(key, val)
+	}
+}
+
+func (index *radixNameIndex) prepare() {
+	if index.txn != nil {
+		index.tree, index.txn = index.txn.Commit(), nil
+	}
+}
+
+func (index *radixNameIndex) longestSuffix(qName string) (string, interface{}, bool) {
+	revQname := []byte(StringReverse(qName))
+	var match []byte
+	var xval interface{}
+	index.tree.Root().WalkPath(revQname, func(key []byte, val interface{}) bool {
+		if len(key) == len(revQname) || revQname[len(key)] == '.' {
+			match, xval = key, val
+		}
+		return false
+	})
+	if match == nil {
+		return "", nil, false
+	}
+	return StringReverse(string(match)), xval, true
+}
+
+// ahoCorasickNameIndex finds all suffix and substring rules in a single pass over a name.
+// Names are matched as "." + name + "\x00", so that a suffix rule is the substring "." + suffix + "\x00".
+type ahoCorasickNameIndex struct {
+	nodes   []ahoCorasickNode
+	rules   []ahoCorasickRule
+	ruleIDs map[string]int32
+}
+
+type ahoCorasickNode struct {
+	edges    []ahoCorasickEdge
+	fail     int32
+	rule     int32 // rule ending at this node, or -1
+	dictLink int32 // next node on the failure path with a rule, or -1
+}
+
+type ahoCorasickEdge struct {
+	label byte
+	node  int32
+}
+
+type ahoCorasickRule struct {
+	length   int
+	suffix   bool
+	name     string
+	val      interface{}
+	position int
+}
+
+func newAhoCorasickNameIndex() *ahoCorasickNameIndex {
+	return &ahoCorasickNameIndex{
+		nodes:   []ahoCorasickNode{{rule: -1, dictLink: -1}},
+		ruleIDs: make(map[string]int32),
+	}
+}
+
+func (index *ahoCorasickNameIndex) child(node int32, label byte) int32 {
+	for _, edge := range index.nodes[node].edges {
+		if edge.label == label {
+			return edge.node
+		}
+	}
+	return -1
+}
+
+func (index *ahoCorasickNameIndex) addRule(key string, rule ahoCorasickRule) {
+	if _, found := index.ruleIDs[key]; found {
+		return
+	}
+	node := int32(0)
+	for i := 0; i < len(key); i++ {
+		next := index.child(node, key[i])
+		if next < 0 {
+			next = int32(len(index.nodes))
+			index.nodes = append(index.nodes, ahoCorasickNode{rule: -1, dictLink: -1})
+			index.nodes[node].edges = append(index.nodes[node].edges, ahoCorasickEdge{label: key[i], node: next})
+		}
+		node = next
+	}
+	rule.length, rule.position = len(key), len(index.rules)
+	id := int32(len(index.rules))
+	index.rules = append(index.rules, rule)
+	index.ruleIDs[key] = id
+	index.nodes[node].rule = id
+}
+
+func (index *ahoCorasickNameIndex) addSuffix(suffix string, val interface{}) {
+	index.addRule("."+suffix+"\x00", ahoCorasickRule{suffix: true, name: suffix, val: val})
+}
+
+func (index *ahoCorasickNameIndex) addSubstring(substring string) {
+	index.addRule(substring, ahoCorasickRule{name: substring})
+}
+
+// prepare computes the failure links, breadth first
+func (index *ahoCorasickNameIndex) prepare() {
+	queue := make([]int32, 0, len(index.nodes))
+	for _, edge := range index.nodes[0].edges {
+		index.nodes[edge.node].fail = 0
+		queue = append(queue, edge.node)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, edge := range index.nodes[node].edges {
+			fail := index.nodes[node].fail
+			for {
+				if next := index.child(fail, edge.label); next >= 0 {
+					index.nodes[edge.node].fail = next
+					break
+				}
+				if fail == 0 {
+					index.nodes[edge.node].fail = 0
+					break
+				}
+				fail = index.nodes[fail].fail
+			}
+			failNode := &index.nodes[index.nodes[edge.node].fail]
+			if failNode.rule >= 0 {
+				index.nodes[edge.node].dictLink = index.nodes[edge.node].fail
+			} else {
+				index.nodes[edge.node].dictLink = failNode.dictLink
+			}
+			queue = append(queue, edge.node)
+		}
+	}
+}
+
+// scan returns the longest matching suffix rule, and the first matching substring rule
+func (index *ahoCorasickNameIndex) scan(qName string) (suffix *ahoCorasickRule, substring *ahoCorasickRule) {
+	text := "." + qName + "\x00"
+	node := int32(0)
+	for i := 0; i < len(text); i++ {
+		for {
+			if next := index.child(node, text[i]); next >= 0 {
+				node = next
+				break
+			}
+			if node == 0 {
+				break
+			}
+			node = index.nodes[node].fail
+		}
+		for output := node; output > 0; output = index.nodes[output].dictLink {
+			if index.nodes[output].rule < 0 {
+				continue
+			}
+			rule := &index.rules[index.nodes[output].rule]
+			if rule.suffix {
+				if suffix == nil || rule.length > suffix.length {
+					suffix = rule
+				}
+			} else if start := i + 1 - rule.length; start >= 1 && i < len(text)-1 {
+				if substring == nil || rule.position < substring.position {
+					substring = rule
+				}
+			}
+		}
+	}
+	return suffix, substring
+}
+
+func (index *ahoCorasickNameIndex) lookup(qName string) nameMatch {
+	var match nameMatch
+	suffix, substring := index.scan(qName)
+	if suffix != nil {
+		match.suffix, match.suffixVal, match.hasSuffix = suffix.name, suffix.val, true
+	}
+	if substring != nil {
+		match.substring, match.hasSubstring = substring.name, true
+	}
+	return match
+}
+
+func (index *ahoCorasickNameIndex) longestSuffix(qName string) (string, interface{}, bool) {
+	match := index.lookup(qName)
+	return match.suffix, match.suffixVal, match.hasSuffix
+}
+
+func (index *ahoCorasickNameIndex) firstSubstring(qName string) (string, bool) {
+	match := index.lookup(qName)
+	return match.substring, match.hasSubstring
+}
+
+// benchmarkPatternMatcherEngines loads a set of rules with every engine, and logs how long it took,
+// the memory used and the lookup speed, so that the engine can be chosen for the hardware
+func benchmarkPatternMatcherEngines(rules []string) {
+	names := make([]string, 0, 1000)
+	for _, rule := range rules {
+		if len(names) >= cap(names)/2 {
+			break
+		}
+		if name := strings.Trim(rule, "*=."); len(name) > 0 && !isGlobCandidate(rule) {
+			names = append(names, "www."+name, name+".example")
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	var memStats runtime.MemStats
+	for _, engine := range MatcherEngines {
+		runtime.GC()
+		runtime.ReadMemStats(&memStats)
+		heapBefore := memStats.HeapAlloc
+		start := time.Now()
+		patternMatcher := NewPatternMatcherWithEngine(engine)
+		for i, rule := range rules {
+			_ = patternMatcher.Add(rule, true, i+1)
+		}
+		patternMatcher.Eval("example.com")
+		buildTime := time.Since(start)
+		runtime.GC()
+		runtime.ReadMemStats(&memStats)
+		heapSize := int64(memStats.HeapAlloc) - int64(heapBefore)
+		lookups := 0
+		start = time.Now()
+		for time.Since(start) < 100*time.Millisecond {
+			for _, name := range names {
+				patternMatcher.Eval(name)
+			}
+			lookups += len(names)
+		}
+		lookupTime := time.Since(start) / time.Duration(lookups)
+		runtime.KeepAlive(patternMatcher)
+		dlog.Noticef("Name matching engine [%s]: %d rules loaded in %v, %d KB, %v per lookup",
+			engine, len(rules), buildTime.Round(time.Millisecond), Max(0, int(heapSize/1024)), lookupTime)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import "testing"
+
+func TestPatternMatcherEngines(t *testing.T) {
+	rules := []string{
+		"example.com",
+		"*.ads.example.net",
+		"ple.com",
+		"com.example",
+		"=exact.example.org",
+		"tracker*",
+		"*banner*",
+		"*.metrics*",
+		"*ad[0-9].example.org",
+	}
+	names := map[string]string{
+		"example.com":            "*.example.com",
+		"www.example.com":        "*.example.com",
+		"apple.com":              "",
+		"x.apple.com":            "",
+		"www.ple.com":            "*.ple.com",
+		"ads.example.net":        "*.ads.example.net",
+		"xads.example.net":       "",
+		"exact.example.org":      "exact.example.org",
+		"www.exact.example.org":  "",
+		"tracker.example.io":     "tracker*",
+		"topbanners.example.io":  "*banner*",
+		"metrics.example.io":     "",
+		"app.metrics.example.io": "*.metrics*",
+		"www.ad7.example.org":    "*ad[0-9].example.org",
+		"com":                    "",
+		"banner.example.com":     "*.example.com",
+		"tracker.banner.io":      "tracker*",
+	}
+	for _, engine := range MatcherEngines {
+		if _, err := parsePatternMatcherEngine(engine); err != nil {
+			t.Fatal(err)
+		}
+		patternMatcher := NewPatternMatcherWithEngine(engine)
+		for i, rule := range rules {
+			if err := patternMatcher.Add(rule, i+1, i+1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for name, expected := range names {
+			_, reason, _ := patternMatcher.Eval(name)
+			if reason != expected {
+				t.Errorf("[%s] %s: expected [%s], got [%s]", engine, name, expected, reason)
+			}
+		}
+	}
+	if _, err := parsePatternMatcherEngine("unknown"); err == nil {
+		t.Error("an unknown engine should be rejected")
+	}
+}
+
+func TestAhoCorasickLookup(t *testing.T) {
+	index := newAhoCorasickNameIndex()
+	index.addSuffix("example.com", 1)
+	index.addSubstring("banner")
+	index.addSubstring("ban")
+	index.prepare()
+	match := index.lookup("banner.example.com")
+	if !match.hasSuffix || match.suffix != "example.com" || match.suffixVal != 1 {
+		t.Errorf("unexpected suffix match: %+v", match)
+	}
+	if !match.hasSubstring || match.substring != "banner" {
+		t.Errorf("unexpected substring match: %+v", match)
+	}
+	if match := index.lookup("www.example.org"); match.hasSuffix || match.hasSubstring {
+		t.Errorf("unexpected match: %+v", match)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"errors"
@@ -34,7 +34,7 @@ func (plugin *PluginAllowName) Init(proxy *Proxy) error {
 		return err
 	}
 	plugin.allWeeklyRanges = proxy.allWeeklyRanges
-	plugin.patternMatcher = NewPatternMatcher()
+	plugin.patternMatcher = NewPatternMatcherWithEngine(proxy.matcherEngine)
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
@@ -93,6 +93,7 @@ func (plugin *PluginAllowName) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 		}
 	}
 	if allowList {
+		pluginsState.trace.add("rule", "[%s] allowed by %s", qName, reason)
 		pluginsState.sessionData["whitelisted"] = true
 		if plugin.logger != nil {
 			var clientIPStr string
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"errors"
@@ -15,9 +15,10 @@
 
 type PluginBlockIP struct {
 	blockedPrefixes *iradix.Tree
-	blockedIPs      map[string]interface{}
+	blockedRanges   IPRangeSet
 	logger          io.Writer
 	format          string
+	logOnly         bool
 }
 
 func (plugin *PluginBlockIP) Name() string {
@@ -35,15 +36,31 @@ func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 		return err
 	}
 	plugin.blockedPrefixes = iradix.New()
-	plugin.blockedIPs = make(map[string]interface{})
+	plugin.logOnly = proxy.blockIPLogOnly
+	rulesCount := 0
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
 			continue
 		}
-		ip := net.ParseIP(line)
+		if strings.ContainsAny(line, "/-") { // networks and address ranges
+			blockedRange, err := parseIPRange(line)
+			if err != nil {
+				dlog.Errorf("%v at line %d", err, lineNo)
+				continue
+			}
+			plugin.blockedRanges.add(blockedRange)
+			rulesCount++
+			continue
+		}
+		if net.ParseIP(line) != nil {
+			blockedRange, _ := parseIPRange(line)
+			plugin.blockedRanges.add(blockedRange)
+			rulesCount++
+			continue
+		}
 		trailingStar := strings.HasSuffix(line, "*")
-		if len(line) < 2 || (ip != nil && trailingStar) {
+		if len(line) < 2 {
 			dlog.Errorf("Suspicious IP blocking rule [%s] at line %d", line, lineNo)
 			continue
 		}
@@ -65,9 +82,13 @@ func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 		if trailingStar {
 			plugin.blockedPrefixes, _, _ = plugin.blockedPrefixes.Insert([]byte(line), 0)
 		} else {
-			plugin.blockedIPs[line] = true
+			dlog.Errorf("Invalid IP blocking rule [%s] at line %d", line, lineNo)
 		}
 	}
+	plugin.blockedRanges.build()
+	if rulesCount > 0 {
+		dlog.Noticef("%d addresses and networks to block, aggregated into %d ranges", rulesCount, plugin.blockedRanges.count())
+	}
 	if len(proxy.blockIPLogFile) == 0 {
 		return nil
 	}
@@ -94,6 +115,7 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 		return nil
 	}
 	reject, reason, ipStr := false, "", ""
+	var ip net.IP
 	for _, answer := range answers {
 		header := answer.Header()
 		Rrtype := header.Rrtype
@@ -101,12 +123,13 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 			continue
 		}
 		if Rrtype == dns.TypeA {
-			ipStr = answer.(*dns.A).A.String()
+			ip = answer.(*dns.A).A
 		} else if Rrtype == dns.TypeAAAA {
-			ipStr = answer.(*dns.AAAA).AAAA.String() // IPv4-mapped IPv6 addresses are converted to IPv4
+			ip = answer.(*dns.AAAA).AAAA
 		}
-		if _, found := plugin.blockedIPs[ipStr]; found {
-			reject, reason = true, ipStr
+		ipStr = ip.String() // IPv4-mapped IPv6 addresses are converted to IPv4
+		if blockedRange, found := plugin.blockedRanges.lookup(ip); found {
+			reject, reason = true, blockedRange.String()
 			break
 		}
 		match, _, found := plugin.blockedPrefixes.Root().LongestPrefix([]byte(ipStr))
@@ -118,8 +141,14 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 		}
 	}
 	if reject {
-		pluginsState.action = PluginsActionReject
-		pluginsState.returnCode = PluginsReturnCodeReject
+		if plugin.logOnly {
+			reason = reason + " (log only)"
+			pluginsState.markWouldBlock(pluginsState.qName, reason)
+		} else {
+			pluginsState.trace.add("rule", "[%s] blocked by %s", pluginsState.qName, reason)
+			pluginsState.action = PluginsActionReject
+			pluginsState.returnCode = PluginsReturnCodeReject
+		}
 		if plugin.logger != nil {
 			qName := pluginsState.qName
 			var clientIPStr string
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"errors"
@@ -15,16 +15,24 @@
 type BlockedNames struct {
 	allWeeklyRanges *map[string]WeeklyRanges
 	patternMatcher  *PatternMatcher
+	lists           *BlockLists
 	logger          io.Writer
 	format          string
+	logOnly         bool
 }
 
 const aliasesLimit = 8
 
-var blockedNames *BlockedNames
-
 func (blockedNames *BlockedNames) check(pluginsState *PluginsState, qName string, aliasFor *string) (bool, error) {
 	reject, reason, xweeklyRanges := blockedNames.patternMatcher.Eval(qName)
+	logOnly := reject && blockedNames.logOnly
+	// Rules being trialed in the names file don't prevent enforced lists from blocking, and vice versa
+	if (!reject || logOnly) && blockedNames.lists != nil {
+		if listReject, listReason, listLogOnly := blockedNames.lists.check(qName); listReject && (!reject || !listLogOnly) {
+			reject, reason, logOnly = true, listReason, listLogOnly
+			xweeklyRanges = nil
+		}
+	}
 	if aliasFor != nil {
 		reason = reason + " (alias for [" + *aliasFor + "])"
 	}
@@ -40,8 +48,14 @@ func (blockedNames *BlockedNames) check(pluginsState *PluginsState, qName string
 	if !reject {
 		return false, nil
 	}
-	pluginsState.action = PluginsActionReject
-	pluginsState.returnCode = PluginsReturnCodeReject
+	if logOnly {
+		reason = reason + " (log only)"
+		pluginsState.markWouldBlock(qName, reason)
+	} else {
+		pluginsState.trace.add("rule", "[%s] blocked by %s", qName, reason)
+		pluginsState.action = PluginsActionReject
+		pluginsState.returnCode = PluginsReturnCodeReject
+	}
 	if blockedNames.logger != nil {
 		var clientIPStr string
 		switch pluginsState.clientProto {
@@ -70,12 +84,14 @@ func (blockedNames *BlockedNames) check(pluginsState *PluginsState, qName string
 		}
 		_, _ = blockedNames.logger.Write([]byte(line))
 	}
-	return true, nil
+	return !logOnly, nil
 }
 
 // ---
 
-type PluginBlockName struct{}
+type PluginBlockName struct {
+	blockedNames *BlockedNames
+}
 
 func (plugin *PluginBlockName) Name() string {
 	return "block_name"
@@ -86,15 +102,24 @@ func (plugin *PluginBlockName) Description() string {
 }
 
 func (plugin *PluginBlockName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of blocking rules from [%s]", proxy.blockNameFile)
-	lines, err := ReadTextFile(proxy.blockNameFile)
-	if err != nil {
-		return err
-	}
 	xBlockedNames := BlockedNames{
 		allWeeklyRanges: proxy.allWeeklyRanges,
-		patternMatcher:  NewPatternMatcher(),
+		patternMatcher:  NewPatternMatcherWithEngine(proxy.matcherEngine),
+		lists:           proxy.blockLists,
+		logOnly:         proxy.blockNameLogOnly,
+	}
+	if proxy.blockLists != nil {
+		proxy.blockLists.loadCached()
+	}
+	lines := ""
+	if len(proxy.blockNameFile) > 0 {
+		dlog.Noticef("Loading the set of blocking rules from [%s]", proxy.blockNameFile)
+		var err error
+		if lines, err = ReadTextFile(proxy.blockNameFile); err != nil {
+			return err
+		}
 	}
+	var benchmarkRules []string
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
@@ -122,13 +147,21 @@ func (plugin *PluginBlockName) Init(proxy *Proxy) error {
 			dlog.Error(err)
 			continue
 		}
+		if proxy.matcherBenchmark {
+			benchmarkRules = append(benchmarkRules, line)
+		}
+	}
+	if len(benchmarkRules) > 0 {
+		benchmarkPatternMatcherEngines(benchmarkRules)
 	}
-	blockedNames = &xBlockedNames
+	plugin.blockedNames = &xBlockedNames
+	// The response plugin, initialized after the query plugins, shares the same rules
+	proxy.blockedNames = plugin.blockedNames
 	if len(proxy.blockNameLogFile) == 0 {
 		return nil
 	}
-	blockedNames.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockNameLogFile)
-	blockedNames.format = proxy.blockNameFormat
+	plugin.blockedNames.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockNameLogFile)
+	plugin.blockedNames.format = proxy.blockNameFormat
 
 	return nil
 }
@@ -142,16 +175,18 @@ func (plugin *PluginBlockName) Reload() error {
 }
 
 func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	if blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
+	if plugin.blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
 		return nil
 	}
-	_, err := blockedNames.check(pluginsState, pluginsState.qName, nil)
+	_, err := plugin.blockedNames.check(pluginsState, pluginsState.qName, nil)
 	return err
 }
 
 // ---
 
-type PluginBlockNameResponse struct{}
+type PluginBlockNameResponse struct {
+	blockedNames *BlockedNames
+}
 
 func (plugin *PluginBlockNameResponse) Name() string {
 	return "block_name"
@@ -162,6 +197,7 @@ func (plugin *PluginBlockNameResponse) Description() string {
 }
 
 func (plugin *PluginBlockNameResponse) Init(proxy *Proxy) error {
+	plugin.blockedNames = proxy.blockedNames
 	return nil
 }
 
@@ -174,13 +210,11 @@ func (plugin *PluginBlockNameResponse) Reload() error {
 }
 
 func (plugin *PluginBlockNameResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	if blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
+	if plugin.blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
 		return nil
 	}
-	aliasFor := pluginsState.qName
-	aliasesLeft := aliasesLimit
-	answers := msg.Answer
-	for _, answer := range answers {
+	var owners, targets []string
+	for _, answer := range msg.Answer {
 		header := answer.Header()
 		if header.Class != dns.ClassINET {
 			continue
@@ -195,17 +229,51 @@ func (plugin *PluginBlockNameResponse) Eval(pluginsState *PluginsState, msg *dns
 		} else {
 			continue
 		}
-		target, err := NormalizeQName(target)
+		owner, err := NormalizeQName(header.Name)
 		if err != nil {
 			return err
 		}
-		if blocked, err := blockedNames.check(pluginsState, target, &aliasFor); blocked || err != nil {
+		target, err = NormalizeQName(target)
+		if err != nil {
 			return err
 		}
+		owners, targets = append(owners, owner), append(targets, target)
+	}
+	aliasFor := pluginsState.qName
+	aliasesLeft := aliasesLimit
+	checked := make([]bool, len(targets))
+	// Follow the chain from the query name first, so that cloaked names are checked in order
+	name := pluginsState.qName
+	for aliasesLeft > 0 {
+		next := -1
+		for i, owner := range owners {
+			if !checked[i] && owner == name {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		checked[next] = true
 		aliasesLeft--
+		if blocked, err := plugin.blockedNames.check(pluginsState, targets[next], &aliasFor); blocked || err != nil {
+			return err
+		}
+		name = targets[next]
+	}
+	// Targets that are not part of the chain are checked as well
+	for i, target := range targets {
 		if aliasesLeft == 0 {
 			break
 		}
+		if checked[i] {
+			continue
+		}
+		aliasesLeft--
+		if blocked, err := plugin.blockedNames.check(pluginsState, target, &aliasFor); blocked || err != nil {
+			return err
+		}
 	}
 	return nil
 }
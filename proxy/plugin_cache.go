@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	sieve "github.com/opencoff/go-sieve"
+)
+
+const StaleResponseTTL = 30 * time.Second
+
+type CachedResponse struct {
+	expiration time.Time
+	// stored is when the response was received, or zero if it is unknown
+	stored time.Time
+	msg    dns.Msg
+}
+
+type CachedResponses struct {
+	sync.RWMutex
+	cache *sieve.Sieve[[32]byte, CachedResponse]
+	// previous holds the entries of the cache before it was resized, until they are moved or dropped
+	previous *sieve.Sieve[[32]byte, CachedResponse]
+	// pinned holds the responses to the priming queries, that are never evicted
+	pinned map[[32]byte]CachedResponse
+	// suspended is the time the system spent suspended, during which the monotonic clock was stopped.
+	// Expirations are stored with the value it had, so that they are shortened by later suspends.
+	suspended time.Duration
+}
+
+func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) [32]byte {
+	question := msg.Question[0]
+	h := sha512.New512_256()
+	var tmp [5]byte
+	binary.LittleEndian.PutUint16(tmp[0:2], question.Qtype)
+	binary.LittleEndian.PutUint16(tmp[2:4], question.Qclass)
+	if pluginsState.dnssec {
+		tmp[4] = 1
+	}
+	h.Write(tmp[:])
+	normalizedRawQName := []byte(question.Name)
+	NormalizeRawQName(&normalizedRawQName)
+	h.Write(normalizedRawQName)
+	var sum [32]byte
+	h.Sum(sum[:0])
+
+	return sum
+}
+
+func (cachedResponses *CachedResponses) store(cacheKey [32]byte, cachedResponse CachedResponse, cacheSize int) {
+	cachedResponses.Lock()
+	if cachedResponses.cache == nil {
+		cachedResponses.cache = sieve.New[[32]byte, CachedResponse](cacheSize)
+	}
+	cachedResponse.shift(cachedResponses.suspended)
+	cachedResponses.cache.Add(cacheKey, cachedResponse)
+	cachedResponses.Unlock()
+}
+
+// pin stores a response that is kept regardless of the cache size, until it is replaced
+func (cachedResponses *CachedResponses) pin(cacheKey [32]byte, cachedResponse CachedResponse) {
+	cachedResponses.Lock()
+	if cachedResponses.pinned == nil {
+		cachedResponses.pinned = make(map[[32]byte]CachedResponse)
+	}
+	cachedResponse.shift(cachedResponses.suspended)
+	cachedResponses.pinned[cacheKey] = cachedResponse
+	cachedResponses.Unlock()
+}
+
+// addSuspended makes the cached responses expire earlier by the time the system spent suspended
+func (cachedResponses *CachedResponses) addSuspended(suspended time.Duration) {
+	cachedResponses.Lock()
+	cachedResponses.suspended += suspended
+	cachedResponses.Unlock()
+}
+
+// lookup returns a cached response. Entries found in the cache used before a resize
+// are moved to the current cache.
+func (cachedResponses *CachedResponses) lookup(cacheKey [32]byte) (CachedResponse, bool) {
+	cachedResponses.RLock()
+	if cached, ok := cachedResponses.pinned[cacheKey]; ok {
+		cached.shift(-cachedResponses.suspended)
+		cachedResponses.RUnlock()
+		return cached, true
+	}
+	if cachedResponses.cache == nil {
+		cachedResponses.RUnlock()
+		return CachedResponse{}, false
+	}
+	cached, ok := cachedResponses.cache.Get(cacheKey)
+	previous := cachedResponses.previous
+	suspended := cachedResponses.suspended
+	cachedResponses.RUnlock()
+	if ok || previous == nil {
+		cached.shift(-suspended)
+		return cached, ok
+	}
+	if cached, ok = previous.Get(cacheKey); !ok {
+		return cached, false
+	}
+	cachedResponses.Lock()
+	if cachedResponses.previous == previous {
+		previous.Delete(cacheKey)
+		cachedResponses.cache.Add(cacheKey, cached)
+	}
+	cachedResponses.Unlock()
+	cached.shift(-suspended)
+	return cached, true
+}
+
+func (cachedResponse *CachedResponse) shift(delta time.Duration) {
+	cachedResponse.expiration = cachedResponse.expiration.Add(delta)
+	if !cachedResponse.stored.IsZero() {
+		cachedResponse.stored = cachedResponse.stored.Add(delta)
+	}
+}
+
+// ---
+
+// bypassesCache tells whether responses for a name must always be fetched from upstream servers
+func bypassesCache(bypass *PatternMatcher, qName string) bool {
+	if bypass == nil {
+		return false
+	}
+	match, _, _ := bypass.Eval(qName)
+	return match
+}
+
+type PluginCache struct {
+	sharedCache *SharedCache
+	bypass      *PatternMatcher
+	proxy       *Proxy
+	lazyGrace   time.Duration
+	refreshing  struct {
+		sync.Mutex
+		keys map[[32]byte]struct{}
+	}
+}
+
+func (plugin *PluginCache) Name() string {
+	return "cache"
+}
+
+func (plugin *PluginCache) Description() string {
+	return "DNS cache (reader)."
+}
+
+func (plugin *PluginCache) Init(proxy *Proxy) error {
+	plugin.sharedCache = proxy.sharedCache
+	plugin.bypass = proxy.cacheBypass
+	plugin.proxy = proxy
+	plugin.lazyGrace = proxy.cacheLazyGrace
+	plugin.refreshing.keys = make(map[[32]byte]struct{})
+	return nil
+}
+
+func (plugin *PluginCache) Drop() error {
+	return nil
+}
+
+func (plugin *PluginCache) Reload() error {
+	return nil
+}
+
+func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if bypassesCache(plugin.bypass, pluginsState.qName) {
+		pluginsState.trace.add("cache", "bypassed for [%s]", pluginsState.qName)
+		return nil
+	}
+	if pluginsState.clientProto == "priming" || pluginsState.clientProto == "refresh" {
+		return nil
+	}
+	cacheKey := computeCacheKey(pluginsState, msg)
+
+	var synth *dns.Msg
+	var expiration, stored time.Time
+	if cached, ok := plugin.proxy.cachedResponses.lookup(cacheKey); ok {
+		expiration, stored = cached.expiration, cached.stored
+		synth = cached.msg.Copy()
+	}
+	if synth == nil {
+		if plugin.sharedCache == nil {
+			return nil
+		}
+		var ok bool
+		if synth, expiration, ok = getShared(&plugin.proxy.cachedResponses, plugin.sharedCache, cacheKey, pluginsState.cacheSize); !ok {
+			return nil
+		}
+		pluginsState.trace.add("cache", "found in the shared cache")
+	}
+
+	synth.Id = msg.Id
+	synth.Response = true
+	synth.Compress = true
+	synth.Question = msg.Question
+
+	if time.Now().After(expiration) {
+		if plugin.lazyGrace > 0 && time.Since(expiration) <= plugin.lazyGrace {
+			updateTTL(synth, time.Now().Add(StaleResponseTTL))
+			pluginsState.trace.add("cache", "expired, served while being refreshed")
+			plugin.refreshLazily(cacheKey, msg)
+			pluginsState.synthResponse = synth
+			pluginsState.action = PluginsActionSynth
+			pluginsState.cacheHit = true
+			return nil
+		}
+		expiration2 := time.Now().Add(StaleResponseTTL)
+		updateTTL(synth, expiration2)
+		pluginsState.sessionData["stale"] = synth
+		return nil
+	}
+
+	updateTTL(synth, expiration)
+
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.cacheHit = true
+	if !stored.IsZero() {
+		pluginsState.cacheAge = time.Since(stored)
+	}
+	return nil
+}
+
+// refreshLazily sends a query in the background to replace an expired entry that was served from the cache.
+// A single refresh is sent at a time for a given entry.
+func (plugin *PluginCache) refreshLazily(cacheKey [32]byte, msg *dns.Msg) {
+	plugin.refreshing.Lock()
+	if _, found := plugin.refreshing.keys[cacheKey]; found {
+		plugin.refreshing.Unlock()
+		return
+	}
+	plugin.refreshing.keys[cacheKey] = struct{}{}
+	plugin.refreshing.Unlock()
+	packet, err := msg.Pack()
+	go func() {
+		defer func() {
+			plugin.refreshing.Lock()
+			delete(plugin.refreshing.keys, cacheKey)
+			plugin.refreshing.Unlock()
+		}()
+		proxy := plugin.proxy
+		if err != nil || !proxy.clientsCountInc() {
+			return
+		}
+		proxy.processIncomingQuery("refresh", proxy.mainProto, packet, nil, nil, time.Now(), false)
+		proxy.clientsCountDec()
+	}()
+}
+
+// ---
+
+type PluginCacheResponse struct {
+	cachedResponses *CachedResponses
+	sharedCache     *SharedCache
+	haPeering       *HAPeering
+	bypass          *PatternMatcher
+}
+
+func (plugin *PluginCacheResponse) Name() string {
+	return "cache_response"
+}
+
+func (plugin *PluginCacheResponse) Description() string {
+	return "DNS cache (writer)."
+}
+
+func (plugin *PluginCacheResponse) Init(proxy *Proxy) error {
+	plugin.cachedResponses = &proxy.cachedResponses
+	plugin.sharedCache = proxy.sharedCache
+	if plugin.sharedCache != nil {
+		go plugin.sharedCache.writeLoop(proxy.quit)
+	}
+	plugin.haPeering = proxy.haPeering
+	plugin.bypass = proxy.cacheBypass
+	return nil
+}
+
+func (plugin *PluginCacheResponse) Drop() error {
+	return nil
+}
+
+func (plugin *PluginCacheResponse) Reload() error {
+	return nil
+}
+
+func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError && msg.Rcode != dns.RcodeNotAuth {
+		return nil
+	}
+	if msg.Truncated || bypassesCache(plugin.bypass, pluginsState.qName) {
+		return nil
+	}
+	cacheKey := computeCacheKey(pluginsState, msg)
+	ttl := getMinTTL(
+		msg,
+		pluginsState.cacheMinTTL,
+		pluginsState.cacheMaxTTL,
+		pluginsState.cacheNegMinTTL,
+		pluginsState.cacheNegMaxTTL,
+	)
+	now := time.Now()
+	cachedResponse := CachedResponse{
+		expiration: now.Add(ttl),
+		stored:     now,
+		msg:        *msg,
+	}
+	if pluginsState.clientProto == "priming" {
+		plugin.cachedResponses.pin(cacheKey, cachedResponse)
+	} else {
+		plugin.cachedResponses.store(cacheKey, cachedResponse, pluginsState.cacheSize)
+	}
+	if plugin.sharedCache != nil {
+		plugin.sharedCache.set(cacheKey, &cachedResponse)
+	}
+	if plugin.haPeering != nil {
+		plugin.haPeering.noticeCached(cacheKey, &cachedResponse)
+	}
+	updateTTL(msg, cachedResponse.expiration)
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedResponsesSuspended(t *testing.T) {
+	var cachedResponses CachedResponses
+	var cacheKey [32]byte
+	expiration := time.Now().Add(time.Hour)
+	cachedResponses.store(cacheKey, CachedResponse{expiration: expiration}, 10)
+	cachedResponses.addSuspended(20 * time.Minute)
+	cached, found := cachedResponses.lookup(cacheKey)
+	if !found || !cached.expiration.Equal(expiration.Add(-20*time.Minute)) {
+		t.Errorf("expiration not shortened by the suspend: %v", cached.expiration)
+	}
+
+	var otherKey [32]byte
+	otherKey[0] = 1
+	cachedResponses.store(otherKey, CachedResponse{expiration: expiration}, 10)
+	if cached, _ := cachedResponses.lookup(otherKey); !cached.expiration.Equal(expiration) {
+		t.Errorf("entry stored after the suspend shortened: %v", cached.expiration)
+	}
+}
+
+func TestCachedResponsesPinned(t *testing.T) {
+	var cachedResponses CachedResponses
+	var pinnedKey [32]byte
+	pinnedKey[0] = 0xff
+	cachedResponses.pin(pinnedKey, CachedResponse{expiration: time.Now().Add(time.Hour)})
+	for i := 0; i < 10; i++ {
+		var cacheKey [32]byte
+		cacheKey[0] = byte(i)
+		cachedResponses.store(cacheKey, CachedResponse{expiration: time.Now().Add(time.Hour)}, 2)
+	}
+	if _, found := cachedResponses.lookup(pinnedKey); !found {
+		t.Error("pinned entry evicted")
+	}
+}
+
+func TestMonotonicExpiration(t *testing.T) {
+	wall := time.Now().Add(time.Minute).Round(0)
+	expiration := monotonicExpiration(wall)
+	if expiration == expiration.Round(0) {
+		t.Error("no monotonic clock reading")
+	}
+	if delta := expiration.Sub(wall); delta < -time.Second || delta > time.Second {
+		t.Errorf("expiration moved by %v", delta)
+	}
+}
@@ -0,0 +1,118 @@
+// Work around Mozilla's evil plan - https://sk.tl/3Ek6tzhq
+// and other mechanisms that let applications bypass the system resolver.
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	CanaryPolicyNXDomain = "nxdomain"
+	CanaryPolicyPass     = "pass"
+)
+
+type canaryDomain struct {
+	name          string
+	canary        string
+	withSubdomain bool
+}
+
+// Applications check these names to decide whether they should use their own encrypted resolver
+var canaryDomains = []canaryDomain{
+	{name: "use-application-dns.net", canary: "mozilla", withSubdomain: true},
+	{name: "mask.icloud.com", canary: "icloud_private_relay"},
+	{name: "mask-h2.icloud.com", canary: "icloud_private_relay"},
+}
+
+type PluginCanaryDomains struct {
+	policies map[string]string
+	logger   io.Writer
+}
+
+func (plugin *PluginCanaryDomains) Name() string {
+	return "canary_domains"
+}
+
+func (plugin *PluginCanaryDomains) Description() string {
+	return "Answer canary domains, so that applications don't bypass the proxy"
+}
+
+func (plugin *PluginCanaryDomains) Init(proxy *Proxy) error {
+	plugin.policies = proxy.canaryPolicies
+	if len(proxy.canaryLogFile) > 0 {
+		plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.canaryLogFile)
+	}
+	dlog.Noticef("Canary domains handling initialized")
+	return nil
+}
+
+func (plugin *PluginCanaryDomains) Drop() error {
+	return nil
+}
+
+func (plugin *PluginCanaryDomains) Reload() error {
+	return nil
+}
+
+func (plugin *PluginCanaryDomains) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.clientProto == "local_doh" {
+		return nil
+	}
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	qName := pluginsState.qName
+	var canary string
+	for _, candidate := range canaryDomains {
+		if qName == candidate.name || (candidate.withSubdomain && strings.HasSuffix(qName, "."+candidate.name)) {
+			canary = candidate.canary
+			break
+		}
+	}
+	if len(canary) == 0 {
+		return nil
+	}
+	policy := plugin.policies[canary]
+	plugin.log(pluginsState, canary, policy)
+	if policy != CanaryPolicyNXDomain {
+		return nil
+	}
+	synth := EmptyResponseFromMessage(msg)
+	synth.Rcode = dns.RcodeNameError
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	pluginsState.trace.add("rule", "[%s] is a %s canary domain", qName, canary)
+	return nil
+}
+
+func (plugin *PluginCanaryDomains) log(pluginsState *PluginsState, canary string, policy string) {
+	var clientIPStr string
+	switch pluginsState.clientProto {
+	case "udp":
+		clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
+	case "tcp":
+		clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
+	default:
+		return
+	}
+	dlog.Infof("Canary domain [%s] (%s) queried by [%s]", pluginsState.qName, canary, clientIPStr)
+	if plugin.logger == nil {
+		return
+	}
+	now := time.Now()
+	year, month, day := now.Date()
+	hour, minute, second := now.Clock()
+	tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+	line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(pluginsState.qName), canary, policy)
+	_, _ = plugin.logger.Write([]byte(line))
+}
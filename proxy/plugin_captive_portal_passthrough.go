@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type PluginCaptivePortalPassthrough struct {
+	detector *CaptivePortalDetector
+}
+
+func (plugin *PluginCaptivePortalPassthrough) Name() string {
+	return "captive_portal_passthrough"
+}
+
+func (plugin *PluginCaptivePortalPassthrough) Description() string {
+	return "Forward queries for the portal names to the local network resolvers while a captive portal is detected"
+}
+
+func (plugin *PluginCaptivePortalPassthrough) Init(proxy *Proxy) error {
+	plugin.detector = proxy.captivePortalDetector
+	dlog.Noticef("Captive portal detection enabled, using %v during portal sessions", plugin.detector.resolvers)
+	return nil
+}
+
+func (plugin *PluginCaptivePortalPassthrough) Drop() error {
+	return nil
+}
+
+func (plugin *PluginCaptivePortalPassthrough) Reload() error {
+	return nil
+}
+
+func (plugin *PluginCaptivePortalPassthrough) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if !plugin.detector.detected.Load() {
+		return nil
+	}
+	if !plugin.detector.isPortalName(pluginsState.qName) {
+		pluginsState.trace.add("captive portal", "[%s] is not a name of the portal", pluginsState.qName)
+		return nil
+	}
+	client := dns.Client{Net: "udp", Timeout: pluginsState.timeout}
+	var respMsg *dns.Msg
+	var err error
+	for _, resolver := range plugin.detector.resolvers {
+		pluginsState.serverName = resolver
+		if respMsg, _, err = client.Exchange(msg, resolver); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	respMsg.Id = msg.Id
+	pluginsState.synthResponse = respMsg
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeForward
+	return nil
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+const ClientTagNone = "-"
+
+// ResponsePluginNames and LoggingPluginNames list the plugins that can be scoped, besides the query plugins
+var (
+	ResponsePluginNames = []string{
+		"scrub_responses", "sanitize_responses", "nx_log", "allow_ip", "block_name", "block_ip", "dns64", "cache_response",
+	}
+	LoggingPluginNames = []string{"query_log"}
+)
+
+// PluginScope restricts a plugin to the queries received on some listeners, or sent by some clients
+type PluginScope struct {
+	Listeners  []string `toml:"listeners"`
+	ClientTags []string `toml:"client_tags"`
+}
+
+func (scope *PluginScope) matches(label string, tag string) bool {
+	if len(scope.Listeners) > 0 && !includesName(scope.Listeners, label) {
+		return false
+	}
+	if len(scope.ClientTags) > 0 && !includesName(scope.ClientTags, tag) {
+		return false
+	}
+	return true
+}
+
+type clientTagNetwork struct {
+	network *net.IPNet
+	tag     string
+}
+
+// ClientTags assigns tags to clients according to their address.
+// If networks of different tags overlap, the most specific network wins.
+type ClientTags struct {
+	networks []clientTagNetwork
+	tags     []string
+}
+
+func NewClientTags(tagsNetworks map[string][]string) (*ClientTags, error) {
+	clientTags := &ClientTags{}
+	for tag, cidrs := range tagsNetworks {
+		networks, err := parseClientNetworks(cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network for client tag [%s]: %v", tag, err)
+		}
+		for _, network := range networks {
+			clientTags.networks = append(clientTags.networks, clientTagNetwork{network: network, tag: tag})
+		}
+		clientTags.tags = append(clientTags.tags, tag)
+	}
+	sort.Strings(clientTags.tags)
+	sort.SliceStable(clientTags.networks, func(i, j int) bool {
+		onesI, _ := clientTags.networks[i].network.Mask.Size()
+		onesJ, _ := clientTags.networks[j].network.Mask.Size()
+		if onesI != onesJ {
+			return onesI > onesJ
+		}
+		return clientTags.networks[i].tag < clientTags.networks[j].tag
+	})
+	return clientTags, nil
+}
+
+func (clientTags *ClientTags) tagForIP(ip net.IP) string {
+	if clientTags == nil || ip == nil {
+		return ClientTagNone
+	}
+	for _, network := range clientTags.networks {
+		if network.network.Contains(ip) {
+			return network.tag
+		}
+	}
+	return ClientTagNone
+}
+
+// pluginChain is the set of plugins applied to the queries of a listener label and a client tag
+type pluginChain struct {
+	queryPlugins    *[]Plugin
+	responsePlugins *[]Plugin
+	loggingPlugins  *[]Plugin
+}
+
+func pluginChainKey(label string, tag string) string {
+	return label + "\x00" + tag
+}
+
+func scopedPlugins(plugins *[]Plugin, scopes map[string]PluginScope, label string, tag string) *[]Plugin {
+	chainPlugins := make([]Plugin, 0, len(*plugins))
+	for _, plugin := range *plugins {
+		if scope, found := scopes[queryPluginName(plugin)]; found && !scope.matches(label, tag) {
+			continue
+		}
+		chainPlugins = append(chainPlugins, plugin)
+	}
+	return &chainPlugins
+}
+
+// buildPluginChains builds a chain of plugins for every combination of a listener label and a client tag
+func (proxy *Proxy) buildPluginChains(queryPlugins *[]Plugin, responsePlugins *[]Plugin, loggingPlugins *[]Plugin) (map[string]*pluginChain, error) {
+	tags := []string{ClientTagNone}
+	if proxy.clientTags != nil {
+		tags = append(tags, proxy.clientTags.tags...)
+	}
+	labels := []string{ListenerLabelNone}
+	for _, options := range proxy.listenerOptions {
+		if len(options.Label) > 0 && !includesName(labels, options.Label) {
+			labels = append(labels, options.Label)
+		}
+	}
+	for name, scope := range proxy.pluginScopes {
+		if !includesName(QueryPluginNames, name) && !includesName(ResponsePluginNames, name) && !includesName(LoggingPluginNames, name) {
+			return nil, fmt.Errorf("Unknown plugin in plugin_scopes: [%s]", name)
+		}
+		for _, tag := range scope.ClientTags {
+			if !includesName(tags, tag) {
+				return nil, fmt.Errorf("Undefined client tag for the [%s] plugin: [%s]", name, tag)
+			}
+		}
+	}
+	chains := make(map[string]*pluginChain)
+	for _, label := range labels {
+		for _, tag := range tags {
+			chains[pluginChainKey(label, tag)] = &pluginChain{
+				queryPlugins:    scopedPlugins(queryPlugins, proxy.pluginScopes, label, tag),
+				responsePlugins: scopedPlugins(responsePlugins, proxy.pluginScopes, label, tag),
+				loggingPlugins:  scopedPlugins(loggingPlugins, proxy.pluginScopes, label, tag),
+			}
+		}
+	}
+	return chains, nil
+}
+
+// pluginChain returns the chain of plugins a query goes through, or nil if plugins are not scoped
+func (pluginsState *PluginsState) pluginChain(pluginsGlobals *PluginsGlobals) *pluginChain {
+	if pluginsGlobals.chains == nil {
+		return nil
+	}
+	if pluginsState.chain != nil {
+		return pluginsState.chain
+	}
+	var clientIP net.IP
+	if pluginsState.clientAddr != nil {
+		switch pluginsState.clientProto {
+		case "udp":
+			clientIP = (*pluginsState.clientAddr).(*net.UDPAddr).IP
+		case "tcp", "local_doh":
+			clientIP = (*pluginsState.clientAddr).(*net.TCPAddr).IP
+		}
+	}
+	tag := pluginsGlobals.clientTags.tagForIP(clientIP)
+	chain, found := pluginsGlobals.chains[pluginChainKey(pluginsState.listenerLabel(), tag)]
+	if !found {
+		chain = pluginsGlobals.chains[pluginChainKey(ListenerLabelNone, tag)]
+	}
+	pluginsState.chain = chain
+	return chain
+}
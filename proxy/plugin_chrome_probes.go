@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+const (
+	ChromeProbesPass     = "pass"
+	ChromeProbesNXDomain = "nxdomain"
+)
+
+// commonBigrams are the most frequent letter pairs in English words
+var commonBigrams = map[string]struct{}{
+	"th": {}, "he": {}, "in": {}, "er": {}, "an": {}, "re": {}, "on": {}, "at": {}, "en": {}, "nd": {},
+	"ti": {}, "es": {}, "or": {}, "te": {}, "of": {}, "ed": {}, "is": {}, "it": {}, "al": {}, "ar": {},
+	"st": {}, "to": {}, "nt": {}, "ng": {}, "se": {}, "ha": {}, "as": {}, "ou": {}, "io": {}, "le": {},
+	"ve": {}, "co": {}, "me": {}, "de": {}, "hi": {}, "ri": {}, "ro": {}, "ic": {}, "ne": {}, "ea": {},
+	"ra": {}, "ce": {},
+}
+
+// Chrome checks whether the network hijacks NXDOMAIN responses by resolving
+// random single-label names made of 7 to 15 lowercase letters. Names with many
+// common English letter pairs are more likely to be actual host names.
+func isChromeProbe(qName string) bool {
+	if len(qName) < 7 || len(qName) > 15 {
+		return false
+	}
+	for i := 0; i < len(qName); i++ {
+		if c := qName[i]; c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	common := 0
+	for i := 0; i+1 < len(qName); i++ {
+		if _, found := commonBigrams[qName[i:i+2]]; found {
+			common++
+		}
+	}
+	return common*4 < len(qName)-1
+}
+
+type PluginChromeProbes struct{}
+
+func (plugin *PluginChromeProbes) Name() string {
+	return "chrome_probes"
+}
+
+func (plugin *PluginChromeProbes) Description() string {
+	return "Answer the random names Chrome queries to detect NXDOMAIN hijacking"
+}
+
+func (plugin *PluginChromeProbes) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginChromeProbes) Drop() error {
+	return nil
+}
+
+func (plugin *PluginChromeProbes) Reload() error {
+	return nil
+}
+
+func (plugin *PluginChromeProbes) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+	if !isChromeProbe(pluginsState.qName) {
+		return nil
+	}
+	synth := EmptyResponseFromMessage(msg)
+	synth.Rcode = dns.RcodeNameError
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	pluginsState.unlogged = true
+	pluginsState.queryStats.recordChromeProbe()
+	pluginsState.trace.add("rule", "[%s] looks like a Chrome probe", pluginsState.qName)
+	return nil
+}
@@ -0,0 +1,16 @@
+package proxy
+
+import "testing"
+
+func TestIsChromeProbe(t *testing.T) {
+	for _, name := range []string{"printer", "desktop", "fileserver", "strength", "homeassistant", "example.com", "abc", "router1"} {
+		if isChromeProbe(name) {
+			t.Errorf("[%s] considered as a probe", name)
+		}
+	}
+	for _, name := range []string{"qxjzlwpk", "bvkqhfzumy", "wdxpgoqyz", "ujfkcbmzqa"} {
+		if !isChromeProbe(name) {
+			t.Errorf("[%s] not considered as a probe", name)
+		}
+	}
+}
@@ -1,7 +1,6 @@
-package main
+package proxy
 
 import (
-	"math/rand"
 	"net"
 	"strings"
 	"sync"
@@ -27,6 +26,7 @@ type PluginCloak struct {
 	patternMatcher *PatternMatcher
 	ttl            uint32
 	createPTR      bool
+	random         *lockedRand
 }
 
 func (plugin *PluginCloak) Name() string {
@@ -45,7 +45,8 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 	}
 	plugin.ttl = proxy.cloakTTL
 	plugin.createPTR = proxy.cloakedPTR
-	plugin.patternMatcher = NewPatternMatcher()
+	plugin.random = proxy.random
+	plugin.patternMatcher = NewPatternMatcherWithEngine(proxy.matcherEngine)
 	cloakedNames := make(map[string]*CloakedName)
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
@@ -153,6 +154,7 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 		return nil
 	}
 	cloakedName := xcloakedName.(*CloakedName)
+	pluginsState.trace.add("rule", "[%s] cloaked by the rule at line %d", pluginsState.qName, cloakedName.lineNo)
 	ttl, expired := plugin.ttl, false
 	if cloakedName.lastUpdate != nil {
 		if elapsed := uint32(now.Sub(*cloakedName.lastUpdate).Seconds()); elapsed < ttl {
@@ -213,7 +215,7 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 			synth.Answer = append(synth.Answer, rr)
 		}
 	}
-	rand.Shuffle(
+	plugin.random.Shuffle(
 		len(synth.Answer),
 		func(i, j int) { synth.Answer[i], synth.Answer[j] = synth.Answer[j], synth.Answer[i] },
 	)
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DDRResolverName = "resolver.arpa"
+	DDRTTL          = 300
+)
+
+type DDREndpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+type PluginDDR struct {
+	targetName string
+	dohPath    string
+	proxy      *Proxy
+}
+
+func (plugin *PluginDDR) Name() string {
+	return "ddr"
+}
+
+func (plugin *PluginDDR) Description() string {
+	return "Advertise the local DoH server using Discovery of Designated Resolvers."
+}
+
+func (plugin *PluginDDR) Init(proxy *Proxy) error {
+	plugin.targetName = proxy.localDoHDDRServerName
+	if len(plugin.targetName) == 0 {
+		plugin.targetName = certificateServerName(proxy.localDoHCertFile, proxy.localDoHCertKeyFile)
+	}
+	if len(plugin.targetName) == 0 {
+		return errors.New("A server name is required to advertise the local DoH server, set `ddr_server_name`")
+	}
+	plugin.targetName = dns.Fqdn(strings.ToLower(plugin.targetName))
+	plugin.dohPath = proxy.localDoHPath + "{?dns}"
+	for _, listenAddrStr := range proxy.currentLocalDoHListenAddresses() {
+		if _, err := net.ResolveTCPAddr("tcp", listenAddrStr); err != nil {
+			return err
+		}
+	}
+	plugin.proxy = proxy
+	dlog.Noticef("Advertising the local DoH server as [%s]", plugin.targetName)
+	return nil
+}
+
+func (plugin *PluginDDR) Drop() error {
+	return nil
+}
+
+func (plugin *PluginDDR) Reload() error {
+	return nil
+}
+
+func (plugin *PluginDDR) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET || question.Qtype != dns.TypeSVCB {
+		return nil
+	}
+	qName := dns.Fqdn(pluginsState.qName)
+	if qName != "_dns."+DDRResolverName+"." && qName != "_dns."+plugin.targetName {
+		return nil
+	}
+	synth := EmptyResponseFromMessage(msg)
+	// Local DoH listeners can be added and removed at runtime
+	for i, endpoint := range ddrEndpoints(plugin.proxy.currentLocalDoHListenAddresses()) {
+		rr := new(dns.SVCB)
+		rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: DDRTTL}
+		rr.Priority = uint16(i + 1)
+		rr.Target = plugin.targetName
+		rr.Value = append(rr.Value, &dns.SVCBAlpn{Alpn: []string{"h2", "http/1.1"}})
+		rr.Value = append(rr.Value, &dns.SVCBPort{Port: endpoint.port})
+		if len(endpoint.ip) > 0 && !endpoint.ip.IsUnspecified() && !endpoint.ip.IsLinkLocalUnicast() {
+			if ipv4 := endpoint.ip.To4(); ipv4 != nil {
+				rr.Value = append(rr.Value, &dns.SVCBIPv4Hint{Hint: []net.IP{ipv4}})
+			} else {
+				rr.Value = append(rr.Value, &dns.SVCBIPv6Hint{Hint: []net.IP{endpoint.ip}})
+			}
+		}
+		rr.Value = append(rr.Value, &dns.SVCBDoHPath{Template: plugin.dohPath})
+		synth.Answer = append(synth.Answer, rr)
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
+
+func ddrEndpoints(listenAddrStrs []string) []DDREndpoint {
+	endpoints := make([]DDREndpoint, 0, len(listenAddrStrs))
+	for _, listenAddrStr := range listenAddrStrs {
+		listenAddr, err := net.ResolveTCPAddr("tcp", listenAddrStr)
+		if err != nil {
+			continue
+		}
+		endpoints = append(endpoints, DDREndpoint{ip: listenAddr.IP, port: uint16(listenAddr.Port)})
+	}
+	return endpoints
+}
+
+// certificateServerName returns the first DNS name of a certificate
+func certificateServerName(certFile string, certKeyFile string) string {
+	if len(certFile) == 0 || len(certKeyFile) == 0 {
+		return ""
+	}
+	keyPair, err := tls.LoadX509KeyPair(certFile, certKeyFile)
+	if err != nil || len(keyPair.Certificate) == 0 {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
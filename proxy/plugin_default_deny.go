@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// PluginDefaultDeny refuses the queries for names that are not explicitly allowed,
+// either for all clients, or only for clients within a set of networks
+type PluginDefaultDeny struct {
+	clients []*net.IPNet
+}
+
+func (plugin *PluginDefaultDeny) Name() string {
+	return "default_deny"
+}
+
+func (plugin *PluginDefaultDeny) Description() string {
+	return "Refuse the names that are not in the allow list"
+}
+
+func (plugin *PluginDefaultDeny) Init(proxy *Proxy) error {
+	plugin.clients = proxy.defaultDenyClients
+	return nil
+}
+
+func (plugin *PluginDefaultDeny) Drop() error {
+	return nil
+}
+
+func (plugin *PluginDefaultDeny) Reload() error {
+	return nil
+}
+
+func (plugin *PluginDefaultDeny) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if allowed, found := pluginsState.sessionData["whitelisted"]; found && allowed.(bool) {
+		return nil
+	}
+	var clientIP net.IP
+	switch pluginsState.clientProto {
+	case "udp":
+		clientIP = (*pluginsState.clientAddr).(*net.UDPAddr).IP
+	case "tcp", "local_doh":
+		clientIP = (*pluginsState.clientAddr).(*net.TCPAddr).IP
+	default:
+		// Ignore internal flow.
+		return nil
+	}
+	if len(plugin.clients) > 0 {
+		matches := false
+		for _, network := range plugin.clients {
+			if network.Contains(clientIP) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return nil
+		}
+	}
+	pluginsState.trace.add("rule", "[%s] is not in the allow list", pluginsState.qName)
+	pluginsState.action = PluginsActionReject
+	pluginsState.returnCode = PluginsReturnCodeReject
+	return nil
+}
@@ -1,7 +1,6 @@
-package main
+package proxy
 
 import (
-	"math/rand"
 	"net"
 
 	"github.com/jedisct1/dlog"
@@ -9,7 +8,8 @@
 )
 
 type PluginECS struct {
-	nets []*net.IPNet
+	nets   []*net.IPNet
+	random *lockedRand
 }
 
 func (plugin *PluginECS) Name() string {
@@ -22,6 +22,7 @@ func (plugin *PluginECS) Description() string {
 
 func (plugin *PluginECS) Init(proxy *Proxy) error {
 	plugin.nets = proxy.ednsClientSubnets
+	plugin.random = proxy.random
 	dlog.Notice("ECS plugin enabled")
 	return nil
 }
@@ -62,7 +63,7 @@ func (plugin *PluginECS) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	}
 	prr := dns.EDNS0_SUBNET{}
 	prr.Code = dns.EDNS0SUBNET
-	net := plugin.nets[rand.Intn(len(plugin.nets))]
+	net := plugin.nets[plugin.random.Intn(len(plugin.nets))]
 	bits, totalSize := net.Mask.Size()
 	if totalSize == 32 {
 		prr.Family = 1
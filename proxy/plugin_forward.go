@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const ForwardHealthCheckInterval = 10 * time.Second
+
+type PluginForwardServer struct {
+	addr string
+	down atomic.Bool
+}
+
+type PluginForwardEntry struct {
+	domain  string
+	servers []*PluginForwardServer
+}
+
+type PluginForward struct {
+	forwardMap           []PluginForwardEntry
+	servers              map[string]*PluginForwardServer
+	truncatedUDPRetryTCP bool
+	failover             bool
+	timeout              time.Duration
+	tcpPool              *TCPPool
+	spoofAudit           *SpoofAudit
+	recorder             *UpstreamRecorder
+	random               *lockedRand
+	quit                 chan struct{}
+}
+
+func (plugin *PluginForward) Name() string {
+	return "forward"
+}
+
+func (plugin *PluginForward) Description() string {
+	return "Route queries matching specific domains to a dedicated set of servers"
+}
+
+func (plugin *PluginForward) Init(proxy *Proxy) error {
+	plugin.truncatedUDPRetryTCP = proxy.truncatedUDPRetryTCP
+	plugin.failover = proxy.forwardFailover
+	plugin.timeout = proxy.timeout
+	plugin.tcpPool = proxy.tcpPool
+	plugin.spoofAudit = proxy.spoofAudit
+	plugin.recorder = proxy.upstreamRecorder
+	plugin.random = proxy.random
+	plugin.quit = proxy.quit
+	plugin.servers = make(map[string]*PluginForwardServer)
+	dlog.Noticef("Loading the set of forwarding rules from [%s]", proxy.forwardFile)
+	lines, err := ReadTextFile(proxy.forwardFile)
+	if err != nil {
+		return err
+	}
+	for lineNo, line := range strings.Split(lines, "\n") {
+		line = TrimAndStripInlineComments(line)
+		if len(line) == 0 {
+			continue
+		}
+		domain, serversStr, ok := StringTwoFields(line)
+		if !ok {
+			return fmt.Errorf(
+				"Syntax error for a forwarding rule at line %d. Expected syntax: example.com 9.9.9.9,8.8.8.8",
+				1+lineNo,
+			)
+		}
+		domain = strings.ToLower(domain)
+		var servers []*PluginForwardServer
+		for _, server := range strings.Split(serversStr, ",") {
+			server = strings.TrimSpace(server)
+			server = strings.TrimPrefix(server, "[")
+			server = strings.TrimSuffix(server, "]")
+			if ip := net.ParseIP(server); ip != nil {
+				if ip.To4() != nil {
+					server = fmt.Sprintf("%s:%d", server, 53)
+				} else {
+					server = fmt.Sprintf("[%s]:%d", server, 53)
+				}
+			}
+			dlog.Infof("Forwarding [%s] to %s", domain, server)
+			forwardServer, found := plugin.servers[server]
+			if !found {
+				forwardServer = &PluginForwardServer{addr: server}
+				plugin.servers[server] = forwardServer
+			}
+			servers = append(servers, forwardServer)
+		}
+		if len(servers) == 0 {
+			continue
+		}
+		plugin.forwardMap = append(plugin.forwardMap, PluginForwardEntry{
+			domain:  domain,
+			servers: servers,
+		})
+	}
+	if plugin.failover && !plugin.recorder.replaying() {
+		go plugin.healthCheck()
+	}
+	return nil
+}
+
+func (plugin *PluginForward) Drop() error {
+	return nil
+}
+
+func (plugin *PluginForward) Reload() error {
+	return nil
+}
+
+func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	qName := pluginsState.qName
+	qNameLen := len(qName)
+	var servers []*PluginForwardServer
+	for _, candidate := range plugin.forwardMap {
+		candidateLen := len(candidate.domain)
+		if candidateLen > qNameLen {
+			continue
+		}
+		if (qName[qNameLen-candidateLen:] == candidate.domain &&
+			(candidateLen == qNameLen || (qName[qNameLen-candidateLen-1] == '.'))) ||
+			(candidate.domain == ".") {
+			servers = candidate.servers
+			break
+		}
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	var respMsg *dns.Msg
+	var err error
+	if plugin.recorder.replaying() {
+		respMsg, err = plugin.replay(pluginsState, msg)
+	} else if !plugin.failover {
+		server := servers[plugin.random.Intn(len(servers))]
+		pluginsState.serverName = server.addr
+		pluginsState.trace.add("forward", "sending the query to [%s]", server.addr)
+		respMsg, err = plugin.exchange(pluginsState, msg, server.addr)
+	} else {
+		respMsg, err = plugin.exchangeWithFailover(pluginsState, msg, servers)
+	}
+	if err != nil {
+		return err
+	}
+	if edns0 := respMsg.IsEdns0(); edns0 == nil || !edns0.Do() {
+		respMsg.AuthenticatedData = false
+	}
+	respMsg.Id = msg.Id
+	pluginsState.synthResponse = respMsg
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeForward
+	return nil
+}
+
+// exchangeWithFailover tries the servers in order, skipping the ones known to be down unless there are no other options
+func (plugin *PluginForward) exchangeWithFailover(pluginsState *PluginsState, msg *dns.Msg, servers []*PluginForwardServer) (*dns.Msg, error) {
+	var respMsg *dns.Msg
+	var err error
+	for i, server := range orderedForwardServers(servers) {
+		if i > 0 {
+			pluginsState.upstreamRetries++
+		}
+		pluginsState.serverName = server.addr
+		pluginsState.trace.add("forward", "sending the query to [%s]", server.addr)
+		respMsg, err = plugin.exchange(pluginsState, msg, server.addr)
+		if err == nil && respMsg.Rcode != dns.RcodeServerFailure {
+			if server.down.CompareAndSwap(true, false) {
+				dlog.Noticef("Forwarding server [%s] is reachable again", server.addr)
+			}
+			break
+		}
+		if server.down.CompareAndSwap(false, true) {
+			dlog.Warnf("Forwarding server [%s] is not responding, trying the next one", server.addr)
+		}
+	}
+	return respMsg, err
+}
+
+func (plugin *PluginForward) exchange(pluginsState *PluginsState, msg *dns.Msg, server string) (*dns.Msg, error) {
+	proto := pluginsState.serverProto
+	pluginsState.upstreamTransport = "dns/" + proto
+	respMsg, err := plugin.exchangeOver(proto, msg, server, pluginsState.timeout)
+	if err == errSpoofingDetected {
+		pluginsState.trace.add("forward", "forged responses received, retrying over TCP")
+		pluginsState.upstreamRetries++
+		pluginsState.upstreamTransport = "dns/tcp"
+		respMsg, err = plugin.exchangeOver("tcp", msg, server, pluginsState.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if respMsg.Truncated && proto != "tcp" && (pluginsState.clientProto != "udp" || plugin.truncatedUDPRetryTCP) {
+		pluginsState.upstreamRetries++
+		pluginsState.upstreamTransport = "dns/tcp"
+		respMsg, err = plugin.exchangeOver("tcp", msg, server, pluginsState.timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if plugin.recorder.recording() {
+		if query, err := msg.Pack(); err == nil {
+			if response, err := respMsg.Pack(); err == nil {
+				plugin.recorder.record(server, query, response)
+			}
+		}
+	}
+	return respMsg, nil
+}
+
+// replay returns the response recorded for a query, instead of sending it to a forwarding server
+func (plugin *PluginForward) replay(pluginsState *PluginsState, msg *dns.Msg) (*dns.Msg, error) {
+	pluginsState.serverName = UpstreamReplayServerName
+	pluginsState.upstreamTransport = "replay"
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	response := plugin.recorder.replay(query)
+	if response == nil {
+		pluginsState.trace.add("forward", "no recorded response")
+		return nil, errors.New("No recorded response")
+	}
+	respMsg := dns.Msg{}
+	if err := respMsg.Unpack(response); err != nil {
+		return nil, err
+	}
+	return &respMsg, nil
+}
+
+func (plugin *PluginForward) exchangeOver(proto string, msg *dns.Msg, server string, timeout time.Duration) (*dns.Msg, error) {
+	if proto == "tcp" && plugin.tcpPool != nil {
+		return plugin.tcpPool.Exchange(msg, server, timeout)
+	}
+	if proto == "udp" && plugin.spoofAudit != nil {
+		return plugin.spoofAudit.exchangeUDP(msg, server, timeout)
+	}
+	client := dns.Client{Net: proto, Timeout: timeout}
+	respMsg, _, err := client.Exchange(msg, server)
+	return respMsg, err
+}
+
+func orderedForwardServers(servers []*PluginForwardServer) []*PluginForwardServer {
+	ordered := make([]*PluginForwardServer, 0, len(servers))
+	for _, server := range servers {
+		if !server.down.Load() {
+			ordered = append(ordered, server)
+		}
+	}
+	for _, server := range servers {
+		if server.down.Load() {
+			ordered = append(ordered, server)
+		}
+	}
+	return ordered
+}
+
+// healthCheck periodically queries the servers marked as down, so that they can be used
+// again as soon as they are back, before the queries themselves get to them
+func (plugin *PluginForward) healthCheck() {
+	ticker := time.NewTicker(ForwardHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-plugin.quit:
+			return
+		case <-ticker.C:
+		}
+		for _, server := range plugin.servers {
+			if !server.down.Load() {
+				continue
+			}
+			msg := new(dns.Msg)
+			msg.SetQuestion(".", dns.TypeNS)
+			// Some servers only accept TCP
+			for _, proto := range []string{"udp", "tcp"} {
+				client := dns.Client{Net: proto, Timeout: plugin.timeout}
+				if respMsg, _, err := client.Exchange(msg, server.addr); err == nil && respMsg.Rcode != dns.RcodeServerFailure {
+					if server.down.CompareAndSwap(true, false) {
+						dlog.Noticef("Forwarding server [%s] is reachable again", server.addr)
+					}
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type PluginLANHosts struct {
+	lanHosts *LANHosts
+	ttl      uint32
+}
+
+func (plugin *PluginLANHosts) Name() string {
+	return "lan_hosts"
+}
+
+func (plugin *PluginLANHosts) Description() string {
+	return "Answer queries for the names and addresses of LAN devices"
+}
+
+func (plugin *PluginLANHosts) Init(proxy *Proxy) error {
+	plugin.lanHosts = proxy.lanHosts
+	plugin.ttl = proxy.lanHostsTTL
+	return nil
+}
+
+func (plugin *PluginLANHosts) Drop() error {
+	return nil
+}
+
+func (plugin *PluginLANHosts) Reload() error {
+	return plugin.lanHosts.load()
+}
+
+func (plugin *PluginLANHosts) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	qName := pluginsState.qName
+	synth := EmptyResponseFromMessage(msg)
+	if strings.HasSuffix(qName, ".in-addr.arpa") || strings.HasSuffix(qName, ".ip6.arpa") {
+		name, found := plugin.lanHosts.nameForReverse(qName)
+		if !found {
+			return nil
+		}
+		if question.Qtype == dns.TypePTR {
+			rr := new(dns.PTR)
+			rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: plugin.ttl}
+			rr.Ptr = dns.Fqdn(name)
+			synth.Answer = []dns.RR{rr}
+		}
+	} else {
+		addrs := plugin.lanHosts.addrs(qName)
+		if len(addrs) == 0 {
+			return nil
+		}
+		for _, ip := range addrs {
+			if ipv4 := ip.To4(); ipv4 != nil && question.Qtype == dns.TypeA {
+				rr := new(dns.A)
+				rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: plugin.ttl}
+				rr.A = ipv4
+				synth.Answer = append(synth.Answer, rr)
+			} else if ipv4 == nil && question.Qtype == dns.TypeAAAA {
+				rr := new(dns.AAAA)
+				rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: plugin.ttl}
+				rr.AAAA = ip
+				synth.Answer = append(synth.Answer, rr)
+			}
+		}
+	}
+	pluginsState.trace.add("rule", "[%s] is a LAN host", qName)
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"errors"
@@ -12,8 +12,9 @@
 )
 
 type PluginNxLog struct {
-	logger io.Writer
-	format string
+	logger   io.Writer
+	format   string
+	nodeName string
 }
 
 func (plugin *PluginNxLog) Name() string {
@@ -25,8 +26,9 @@ func (plugin *PluginNxLog) Description() string {
 }
 
 func (plugin *PluginNxLog) Init(proxy *Proxy) error {
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.nxLogFile)
+	plugin.logger = RetainedLogger(proxy.logMaxSize, proxy.logMaxBackups, proxy.nxLogFile, proxy.nxLogRetention)
 	plugin.format = proxy.nxLogFormat
+	plugin.nodeName = proxy.nodeName
 
 	return nil
 }
@@ -66,10 +68,18 @@ func (plugin *PluginNxLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 		year, month, day := now.Date()
 		hour, minute, second := now.Clock()
 		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
-		line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(qName), qType)
+		line = fmt.Sprintf("%s\t%s\t%s\t%s", tsStr, clientIPStr, StringQuote(qName), qType)
+		if len(plugin.nodeName) > 0 {
+			line += "\t" + plugin.nodeName
+		}
+		line += "\n"
 	} else if plugin.format == "ltsv" {
-		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\n",
+		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s",
 			time.Now().Unix(), clientIPStr, StringQuote(qName), qType)
+		if len(plugin.nodeName) > 0 {
+			line += "\tnode:" + plugin.nodeName
+		}
+		line += "\n"
 	} else {
 		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 	}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const QueryLogWouldBlockMarker = "WOULD_BLOCK"
+
+type PluginQueryLog struct {
+	logger        io.Writer
+	format        string
+	ignoredQtypes []string
+	anonymizer    *IPAnonymizer
+	lanHosts      *LANHosts
+	labels        bool
+	bus           *QueryLogBus
+	nodeName      string
+	ipTags        bool
+	annotations   bool
+	wouldBlock    bool
+}
+
+func (plugin *PluginQueryLog) Name() string {
+	return "query_log"
+}
+
+func (plugin *PluginQueryLog) Description() string {
+	return "Log DNS queries."
+}
+
+func (plugin *PluginQueryLog) Init(proxy *Proxy) error {
+	if len(proxy.queryLogFile) != 0 {
+		plugin.logger = RetainedLogger(proxy.logMaxSize, proxy.logMaxBackups, proxy.queryLogFile, proxy.queryLogRetention)
+	}
+	plugin.bus = proxy.queryLogBus
+	plugin.format = proxy.queryLogFormat
+	plugin.ignoredQtypes = proxy.queryLogIgnoredQtypes
+	plugin.anonymizer = proxy.queryLogAnonymizer
+	plugin.labels = proxy.listenerLabels
+	plugin.nodeName = proxy.nodeName
+	plugin.ipTags = proxy.queryLogIPTags != nil
+	plugin.annotations = proxy.queryLogAnnotations
+	plugin.wouldBlock = proxy.queryLogWouldBlock
+	// Names of LAN devices are not shown if client addresses have to be anonymized
+	if proxy.lanHostsLogClientNames && (plugin.anonymizer == nil || plugin.anonymizer.mode == IPAnonymizationNone) {
+		plugin.lanHosts = proxy.lanHosts
+	}
+
+	return nil
+}
+
+func (plugin *PluginQueryLog) Drop() error {
+	return nil
+}
+
+func (plugin *PluginQueryLog) Reload() error {
+	return nil
+}
+
+func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	var clientIP net.IP
+	switch pluginsState.clientProto {
+	case "udp":
+		clientIP = (*pluginsState.clientAddr).(*net.UDPAddr).IP
+	case "tcp", "local_doh":
+		clientIP = (*pluginsState.clientAddr).(*net.TCPAddr).IP
+	default:
+		// Ignore internal flow.
+		return nil
+	}
+	clientIPStr := clientIP.String()
+	if name, found := plugin.clientName(clientIP); found {
+		clientIPStr = name
+	} else if plugin.anonymizer != nil {
+		clientIPStr = plugin.anonymizer.Anonymize(clientIP)
+	}
+	question := msg.Question[0]
+	qType, ok := dns.TypeToString[question.Qtype]
+	if !ok {
+		qType = string(qType)
+	}
+	if len(plugin.ignoredQtypes) > 0 {
+		for _, ignoredQtype := range plugin.ignoredQtypes {
+			if strings.EqualFold(ignoredQtype, qType) {
+				return nil
+			}
+		}
+	}
+	qName := pluginsState.qName
+
+	if pluginsState.cacheHit {
+		pluginsState.serverName = "-"
+	} else {
+		switch pluginsState.returnCode {
+		case PluginsReturnCodeSynth, PluginsReturnCodeCloak, PluginsReturnCodeParseError:
+			pluginsState.serverName = "-"
+		}
+	}
+	transport := pluginsState.upstreamTransport
+	if pluginsState.serverName == "-" || len(transport) == 0 {
+		transport = "-"
+	}
+	cached := 0
+	if pluginsState.cacheHit {
+		cached = 1
+	}
+	returnCode, ok := PluginsReturnCodeToString[pluginsState.returnCode]
+	if !ok {
+		returnCode = string(returnCode)
+	}
+
+	var requestDuration time.Duration
+	if !pluginsState.requestStart.IsZero() && !pluginsState.requestEnd.IsZero() {
+		requestDuration = pluginsState.requestEnd.Sub(pluginsState.requestStart)
+	}
+	if plugin.bus != nil {
+		event := &QueryLogEvent{
+			Time:       time.Now(),
+			Client:     clientIPStr,
+			Name:       qName,
+			Type:       qType,
+			ReturnCode: returnCode,
+			Cached:     pluginsState.cacheHit,
+			DurationMs: int64(requestDuration / time.Millisecond),
+			Server:     pluginsState.serverName,
+			Transport:  transport,
+			Retries:    pluginsState.upstreamRetries,
+			Size:       pluginsState.responseSize,
+			Node:       plugin.nodeName,
+			Tags:       pluginsState.ipTags,
+			WouldBlock: pluginsState.wouldBlock,
+		}
+		if plugin.labels {
+			event.Listener = pluginsState.listenerLabel()
+		}
+		plugin.bus.enqueue(event)
+		if plugin.logger == nil {
+			return nil
+		}
+	}
+	var line string
+	if plugin.format == "tsv" {
+		now := time.Now()
+		year, month, day := now.Date()
+		hour, minute, second := now.Clock()
+		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+		line = fmt.Sprintf(
+			"%s\t%s\t%s\t%s\t%s\t%dms\t%s",
+			tsStr,
+			clientIPStr,
+			StringQuote(qName),
+			qType,
+			returnCode,
+			requestDuration/time.Millisecond,
+			StringQuote(pluginsState.serverName),
+		)
+		// Additional columns are only added if one of them is enabled, so that the format doesn't change otherwise.
+		// They are then all present, in the same order, with placeholders for the ones that are not enabled.
+		if plugin.extendedColumns() {
+			label, node, tags, wouldBlock := "-", "-", "-", "-"
+			if plugin.labels {
+				label = StringQuote(pluginsState.listenerLabel())
+			}
+			if len(plugin.nodeName) > 0 {
+				node = plugin.nodeName
+			}
+			if plugin.ipTags {
+				tags = formatIPTags(pluginsState.ipTags)
+			}
+			// Queries that a log-only rule would have blocked are marked, so that rules can be trialed
+			if plugin.wouldBlock && pluginsState.wouldBlock {
+				wouldBlock = QueryLogWouldBlockMarker
+			}
+			line += fmt.Sprintf("\t%s\t%s\t%s\t%s", label, node, tags, wouldBlock)
+			if plugin.annotations {
+				line += fmt.Sprintf("\t%s\t%d\t%d\t%d", transport, pluginsState.upstreamRetries, pluginsState.responseSize, cached)
+			} else {
+				line += "\t-\t-\t-\t-"
+			}
+		}
+		line += "\n"
+	} else if plugin.format == "ltsv" {
+		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\treturn:%s\tcached:%d\tduration:%d\tserver:%s",
+			time.Now().Unix(), clientIPStr, StringQuote(qName), qType, returnCode, cached, requestDuration/time.Millisecond, StringQuote(pluginsState.serverName))
+		if plugin.labels {
+			line += "\tlistener:" + StringQuote(pluginsState.listenerLabel())
+		}
+		if len(plugin.nodeName) > 0 {
+			line += "\tnode:" + plugin.nodeName
+		}
+		if plugin.ipTags {
+			line += "\ttags:" + formatIPTags(pluginsState.ipTags)
+		}
+		if plugin.wouldBlock {
+			wouldBlock := 0
+			if pluginsState.wouldBlock {
+				wouldBlock = 1
+			}
+			line += fmt.Sprintf("\twould_block:%d", wouldBlock)
+		}
+		if plugin.annotations {
+			line += fmt.Sprintf("\ttransport:%s\tretries:%d\tsize:%d", transport, pluginsState.upstreamRetries, pluginsState.responseSize)
+		}
+		line += "\n"
+	} else {
+		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
+	}
+	if plugin.logger == nil {
+		return errors.New("Log file not initialized")
+	}
+	_, _ = plugin.logger.Write([]byte(line))
+
+	return nil
+}
+
+// extendedColumns tells whether columns are added to the default TSV format
+func (plugin *PluginQueryLog) extendedColumns() bool {
+	return plugin.labels || len(plugin.nodeName) > 0 || plugin.ipTags || plugin.wouldBlock || plugin.annotations
+}
+
+func (plugin *PluginQueryLog) clientName(clientIP net.IP) (string, bool) {
+	if plugin.lanHosts == nil {
+		return "", false
+	}
+	return plugin.lanHosts.nameForIP(clientIP)
+}
+
+func formatIPTags(tags []string) string {
+	if len(tags) == 0 {
+		return "-"
+	}
+	return strings.Join(tags, ",")
+}
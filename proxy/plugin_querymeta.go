@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"github.com/miekg/dns"
@@ -9,7 +9,7 @@ type PluginQueryMeta struct {
 }
 
 func (plugin *PluginQueryMeta) Name() string {
-	return "query_log"
+	return "query_meta"
 }
 
 func (plugin *PluginQueryMeta) Description() string {
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// PluginSanitizeResponses removes control characters, such as terminal escape sequences, from text
+// records before they reach clients and logs, and optionally limits the size of TXT records
+type PluginSanitizeResponses struct {
+	replace      bool
+	maxTXTLength int
+}
+
+func (plugin *PluginSanitizeResponses) Name() string {
+	return "sanitize_responses"
+}
+
+func (plugin *PluginSanitizeResponses) Description() string {
+	return "Remove control characters and overlong payloads from text records"
+}
+
+func (plugin *PluginSanitizeResponses) Init(proxy *Proxy) error {
+	plugin.replace = proxy.sanitizeResponses == "replace"
+	plugin.maxTXTLength = proxy.sanitizeMaxTXTLength
+	return nil
+}
+
+func (plugin *PluginSanitizeResponses) Drop() error {
+	return nil
+}
+
+func (plugin *PluginSanitizeResponses) Reload() error {
+	return nil
+}
+
+func (plugin *PluginSanitizeResponses) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	changed := false
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.TXT:
+				rr.Txt, changed = plugin.sanitizeTXT(rr.Txt, changed)
+			case *dns.SPF:
+				rr.Txt, changed = plugin.sanitizeTXT(rr.Txt, changed)
+			case *dns.HINFO:
+				rr.Cpu = plugin.sanitizeField(rr.Cpu, &changed)
+				rr.Os = plugin.sanitizeField(rr.Os, &changed)
+			case *dns.CAA:
+				rr.Value = plugin.sanitizeField(rr.Value, &changed)
+			case *dns.NAPTR:
+				rr.Service = plugin.sanitizeField(rr.Service, &changed)
+				rr.Regexp = plugin.sanitizeField(rr.Regexp, &changed)
+			}
+		}
+	}
+	if changed {
+		dlog.Debugf("Sanitized the response to [%v]", pluginsState.qName)
+	}
+	return nil
+}
+
+func (plugin *PluginSanitizeResponses) sanitizeTXT(txt []string, changed bool) ([]string, bool) {
+	total := 0
+	for i, field := range txt {
+		field = plugin.sanitizeField(field, &changed)
+		if plugin.maxTXTLength > 0 {
+			raw := unescapeTXTString(field)
+			if total+len(raw) > plugin.maxTXTLength {
+				cut := plugin.maxTXTLength - total
+				for cut > 0 && !utf8.RuneStart(raw[cut]) {
+					cut--
+				}
+				if cut == 0 && i > 0 {
+					return txt[:i], true
+				}
+				txt[i] = escapeTXTString(raw[:cut])
+				return txt[:i+1], true
+			}
+			total += len(raw)
+		}
+		txt[i] = field
+	}
+	return txt, changed
+}
+
+// sanitizeField works on the presentation format used by the dns package, where
+// non-printable bytes are usually escaped as \DDD
+func (plugin *PluginSanitizeResponses) sanitizeField(field string, changed *bool) string {
+	if isPrintableASCII(field) && strings.IndexByte(field, '\\') < 0 {
+		return field
+	}
+	raw := unescapeTXTString(field)
+	var sanitized strings.Builder
+	modified := false
+	for len(raw) > 0 {
+		r, size := utf8.DecodeRuneInString(raw)
+		if (r == utf8.RuneError && size == 1) || isUnsafeTextRune(r) {
+			modified = true
+			if plugin.replace {
+				sanitized.WriteByte('?')
+			}
+		} else {
+			sanitized.WriteString(raw[:size])
+		}
+		raw = raw[size:]
+	}
+	if !modified {
+		return field
+	}
+	*changed = true
+	return escapeTXTString(sanitized.String())
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// isUnsafeTextRune tells whether a character can change how the text around it is displayed
+func isUnsafeTextRune(r rune) bool {
+	return unicode.IsControl(r) ||
+		r == '\u2028' || r == '\u2029' ||
+		(r >= '\u202a' && r <= '\u202e') ||
+		(r >= '\u2066' && r <= '\u2069')
+}
+
+func unescapeTXTString(s string) string {
+	var raw strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			raw.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			if b, err := strconv.ParseUint(s[i+1:i+4], 10, 8); err == nil {
+				raw.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		raw.WriteByte(s[i+1])
+		i++
+	}
+	return raw.String()
+}
+
+func escapeTXTString(raw string) string {
+	var s strings.Builder
+	for i := 0; i < len(raw); i++ {
+		b := raw[i]
+		switch {
+		case b == '"' || b == '\\':
+			s.WriteByte('\\')
+			s.WriteByte(b)
+		case b < ' ' || b > '~':
+			s.WriteString("\\" + strconv.Itoa(int(b)/100) + strconv.Itoa(int(b)/10%10) + strconv.Itoa(int(b)%10))
+		default:
+			s.WriteByte(b)
+		}
+	}
+	return s.String()
+}
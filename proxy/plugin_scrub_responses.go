@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const MaxScrubCNAMEChainLength = 16
+
+// PluginScrubResponses removes records that are unrelated to the question from upstream responses,
+// so that they cannot be cached, the same way recursive resolvers scrub out-of-bailiwick data
+type PluginScrubResponses struct{}
+
+func (plugin *PluginScrubResponses) Name() string {
+	return "scrub_responses"
+}
+
+func (plugin *PluginScrubResponses) Description() string {
+	return "Remove out-of-bailiwick records from responses"
+}
+
+func (plugin *PluginScrubResponses) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginScrubResponses) Drop() error {
+	return nil
+}
+
+func (plugin *PluginScrubResponses) Reload() error {
+	return nil
+}
+
+func (plugin *PluginScrubResponses) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	removed := scrubResponse(msg)
+	if removed > 0 {
+		dlog.Debugf("%d unrelated records removed from the response to [%v]", removed, pluginsState.qName)
+		pluginsState.trace.add("response", "%d out-of-bailiwick records removed", removed)
+	}
+	return nil
+}
+
+// rrOwnerType returns the owner of a record, and its type - the type covered for signatures
+func rrOwnerType(rr dns.RR) (string, uint16) {
+	owner := strings.ToLower(rr.Header().Name)
+	if rrsig, ok := rr.(*dns.RRSIG); ok {
+		return owner, rrsig.TypeCovered
+	}
+	return owner, rr.Header().Rrtype
+}
+
+// scrubResponse keeps the answers that belong to the chain of aliases starting at the question,
+// authority records for the zones of these names, and the addresses of the names they refer to
+func scrubResponse(msg *dns.Msg) int {
+	removed := 0
+	question := msg.Question[0]
+	chain := map[string]bool{strings.ToLower(question.Name): true}
+	current := strings.ToLower(question.Name)
+	for i := 0; i < MaxScrubCNAMEChainLength; i++ {
+		next := ""
+		for _, rr := range msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				if strings.EqualFold(rr.Hdr.Name, current) {
+					next = strings.ToLower(rr.Target)
+				}
+			case *dns.DNAME:
+				owner := strings.ToLower(rr.Hdr.Name)
+				if dns.IsSubDomain(owner, current) && owner != current {
+					chain[owner] = true
+					next = strings.TrimSuffix(current, owner) + strings.ToLower(rr.Target)
+				}
+			}
+		}
+		if len(next) == 0 || chain[next] {
+			break
+		}
+		chain[next], current = true, next
+	}
+
+	targets := make(map[string]bool)
+	answer := msg.Answer[:0]
+	for _, rr := range msg.Answer {
+		if owner, _ := rrOwnerType(rr); !chain[owner] {
+			removed++
+			continue
+		}
+		addTargets(targets, rr)
+		answer = append(answer, rr)
+	}
+	msg.Answer = answer
+
+	// The zone of a name is one of its ancestors
+	inZoneOfChain := func(owner string) bool {
+		for name := range chain {
+			if dns.IsSubDomain(owner, name) {
+				return true
+			}
+		}
+		return false
+	}
+	zones := make(map[string]bool)
+	for _, rr := range msg.Ns {
+		if owner, rrType := rrOwnerType(rr); (rrType == dns.TypeSOA || rrType == dns.TypeNS) && inZoneOfChain(owner) {
+			zones[owner] = true
+		}
+	}
+	ns := msg.Ns[:0]
+	for _, rr := range msg.Ns {
+		owner, rrType := rrOwnerType(rr)
+		keep := inZoneOfChain(owner)
+		if !keep && (rrType == dns.TypeNSEC || rrType == dns.TypeNSEC3) {
+			// Denial of existence records can be anywhere in the zone
+			for zone := range zones {
+				if dns.IsSubDomain(zone, owner) {
+					keep = true
+					break
+				}
+			}
+		}
+		if !keep {
+			removed++
+			continue
+		}
+		addTargets(targets, rr)
+		ns = append(ns, rr)
+	}
+	msg.Ns = ns
+
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		owner, rrType := rrOwnerType(rr)
+		if rrType != dns.TypeOPT && !((rrType == dns.TypeA || rrType == dns.TypeAAAA) && targets[owner]) {
+			removed++
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	msg.Extra = extra
+	return removed
+}
+
+// addTargets adds the names a record refers to, whose addresses can be in the additional section
+func addTargets(targets map[string]bool, rr dns.RR) {
+	switch rr := rr.(type) {
+	case *dns.NS:
+		targets[strings.ToLower(rr.Ns)] = true
+	case *dns.MX:
+		targets[strings.ToLower(rr.Mx)] = true
+	case *dns.SRV:
+		targets[strings.ToLower(rr.Target)] = true
+	case *dns.SVCB:
+		targets[strings.ToLower(rr.Target)] = true
+	case *dns.HTTPS:
+		targets[strings.ToLower(rr.Target)] = true
+	}
+}
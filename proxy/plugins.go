@@ -1,8 +1,10 @@
-package main
+package proxy
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -26,6 +28,8 @@ type PluginsGlobals struct {
 	queryPlugins           *[]Plugin
 	responsePlugins        *[]Plugin
 	loggingPlugins         *[]Plugin
+	chains                 map[string]*pluginChain
+	clientTags             *ClientTags
 	refusedCodeInResponses bool
 	respondWithIPv4        net.IP
 	respondWithIPv6        net.IP
@@ -71,8 +75,12 @@ type PluginsState struct {
 	clientProto                      string
 	serverName                       string
 	serverProto                      string
+	upstreamTransport                string
+	upstreamRetries                  int
+	responseSize                     int
 	qName                            string
 	clientAddr                       *net.Addr
+	listenerOptions                  *ListenerOptions
 	synthResponse                    *dns.Msg
 	questionMsg                      *dns.Msg
 	sessionData                      map[string]interface{}
@@ -89,7 +97,15 @@ type PluginsState struct {
 	cacheNegMinTTL                   uint32
 	cacheMinTTL                      uint32
 	cacheHit                         bool
+	cacheAge                         time.Duration
 	dnssec                           bool
+	unlogged                         bool
+	wouldBlock                       bool
+	ipTags                           []string
+	trace                            *queryTrace
+	queryStats                       *QueryStats
+	reporter                         *Reporter
+	chain                            *pluginChain
 }
 
 func (proxy *Proxy) InitPluginsGlobals() error {
@@ -104,13 +120,23 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.allowNameFile) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginAllowName)))
 	}
+	if proxy.defaultDeny {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginDefaultDeny)))
+	}
+
+	if len(proxy.canaryLogFile) != 0 || proxy.canaryPolicies["mozilla"] != CanaryPolicyPass ||
+		proxy.canaryPolicies["icloud_private_relay"] != CanaryPolicyPass {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCanaryDomains)))
+	}
 
-	*queryPlugins = append(*queryPlugins, Plugin(new(PluginFirefox)))
+	if proxy.localDoHDDR && len(proxy.localDoHListenAddresses) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginDDR)))
+	}
 
 	if len(proxy.ednsClientSubnets) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginECS)))
 	}
-	if len(proxy.blockNameFile) != 0 {
+	if len(proxy.blockNameFile) != 0 || proxy.blockLists != nil {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockName)))
 	}
 	if proxy.pluginBlockIPv6 {
@@ -119,6 +145,9 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.cloakFile) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCloak)))
 	}
+	if proxy.lanHosts != nil {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginLANHosts)))
+	}
 	*queryPlugins = append(*queryPlugins, Plugin(new(PluginGetSetPayloadSize)))
 	if proxy.cache {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCache)))
@@ -126,6 +155,14 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.forwardFile) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginForward)))
 	}
+	// Names that are cloaked or forwarded are never handled as probes
+	if proxy.chromeProbes == ChromeProbesNXDomain {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginChromeProbes)))
+	}
+	// Queries are only sent in clear during portal sessions after the filtering plugins had a chance to run
+	if proxy.captivePortalDetector != nil {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCaptivePortalPassthrough)))
+	}
 	if proxy.pluginBlockUnqualified {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockUnqualified)))
 	}
@@ -133,14 +170,28 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockUndelegated)))
 	}
 
+	if len(proxy.queryPluginsOrder) > 0 {
+		ordered, err := orderQueryPlugins(*queryPlugins, proxy.queryPluginsOrder)
+		if err != nil {
+			return err
+		}
+		queryPlugins = &ordered
+	}
+
 	responsePlugins := &[]Plugin{}
+	if proxy.scrubResponses {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginScrubResponses)))
+	}
+	if len(proxy.sanitizeResponses) != 0 {
+		*responsePlugins = append(*responsePlugins, Plugin(new(PluginSanitizeResponses)))
+	}
 	if len(proxy.nxLogFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginNxLog)))
 	}
 	if len(proxy.allowedIPFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginAllowedIP)))
 	}
-	if len(proxy.blockNameFile) != 0 {
+	if (len(proxy.blockNameFile) != 0 || proxy.blockLists != nil) && proxy.blockNameCNAMETargets {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockNameResponse)))
 	}
 	if len(proxy.blockIPFile) != 0 {
@@ -154,7 +205,7 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	}
 
 	loggingPlugins := &[]Plugin{}
-	if len(proxy.queryLogFile) != 0 {
+	if len(proxy.queryLogFile) != 0 || proxy.queryLogBus != nil {
 		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginQueryLog)))
 	}
 
@@ -174,9 +225,19 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 		}
 	}
 
+	var chains map[string]*pluginChain
+	if len(proxy.pluginScopes) > 0 {
+		var err error
+		if chains, err = proxy.buildPluginChains(queryPlugins, responsePlugins, loggingPlugins); err != nil {
+			return err
+		}
+	}
+
 	proxy.pluginsGlobals.queryPlugins = queryPlugins
 	proxy.pluginsGlobals.responsePlugins = responsePlugins
 	proxy.pluginsGlobals.loggingPlugins = loggingPlugins
+	proxy.pluginsGlobals.chains = chains
+	proxy.pluginsGlobals.clientTags = proxy.clientTags
 
 	parseBlockedQueryResponse(proxy.blockedQueryResponse, &proxy.pluginsGlobals)
 
@@ -231,6 +292,70 @@ func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGl
 	}
 }
 
+// QueryPluginNames lists the query plugins, in their default order
+var QueryPluginNames = []string{
+	"captive_portal_handlers", "query_meta", "allow_name", "default_deny", "canary_domains", "ddr", "ecs",
+	"block_name", "block_ipv6", "cloak", "lan_hosts", "get_set_payload_size", "cache", "forward", "chrome_probes",
+	"captive_portal_passthrough", "block_unqualified", "block_undelegated",
+}
+
+// queryPluginsDependencies lists the query plugins that must run before a given plugin, if they are enabled
+var queryPluginsDependencies = map[string][]string{
+	"block_name":                 {"allow_name"},
+	"default_deny":               {"allow_name"},
+	"cache":                      {"get_set_payload_size"},
+	"chrome_probes":              {"cloak", "lan_hosts", "forward"},
+	"captive_portal_passthrough": {"allow_name", "default_deny", "block_name", "cloak", "forward"},
+}
+
+func queryPluginName(plugin Plugin) string {
+	return strings.ReplaceAll(plugin.Name(), " ", "_")
+}
+
+// orderQueryPlugins runs the plugins listed in order in that order. They take the positions they
+// have in the default order, so that plugins that are not listed keep running where they used to.
+func orderQueryPlugins(plugins []Plugin, order []string) ([]Plugin, error) {
+	positions := make(map[string]int)
+	for i, name := range order {
+		name = strings.ToLower(name)
+		if !includesName(QueryPluginNames, name) {
+			return nil, fmt.Errorf("Unknown query plugin in query_plugins_order: [%s]", name)
+		}
+		if _, found := positions[name]; found {
+			return nil, fmt.Errorf("Query plugin listed multiple times in query_plugins_order: [%s]", name)
+		}
+		positions[name] = i
+	}
+	var listed []Plugin
+	for _, plugin := range plugins {
+		if _, found := positions[queryPluginName(plugin)]; found {
+			listed = append(listed, plugin)
+		}
+	}
+	sort.SliceStable(listed, func(i, j int) bool {
+		return positions[queryPluginName(listed[i])] < positions[queryPluginName(listed[j])]
+	})
+	ordered := make([]Plugin, 0, len(plugins))
+	for _, plugin := range plugins {
+		if _, found := positions[queryPluginName(plugin)]; found {
+			plugin, listed = listed[0], listed[1:]
+		}
+		ordered = append(ordered, plugin)
+	}
+	indexes := make(map[string]int)
+	for i, plugin := range ordered {
+		indexes[queryPluginName(plugin)] = i
+	}
+	for i, plugin := range ordered {
+		for _, dependency := range queryPluginsDependencies[queryPluginName(plugin)] {
+			if j, found := indexes[dependency]; found && j > i {
+				return nil, fmt.Errorf("Query plugin [%s] must run after [%s]", queryPluginName(plugin), dependency)
+			}
+		}
+	}
+	return ordered, nil
+}
+
 type Plugin interface {
 	Name() string
 	Description() string
@@ -267,6 +392,8 @@ func NewPluginsState(
 		requestStart:                     start,
 		maxUnencryptedUDPSafePayloadSize: MaxDNSUDPSafePacketSize,
 		sessionData:                      make(map[string]interface{}),
+		queryStats:                       proxy.queryStats,
+		reporter:                         proxy.reporter,
 	}
 }
 
@@ -289,16 +416,29 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(
 	dlog.Debugf("Handling query for [%v]", qName)
 	pluginsState.qName = qName
 	pluginsState.questionMsg = &msg
-	if len(*pluginsGlobals.queryPlugins) == 0 && len(*pluginsGlobals.loggingPlugins) == 0 {
+	queryPlugins, loggingPlugins := pluginsGlobals.queryPlugins, pluginsGlobals.loggingPlugins
+	if chain := pluginsState.pluginChain(pluginsGlobals); chain != nil {
+		queryPlugins, loggingPlugins = chain.queryPlugins, chain.loggingPlugins
+	}
+	if len(*queryPlugins) == 0 && len(*loggingPlugins) == 0 {
 		return packet, nil
 	}
 	pluginsGlobals.RLock()
 	defer pluginsGlobals.RUnlock()
-	for _, plugin := range *pluginsGlobals.queryPlugins {
+	for _, plugin := range *queryPlugins {
+		evalStart := time.Now()
 		if err := plugin.Eval(pluginsState, &msg); err != nil {
 			pluginsState.action = PluginsActionDrop
+			pluginsState.trace.add("query plugin", "[%s] failed: %v", plugin.Name(), err)
 			return packet, err
 		}
+		pluginsState.trace.add(
+			"query plugin",
+			"[%s] %s (%v)",
+			plugin.Name(),
+			pluginsActionToString(pluginsState.action),
+			time.Since(evalStart).Round(time.Microsecond),
+		)
 		if pluginsState.action == PluginsActionReject {
 			synth := RefusedResponseFromMessage(
 				&msg,
@@ -350,13 +490,26 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(
 		pluginsState.returnCode = PluginsReturnCodeResponseError
 	}
 	removeEDNS0Options(&msg)
+	responsePlugins := pluginsGlobals.responsePlugins
+	if chain := pluginsState.pluginChain(pluginsGlobals); chain != nil {
+		responsePlugins = chain.responsePlugins
+	}
 	pluginsGlobals.RLock()
 	defer pluginsGlobals.RUnlock()
-	for _, plugin := range *pluginsGlobals.responsePlugins {
+	for _, plugin := range *responsePlugins {
+		evalStart := time.Now()
 		if err := plugin.Eval(pluginsState, &msg); err != nil {
 			pluginsState.action = PluginsActionDrop
+			pluginsState.trace.add("response plugin", "[%s] failed: %v", plugin.Name(), err)
 			return packet, err
 		}
+		pluginsState.trace.add(
+			"response plugin",
+			"[%s] %s (%v)",
+			plugin.Name(),
+			pluginsActionToString(pluginsState.action),
+			time.Since(evalStart).Round(time.Microsecond),
+		)
 		if pluginsState.action == PluginsActionReject {
 			synth := RefusedResponseFromMessage(
 				&msg,
@@ -381,8 +534,23 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(
 	return packet2, nil
 }
 
+// markWouldBlock records that a rule in log-only mode would have blocked the query
+func (pluginsState *PluginsState) markWouldBlock(qName string, reason string) {
+	pluginsState.wouldBlock = true
+	pluginsState.trace.add("rule", "[%s] would be blocked by %s", qName, reason)
+}
+
 func (pluginsState *PluginsState) ApplyLoggingPlugins(pluginsGlobals *PluginsGlobals) error {
-	if len(*pluginsGlobals.loggingPlugins) == 0 {
+	pluginsState.trace.add("result", "%s", PluginsReturnCodeToString[pluginsState.returnCode])
+	pluginsState.queryStats.record(pluginsState)
+	if !pluginsState.unlogged {
+		pluginsState.reporter.record(pluginsState)
+	}
+	loggingPlugins := pluginsGlobals.loggingPlugins
+	if chain := pluginsState.pluginChain(pluginsGlobals); chain != nil {
+		loggingPlugins = chain.loggingPlugins
+	}
+	if len(*loggingPlugins) == 0 || pluginsState.unlogged {
 		return nil
 	}
 	pluginsState.requestEnd = time.Now()
@@ -392,7 +560,7 @@ func (pluginsState *PluginsState) ApplyLoggingPlugins(pluginsGlobals *PluginsGlo
 	}
 	pluginsGlobals.RLock()
 	defer pluginsGlobals.RUnlock()
-	for _, plugin := range *pluginsGlobals.loggingPlugins {
+	for _, plugin := range *loggingPlugins {
 		if err := plugin.Eval(pluginsState, questionMsg); err != nil {
 			return err
 		}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type namedPlugin struct {
+	name string
+}
+
+func (plugin *namedPlugin) Name() string                                        { return plugin.name }
+func (plugin *namedPlugin) Description() string                                 { return plugin.name }
+func (plugin *namedPlugin) Init(proxy *Proxy) error                             { return nil }
+func (plugin *namedPlugin) Drop() error                                         { return nil }
+func (plugin *namedPlugin) Reload() error                                       { return nil }
+func (plugin *namedPlugin) Eval(pluginsState *PluginsState, msg *dns.Msg) error { return nil }
+
+func TestDefaultQueryPluginsOrder(t *testing.T) {
+	plugins := make([]Plugin, 0, len(QueryPluginNames))
+	for _, name := range QueryPluginNames {
+		plugins = append(plugins, &namedPlugin{name: name})
+	}
+	for _, order := range [][]string{QueryPluginNames, {"cloak", "block_name"}, {"ecs"}} {
+		ordered, err := orderQueryPlugins(plugins, order)
+		if err != nil {
+			t.Errorf("%v: %v", order, err)
+			continue
+		}
+		if len(ordered) != len(plugins) {
+			t.Errorf("%v: %d plugins instead of %d", order, len(ordered), len(plugins))
+		}
+	}
+	if _, err := orderQueryPlugins(plugins, []string{"cache", "get_set_payload_size"}); err == nil {
+		t.Error("dependency not enforced")
+	}
+}
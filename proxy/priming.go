@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	PrimingCheckInterval = 30 * time.Second
+	PrimingRefreshMargin = 2 * PrimingCheckInterval
+	PrimingMinInterval   = 30 * time.Second
+	PrimingNegativeTTL   = 5 * time.Minute
+)
+
+// Priming keeps the addresses of the server host names, and the responses for a set of
+// infrastructure names, fresh, by resolving them again before they expire.
+// Names are thus never resolved on demand while the network is unreliable. The responses
+// for the names are pinned in the cache, so that they are not evicted by other entries.
+type Priming struct {
+	serverHosts bool
+	queries     []warmupQuery
+	nextRefresh []time.Time
+}
+
+func NewPriming(serverHosts bool, names []string) (*Priming, error) {
+	queries, err := parseWarmupQueries(strings.Join(names, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	return &Priming{
+		serverHosts: serverHosts,
+		queries:     queries,
+		nextRefresh: make([]time.Time, len(queries)),
+	}, nil
+}
+
+// refreshServerHosts resolves the server host names whose addresses are about to expire.
+// If they cannot be resolved, the previous addresses remain in use.
+func (priming *Priming) refreshServerHosts(xTransport *XTransport) {
+	for _, host := range xTransport.expiringCachedHosts(PrimingRefreshMargin) {
+		cachedIP, _ := xTransport.loadCachedIP(host)
+		if err := xTransport.resolveAndReplaceCachedIP(host, cachedIP); err != nil {
+			dlog.Debugf("Priming: unable to refresh the address of [%s]: %v", host, err)
+		}
+	}
+}
+
+// refreshName sends a query that bypasses the cache reader, so that the cache gets an
+// up-to-date response, and returns the delay after which the query should be sent again
+func (priming *Priming) refreshName(proxy *Proxy, query warmupQuery) time.Duration {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(query.name), query.qType)
+	packet, err := msg.Pack()
+	if err != nil || !proxy.clientsCountInc() {
+		return PrimingMinInterval
+	}
+	responsePacket := proxy.processIncomingQuery("priming", proxy.mainProto, packet, nil, nil, time.Now(), false)
+	proxy.clientsCountDec()
+	response := dns.Msg{}
+	if err := response.Unpack(responsePacket); err != nil {
+		dlog.Debugf("Priming: no response for [%s] (%s)", query.name, dns.TypeToString[query.qType])
+		return PrimingMinInterval
+	}
+	if len(response.Answer) == 0 {
+		return PrimingNegativeTTL
+	}
+	minTTL := response.Answer[0].Header().Ttl
+	for _, rr := range response.Answer[1:] {
+		if ttl := rr.Header().Ttl; ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	delay := time.Duration(minTTL)*time.Second - PrimingRefreshMargin
+	if delay < PrimingMinInterval {
+		delay = PrimingMinInterval
+	}
+	return delay
+}
+
+func (priming *Priming) run(proxy *Proxy) {
+	for {
+		if proxy.serversInfo.count() > 0 {
+			if priming.serverHosts {
+				priming.refreshServerHosts(proxy.xTransport)
+			}
+			now := time.Now()
+			for i, query := range priming.queries {
+				if now.Before(priming.nextRefresh[i]) {
+					continue
+				}
+				priming.nextRefresh[i] = time.Now().Add(priming.refreshName(proxy, query))
+			}
+		}
+		select {
+		case <-proxy.quit:
+			return
+		case <-time.After(PrimingCheckInterval):
+		}
+	}
+}
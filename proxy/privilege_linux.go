@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"os"
@@ -62,6 +62,11 @@ func (proxy *Proxy) dropPrivilege(userStr string, fds []*os.File) {
 
 	args = append(args, "-child")
 
+	if proxy.superviseChild {
+		dlog.Notice("Supervising an unprivileged child process")
+		proxy.runChildSupervisor(path, args, uid, gid, fds)
+	}
+
 	dlog.Notice("Dropping privileges")
 
 	runtime.LockOSThread()
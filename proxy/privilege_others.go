@@ -1,7 +1,7 @@
 //go:build !windows && !linux
 // +build !windows,!linux
 
-package main
+package proxy
 
 import (
 	"os"
@@ -64,6 +64,11 @@ func (proxy *Proxy) dropPrivilege(userStr string, fds []*os.File) {
 
 	args = append(args, "-child")
 
+	if proxy.superviseChild {
+		dlog.Notice("Supervising an unprivileged child process")
+		proxy.runChildSupervisor(path, args, uid, gid, fds)
+	}
+
 	dlog.Notice("Dropping privileges")
 
 	runtime.LockOSThread()
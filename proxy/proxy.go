@@ -1,14 +1,16 @@
-package main
+package proxy
 
 import (
 	"context"
 	crypto_rand "crypto/rand"
 	"encoding/binary"
-	"math/rand"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -29,6 +31,9 @@ type Proxy struct {
 	serversBlockingFragments      []string
 	ednsClientSubnets             []*net.IPNet
 	queryLogIgnoredQtypes         []string
+	queryLogIPTags                *IPTags
+	queryLogAnnotations           bool
+	queryLogWouldBlock            bool
 	localDoHListeners             []*net.TCPListener
 	queryMeta                     []string
 	udpListeners                  []*net.UDPConn
@@ -38,43 +43,101 @@ type Proxy struct {
 	listenAddresses               []string
 	localDoHListenAddresses       []string
 	xTransport                    *XTransport
+	quit                          chan struct{}
+	refreshRequests               chan string
+	refreshRequestsLock           sync.Mutex
+	lastRefreshRequest            time.Time
+	activeListeners               map[string][]io.Closer
+	listenersLock                 sync.Mutex
+	controlListener               net.Listener
+	controlSocket                 string
+	sighupReloadListeners         bool
+	configFile                    string
+	fallbackConfigFile            string
+	nodeName                      string
+	listenerOptions               map[string]*ListenerOptions
 	allWeeklyRanges               *map[string]WeeklyRanges
+	maintenanceWindow             *MaintenanceWindow
 	routes                        *map[string][]string
 	captivePortalMap              *CaptivePortalMap
+	captivePortalDetector         *CaptivePortalDetector
+	lanHosts                      *LANHosts
+	blockLists                    *BlockLists
+	serverOptions                 map[string]ServerOptions
+	queryRoutes                   *QueryRoutes
+	routeOverrideClients          []*net.IPNet
+	routeOverrideOption           uint16
+	queryStats                    *QueryStats
 	nxLogFormat                   string
 	localDoHCertFile              string
 	localDoHCertKeyFile           string
 	captivePortalMapFile          string
 	localDoHPath                  string
+	localDoHDDRServerName         string
 	mainProto                     string
 	cloakFile                     string
 	forwardFile                   string
+	forwardFailover               bool
 	blockIPFormat                 string
 	blockIPLogFile                string
+	blockIPLogOnly                bool
 	allowedIPFile                 string
 	allowedIPFormat               string
 	allowedIPLogFile              string
 	queryLogFormat                string
 	blockIPFile                   string
 	allowNameFile                 string
+	defaultDeny                   bool
+	defaultDenyClients            []*net.IPNet
 	allowNameFormat               string
 	allowNameLogFile              string
 	blockNameLogFile              string
+	blockNameLogOnly              bool
 	blockNameFormat               string
 	blockNameFile                 string
+	blockedNames                  *BlockedNames
 	queryLogFile                  string
+	queryLogAnonymizer            *IPAnonymizer
+	queryLogBus                   *QueryLogBus
+	cachedResponses               CachedResponses
+	sharedCache                   *SharedCache
+	haPeering                     *HAPeering
+	httpAccessLog                 *HTTPAccessLog
+	reporter                      *Reporter
+	statusPage                    *StatusPage
+	faultInjector                 *FaultInjector
+	random                        *lockedRand
+	upstreamRecorder              *UpstreamRecorder
+	queryPluginsOrder             []string
+	pluginScopes                  map[string]PluginScope
+	clientTags                    *ClientTags
+	fdLimits                      *FDLimits
+	memoryLimiter                 *MemoryLimiter
+	canaryPolicies                map[string]string
+	canaryLogFile                 string
 	blockedQueryResponse          string
+	scrubResponses                bool
+	maxResponseSize               int
+	maxResponseRecords            int
+	responseLimitAction           string
+	sanitizeResponses             string
 	userName                      string
 	nxLogFile                     string
+	nxLogRetention                LogRetention
+	queryLogRetention             LogRetention
 	proxySecretKey                [32]byte
 	proxyPublicKey                [32]byte
 	ServerNames                   []string
 	DisabledServerNames           []string
+	serverCountriesFilter         []string
+	disabledServerCountries       []string
 	requiredProps                 stamps.ServerInformalProperties
 	certRefreshDelayAfterFailure  time.Duration
 	timeout                       time.Duration
 	certRefreshDelay              time.Duration
 	certRefreshConcurrency        int
+	certRefreshJitter             int
+	certRefreshSpread             time.Duration
 	cacheSize                     int
 	logMaxBackups                 int
 	logMaxAge                     int
@@ -82,8 +145,19 @@ type Proxy struct {
 	cacheNegMinTTL                uint32
 	rejectTTL                     uint32
 	cacheMaxTTL                   uint32
+	cacheBypass                   *PatternMatcher
+	cacheLazyGrace                time.Duration
+	matcherBenchmark              bool
+	matcherEngine                 string
+	warmup                        *Warmup
+	startTime                     time.Time
+	priming                       *Priming
+	beacons                       *Beacons
 	clientsCount                  uint32
 	maxClients                    uint32
+	lanHostsTTL                   uint32
+	sanitizeMaxTXTLength          int
+	udpListenerSockets            int
 	cacheMinTTL                   uint32
 	cacheNegMaxTTL                uint32
 	cloakTTL                      uint32
@@ -91,13 +165,29 @@ type Proxy struct {
 	cache                         bool
 	pluginBlockIPv6               bool
 	ephemeralKeys                 bool
+	preferredConstruction         CryptoConstruction
+	ephemeralKeyReuse             time.Duration
 	pluginBlockUnqualified        bool
+	chromeProbes                  string
 	showCerts                     bool
 	certIgnoreTimestamp           bool
+	certExpiryWarning             time.Duration
 	skipAnonIncompatibleResolvers bool
 	anonDirectCertFallback        bool
 	pluginBlockUndelegated        bool
 	child                         bool
+	superviseChild                bool
+	localDoHDDR                   bool
+	lanHostsLogClientNames        bool
+	listenerLabels                bool
+	blockNameCNAMETargets         bool
+	truncatedUDPRetryTCP          bool
+	tcpPool                       *TCPPool
+	networkChangeRefresh          bool
+	responseRateLimiter           *ResponseRateLimiter
+	spoofAudit                    *SpoofAudit
+	relayService                  *RelayService
+	netprobeAddresses             []string
 	SourceIPv4                    bool
 	SourceIPv6                    bool
 	SourceDNSCrypt                bool
@@ -117,7 +207,17 @@ func (proxy *Proxy) registerLocalDoHListener(listener *net.TCPListener) {
 	proxy.localDoHListeners = append(proxy.localDoHListeners, listener)
 }
 
-func (proxy *Proxy) addDNSListener(listenAddrStr string) {
+// inheritDNSListeners takes over the DNS sockets of a proxy that couldn't be started
+func (proxy *Proxy) inheritDNSListeners(previous *Proxy) {
+	proxy.udpListeners, previous.udpListeners = previous.udpListeners, nil
+	proxy.tcpListeners, previous.tcpListeners = previous.tcpListeners, nil
+	for _, listener := range previous.localDoHListeners {
+		listener.Close()
+	}
+	previous.localDoHListeners = nil
+}
+
+func (proxy *Proxy) addDNSListener(listenAddrStr string) error {
 	udp := "udp"
 	tcp := "tcp"
 	isIPv4 := isDigit(listenAddrStr[0])
@@ -127,72 +227,85 @@ func (proxy *Proxy) addDNSListener(listenAddrStr string) {
 	}
 	listenUDPAddr, err := net.ResolveUDPAddr(udp, listenAddrStr)
 	if err != nil {
-		dlog.Fatal(err)
+		return err
 	}
 	listenTCPAddr, err := net.ResolveTCPAddr(tcp, listenAddrStr)
 	if err != nil {
-		dlog.Fatal(err)
+		return err
 	}
+	withUDP, withTCP := proxy.listenerProtocols(listenTCPAddr.String())
 
 	// if 'userName' is not set, continue as before
 	if len(proxy.userName) <= 0 {
-		if err := proxy.udpListenerFromAddr(listenUDPAddr); err != nil {
-			dlog.Fatal(err)
+		if withUDP {
+			if err := proxy.udpListenerFromAddr(listenUDPAddr); err != nil {
+				return err
+			}
 		}
-		if err := proxy.tcpListenerFromAddr(listenTCPAddr); err != nil {
-			dlog.Fatal(err)
+		if withTCP {
+			if err := proxy.tcpListenerFromAddr(listenTCPAddr); err != nil {
+				return err
+			}
 		}
-		return
+		return nil
 	}
 
 	// if 'userName' is set and we are the parent process
 	if !proxy.child {
 		// parent
-		listenerUDP, err := net.ListenUDP(udp, listenUDPAddr)
-		if err != nil {
-			dlog.Fatal(err)
-		}
-		listenerTCP, err := net.ListenTCP(tcp, listenTCPAddr)
-		if err != nil {
-			dlog.Fatal(err)
-		}
-
-		fdUDP, err := listenerUDP.File() // On Windows, the File method of UDPConn is not implemented.
-		if err != nil {
-			dlog.Fatalf("Unable to switch to a different user: %v", err)
+		if withUDP {
+			listenerUDP, err := net.ListenUDP(udp, listenUDPAddr)
+			if err != nil {
+				return err
+			}
+			fdUDP, err := listenerUDP.File() // On Windows, the File method of UDPConn is not implemented.
+			if err != nil {
+				return fmt.Errorf("Unable to switch to a different user: %v", err)
+			}
+			defer listenerUDP.Close()
+			FileDescriptors = append(FileDescriptors, fdUDP)
 		}
-		fdTCP, err := listenerTCP.File() // On Windows, the File method of TCPListener is not implemented.
-		if err != nil {
-			dlog.Fatalf("Unable to switch to a different user: %v", err)
+		if withTCP {
+			listenerTCP, err := net.ListenTCP(tcp, listenTCPAddr)
+			if err != nil {
+				return err
+			}
+			fdTCP, err := listenerTCP.File() // On Windows, the File method of TCPListener is not implemented.
+			if err != nil {
+				return fmt.Errorf("Unable to switch to a different user: %v", err)
+			}
+			defer listenerTCP.Close()
+			FileDescriptors = append(FileDescriptors, fdTCP)
 		}
-		defer listenerUDP.Close()
-		defer listenerTCP.Close()
-		FileDescriptors = append(FileDescriptors, fdUDP)
-		FileDescriptors = append(FileDescriptors, fdTCP)
-		return
+		return nil
 	}
 
 	// child
-	listenerUDP, err := net.FilePacketConn(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerUDP"))
-	if err != nil {
-		dlog.Fatalf("Unable to switch to a different user: %v", err)
-	}
-	FileDescriptorNum++
+	if withUDP {
+		listenerUDP, err := net.FilePacketConn(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerUDP"))
+		if err != nil {
+			return fmt.Errorf("Unable to switch to a different user: %v", err)
+		}
+		FileDescriptorNum++
 
-	listenerTCP, err := net.FileListener(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerTCP"))
-	if err != nil {
-		dlog.Fatalf("Unable to switch to a different user: %v", err)
+		dlog.Noticef("Now listening to %v [UDP]", listenUDPAddr)
+		proxy.registerUDPListener(listenerUDP.(*net.UDPConn))
 	}
-	FileDescriptorNum++
 
-	dlog.Noticef("Now listening to %v [UDP]", listenUDPAddr)
-	proxy.registerUDPListener(listenerUDP.(*net.UDPConn))
+	if withTCP {
+		listenerTCP, err := net.FileListener(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerTCP"))
+		if err != nil {
+			return fmt.Errorf("Unable to switch to a different user: %v", err)
+		}
+		FileDescriptorNum++
 
-	dlog.Noticef("Now listening to %v [TCP]", listenAddrStr)
-	proxy.registerTCPListener(listenerTCP.(*net.TCPListener))
+		dlog.Noticef("Now listening to %v [TCP]", listenAddrStr)
+		proxy.registerTCPListener(listenerTCP.(*net.TCPListener))
+	}
+	return nil
 }
 
-func (proxy *Proxy) addLocalDoHListener(listenAddrStr string) {
+func (proxy *Proxy) addLocalDoHListener(listenAddrStr string) error {
 	network := "tcp"
 	isIPv4 := isDigit(listenAddrStr[0])
 	if isIPv4 {
@@ -200,15 +313,15 @@ func (proxy *Proxy) addLocalDoHListener(listenAddrStr string) {
 	}
 	listenTCPAddr, err := net.ResolveTCPAddr(network, listenAddrStr)
 	if err != nil {
-		dlog.Fatal(err)
+		return err
 	}
 
 	// if 'userName' is not set, continue as before
 	if len(proxy.userName) <= 0 {
 		if err := proxy.localDoHListenerFromAddr(listenTCPAddr); err != nil {
-			dlog.Fatal(err)
+			return err
 		}
-		return
+		return nil
 	}
 
 	// if 'userName' is set and we are the parent process
@@ -216,36 +329,44 @@ func (proxy *Proxy) addLocalDoHListener(listenAddrStr string) {
 		// parent
 		listenerTCP, err := net.ListenTCP(network, listenTCPAddr)
 		if err != nil {
-			dlog.Fatal(err)
+			return err
 		}
 		fdTCP, err := listenerTCP.File() // On Windows, the File method of TCPListener is not implemented.
 		if err != nil {
-			dlog.Fatalf("Unable to switch to a different user: %v", err)
+			return fmt.Errorf("Unable to switch to a different user: %v", err)
 		}
 		defer listenerTCP.Close()
 		FileDescriptors = append(FileDescriptors, fdTCP)
-		return
+		return nil
 	}
 
 	// child
 
 	listenerTCP, err := net.FileListener(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerTCP"))
 	if err != nil {
-		dlog.Fatalf("Unable to switch to a different user: %v", err)
+		return fmt.Errorf("Unable to switch to a different user: %v", err)
 	}
 	FileDescriptorNum++
 
 	proxy.registerLocalDoHListener(listenerTCP.(*net.TCPListener))
 	dlog.Noticef("Now listening to https://%v%v [DoH]", listenAddrStr, proxy.localDoHPath)
+	return nil
 }
 
-func (proxy *Proxy) StartProxy() {
+// Start binds the listeners, fetches the certificates of the configured servers and starts
+// accepting client queries. It returns once the initial set of servers has been probed.
+func (proxy *Proxy) Start() {
+	proxy.startTime = time.Now()
 	proxy.questionSizeEstimator = NewQuestionSizeEstimator()
 	if _, err := crypto_rand.Read(proxy.proxySecretKey[:]); err != nil {
 		dlog.Fatal(err)
 	}
 	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
 	proxy.startAcceptingClients()
+	if err := proxy.controlSocketListen(); err != nil {
+		dlog.Errorf("Unable to create the control socket: [%v]", err)
+	}
+	proxy.handleReloadSignal()
 	if !proxy.child {
 		// Notify the service manager that dnscrypt-proxy is ready. dnscrypt-proxy manages itself in case
 		// servers are not immediately live/reachable. The service manager may assume it is initialized and
@@ -257,14 +378,16 @@ func (proxy *Proxy) StartProxy() {
 	}
 	proxy.xTransport.internalResolverReady = false
 	proxy.xTransport.internalResolvers = proxy.listenAddresses
-	liveServers, err := proxy.serversInfo.refresh(proxy)
+	liveServers, err := proxy.serversInfo.refresh(proxy, 0)
 	if liveServers > 0 {
 		proxy.certIgnoreTimestamp = false
 	}
 	if proxy.showCerts {
 		os.Exit(0)
 	}
-	if liveServers > 0 {
+	if proxy.upstreamRecorder.replaying() {
+		dlog.Notice("dnscrypt-proxy is ready - replaying the recorded responses")
+	} else if liveServers > 0 {
 		dlog.Noticef("dnscrypt-proxy is ready - live servers: %d", liveServers)
 	} else if err != nil {
 		dlog.Error(err)
@@ -272,20 +395,93 @@ func (proxy *Proxy) StartProxy() {
 	}
 	go func() {
 		for {
-			clocksmith.Sleep(PrefetchSources(proxy.xTransport, proxy.sources))
+			if !proxy.sleepUnlessStopped(PrefetchSources(proxy.xTransport, proxy.sources)) {
+				return
+			}
+			if !proxy.waitForMaintenanceWindow(MaintenanceTaskSources, time.Time{}) {
+				return
+			}
 			proxy.updateRegisteredServers()
 			runtime.GC()
 		}
 	}()
+	if proxy.captivePortalDetector != nil {
+		go proxy.runCaptivePortalDetector()
+	}
+	if proxy.lanHosts != nil {
+		go proxy.lanHosts.refreshLoop(proxy.quit)
+	}
+	if proxy.queryLogBus != nil && !proxy.showCerts {
+		go proxy.queryLogBus.run(proxy.quit)
+	}
+	if proxy.memoryLimiter != nil && !proxy.showCerts {
+		go proxy.memoryLimiter.run(proxy.quit)
+	}
+	if proxy.fdLimits != nil && !proxy.showCerts {
+		go proxy.fdLimits.run(proxy.quit)
+	}
+	if proxy.warmup != nil && !proxy.showCerts {
+		go proxy.warmup.run(proxy)
+	}
+	if proxy.priming != nil && !proxy.showCerts {
+		go proxy.priming.run(proxy)
+	}
+	if proxy.beacons != nil && !proxy.showCerts {
+		go proxy.beacons.run(proxy)
+	}
+	if proxy.reporter != nil && !proxy.showCerts {
+		go proxy.reporter.run(proxy.quit)
+	}
+	if proxy.blockLists != nil {
+		go proxy.blockLists.refreshLoop(proxy.xTransport, proxy.quit, func() bool {
+			return proxy.waitForMaintenanceWindow(MaintenanceTaskLists, time.Time{})
+		})
+	}
+	if proxy.haPeering != nil && !proxy.showCerts {
+		if err := proxy.haPeering.start(proxy); err != nil {
+			dlog.Errorf("Unable to start HA peering: [%v]", err)
+		}
+	}
+	if proxy.statusPage != nil && !proxy.showCerts {
+		if err := proxy.statusPage.start(proxy); err != nil {
+			dlog.Errorf("Unable to start the status page: [%v]", err)
+		}
+	}
+	if proxy.relayService != nil && !proxy.showCerts {
+		if err := proxy.relayService.start(proxy); err != nil {
+			dlog.Errorf("Unable to start the DNSCrypt relay: [%v]", err)
+		}
+	}
 	if len(proxy.serversInfo.registeredServers) > 0 {
+		go proxy.watchClockSteps()
+		if proxy.networkChangeRefresh {
+			go proxy.watchNetworkChanges()
+		}
 		go func() {
 			for {
 				delay := proxy.certRefreshDelay
 				if liveServers == 0 {
 					delay = proxy.certRefreshDelayAfterFailure
 				}
-				clocksmith.Sleep(delay)
-				liveServers, _ = proxy.serversInfo.refresh(proxy)
+				requested := proxy.sleepUntilRefresh(jitteredDelay(proxy.random, delay, proxy.certRefreshJitter))
+				if proxy.stopped() {
+					return
+				}
+				if !requested && liveServers > 0 {
+					// Certificates must still be refreshed before they expire
+					deadline := proxy.serversInfo.earliestCertExpiration()
+					if !deadline.IsZero() {
+						deadline = deadline.Add(-proxy.certRefreshDelay)
+					}
+					if !proxy.waitForMaintenanceWindow(MaintenanceTaskBenchmark, deadline) {
+						return
+					}
+				}
+				spread := proxy.certRefreshSpread
+				if liveServers == 0 {
+					spread = 0
+				}
+				liveServers, _ = proxy.serversInfo.refresh(proxy, spread)
 				if liveServers > 0 {
 					proxy.certIgnoreTimestamp = false
 				}
@@ -295,7 +491,57 @@ func (proxy *Proxy) StartProxy() {
 	}
 }
 
+// Stop closes the listeners and terminates the background tasks
+func (proxy *Proxy) Stop() {
+	select {
+	case <-proxy.quit:
+		return
+	default:
+	}
+	close(proxy.quit)
+	proxy.listenersLock.Lock()
+	for _, listeners := range proxy.activeListeners {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	proxy.activeListeners = nil
+	// Listeners that were bound, but never started
+	for _, clientPc := range proxy.udpListeners {
+		clientPc.Close()
+	}
+	proxy.udpListeners = nil
+	for _, acceptPc := range proxy.tcpListeners {
+		acceptPc.Close()
+	}
+	proxy.tcpListeners = nil
+	for _, acceptPc := range proxy.localDoHListeners {
+		acceptPc.Close()
+	}
+	proxy.localDoHListeners = nil
+	proxy.listenersLock.Unlock()
+	if proxy.controlListener != nil {
+		proxy.controlListener.Close()
+	}
+	if proxy.tcpPool != nil {
+		proxy.tcpPool.closeAll()
+	}
+	if proxy.xTransport != nil && proxy.xTransport.transport != nil {
+		proxy.xTransport.transport.CloseIdleConnections()
+	}
+}
+
+func (proxy *Proxy) stopped() bool {
+	select {
+	case <-proxy.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (proxy *Proxy) updateRegisteredServers() error {
+	var relayTargets []RegisteredServer
 	for _, source := range proxy.sources {
 		registeredServers, err := source.Parse()
 		if err != nil {
@@ -310,6 +556,7 @@ func (proxy *Proxy) updateRegisteredServers() error {
 				len(registeredServers),
 			)
 		}
+		relayTargets = append(relayTargets, registeredServers...)
 		for _, registeredServer := range registeredServers {
 			if registeredServer.stamp.Proto != stamps.StampProtoTypeDNSCryptRelay &&
 				registeredServer.stamp.Proto != stamps.StampProtoTypeODoHRelay {
@@ -319,6 +566,8 @@ func (proxy *Proxy) updateRegisteredServers() error {
 					}
 				} else if registeredServer.stamp.Props&proxy.requiredProps != proxy.requiredProps {
 					continue
+				} else if !proxy.acceptsServerCountries(&registeredServer) {
+					continue
 				}
 			}
 			if includesName(proxy.DisabledServerNames, registeredServer.name) {
@@ -388,6 +637,9 @@ func (proxy *Proxy) updateRegisteredServers() error {
 	for _, registeredRelay := range proxy.registeredRelays {
 		proxy.serversInfo.registerRelay(registeredRelay.name, registeredRelay.stamp)
 	}
+	if proxy.relayService != nil {
+		proxy.relayService.setTargets(append(relayTargets, proxy.registeredServers...))
+	}
 	return nil
 }
 
@@ -425,15 +677,24 @@ func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener) {
 	for {
 		clientPc, err := acceptPc.Accept()
 		if err != nil {
+			if !proxy.fdLimits.noticeAcceptError(err) {
+				return
+			}
+			continue
+		}
+		if !proxy.fdLimits.acquireClient() {
+			clientPc.Close()
 			continue
 		}
 		if !proxy.clientsCountInc() {
 			dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+			proxy.fdLimits.releaseClient()
 			clientPc.Close()
 			continue
 		}
 		go func() {
 			defer clientPc.Close()
+			defer proxy.fdLimits.releaseClient()
 			defer proxy.clientsCountDec()
 			if err := clientPc.SetDeadline(time.Now().Add(proxy.timeout)); err != nil {
 				return
@@ -460,12 +721,26 @@ func (proxy *Proxy) udpListenerFromAddr(listenAddr *net.UDPAddr) error {
 	if isIPv4 {
 		network = "udp4"
 	}
-	clientPc, err := listenConfig.ListenPacket(context.Background(), network, listenAddrStr)
-	if err != nil {
-		return err
+	// With SO_REUSEPORT, the kernel spreads the queries over several sockets, each served by its own goroutine
+	var clientPcs []*net.UDPConn
+	for i := 0; i < max(1, proxy.udpListenerSockets); i++ {
+		clientPc, err := listenConfig.ListenPacket(context.Background(), network, listenAddrStr)
+		if err != nil {
+			for _, clientPc := range clientPcs {
+				clientPc.Close()
+			}
+			return err
+		}
+		clientPcs = append(clientPcs, clientPc.(*net.UDPConn))
+	}
+	for _, clientPc := range clientPcs {
+		proxy.registerUDPListener(clientPc)
+	}
+	if len(clientPcs) > 1 {
+		dlog.Noticef("Now listening to %v [UDP] with %d sockets", listenAddr, len(clientPcs))
+	} else {
+		dlog.Noticef("Now listening to %v [UDP]", listenAddr)
 	}
-	proxy.registerUDPListener(clientPc.(*net.UDPConn))
-	dlog.Noticef("Now listening to %v [UDP]", listenAddr)
 	return nil
 }
 
@@ -510,15 +785,30 @@ func (proxy *Proxy) localDoHListenerFromAddr(listenAddr *net.TCPAddr) error {
 }
 
 func (proxy *Proxy) startAcceptingClients() {
+	proxy.listenersLock.Lock()
+	proxy.startAcceptingClientsLocked()
+	proxy.listenersLock.Unlock()
+}
+
+func (proxy *Proxy) startAcceptingClientsLocked() {
+	if proxy.activeListeners == nil {
+		proxy.activeListeners = make(map[string][]io.Closer)
+	}
 	for _, clientPc := range proxy.udpListeners {
+		key := listenerKey(ListenerKindDNS, clientPc.LocalAddr().String())
+		proxy.activeListeners[key] = append(proxy.activeListeners[key], clientPc)
 		go proxy.udpListener(clientPc)
 	}
 	proxy.udpListeners = nil
 	for _, acceptPc := range proxy.tcpListeners {
+		key := listenerKey(ListenerKindDNS, acceptPc.Addr().String())
+		proxy.activeListeners[key] = append(proxy.activeListeners[key], acceptPc)
 		go proxy.tcpListener(acceptPc)
 	}
 	proxy.tcpListeners = nil
 	for _, acceptPc := range proxy.localDoHListeners {
+		key := listenerKey(ListenerKindDoH, acceptPc.Addr().String())
+		proxy.activeListeners[key] = append(proxy.activeListeners[key], acceptPc)
 		go proxy.localDoHListener(acceptPc)
 	}
 	proxy.localDoHListeners = nil
@@ -552,6 +842,7 @@ func (proxy *Proxy) exchangeWithUDPServer(
 	} else {
 		pc, err = (*proxyDialer).Dial("udp", upstreamAddr.String())
 	}
+	pc, err = proxy.fdLimits.countUpstream(pc, err)
 	if err != nil {
 		return nil, err
 	}
@@ -595,6 +886,7 @@ func (proxy *Proxy) exchangeWithTCPServer(
 	} else {
 		pc, err = (*proxyDialer).Dial("tcp", upstreamAddr.String())
 	}
+	pc, err = proxy.fdLimits.countUpstream(pc, err)
 	if err != nil {
 		return nil, err
 	}
@@ -649,18 +941,70 @@ func (proxy *Proxy) processIncomingQuery(
 	clientPc net.Conn,
 	start time.Time,
 	onlyCached bool,
+) []byte {
+	var listenerOptions *ListenerOptions
+	if clientPc != nil {
+		listenerOptions = proxy.listenerOptionsFor(clientPc.LocalAddr())
+	}
+	return proxy.processQuery(clientProto, serverProto, query, clientAddr, clientPc, start, onlyCached, listenerOptions, nil, nil)
+}
+
+// upstreamTransport describes how a query is sent to a server, for the query log
+func upstreamTransport(serverInfo *ServerInfo, serverProto string) string {
+	var transport string
+	switch serverInfo.Proto {
+	case stamps.StampProtoTypeDNSCrypt:
+		transport = "dnscrypt/" + serverProto
+	case stamps.StampProtoTypeDoH:
+		transport = "doh"
+	case stamps.StampProtoTypeODoHTarget:
+		transport = "odoh"
+	default:
+		transport = serverProto
+	}
+	if serverInfo.Relay != nil {
+		transport += "+relay"
+	}
+	return transport
+}
+
+// processQuery is processIncomingQuery() for queries that didn't arrive on a socket-based
+// listener, or that have to be traced. cacheAge, if not nil, is set to the time a response
+// served from the cache has been stored for.
+func (proxy *Proxy) processQuery(
+	clientProto string,
+	serverProto string,
+	query []byte,
+	clientAddr *net.Addr,
+	clientPc net.Conn,
+	start time.Time,
+	onlyCached bool,
+	listenerOptions *ListenerOptions,
+	trace *queryTrace,
+	cacheAge *time.Duration,
 ) []byte {
 	var response []byte
 	if len(query) < MinDNSPacketSize {
 		return response
 	}
 	pluginsState := NewPluginsState(proxy, clientProto, clientAddr, serverProto, start)
+	pluginsState.listenerOptions = listenerOptions
+	pluginsState.trace = trace
 	serverName := "-"
 	needsEDNS0Padding := false
-	serverInfo := proxy.serversInfo.getOne()
+	query, routeOverride := proxy.routeOverride(clientProto, clientAddr, query, trace)
+	var serverInfo *ServerInfo
+	if proxy.upstreamRecorder.replaying() {
+		serverInfo = proxy.upstreamRecorder.replayServer
+	} else {
+		serverInfo = proxy.selectServer(query, routeOverride, trace)
+	}
 	if serverInfo != nil {
 		serverName = serverInfo.Name
 		needsEDNS0Padding = (serverInfo.Proto == stamps.StampProtoTypeDoH || serverInfo.Proto == stamps.StampProtoTypeTLS)
+		trace.add("server", "[%s] selected (%s)", serverName, serverInfo.Proto.String())
+	} else {
+		trace.add("server", "no servers available")
 	}
 	query, _ = pluginsState.ApplyQueryPlugins(&proxy.pluginsGlobals, query, needsEDNS0Padding)
 	if len(query) < MinDNSPacketSize || len(query) > MaxDNSPacketSize {
@@ -679,6 +1023,9 @@ func (proxy *Proxy) processIncomingQuery(
 			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
 			return response
 		}
+		if cacheAge != nil {
+			*cacheAge = pluginsState.cacheAge
+		}
 	}
 	if onlyCached {
 		if len(response) == 0 {
@@ -689,11 +1036,41 @@ func (proxy *Proxy) processIncomingQuery(
 	if len(response) == 0 && serverInfo != nil {
 		var ttl *uint32
 		pluginsState.serverName = serverName
-		if serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
+		trace.add("upstream", "sending the query to [%s]", serverName)
+		pluginsState.upstreamTransport = upstreamTransport(serverInfo, serverProto)
+		if proxy.upstreamRecorder.replaying() {
+			pluginsState.upstreamTransport = "replay"
+			if response = proxy.upstreamRecorder.replay(query); response == nil {
+				trace.add("upstream", "no recorded response")
+				pluginsState.returnCode = PluginsReturnCodeNetworkError
+				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+				return response
+			}
+		} else if faultErr := proxy.faultInjector.inject(serverName, proxy.timeout); faultErr != nil {
+			trace.add("upstream", "%v", faultErr)
+			serverInfo.noticeBegin(proxy)
+			if stale, ok := pluginsState.sessionData["stale"]; ok {
+				dlog.Debug("Serving stale response")
+				response, err = (stale.(*dns.Msg)).Pack()
+			} else {
+				err = faultErr
+			}
+			if err != nil {
+				if faultErr.Timeout() {
+					pluginsState.returnCode = PluginsReturnCodeServerTimeout
+				} else {
+					pluginsState.returnCode = PluginsReturnCodeNetworkError
+				}
+				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+				serverInfo.noticeFailure(proxy)
+				return response
+			}
+		} else if serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
 			sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
 			if err != nil && serverProto == "udp" {
 				dlog.Debug("Unable to pad for UDP, re-encrypting query for TCP")
 				serverProto = "tcp"
+				pluginsState.upstreamTransport = upstreamTransport(serverInfo, serverProto)
 				sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
 			}
 			if err != nil {
@@ -706,13 +1083,16 @@ func (proxy *Proxy) processIncomingQuery(
 				response, err = proxy.exchangeWithUDPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
 				retryOverTCP := false
 				if err == nil && len(response) >= MinDNSPacketSize && response[2]&0x02 == 0x02 {
-					retryOverTCP = true
+					retryOverTCP = clientProto != "udp" || proxy.truncatedUDPRetryTCP
 				} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 					dlog.Debugf("[%v] Retry over TCP after UDP timeouts", serverName)
 					retryOverTCP = true
 				}
 				if retryOverTCP {
+					trace.add("upstream", "retrying over TCP")
 					serverProto = "tcp"
+					pluginsState.upstreamRetries++
+					pluginsState.upstreamTransport = upstreamTransport(serverInfo, serverProto)
 					sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
 					if err != nil {
 						pluginsState.returnCode = PluginsReturnCodeParseError
@@ -744,8 +1124,17 @@ func (proxy *Proxy) processIncomingQuery(
 			tid := TransactionID(query)
 			SetTransactionID(query, 0)
 			serverInfo.noticeBegin(proxy)
-			serverResponse, _, tls, _, err := proxy.xTransport.DoHQuery(serverInfo.useGet, serverInfo.URL, query, proxy.timeout)
+			serverResponse, _, tls, _, err := proxy.xTransport.DoHQuery(
+				serverInfo.useGet,
+				serverInfo.URL,
+				query,
+				proxy.timeout,
+				serverInfo.httpHeaders,
+			)
 			SetTransactionID(query, tid)
+			if tls != nil && len(tls.NegotiatedProtocol) > 0 {
+				pluginsState.upstreamTransport += "/" + tls.NegotiatedProtocol
+			}
 
 			if err != nil || tls == nil || !tls.HandshakeComplete {
 				if stale, ok := pluginsState.sessionData["stale"]; ok {
@@ -770,7 +1159,7 @@ func (proxy *Proxy) processIncomingQuery(
 			if len(serverInfo.odohTargetConfigs) == 0 {
 				return response
 			}
-			target := serverInfo.odohTargetConfigs[rand.Intn(len(serverInfo.odohTargetConfigs))]
+			target := serverInfo.odohTargetConfigs[proxy.random.Intn(len(serverInfo.odohTargetConfigs))]
 			odohQuery, err := target.encryptQuery(query)
 			if err != nil {
 				dlog.Errorf("Failed to encrypt query for [%v]", serverName)
@@ -820,12 +1209,19 @@ func (proxy *Proxy) processIncomingQuery(
 		} else {
 			dlog.Fatal("Unsupported protocol")
 		}
-		if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
+		if len(response) < MinDNSPacketSize || len(response) > MaxDNSMessageSize {
 			pluginsState.returnCode = PluginsReturnCodeParseError
 			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
 			serverInfo.noticeFailure(proxy)
 			return response
 		}
+		trace.add("upstream", "received a %d bytes response", len(response))
+		if proxy.upstreamRecorder.recording() {
+			proxy.upstreamRecorder.record(serverName, query, response)
+		}
+		if serverInfo.requireDNSSEC && !checkDNSSECResponse(response) {
+			proxy.serversInfo.demote(serverName, "a signed response was not validated")
+		}
 		response, err = pluginsState.ApplyResponsePlugins(&proxy.pluginsGlobals, response, ttl)
 		if err != nil {
 			pluginsState.returnCode = PluginsReturnCodeParseError
@@ -857,7 +1253,16 @@ func (proxy *Proxy) processIncomingQuery(
 			serverInfo.noticeSuccess(proxy)
 		}
 	}
-	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
+	// Limits also apply to cached and synthesized responses
+	if len(response) >= MinDNSPacketSize {
+		response, err = proxy.applyResponseLimits(&pluginsState, response)
+		if err != nil {
+			pluginsState.returnCode = PluginsReturnCodeParseError
+			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+			return response
+		}
+	}
+	if len(response) < MinDNSPacketSize || len(response) > MaxDNSMessageSize {
 		if len(response) == 0 {
 			pluginsState.returnCode = PluginsReturnCodeNotReady
 		} else {
@@ -869,7 +1274,17 @@ func (proxy *Proxy) processIncomingQuery(
 		}
 		return response
 	}
+	if proxy.queryLogIPTags != nil {
+		pluginsState.ipTags = proxy.queryLogIPTags.tagsForResponse(response)
+	}
+	pluginsState.responseSize = len(response)
 	if clientProto == "udp" {
+		if options := pluginsState.listenerOptions; options != nil && options.EDNSPayloadSize > 0 {
+			pluginsState.maxUnencryptedUDPSafePayloadSize = Min(pluginsState.maxUnencryptedUDPSafePayloadSize, options.EDNSPayloadSize)
+			if advertised, err := setEDNS0PayloadSize(response, uint16(options.EDNSPayloadSize)); err == nil {
+				response = advertised
+			}
+		}
 		if len(response) > pluginsState.maxUnencryptedUDPSafePayloadSize {
 			response, err = TruncatedResponse(response)
 			if err != nil {
@@ -877,6 +1292,21 @@ func (proxy *Proxy) processIncomingQuery(
 				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
 				return response
 			}
+			pluginsState.responseSize = len(response)
+		}
+		// Rate limited responses are not logged, since they are likely to be caused by spoofed queries
+		if proxy.responseRateLimiter != nil {
+			switch proxy.responseRateLimiter.check((*clientAddr).(*net.UDPAddr).IP, response) {
+			case RRLActionDrop:
+				pluginsState.trace.add("listener", "response dropped by the rate limiter")
+				return response
+			case RRLActionSlip:
+				pluginsState.trace.add("listener", "truncated response sent by the rate limiter")
+				if truncated, err := TruncatedResponse(response); err == nil {
+					clientPc.(net.PacketConn).WriteTo(truncated, *clientAddr)
+				}
+				return response
+			}
 		}
 		clientPc.(net.PacketConn).WriteTo(response, *clientAddr)
 		if HasTCFlag(response) {
@@ -905,6 +1335,9 @@ func (proxy *Proxy) processIncomingQuery(
 
 func NewProxy() *Proxy {
 	return &Proxy{
-		serversInfo: NewServersInfo(),
+		serversInfo:     NewServersInfo(),
+		quit:            make(chan struct{}),
+		refreshRequests: make(chan string, 1),
+		queryStats:      NewQueryStats(),
 	}
 }
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	QueryRouteAny        = "any"
+	QueryRouteDirect     = "direct"
+	QueryRouteAnonymized = "anonymized"
+
+	// DefaultRouteOverrideOption is in the range reserved for local and experimental EDNS options
+	DefaultRouteOverrideOption = 65430
+)
+
+// queryRoute is a set of servers that queries for some names can be sent to
+type queryRoute struct {
+	target  string
+	servers map[string]struct{}
+	// fallback allows other servers to be used if none of the route's servers are available
+	fallback bool
+}
+
+func newQueryRoute(target string, fallback bool) *queryRoute {
+	route := &queryRoute{target: target, fallback: fallback}
+	switch target {
+	case QueryRouteAny, QueryRouteDirect, QueryRouteAnonymized:
+		return route
+	}
+	route.servers = make(map[string]struct{})
+	for _, name := range strings.Split(target, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			route.servers[name] = struct{}{}
+		}
+	}
+	return route
+}
+
+func (route *queryRoute) accepts(serverInfo *ServerInfo) bool {
+	switch route.target {
+	case QueryRouteAny:
+		return true
+	case QueryRouteDirect:
+		return serverInfo.Relay == nil
+	case QueryRouteAnonymized:
+		return serverInfo.Relay != nil
+	}
+	_, found := route.servers[serverInfo.Name]
+	return found
+}
+
+// QueryRoutes maps name patterns to the servers that can resolve them, so that sensitive
+// names can be only sent through relays, while other names use the fastest servers
+type QueryRoutes struct {
+	patternMatcher *PatternMatcher
+	defaultRoute   *queryRoute
+}
+
+func NewQueryRoutes(rulesFile string, defaultRoute string, matcherEngine string) (*QueryRoutes, error) {
+	queryRoutes := &QueryRoutes{patternMatcher: NewPatternMatcherWithEngine(matcherEngine)}
+	if len(defaultRoute) > 0 && defaultRoute != QueryRouteAny {
+		queryRoutes.defaultRoute = newQueryRoute(defaultRoute, true)
+	}
+	if len(rulesFile) == 0 {
+		return queryRoutes, nil
+	}
+	dlog.Noticef("Loading the set of query routing rules from [%s]", rulesFile)
+	lines, err := ReadTextFile(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	for lineNo, line := range strings.Split(lines, "\n") {
+		line = TrimAndStripInlineComments(line)
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Syntax error in query routing rules at line %d", 1+lineNo)
+		}
+		if err := queryRoutes.patternMatcher.Add(strings.ToLower(parts[0]), newQueryRoute(parts[1], false), 1+lineNo); err != nil {
+			return nil, err
+		}
+	}
+	return queryRoutes, nil
+}
+
+func (queryRoutes *QueryRoutes) routeFor(qName string) (*queryRoute, string) {
+	if match, reason, xroute := queryRoutes.patternMatcher.Eval(qName); match {
+		return xroute.(*queryRoute), "rule " + reason
+	}
+	return queryRoutes.defaultRoute, "default route"
+}
+
+// routeOverride extracts the route requested by a trusted client using an EDNS option.
+// The option is removed from queries sent by all clients, so that it never reaches upstream servers.
+func (proxy *Proxy) routeOverride(clientProto string, clientAddr *net.Addr, query []byte, trace *queryTrace) ([]byte, *queryRoute) {
+	if len(proxy.routeOverrideClients) == 0 {
+		return query, nil
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil {
+		return query, nil
+	}
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return query, nil
+	}
+	target := ""
+	found := false
+	options := edns0.Option[:0]
+	for _, option := range edns0.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == proxy.routeOverrideOption {
+			target, found = strings.TrimSpace(string(local.Data)), true
+			continue
+		}
+		options = append(options, option)
+	}
+	if !found {
+		return query, nil
+	}
+	edns0.Option = options
+	strippedQuery, err := msg.Pack()
+	if err != nil {
+		return query, nil
+	}
+	var clientIP net.IP
+	switch clientProto {
+	case "udp":
+		clientIP = (*clientAddr).(*net.UDPAddr).IP
+	case "tcp", "local_doh":
+		clientIP = (*clientAddr).(*net.TCPAddr).IP
+	}
+	trusted := false
+	if clientIP != nil {
+		for _, network := range proxy.routeOverrideClients {
+			if network.Contains(clientIP) {
+				trusted = true
+				break
+			}
+		}
+	}
+	if !trusted || len(target) == 0 {
+		dlog.Debugf("Ignoring the route requested by an untrusted client: [%s]", target)
+		return strippedQuery, nil
+	}
+	trace.add("route", "the client requested the [%s] servers", target)
+	return strippedQuery, newQueryRoute(target, false)
+}
+
+// selectServer picks a server for a query, among the ones allowed by the route requested
+// by the client, or else by the routing rules.
+// Names matching a rule are never sent to other servers.
+func (proxy *Proxy) selectServer(query []byte, override *queryRoute, trace *queryTrace) *ServerInfo {
+	if override != nil {
+		serverInfo := proxy.serversInfo.getOneMatching(override.accepts)
+		if serverInfo == nil {
+			dlog.Debugf("No [%s] servers available for the route requested by the client", override.target)
+		}
+		return serverInfo
+	}
+	if proxy.queryRoutes == nil {
+		return proxy.serversInfo.getOne()
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		return proxy.serversInfo.getOne()
+	}
+	qName, err := NormalizeQName(msg.Question[0].Name)
+	if err != nil {
+		return proxy.serversInfo.getOne()
+	}
+	route, reason := proxy.queryRoutes.routeFor(qName)
+	if route == nil {
+		return proxy.serversInfo.getOne()
+	}
+	trace.add("route", "[%s] uses the [%s] servers (%s)", qName, route.target, reason)
+	serverInfo := proxy.serversInfo.getOneMatching(route.accepts)
+	if serverInfo == nil {
+		if route.fallback {
+			return proxy.serversInfo.getOne()
+		}
+		dlog.Debugf("No [%s] servers available for [%s]", route.target, qName)
+	}
+	return serverInfo
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	QueryLogBusNATS      = "nats"
+	QueryLogBusKafkaREST = "kafka_rest"
+
+	DefaultQueryLogBusBatchSize     = 100
+	DefaultQueryLogBusFlushInterval = time.Second
+	DefaultQueryLogBusQueueSize     = 10000
+	QueryLogBusRetryDelay           = 5 * time.Second
+)
+
+// QueryLogEvent is a query log entry, as published to a message bus
+type QueryLogEvent struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	ReturnCode string    `json:"return_code"`
+	Cached     bool      `json:"cached"`
+	DurationMs int64     `json:"duration_ms"`
+	Server     string    `json:"server"`
+	Transport  string    `json:"transport"`
+	Retries    int       `json:"retries"`
+	Size       int       `json:"size"`
+	Listener   string    `json:"listener,omitempty"`
+	Node       string    `json:"node,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	WouldBlock bool      `json:"would_block,omitempty"`
+}
+
+type queryLogBusPublisher interface {
+	publish(events [][]byte) error
+	close()
+}
+
+// QueryLogBus sends query log events to Kafka or NATS, in batches.
+// If the bus can't keep up, events are dropped instead of slowing down queries.
+type QueryLogBus struct {
+	publisher     queryLogBusPublisher
+	queue         chan []byte
+	batchSize     int
+	flushInterval time.Duration
+	dropped       atomic.Uint64
+}
+
+func NewQueryLogBus(config *QueryLogBusConfig, xTransport *XTransport) (*QueryLogBus, error) {
+	busURL, err := url.Parse(config.URL)
+	if err != nil || len(busURL.Host) == 0 {
+		return nil, fmt.Errorf("Query log bus: invalid URL [%s]", config.URL)
+	}
+	if len(config.Topic) == 0 {
+		return nil, errors.New("Query log bus: a topic is required")
+	}
+	bus := &QueryLogBus{
+		batchSize:     config.BatchSize,
+		flushInterval: time.Duration(config.FlushInterval) * time.Millisecond,
+	}
+	if bus.batchSize <= 0 {
+		bus.batchSize = DefaultQueryLogBusBatchSize
+	}
+	if bus.flushInterval <= 0 {
+		bus.flushInterval = DefaultQueryLogBusFlushInterval
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueryLogBusQueueSize
+	}
+	bus.queue = make(chan []byte, queueSize)
+	switch strings.ToLower(config.Type) {
+	case QueryLogBusNATS:
+		if busURL.Scheme != "nats" && busURL.Scheme != "tls" {
+			return nil, fmt.Errorf("Query log bus: unsupported URL scheme for NATS [%s]", busURL.Scheme)
+		}
+		bus.publisher = &natsPublisher{url: busURL, subject: config.Topic}
+	case QueryLogBusKafkaREST:
+		if busURL.Scheme != "http" && busURL.Scheme != "https" {
+			return nil, fmt.Errorf("Query log bus: unsupported URL scheme for a Kafka REST proxy [%s]", busURL.Scheme)
+		}
+		bus.publisher = newKafkaRESTPublisher(busURL, config.Topic, xTransport)
+	default:
+		return nil, fmt.Errorf("Query log bus: unsupported type [%s] - Use '%s' or '%s'", config.Type, QueryLogBusNATS, QueryLogBusKafkaREST)
+	}
+	return bus, nil
+}
+
+// enqueue adds an event to the queue, or drops it if the queue is full
+func (bus *QueryLogBus) enqueue(event *QueryLogEvent) {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	select {
+	case bus.queue <- encoded:
+	default:
+		bus.dropped.Add(1)
+	}
+}
+
+func (bus *QueryLogBus) run(quit chan struct{}) {
+	ticker := time.NewTicker(bus.flushInterval)
+	defer ticker.Stop()
+	defer bus.publisher.close()
+	batch := make([][]byte, 0, bus.batchSize)
+	var retryAfter time.Time
+	flush := func() {
+		if dropped := bus.dropped.Swap(0); dropped > 0 {
+			dlog.Warnf("Query log bus: %d events dropped", dropped)
+		}
+		if len(batch) == 0 || time.Now().Before(retryAfter) {
+			return
+		}
+		if err := bus.publisher.publish(batch); err != nil {
+			// Keep the batch until the bus is reachable again, and drop new events in the meantime
+			dlog.Warnf("Query log bus: %v", err)
+			retryAfter = time.Now().Add(QueryLogBusRetryDelay)
+			return
+		}
+		batch = batch[:0]
+	}
+	for {
+		full := len(batch) >= bus.batchSize
+		queue := bus.queue
+		if full {
+			queue = nil
+		}
+		select {
+		case <-quit:
+			flush()
+			return
+		case event := <-queue:
+			batch = append(batch, event)
+			if len(batch) >= bus.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// natsPublisher uses the NATS text protocol
+type natsPublisher struct {
+	sync.Mutex
+	url     *url.URL
+	subject string
+	conn    net.Conn
+}
+
+func (publisher *natsPublisher) connect() error {
+	timeout := 10 * time.Second
+	var conn net.Conn
+	var err error
+	if publisher.url.Scheme == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", publisher.url.Host, &tls.Config{
+			ServerName: publisher.url.Hostname(),
+		})
+	} else {
+		conn, err = net.DialTimeout("tcp", publisher.url.Host, timeout)
+	}
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	info, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return errors.New("Unexpected response from the NATS server")
+	}
+	conn.SetReadDeadline(time.Time{})
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "dnscrypt-proxy", "lang": "go"}
+	if user := publisher.url.User; user != nil {
+		if password, hasPassword := user.Password(); hasPassword {
+			options["user"], options["pass"] = user.Username(), password
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+	publisher.conn = conn
+	go publisher.readLoop(conn, reader)
+	return nil
+}
+
+// readLoop answers the keepalive pings sent by the server
+func (publisher *natsPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			publisher.Lock()
+			_, err = conn.Write([]byte("PONG\r\n"))
+			publisher.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			dlog.Warnf("Query log bus: NATS server error: %s", strings.TrimSpace(line[4:]))
+		}
+		if err != nil {
+			break
+		}
+	}
+	publisher.Lock()
+	if publisher.conn == conn {
+		publisher.conn = nil
+	}
+	publisher.Unlock()
+	conn.Close()
+}
+
+func (publisher *natsPublisher) publish(events [][]byte) error {
+	publisher.Lock()
+	defer publisher.Unlock()
+	if publisher.conn == nil {
+		if err := publisher.connect(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	for _, event := range events {
+		fmt.Fprintf(&buf, "PUB %s %d\r\n", publisher.subject, len(event))
+		buf.Write(event)
+		buf.WriteString("\r\n")
+	}
+	publisher.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := publisher.conn.Write(buf.Bytes()); err != nil {
+		publisher.conn.Close()
+		publisher.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (publisher *natsPublisher) close() {
+	publisher.Lock()
+	defer publisher.Unlock()
+	if publisher.conn != nil {
+		publisher.conn.Close()
+		publisher.conn = nil
+	}
+}
+
+// kafkaRESTPublisher sends events to a Kafka REST proxy
+type kafkaRESTPublisher struct {
+	url        *url.URL
+	headers    map[string]string
+	xTransport *XTransport
+}
+
+func newKafkaRESTPublisher(busURL *url.URL, topic string, xTransport *XTransport) *kafkaRESTPublisher {
+	publisher := &kafkaRESTPublisher{xTransport: xTransport}
+	if user := busURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		publisher.headers = map[string]string{"Authorization": "Basic " + credentials}
+	}
+	topicURL := *busURL
+	topicURL.User = nil
+	topicURL.Path = strings.TrimSuffix(topicURL.Path, "/") + "/topics/" + url.PathEscape(topic)
+	publisher.url = &topicURL
+	return publisher
+}
+
+func (publisher *kafkaRESTPublisher) publish(events [][]byte) error {
+	var buf bytes.Buffer
+	buf.WriteString(`{"records":[`)
+	for i, event := range events {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`{"value":`)
+		buf.Write(event)
+		buf.WriteByte('}')
+	}
+	buf.WriteString("]}")
+	body := buf.Bytes()
+	_, _, _, _, err := publisher.xTransport.fetch(
+		"POST",
+		publisher.url,
+		"application/vnd.kafka.v2+json",
+		"application/vnd.kafka.json.v2+json",
+		&body,
+		30*time.Second,
+		false,
+		MaxHTTPBodyLength,
+		publisher.headers,
+	)
+	return err
+}
+
+func (publisher *kafkaRESTPublisher) close() {}
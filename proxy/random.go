@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// lockedRand is used for choices that don't have to be unpredictable, such as server and relay selection,
+// or jitter. In deterministic mode, each proxy has its own generator, seeded with a known value, so that
+// a run can be reproduced; it is shared by multiple goroutines and serialized by a mutex.
+// A nil lockedRand uses the top-level math/rand functions, whose source is per-thread and lock-free.
+type lockedRand struct {
+	sync.Mutex
+	rng *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) Intn(n int) int {
+	if r == nil {
+		return rand.Intn(n)
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.rng.Intn(n)
+}
+
+func (r *lockedRand) Int63n(n int64) int64 {
+	if r == nil {
+		return rand.Int63n(n)
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.rng.Int63n(n)
+}
+
+func (r *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	if r == nil {
+		rand.Shuffle(n, swap)
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.rng.Shuffle(n, swap)
+}
@@ -0,0 +1,433 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+const (
+	RelayHeaderLen            = 10 + 16 + 2
+	RelayMaxQueries           = 1000
+	DefaultRelayQueriesPerSec = 50
+	RelayTCPIdleTimeout       = 10 * time.Second
+	RelayMaxClients           = 10000
+	RelayMaxMagics            = 4096
+	RelayMagicTTL             = 24 * time.Hour
+)
+
+var relayMagic = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+// RelayService forwards Anonymized DNSCrypt queries to the servers they are addressed to,
+// without keeping any state besides per-client rate limits.
+// Only DNSCrypt servers listed in the configured sources, or within the allowed networks, can be reached,
+// and only certificate requests, and queries using a client magic from a relayed certificate, are forwarded.
+type RelayService struct {
+	sync.Mutex
+	listenAddresses []string
+	allowedTargets  []*net.IPNet
+	queriesPerSec   int
+	timeout         time.Duration
+	clients         map[string]*rrlBucket
+	lastCleanup     time.Time
+	slots           chan struct{}
+	targets         map[string]struct{}
+	magics          map[[ClientMagicLen]byte]time.Time
+}
+
+func NewRelayService(config *RelayServiceConfig, timeout time.Duration) (*RelayService, error) {
+	relay := &RelayService{
+		listenAddresses: config.ListenAddresses,
+		queriesPerSec:   config.QueriesPerSecond,
+		timeout:         timeout,
+		clients:         make(map[string]*rrlBucket),
+		slots:           make(chan struct{}, RelayMaxQueries),
+		targets:         make(map[string]struct{}),
+		magics:          make(map[[ClientMagicLen]byte]time.Time),
+	}
+	if relay.queriesPerSec <= 0 {
+		relay.queriesPerSec = DefaultRelayQueriesPerSec
+	}
+	for _, target := range config.AllowedTargets {
+		if !strings.Contains(target, "/") {
+			if ip := net.ParseIP(target); ip != nil && ip.To4() != nil {
+				target += "/32"
+			} else {
+				target += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			return nil, fmt.Errorf("DNSCrypt relay: invalid target network [%s]", target)
+		}
+		relay.allowedTargets = append(relay.allowedTargets, network)
+	}
+	return relay, nil
+}
+
+// setTargets replaces the addresses of the DNSCrypt servers listed in the sources
+func (relay *RelayService) setTargets(registeredServers []RegisteredServer) {
+	targets := make(map[string]struct{})
+	for _, registeredServer := range registeredServers {
+		if registeredServer.stamp.Proto != stamps.StampProtoTypeDNSCrypt {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", registeredServer.stamp.ServerAddrStr)
+		if err != nil || addr.IP == nil {
+			continue
+		}
+		targets[relayTargetKey(addr.IP, addr.Port)] = struct{}{}
+	}
+	relay.Lock()
+	relay.targets = targets
+	relay.Unlock()
+	dlog.Debugf("DNSCrypt relay: %d servers can be reached", len(targets))
+}
+
+func relayTargetKey(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// targetAllowed only accepts the servers within the allowed networks, if there are any,
+// or else the DNSCrypt servers listed in the sources
+func (relay *RelayService) targetAllowed(ip net.IP, port int) bool {
+	if port == 0 || ip.IsUnspecified() || ip.IsMulticast() || ip.IsLoopback() {
+		return false
+	}
+	if len(relay.allowedTargets) > 0 {
+		for _, network := range relay.allowedTargets {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	relay.Lock()
+	_, found := relay.targets[relayTargetKey(ip, port)]
+	relay.Unlock()
+	return found
+}
+
+// learnMagics records the client magics of the certificates returned by a server
+func (relay *RelayService) learnMagics(response []byte) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err != nil {
+		return
+	}
+	now := time.Now()
+	relay.Lock()
+	defer relay.Unlock()
+	for _, rr := range msg.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		binCert := PackTXTRR(strings.Join(txt.Txt, ""))
+		if len(binCert) < 124 || !bytes.Equal(binCert[:4], CertMagic[:4]) {
+			continue
+		}
+		var magic [ClientMagicLen]byte
+		copy(magic[:], binCert[104:112])
+		if _, found := relay.magics[magic]; !found && len(relay.magics) >= RelayMaxMagics {
+			for key, seen := range relay.magics {
+				if now.Sub(seen) > RelayMagicTTL {
+					delete(relay.magics, key)
+				}
+			}
+			if len(relay.magics) >= RelayMaxMagics {
+				continue
+			}
+		}
+		relay.magics[magic] = now
+	}
+}
+
+func (relay *RelayService) knownMagic(query []byte) bool {
+	var magic [ClientMagicLen]byte
+	copy(magic[:], query)
+	relay.Lock()
+	seen, found := relay.magics[magic]
+	relay.Unlock()
+	return found && time.Since(seen) <= RelayMagicTTL
+}
+
+func (relay *RelayService) allowClient(clientIP net.IP) bool {
+	now := time.Now()
+	relay.Lock()
+	defer relay.Unlock()
+	if now.Sub(relay.lastCleanup) > time.Minute {
+		for key, bucket := range relay.clients {
+			if now.Sub(bucket.lastSeen) > time.Second {
+				delete(relay.clients, key)
+			}
+		}
+		relay.lastCleanup = now
+	}
+	key := clientIP.String()
+	bucket, found := relay.clients[key]
+	if !found {
+		// Spoofed source addresses could otherwise grow the table without bounds
+		if len(relay.clients) >= RelayMaxClients {
+			for key, bucket := range relay.clients {
+				if now.Sub(bucket.lastSeen) > time.Second {
+					delete(relay.clients, key)
+				}
+			}
+			relay.lastCleanup = now
+			for evicted := range relay.clients {
+				if len(relay.clients) < RelayMaxClients {
+					break
+				}
+				delete(relay.clients, evicted)
+			}
+		}
+		bucket = &rrlBucket{balance: float64(relay.queriesPerSec), lastSeen: now}
+		relay.clients[key] = bucket
+	}
+	bucket.balance += now.Sub(bucket.lastSeen).Seconds() * float64(relay.queriesPerSec)
+	if bucket.balance > float64(relay.queriesPerSec) {
+		bucket.balance = float64(relay.queriesPerSec)
+	}
+	bucket.lastSeen = now
+	if bucket.balance < 1 {
+		return false
+	}
+	bucket.balance--
+	return true
+}
+
+// isCertRequest checks that a query is a request for the certificates of a DNSCrypt server
+func isCertRequest(query []byte) bool {
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil || msg.Response || len(msg.Question) != 1 {
+		return false
+	}
+	question := msg.Question[0]
+	return question.Qtype == dns.TypeTXT && strings.HasPrefix(strings.ToLower(question.Name), "2.dnscrypt-cert.")
+}
+
+// parse checks a relayed query, and returns the target address, the query to forward,
+// and whether it is a certificate request. Only encrypted queries and certificate requests are relayed.
+func (relay *RelayService) parse(packet []byte) (*net.UDPAddr, []byte, bool, error) {
+	if len(packet) < RelayHeaderLen+MinDNSPacketSize || !bytes.Equal(packet[:len(relayMagic)], relayMagic) {
+		return nil, nil, false, errors.New("Not an anonymized query")
+	}
+	target := &net.UDPAddr{
+		IP:   net.IP(append([]byte{}, packet[10:26]...)),
+		Port: int(binary.BigEndian.Uint16(packet[26:28])),
+	}
+	if !relay.targetAllowed(target.IP, target.Port) {
+		return nil, nil, false, fmt.Errorf("Target [%v] not allowed", target)
+	}
+	query := packet[RelayHeaderLen:]
+	if bytes.HasPrefix(query, relayMagic) {
+		return nil, nil, false, errors.New("Relay loop")
+	}
+	if isCertRequest(query) {
+		return target, query, true, nil
+	}
+	if len(query) < QueryOverhead+MinDNSPacketSize || !relay.knownMagic(query) {
+		return nil, nil, false, errors.New("Unexpected query")
+	}
+	return target, query, false, nil
+}
+
+// validResponse accepts encrypted responses and certificates
+func validResponse(response []byte) bool {
+	if bytes.HasPrefix(response, ServerMagic[:]) {
+		return true
+	}
+	return len(response) >= MinDNSPacketSize && response[2]&0x80 != 0
+}
+
+func (relay *RelayService) serveUDP(pc *net.UDPConn) {
+	buf := make([]byte, MaxDNSPacketSize)
+	for {
+		length, clientAddr, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !relay.allowClient(clientAddr.IP) {
+			continue
+		}
+		target, query, certRequest, err := relay.parse(buf[:length])
+		if err != nil {
+			dlog.Debugf("DNSCrypt relay: [%v]: %v", clientAddr, err)
+			continue
+		}
+		select {
+		case relay.slots <- struct{}{}:
+		default:
+			continue
+		}
+		query = append([]byte{}, query...)
+		go func() {
+			defer func() { <-relay.slots }()
+			response, err := relay.exchangeUDP(target, query)
+			if err != nil {
+				dlog.Debugf("DNSCrypt relay: [%v]: %v", target, err)
+				return
+			}
+			if certRequest {
+				relay.learnMagics(response)
+			}
+			pc.WriteToUDP(response, clientAddr)
+		}()
+	}
+}
+
+func (relay *RelayService) exchangeUDP(target *net.UDPAddr, query []byte) ([]byte, error) {
+	pc, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(relay.timeout))
+	if _, err := pc.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, MaxDNSPacketSize)
+	length, err := pc.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	if !validResponse(response[:length]) {
+		return nil, errors.New("Unexpected response")
+	}
+	return response[:length], nil
+}
+
+func (relay *RelayService) serveTCP(listener *net.TCPListener) {
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		select {
+		case relay.slots <- struct{}{}:
+		default:
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-relay.slots }()
+			defer conn.Close()
+			relay.handleTCP(conn)
+		}()
+	}
+}
+
+func (relay *RelayService) handleTCP(conn *net.TCPConn) {
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	for {
+		conn.SetDeadline(time.Now().Add(RelayTCPIdleTimeout))
+		packet, err := readPrefixedMessage(conn)
+		if err != nil || !relay.allowClient(clientIP) {
+			return
+		}
+		target, query, certRequest, err := relay.parse(packet)
+		if err != nil {
+			dlog.Debugf("DNSCrypt relay: [%v]: %v", clientIP, err)
+			return
+		}
+		response, err := relay.exchangeTCP(target, query)
+		if err != nil {
+			dlog.Debugf("DNSCrypt relay: [%v]: %v", target, err)
+			return
+		}
+		if certRequest {
+			relay.learnMagics(response)
+		}
+		if response, err = PrefixWithSize(response); err != nil {
+			return
+		}
+		conn.SetDeadline(time.Now().Add(relay.timeout))
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+func (relay *RelayService) exchangeTCP(target *net.UDPAddr, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", target.String(), relay.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(relay.timeout))
+	prefixed, err := PrefixWithSize(append([]byte{}, query...))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(prefixed); err != nil {
+		return nil, err
+	}
+	response, err := readPrefixedMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !validResponse(response) {
+		return nil, errors.New("Unexpected response")
+	}
+	return response, nil
+}
+
+func readPrefixedMessage(conn net.Conn) ([]byte, error) {
+	var lengthBuf [2]byte
+	if _, err := io.ReadFull(conn, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(lengthBuf[:]))
+	if length < MinDNSPacketSize || length > MaxDNSPacketSize+RelayHeaderLen {
+		return nil, errors.New("Invalid message length")
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(conn, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func (relay *RelayService) start(proxy *Proxy) error {
+	var closers []io.Closer
+	for _, listenAddress := range relay.listenAddresses {
+		udpAddr, err := net.ResolveUDPAddr("udp", listenAddress)
+		if err != nil {
+			return err
+		}
+		pc, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		listener, err := net.ListenTCP("tcp", (*net.TCPAddr)(udpAddr))
+		if err != nil {
+			pc.Close()
+			return err
+		}
+		closers = append(closers, pc, listener)
+		go relay.serveUDP(pc)
+		go relay.serveTCP(listener)
+		dlog.Noticef("Now relaying Anonymized DNSCrypt queries on %v", listenAddress)
+	}
+	go func() {
+		<-proxy.quit
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+func relayedPacket(ip net.IP, port int, query []byte) []byte {
+	packet := append([]byte{}, relayMagic...)
+	packet = append(packet, ip.To16()...)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(port))
+	return append(packet, query...)
+}
+
+func certResponse(t *testing.T, magic []byte) []byte {
+	binCert := make([]byte, 124)
+	copy(binCert, CertMagic[:])
+	copy(binCert[104:112], magic)
+	txt := ""
+	for _, c := range binCert {
+		txt += "\\" + strconv.Itoa(int(c)/100) + strconv.Itoa(int(c)/10%10) + strconv.Itoa(int(c)%10)
+	}
+	msg := dns.Msg{}
+	msg.SetQuestion("2.dnscrypt-cert.example.com.", dns.TypeTXT)
+	msg.Response = true
+	rr, err := dns.NewRR("2.dnscrypt-cert.example.com. 60 IN TXT \"" + txt + "\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Answer = append(msg.Answer, rr)
+	response, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestRelayServiceParse(t *testing.T) {
+	dlog.Init("t", dlog.SeverityNotice, "")
+	relay, err := NewRelayService(&RelayServiceConfig{}, DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp, err := stamps.NewDNSCryptServerStampFromLegacy("198.51.100.1:8443",
+		"0000000000000000000000000000000000000000000000000000000000000000", "2.dnscrypt-cert.example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.setTargets([]RegisteredServer{{name: "example", stamp: stamp}})
+	server := net.ParseIP("198.51.100.1")
+
+	certQuery := dns.Msg{}
+	certQuery.SetQuestion("2.dnscrypt-cert.example.com.", dns.TypeTXT)
+	packedCertQuery, _ := certQuery.Pack()
+	if _, _, certRequest, err := relay.parse(relayedPacket(server, 8443, packedCertQuery)); err != nil || !certRequest {
+		t.Errorf("certificate request rejected: %v", err)
+	}
+	if _, _, _, err := relay.parse(relayedPacket(net.ParseIP("198.51.100.2"), 8443, packedCertQuery)); err == nil {
+		t.Error("server not listed in the sources accepted")
+	}
+	if _, _, _, err := relay.parse(relayedPacket(server, 53, packedCertQuery)); err == nil {
+		t.Error("unexpected port accepted")
+	}
+
+	otherQuery := dns.Msg{}
+	otherQuery.SetQuestion("example.com.", dns.TypeTXT)
+	packedOtherQuery, _ := otherQuery.Pack()
+	if _, _, _, err := relay.parse(relayedPacket(server, 8443, packedOtherQuery)); err == nil {
+		t.Error("plain DNS query accepted")
+	}
+
+	magic := []byte("qmagic00")
+	encryptedQuery := make([]byte, QueryOverhead+MinDNSPacketSize+64)
+	copy(encryptedQuery, magic)
+	if _, _, _, err := relay.parse(relayedPacket(server, 8443, encryptedQuery)); err == nil {
+		t.Error("query with an unknown client magic accepted")
+	}
+	relay.learnMagics(certResponse(t, magic))
+	if _, _, certRequest, err := relay.parse(relayedPacket(server, 8443, encryptedQuery)); err != nil || certRequest {
+		t.Errorf("query with a known client magic rejected: %v", err)
+	}
+	if _, _, _, err := relay.parse(relayedPacket(server, 8443, encryptedQuery[:QueryOverhead])); err == nil {
+		t.Error("short query accepted")
+	}
+}
+
+func TestRelayServiceClientsLimit(t *testing.T) {
+	relay, err := NewRelayService(&RelayServiceConfig{}, DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < RelayMaxClients+100; i++ {
+		ip := make(net.IP, 16)
+		binary.BigEndian.PutUint32(ip[12:], uint32(i))
+		relay.allowClient(ip)
+	}
+	if len(relay.clients) > RelayMaxClients {
+		t.Errorf("%d clients tracked, the limit is %d", len(relay.clients), RelayMaxClients)
+	}
+}
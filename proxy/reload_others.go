@@ -0,0 +1,36 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+// handleReloadSignal reloads the listen addresses when SIGHUP is received
+func (proxy *Proxy) handleReloadSignal() {
+	if !proxy.sighupReloadListeners || len(proxy.configFile) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-proxy.quit:
+				signal.Stop(signals)
+				return
+			case <-signals:
+				dlog.Notice("SIGHUP received, reloading the listen addresses")
+				added, removed, err := proxy.ReloadListeners()
+				if err != nil {
+					dlog.Errorf("Unable to reload the listen addresses: [%v]", err)
+				}
+				dlog.Noticef("Listeners added: %d, removed: %d", len(added), len(removed))
+			}
+		}
+	}()
+}
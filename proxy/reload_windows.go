@@ -0,0 +1,4 @@
+package proxy
+
+// handleReloadSignal does nothing on Windows, where listeners can be reloaded through the control socket
+func (proxy *Proxy) handleReloadSignal() {}
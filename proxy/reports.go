@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	ReportPeriodDaily     = "daily"
+	ReportPeriodWeekly    = "weekly"
+	ReportMaxTrackedNames = 10000
+	ReportCommandTimeout  = 60 * time.Second
+)
+
+// Reporter aggregates the client queries over a day or a week, and writes a summary
+// as JSON and HTML files at the end of every period
+type Reporter struct {
+	sync.Mutex
+	period     string
+	directory  string
+	command    string
+	top        int
+	epsilon    float64
+	minCount   int
+	anonymizer *IPAnonymizer
+	start      time.Time
+	queries    uint64
+	blocked    uint64
+	cached     uint64
+	names      *topKCounter
+	blockedBy  *topKCounter
+	clients    *topKCounter
+	servers    map[string]*reportServerCounters
+}
+
+type reportServerCounters struct {
+	queries  uint64
+	failures uint64
+}
+
+type ReportCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type ReportServer struct {
+	Name         string  `json:"name"`
+	Queries      uint64  `json:"queries"`
+	Failures     uint64  `json:"failures"`
+	Availability float64 `json:"availability"`
+}
+
+type Report struct {
+	Start          time.Time      `json:"start"`
+	End            time.Time      `json:"end"`
+	Queries        uint64         `json:"queries"`
+	Cached         uint64         `json:"cached"`
+	Blocked        uint64         `json:"blocked"`
+	BlockedPercent float64        `json:"blocked_percent"`
+	TopNames       []ReportCount  `json:"top_names"`
+	TopBlocked     []ReportCount  `json:"top_blocked"`
+	TopClients     []ReportCount  `json:"top_clients"`
+	Servers        []ReportServer `json:"servers"`
+	PrivacyEpsilon float64        `json:"privacy_epsilon,omitempty"`
+	MinCount       int            `json:"min_count,omitempty"`
+}
+
+func NewReporter(
+	period string,
+	directory string,
+	command string,
+	top int,
+	epsilon float64,
+	minCount int,
+	anonymizer *IPAnonymizer,
+) *Reporter {
+	reporter := &Reporter{
+		period:     period,
+		directory:  directory,
+		command:    command,
+		top:        top,
+		epsilon:    epsilon,
+		minCount:   minCount,
+		anonymizer: anonymizer,
+	}
+	reporter.reset(time.Now())
+	return reporter
+}
+
+func (reporter *Reporter) reset(now time.Time) {
+	reporter.start = now
+	reporter.queries, reporter.blocked, reporter.cached = 0, 0, 0
+	reporter.names = newTopKCounter(ReportMaxTrackedNames)
+	reporter.blockedBy = newTopKCounter(ReportMaxTrackedNames)
+	reporter.clients = newTopKCounter(ReportMaxTrackedNames)
+	reporter.servers = make(map[string]*reportServerCounters)
+}
+
+func (reporter *Reporter) record(pluginsState *PluginsState) {
+	if reporter == nil || pluginsState.clientAddr == nil {
+		return
+	}
+	var clientIP net.IP
+	switch pluginsState.clientProto {
+	case "udp":
+		clientIP = (*pluginsState.clientAddr).(*net.UDPAddr).IP
+	case "tcp", "local_doh":
+		clientIP = (*pluginsState.clientAddr).(*net.TCPAddr).IP
+	default:
+		return
+	}
+	reporter.Lock()
+	defer reporter.Unlock()
+	reporter.queries++
+	// Clients are identified the same way as in the query log
+	client := clientIP.String()
+	if reporter.anonymizer != nil {
+		client = reporter.anonymizer.Anonymize(clientIP)
+	}
+	reporter.clients.add(client)
+	if len(pluginsState.qName) > 0 {
+		reporter.names.add(pluginsState.qName)
+	}
+	if pluginsState.cacheHit {
+		reporter.cached++
+	}
+	if pluginsState.returnCode == PluginsReturnCodeReject {
+		reporter.blocked++
+		reporter.blockedBy.add(pluginsState.qName)
+		return
+	}
+	if pluginsState.cacheHit || len(pluginsState.serverName) == 0 || pluginsState.serverName == "-" {
+		return
+	}
+	counters, found := reporter.servers[pluginsState.serverName]
+	if !found {
+		counters = &reportServerCounters{}
+		reporter.servers[pluginsState.serverName] = counters
+	}
+	counters.queries++
+	switch pluginsState.returnCode {
+	case PluginsReturnCodeServerTimeout, PluginsReturnCodeNetworkError, PluginsReturnCodeServFail:
+		counters.failures++
+	}
+}
+
+func topCounts(counters map[string]uint64, top int) []ReportCount {
+	counts := make([]ReportCount, 0, len(counters))
+	for name, count := range counters {
+		counts = append(counts, ReportCount{Name: name, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > top {
+		counts = counts[:top]
+	}
+	return counts
+}
+
+// snapshot returns the report for the current period, and starts a new one
+func (reporter *Reporter) snapshot(now time.Time) *Report {
+	reporter.Lock()
+	defer reporter.Unlock()
+	report := &Report{
+		Start:          reporter.start,
+		End:            now,
+		Queries:        reporter.queries,
+		Cached:         reporter.cached,
+		Blocked:        reporter.blocked,
+		TopNames:       topCounts(privatizeCounts(reporter.names.counts(), reporter.epsilon, reporter.minCount), reporter.top),
+		TopBlocked:     topCounts(privatizeCounts(reporter.blockedBy.counts(), reporter.epsilon, reporter.minCount), reporter.top),
+		TopClients:     topCounts(privatizeCounts(reporter.clients.counts(), reporter.epsilon, reporter.minCount), reporter.top),
+		Servers:        make([]ReportServer, 0, len(reporter.servers)),
+		PrivacyEpsilon: reporter.epsilon,
+		MinCount:       reporter.minCount,
+	}
+	if report.Queries > 0 {
+		report.BlockedPercent = float64(report.Blocked) * 100.0 / float64(report.Queries)
+	}
+	for name, counters := range reporter.servers {
+		report.Servers = append(report.Servers, ReportServer{
+			Name:         name,
+			Queries:      counters.queries,
+			Failures:     counters.failures,
+			Availability: float64(counters.queries-counters.failures) * 100.0 / float64(counters.queries),
+		})
+	}
+	sort.Slice(report.Servers, func(i, j int) bool { return report.Servers[i].Name < report.Servers[j].Name })
+	reporter.reset(now)
+	return report
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>dnscrypt-proxy report</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse;margin-bottom:1em}td,th{border:1px solid #ccc;padding:2px 8px;text-align:left}</style>
+</head><body>
+<h1>dnscrypt-proxy report</h1>
+<p>{{.Start.Format "2006-01-02 15:04"}} &ndash; {{.End.Format "2006-01-02 15:04"}}</p>
+<p>Queries: {{.Queries}} &middot; Cached: {{.Cached}} &middot; Blocked: {{.Blocked}} ({{printf "%.1f" .BlockedPercent}}%)</p>
+{{if or .PrivacyEpsilon .MinCount}}<p>Counts of names and clients are approximate{{if .MinCount}}, and names or clients seen less than {{.MinCount}} times are not shown{{end}}.</p>{{end}}
+<h2>Top names</h2><table>{{range .TopNames}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+<h2>Top blocked names</h2><table>{{range .TopBlocked}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+<h2>Top clients</h2><table>{{range .TopClients}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+<h2>Servers</h2><table><tr><th>Server</th><th>Queries</th><th>Failures</th><th>Availability</th></tr>
+{{range .Servers}}<tr><td>{{.Name}}</td><td>{{.Queries}}</td><td>{{.Failures}}</td><td>{{printf "%.2f" .Availability}}%</td></tr>{{end}}</table>
+</body></html>
+`))
+
+// write saves a report, and runs the report command with the paths of the files
+func (reporter *Reporter) write(report *Report) error {
+	if err := os.MkdirAll(reporter.directory, 0o700); err != nil {
+		return err
+	}
+	baseName := filepath.Join(reporter.directory, "report-"+report.Start.Format("2006-01-02"))
+	jsonReport, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Reports reveal the names that have been resolved
+	if err := os.WriteFile(baseName+".json", jsonReport, 0o600); err != nil {
+		return err
+	}
+	var htmlReport bytes.Buffer
+	if err := reportTemplate.Execute(&htmlReport, report); err != nil {
+		return err
+	}
+	if err := os.WriteFile(baseName+".html", htmlReport.Bytes(), 0o600); err != nil {
+		return err
+	}
+	dlog.Noticef("Report saved as [%s.json] and [%s.html]", baseName, baseName)
+	if len(reporter.command) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ReportCommandTimeout)
+	defer cancel()
+	if output, err := exec.CommandContext(ctx, reporter.command, baseName+".json", baseName+".html").CombinedOutput(); err != nil {
+		return fmt.Errorf("Report command failed: %v: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// nextBoundary returns the beginning of the next day, or of the next week (on Monday)
+func nextBoundary(now time.Time, period string) time.Time {
+	year, month, day := now.Date()
+	next := time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	if period == ReportPeriodWeekly {
+		for next.Weekday() != time.Monday {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
+
+func (reporter *Reporter) run(quit chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(time.Until(nextBoundary(time.Now(), reporter.period))):
+		}
+		if err := reporter.write(reporter.snapshot(time.Now())); err != nil {
+			dlog.Errorf("Unable to write the report: %v", err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"math"
+
+	"github.com/jedisct1/dlog"
+)
+
+// laplaceNoise returns a random value following a Laplace distribution centered on 0.
+// The noise has to be unpredictable, so it doesn't come from the shared generator.
+func laplaceNoise(scale float64) float64 {
+	var buf [8]byte
+	if _, err := crypto_rand.Read(buf[:]); err != nil {
+		dlog.Fatal(err)
+	}
+	u := (float64(binary.LittleEndian.Uint64(buf[:])>>11)+0.5)/float64(1<<53) - 0.5
+	if u < 0 {
+		return scale * math.Log(1.0+2.0*u)
+	}
+	return -scale * math.Log(1.0-2.0*u)
+}
+
+// privatizeCounts adds Laplace noise to every counter, so that a report doesn't reveal whether a single
+// query was made, and drops the entries whose noisy count is below minCount
+func privatizeCounts(counters map[string]uint64, epsilon float64, minCount int) map[string]uint64 {
+	if epsilon <= 0 && minCount <= 1 {
+		return counters
+	}
+	noisy := make(map[string]uint64, len(counters))
+	for name, count := range counters {
+		value := float64(count)
+		if epsilon > 0 {
+			value = math.Round(value + laplaceNoise(1.0/epsilon))
+		}
+		if value < math.Max(1.0, float64(minCount)) {
+			continue
+		}
+		noisy[name] = uint64(value)
+	}
+	return noisy
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import "container/heap"
+
+// topKCounter approximates the most frequent keys of a stream with the Space-Saving algorithm:
+// when all the slots are used, a new key replaces the least frequent one, and inherits its count.
+// The counts of the most frequent keys are overestimated by at most the count of the replaced keys.
+type topKCounter struct {
+	capacity int
+	entries  topKEntries
+	index    map[string]*topKEntry
+}
+
+type topKEntry struct {
+	key   string
+	count uint64
+	pos   int
+}
+
+type topKEntries []*topKEntry
+
+func (entries topKEntries) Len() int           { return len(entries) }
+func (entries topKEntries) Less(i, j int) bool { return entries[i].count < entries[j].count }
+func (entries topKEntries) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+	entries[i].pos, entries[j].pos = i, j
+}
+
+func (entries *topKEntries) Push(x interface{}) {
+	entry := x.(*topKEntry)
+	entry.pos = len(*entries)
+	*entries = append(*entries, entry)
+}
+
+func (entries *topKEntries) Pop() interface{} {
+	old := *entries
+	entry := old[len(old)-1]
+	*entries = old[:len(old)-1]
+	return entry
+}
+
+func newTopKCounter(capacity int) *topKCounter {
+	return &topKCounter{capacity: capacity, index: make(map[string]*topKEntry)}
+}
+
+func (counter *topKCounter) add(key string) {
+	if entry, found := counter.index[key]; found {
+		entry.count++
+		heap.Fix(&counter.entries, entry.pos)
+		return
+	}
+	if len(counter.entries) < counter.capacity {
+		entry := &topKEntry{key: key, count: 1}
+		heap.Push(&counter.entries, entry)
+		counter.index[key] = entry
+		return
+	}
+	entry := counter.entries[0]
+	delete(counter.index, entry.key)
+	entry.key = key
+	entry.count++
+	counter.index[key] = entry
+	heap.Fix(&counter.entries, 0)
+}
+
+// counts returns the tracked keys and their estimated counts
+func (counter *topKCounter) counts() map[string]uint64 {
+	counts := make(map[string]uint64, len(counter.entries))
+	for _, entry := range counter.entries {
+		counts[entry.key] = entry.count
+	}
+	return counts
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTopKCounter(t *testing.T) {
+	counter := newTopKCounter(10)
+	for i := 0; i < 1000; i++ {
+		counter.add("frequent")
+		if i%2 == 0 {
+			counter.add("common")
+		}
+		counter.add("rare" + strconv.Itoa(i))
+	}
+	counts := counter.counts()
+	if len(counts) != 10 {
+		t.Errorf("%d keys tracked, the limit is 10", len(counts))
+	}
+	if counts["frequent"] < 1000 || counts["common"] < 500 {
+		t.Errorf("frequent keys evicted: %v", counts)
+	}
+	top := topCounts(counts, 2)
+	if len(top) != 2 || top[0].Name != "frequent" || top[1].Name != "common" {
+		t.Errorf("unexpected top keys: %v", top)
+	}
+}
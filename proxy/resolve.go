@@ -0,0 +1,440 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	myResolverHost  string = "resolver.dnscrypt.info."
+	nonexistentName string = "nonexistent-zone.dnscrypt-test."
+)
+
+// ResolveResult is the JSON representation of the output of the -resolve command.
+// A nil slice means that the corresponding query failed, an empty slice that no records were found.
+type ResolveResult struct {
+	SchemaVersion  int      `json:"schema_version"`
+	Name           string   `json:"name"`
+	Protocol       string   `json:"protocol"`
+	Address        string   `json:"address"`
+	RTT            float64  `json:"rtt_ms"`
+	ResolverIPs    []string `json:"resolver_ips"`
+	Lying          *bool    `json:"lying,omitempty"`
+	LyingRcode     string   `json:"lying_rcode,omitempty"`
+	DNSSEC         *bool    `json:"dnssec,omitempty"`
+	ECS            *bool    `json:"ecs,omitempty"`
+	CanonicalName  string   `json:"canonical_name,omitempty"`
+	IPv4           []string `json:"ipv4"`
+	IPv6           []string `json:"ipv6"`
+	NameServers    []string `json:"name_servers"`
+	NameRcode      string   `json:"name_rcode,omitempty"`
+	DNSSECSigned   bool     `json:"dnssec_signed"`
+	MailServers    []string `json:"mail_servers"`
+	HTTPSAliases   []string `json:"https_aliases"`
+	HTTPSInfo      []string `json:"https_info"`
+	HostInfo       []string `json:"host_info"`
+	TXT            []string `json:"txt"`
+	singleResolver bool
+	lyingErr       error
+}
+
+func resolveQuery(server string, qName string, qType uint16, sendClientSubnet bool) (*dns.Msg, time.Duration, error) {
+	response, rtt, _, err := resolveQueryWithProto(server, qName, qType, sendClientSubnet)
+	return response, rtt, err
+}
+
+// resolveQueryWithProto also returns the transport the response was received over
+func resolveQueryWithProto(server string, qName string, qType uint16, sendClientSubnet bool) (*dns.Msg, time.Duration, string, error) {
+	client := new(dns.Client)
+	client.Net = "udp"
+	client.ReadTimeout = 2 * time.Second
+	msg := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			RecursionDesired: true,
+			Opcode:           dns.OpcodeQuery,
+		},
+		Question: make([]dns.Question, 1),
+	}
+	options := &dns.OPT{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeOPT,
+		},
+	}
+
+	if sendClientSubnet {
+		subnet := net.IPNet{IP: net.IPv4(93, 184, 216, 0), Mask: net.CIDRMask(24, 32)}
+		prr := dns.EDNS0_SUBNET{}
+		prr.Code = dns.EDNS0SUBNET
+		bits, totalSize := subnet.Mask.Size()
+		if totalSize == 32 {
+			prr.Family = 1
+		} else if totalSize == 128 { // if we want to test with IPv6
+			prr.Family = 2
+		}
+		prr.SourceNetmask = uint8(bits)
+		prr.SourceScope = 0
+		prr.Address = subnet.IP
+		options.Option = append(options.Option, &prr)
+	}
+
+	msg.Extra = append(msg.Extra, options)
+	options.SetDo()
+	options.SetUDPSize(uint16(MaxDNSPacketSize))
+
+	msg.Question[0] = dns.Question{Name: qName, Qtype: qType, Qclass: dns.ClassINET}
+	msg.Id = dns.Id()
+	for i := 0; i < 3; i++ {
+		response, rtt, err := client.Exchange(msg, server)
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			client.ReadTimeout *= 2
+			continue
+		}
+		if err != nil {
+			return nil, 0, client.Net, err
+		}
+		if response.Truncated && client.Net == "udp" {
+			client.Net = "tcp"
+			i--
+			continue
+		}
+		return response, rtt, client.Net, nil
+	}
+	return nil, 0, client.Net, errors.New("Timeout")
+}
+
+func Resolve(server string, name string, singleResolver bool, jsonOutput bool) {
+	parts := strings.SplitN(name, ",", 2)
+	if len(parts) == 2 {
+		name, server = parts[0], parts[1]
+		singleResolver = true
+	}
+
+	host, port := ExtractHostAndPort(server, 53)
+	if host == "0.0.0.0" {
+		host = "127.0.0.1"
+	} else if host == "[::]" {
+		host = "[::1]"
+	}
+	server = fmt.Sprintf("%s:%d", host, port)
+
+	if !jsonOutput {
+		fmt.Printf("Resolving [%s] using %s port %d\n\n", name, host, port)
+	}
+	result, err := resolveAll(server, dns.Fqdn(name), singleResolver)
+	if err != nil {
+		if jsonOutput {
+			fmt.Fprintf(os.Stderr, "Unable to resolve: [%s]\n", err)
+		} else {
+			fmt.Printf("Unable to resolve: [%s]\n", err)
+		}
+		os.Exit(1)
+	}
+	if jsonOutput {
+		jsonStr, err := json.MarshalIndent(result, "", " ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(jsonStr))
+		return
+	}
+	result.print()
+}
+
+func resolveAll(server string, name string, singleResolver bool) (*ResolveResult, error) {
+	result := &ResolveResult{
+		SchemaVersion:  JSONSchemaVersion,
+		Name:           name,
+		Address:        server,
+		singleResolver: singleResolver,
+	}
+	var clientSubnet string
+
+	response, rtt, protocol, err := resolveQueryWithProto(server, myResolverHost, dns.TypeTXT, true)
+	if err != nil {
+		return nil, err
+	}
+	result.Protocol = protocol
+	result.RTT = float64(rtt.Microseconds()) / 1000.0
+	result.ResolverIPs = make([]string, 0)
+	for _, answer := range response.Answer {
+		if answer.Header().Class != dns.ClassINET || answer.Header().Rrtype != dns.TypeTXT {
+			continue
+		}
+		var ip string
+		for _, txt := range answer.(*dns.TXT).Txt {
+			if strings.HasPrefix(txt, "Resolver IP: ") {
+				ip = strings.TrimPrefix(txt, "Resolver IP: ")
+			} else if strings.HasPrefix(txt, "EDNS0 client subnet: ") {
+				clientSubnet = strings.TrimPrefix(txt, "EDNS0 client subnet: ")
+			}
+		}
+		if ip == "" {
+			continue
+		}
+		if rev, err := dns.ReverseAddr(ip); err == nil {
+			response, _, err = resolveQuery(server, rev, dns.TypePTR, false)
+			if err != nil {
+				break
+			}
+			for _, answer := range response.Answer {
+				if answer.Header().Rrtype != dns.TypePTR || answer.Header().Class != dns.ClassINET {
+					continue
+				}
+				ip = ip + " (" + answer.(*dns.PTR).Ptr + ")"
+				break
+			}
+		}
+		result.ResolverIPs = append(result.ResolverIPs, ip)
+	}
+
+	if singleResolver {
+		if response, _, err := resolveQuery(server, nonexistentName, dns.TypeA, false); err != nil {
+			result.lyingErr = err
+		} else {
+			if response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError {
+				lying := response.Rcode == dns.RcodeSuccess
+				result.Lying = &lying
+			} else {
+				result.LyingRcode = dns.RcodeToString[response.Rcode]
+			}
+			if response.Rcode == dns.RcodeNameError {
+				dnssec := response.AuthenticatedData
+				result.DNSSEC = &dnssec
+			}
+			ecs := clientSubnet != ""
+			result.ECS = &ecs
+		}
+	}
+
+	cname := name
+	cnameFound := true
+	for i := 0; i < 100; i++ {
+		response, _, err := resolveQuery(server, cname, dns.TypeCNAME, false)
+		if err != nil {
+			cnameFound = false
+			break
+		}
+		found := false
+		for _, answer := range response.Answer {
+			if answer.Header().Rrtype != dns.TypeCNAME || answer.Header().Class != dns.ClassINET {
+				continue
+			}
+			cname = answer.(*dns.CNAME).Target
+			found = true
+			break
+		}
+		if !found {
+			break
+		}
+	}
+	if cnameFound {
+		result.CanonicalName = cname
+	}
+
+	if response, _, err := resolveQuery(server, cname, dns.TypeA, false); err == nil {
+		result.IPv4 = make([]string, 0)
+		for _, answer := range response.Answer {
+			if answer.Header().Rrtype != dns.TypeA || answer.Header().Class != dns.ClassINET {
+				continue
+			}
+			result.IPv4 = append(result.IPv4, answer.(*dns.A).A.String())
+		}
+	}
+
+	if response, _, err := resolveQuery(server, cname, dns.TypeAAAA, false); err == nil {
+		result.IPv6 = make([]string, 0)
+		for _, answer := range response.Answer {
+			if answer.Header().Rrtype != dns.TypeAAAA || answer.Header().Class != dns.ClassINET {
+				continue
+			}
+			result.IPv6 = append(result.IPv6, answer.(*dns.AAAA).AAAA.String())
+		}
+	}
+
+	if response, _, err := resolveQuery(server, cname, dns.TypeNS, false); err == nil {
+		result.NameServers = make([]string, 0)
+		for _, answer := range response.Answer {
+			if answer.Header().Rrtype != dns.TypeNS || answer.Header().Class != dns.ClassINET {
+				continue
+			}
+			result.NameServers = append(result.NameServers, answer.(*dns.NS).Ns)
+		}
+		if response.Rcode != dns.RcodeSuccess {
+			result.NameRcode = dns.RcodeToString[response.Rcode]
+		}
+		result.DNSSECSigned = response.AuthenticatedData
+	}
+
+	if response, _, err := resolveQuery(server, cname, dns.TypeMX, false); err == nil {
+		result.MailServers = make([]string, 0)
+		for _, answer := range response.Answer {
+			if answer.Header().Rrtype != dns.TypeMX || answer.Header().Class != dns.ClassINET {
+				continue
+			}
+			result.MailServers = append(result.MailServers, answer.(*dns.MX).Mx)
+		}
+	}
+
+	if response, _, err := resolveQuery(server, cname, dns.TypeHTTPS, false); err == nil {
+		result.HTTPSAliases = make([]string, 0)
+		result.HTTPSInfo = make([]string, 0)
+		for _, answer := range response.Answer {
+			if answer.Header().Rrtype != dns.TypeHTTPS || answer.Header().Class != dns.ClassINET {
+				continue
+			}
+			https := answer.(*dns.HTTPS)
+			if https.Priority == 0 && len(https.Target) >= 2 {
+				result.HTTPSAliases = append(result.HTTPSAliases, https.Target)
+			}
+			if https.Priority == 0 || len(https.Target) > 1 {
+				continue
+			}
+			for _, value := range https.Value {
+				result.HTTPSInfo = append(result.HTTPSInfo, fmt.Sprintf("[%s]=[%s]", value.Key(), value.String()))
+			}
+		}
+	}
+
+	if response, _, err := resolveQuery(server, cname, dns.TypeHINFO, false); err == nil {
+		result.HostInfo = make([]string, 0)
+		for _, answer := range response.Answer {
+			if answer.Header().Rrtype != dns.TypeHINFO || answer.Header().Class != dns.ClassINET {
+				continue
+			}
+			result.HostInfo = append(
+				result.HostInfo,
+				fmt.Sprintf("%s %s", answer.(*dns.HINFO).Cpu, answer.(*dns.HINFO).Os),
+			)
+		}
+	}
+
+	if response, _, err := resolveQuery(server, cname, dns.TypeTXT, false); err == nil {
+		result.TXT = make([]string, 0)
+		for _, answer := range response.Answer {
+			if answer.Header().Rrtype != dns.TypeTXT || answer.Header().Class != dns.ClassINET {
+				continue
+			}
+			result.TXT = append(result.TXT, strings.Join(answer.(*dns.TXT).Txt, " "))
+		}
+	}
+
+	return result, nil
+}
+
+func printList(list []string) {
+	if list == nil {
+		return
+	}
+	if len(list) == 0 {
+		fmt.Println("-")
+	} else {
+		fmt.Println(strings.Join(list, ", "))
+	}
+}
+
+func (result *ResolveResult) print() {
+	fmt.Printf("Resolver      : ")
+	printList(result.ResolverIPs)
+
+	if result.singleResolver {
+		fmt.Printf("Lying         : ")
+		if result.lyingErr != nil {
+			fmt.Printf("[%v]", result.lyingErr)
+		} else {
+			if result.Lying == nil {
+				fmt.Printf("unknown - query returned %s\n", result.LyingRcode)
+			} else if *result.Lying {
+				fmt.Println("yes. That resolver returns wrong responses")
+			} else {
+				fmt.Println("no")
+			}
+			if result.DNSSEC != nil {
+				fmt.Printf("DNSSEC        : ")
+				if *result.DNSSEC {
+					fmt.Println("yes, the resolver supports DNSSEC")
+				} else {
+					fmt.Println("no, the resolver doesn't support DNSSEC")
+				}
+			}
+			fmt.Printf("ECS           : ")
+			if *result.ECS {
+				fmt.Println("client network address is sent to authoritative servers")
+			} else {
+				fmt.Println("ignored or selective")
+			}
+		}
+	}
+
+	fmt.Println("")
+
+	fmt.Printf("Canonical name: ")
+	if len(result.CanonicalName) > 0 {
+		fmt.Println(result.CanonicalName)
+	}
+
+	fmt.Println("")
+
+	fmt.Printf("IPv4 addresses: ")
+	printList(result.IPv4)
+	fmt.Printf("IPv6 addresses: ")
+	printList(result.IPv6)
+
+	fmt.Println("")
+
+	fmt.Printf("Name servers  : ")
+	if result.NameServers != nil {
+		if result.NameRcode == dns.RcodeToString[dns.RcodeNameError] {
+			fmt.Println("name does not exist")
+		} else if len(result.NameRcode) > 0 {
+			fmt.Printf("server returned %s", result.NameRcode)
+		} else if len(result.NameServers) == 0 {
+			fmt.Println("no name servers found")
+		} else {
+			fmt.Println(strings.Join(result.NameServers, ", "))
+		}
+		fmt.Printf("DNSSEC signed : ")
+		if result.DNSSECSigned {
+			fmt.Println("yes")
+		} else {
+			fmt.Println("no")
+		}
+	}
+
+	fmt.Printf("Mail servers  : ")
+	if result.MailServers != nil {
+		if len(result.MailServers) == 0 {
+			fmt.Println("no mail servers found")
+		} else if len(result.MailServers) > 1 {
+			fmt.Printf("%d mail servers found\n", len(result.MailServers))
+		} else {
+			fmt.Println("1 mail servers found")
+		}
+	}
+
+	fmt.Println("")
+
+	fmt.Printf("HTTPS alias   : ")
+	printList(result.HTTPSAliases)
+	if result.HTTPSInfo != nil {
+		fmt.Printf("HTTPS info    : ")
+		printList(result.HTTPSInfo)
+	}
+
+	fmt.Println("")
+
+	fmt.Printf("Host info     : ")
+	printList(result.HostInfo)
+	fmt.Printf("TXT records   : ")
+	printList(result.TXT)
+
+	fmt.Println("")
+}
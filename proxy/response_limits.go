@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"encoding/binary"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	ResponseLimitServFail = "servfail"
+	ResponseLimitTruncate = "truncate"
+)
+
+// responseRecordCount returns the number of records in a response, according to its header
+func responseRecordCount(packet []byte) int {
+	return int(binary.BigEndian.Uint16(packet[6:8])) + int(binary.BigEndian.Uint16(packet[8:10])) +
+		int(binary.BigEndian.Uint16(packet[10:12]))
+}
+
+// applyResponseLimits replaces responses that are larger or have more records than allowed by
+// either truncated responses, or SERVFAIL responses
+func (proxy *Proxy) applyResponseLimits(pluginsState *PluginsState, response []byte) ([]byte, error) {
+	tooLarge := proxy.maxResponseSize > 0 && len(response) > proxy.maxResponseSize
+	tooManyRecords := proxy.maxResponseRecords > 0 && responseRecordCount(response) > proxy.maxResponseRecords
+	if !tooLarge && !tooManyRecords {
+		return response, nil
+	}
+	dlog.Infof("The response to [%s] exceeds the size limits (%d bytes, %d records)",
+		pluginsState.qName, len(response), responseRecordCount(response))
+	pluginsState.trace.add("response", "the response exceeds the size limits")
+	if proxy.responseLimitAction == ResponseLimitTruncate {
+		msg := dns.Msg{}
+		if err := msg.Unpack(response); err != nil {
+			return response, err
+		}
+		msg.Compress = true
+		truncateMsg(&msg, proxy.maxResponseRecords, proxy.maxResponseSize)
+		return msg.PackBuffer(response)
+	}
+	if pluginsState.questionMsg == nil {
+		return TruncatedResponse(response)
+	}
+	synth := EmptyResponseFromMessage(pluginsState.questionMsg)
+	synth.Id = TransactionID(response)
+	synth.Rcode = dns.RcodeServerFailure
+	return synth.PackBuffer(response)
+}
+
+// truncateMsg removes records, starting with the additional section, until the message fits,
+// and sets the TC bit so that clients know that the response is incomplete
+func truncateMsg(msg *dns.Msg, maxRecords int, maxSize int) {
+	opt := msg.IsEdns0()
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+	sections := []*[]dns.RR{&msg.Extra, &msg.Ns, &msg.Answer}
+	count := len(msg.Answer) + len(msg.Ns) + len(msg.Extra)
+	optSize := 0
+	if opt != nil {
+		count++
+		optSize = dns.Len(opt)
+	}
+	fits := func() bool {
+		if maxRecords > 0 && count > maxRecords {
+			return false
+		}
+		// The OPT record is added back once the message fits
+		return maxSize <= 0 || msg.Len()+optSize <= maxSize
+	}
+	for _, section := range sections {
+		for len(*section) > 0 && !fits() {
+			*section = (*section)[:len(*section)-1]
+			count--
+		}
+	}
+	if opt != nil {
+		msg.Extra = append(msg.Extra, opt)
+	}
+	msg.Truncated = true
+}
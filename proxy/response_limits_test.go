@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTruncateMsg(t *testing.T) {
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Response = true
+	for i := 0; i < 50; i++ {
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	msg.SetEdns0(uint16(MaxDNSPacketSize), false)
+	msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 64)})
+	msg.Compress = true
+	maxSize := 512
+	truncateMsg(&msg, 0, maxSize)
+	packet, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) > maxSize {
+		t.Errorf("truncated response of %d bytes, the limit is %d", len(packet), maxSize)
+	}
+	if !msg.Truncated || msg.IsEdns0() == nil || len(msg.Answer) == 0 {
+		t.Errorf("unexpected truncated response: %v", msg)
+	}
+}
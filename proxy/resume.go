@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const ResumeNetprobeTimeout = 30 * time.Second
+
+// handleResume is called after the system has been suspended: connections opened before are likely
+// to be dead, and the certificate refreshes scheduled during the suspension didn't happen
+func (proxy *Proxy) handleResume(suspended time.Duration) {
+	if suspended > 0 {
+		dlog.Noticef("The system has been resumed after %v", suspended.Round(time.Second))
+		proxy.cachedResponses.addSuspended(suspended)
+	} else {
+		dlog.Notice("The system has probably been resumed")
+	}
+	proxy.resetUpstreamConnections()
+	waitForConnectivity(proxy.netprobeAddresses, ResumeNetprobeTimeout)
+	proxy.requestServersRefresh("a system resume")
+}
+
+// waitForConnectivity waits until a route to one of the given addresses is available
+func waitForConnectivity(addresses []string, timeout time.Duration) bool {
+	if len(addresses) == 0 {
+		return true
+	}
+	addresses = append([]string{}, addresses...)
+	deadline := time.Now().Add(timeout)
+	for !netprobeAny(addresses) {
+		if time.Now().After(deadline) {
+			dlog.Warnf("Network still unavailable after %v", timeout)
+			return false
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return true
+}
@@ -0,0 +1,17 @@
+package proxy
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// suspendedTime returns the total time the system has been suspended since it booted
+func suspendedTime() (time.Duration, bool) {
+	var boottime, monotonic unix.Timespec
+	if unix.ClockGettime(unix.CLOCK_BOOTTIME, &boottime) != nil ||
+		unix.ClockGettime(unix.CLOCK_MONOTONIC, &monotonic) != nil {
+		return 0, false
+	}
+	return time.Duration(boottime.Nano() - monotonic.Nano()), true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import "time"
+
+func suspendedTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	sieve "github.com/opencoff/go-sieve"
+)
+
+const (
+	DefaultRRLIPv4PrefixLength = 24
+	DefaultRRLIPv6PrefixLength = 56
+	RRLMaxBuckets              = 100000
+)
+
+type RRLAction int
+
+const (
+	RRLActionSend RRLAction = iota
+	RRLActionDrop
+	RRLActionSlip
+)
+
+// ResponseRateLimiter limits the rate of identical responses sent to a network over UDP, so that
+// the proxy cannot be used to flood the victim of spoofed queries - see the BIND RRL design
+type ResponseRateLimiter struct {
+	sync.Mutex
+	responsesPerSecond int
+	slip               int
+	ipv4Mask           net.IPMask
+	ipv6Mask           net.IPMask
+	// buckets are evicted with SIEVE, so that a flood of new keys evicts the buckets seen only once,
+	// and not the ones of the networks being limited
+	buckets *sieve.Sieve[string, *rrlBucket]
+}
+
+type rrlBucket struct {
+	balance  float64
+	lastSeen time.Time
+	limited  int
+}
+
+func NewResponseRateLimiter(config *ResponseRateLimitConfig) *ResponseRateLimiter {
+	ipv4PrefixLength, ipv6PrefixLength := config.IPv4PrefixLength, config.IPv6PrefixLength
+	if ipv4PrefixLength <= 0 || ipv4PrefixLength > 32 {
+		ipv4PrefixLength = DefaultRRLIPv4PrefixLength
+	}
+	if ipv6PrefixLength <= 0 || ipv6PrefixLength > 128 {
+		ipv6PrefixLength = DefaultRRLIPv6PrefixLength
+	}
+	return &ResponseRateLimiter{
+		responsesPerSecond: config.ResponsesPerSecond,
+		slip:               config.Slip,
+		ipv4Mask:           net.CIDRMask(ipv4PrefixLength, 32),
+		ipv6Mask:           net.CIDRMask(ipv6PrefixLength, 128),
+		buckets:            sieve.New[string, *rrlBucket](RRLMaxBuckets),
+	}
+}
+
+// key identifies the responses that are counted together: positive responses for the same
+// name and type, and all the NXDOMAIN or error responses sent to a network
+func (rrl *ResponseRateLimiter) key(clientIP net.IP, response []byte) string {
+	var network net.IP
+	if ipv4 := clientIP.To4(); ipv4 != nil {
+		network = ipv4.Mask(rrl.ipv4Mask)
+	} else {
+		network = clientIP.Mask(rrl.ipv6Mask)
+	}
+	switch Rcode(response) {
+	case dns.RcodeSuccess:
+		msg := dns.Msg{}
+		if err := msg.Unpack(response); err != nil || len(msg.Question) != 1 {
+			return network.String() + "|error"
+		}
+		qType := make([]byte, 2)
+		binary.BigEndian.PutUint16(qType, msg.Question[0].Qtype)
+		return network.String() + "|" + strings.ToLower(msg.Question[0].Name) + "|" + string(qType)
+	case dns.RcodeNameError:
+		return network.String() + "|nxdomain"
+	default:
+		return network.String() + "|error"
+	}
+}
+
+// check returns what to do with a response: send it, drop it, or send an empty, truncated response
+// instead, so that legitimate clients can retry over TCP
+func (rrl *ResponseRateLimiter) check(clientIP net.IP, response []byte) RRLAction {
+	key := rrl.key(clientIP, response)
+	now := time.Now()
+	rrl.Lock()
+	defer rrl.Unlock()
+	bucket, found := rrl.buckets.Get(key)
+	if !found {
+		bucket = &rrlBucket{balance: float64(rrl.responsesPerSecond), lastSeen: now}
+		rrl.buckets.Add(key, bucket)
+	}
+	bucket.balance += now.Sub(bucket.lastSeen).Seconds() * float64(rrl.responsesPerSecond)
+	if bucket.balance > float64(rrl.responsesPerSecond) {
+		bucket.balance = float64(rrl.responsesPerSecond)
+	}
+	bucket.lastSeen = now
+	if bucket.balance >= 1 {
+		bucket.balance--
+		bucket.limited = 0
+		return RRLActionSend
+	}
+	bucket.limited++
+	if rrl.slip > 0 && bucket.limited%rrl.slip == 0 {
+		return RRLActionSlip
+	}
+	return RRLActionDrop
+}
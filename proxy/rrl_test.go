@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func rrlResponse(t *testing.T, name string, rcode int) []byte {
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.Response = true
+	msg.Rcode = rcode
+	packet, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func TestResponseRateLimiter(t *testing.T) {
+	rrl := NewResponseRateLimiter(&ResponseRateLimitConfig{ResponsesPerSecond: 5, Slip: 2})
+	client := net.ParseIP("192.0.2.1")
+	response := rrlResponse(t, "example.com", dns.RcodeSuccess)
+	for i := 0; i < 5; i++ {
+		if action := rrl.check(client, response); action != RRLActionSend {
+			t.Fatalf("response %d: action %v", i, action)
+		}
+	}
+	if action := rrl.check(client, response); action != RRLActionDrop {
+		t.Errorf("expected the response to be dropped, got %v", action)
+	}
+	if action := rrl.check(client, response); action != RRLActionSlip {
+		t.Errorf("expected a truncated response, got %v", action)
+	}
+	if action := rrl.check(net.ParseIP("192.0.2.200"), response); action == RRLActionSend {
+		t.Error("clients of the same network are not limited together")
+	}
+	if action := rrl.check(net.ParseIP("198.51.100.1"), response); action != RRLActionSend {
+		t.Errorf("another network is limited: %v", action)
+	}
+	if action := rrl.check(client, rrlResponse(t, "other.example.com", dns.RcodeSuccess)); action != RRLActionSend {
+		t.Errorf("another name is limited: %v", action)
+	}
+}
+
+func TestResponseRateLimiterFlood(t *testing.T) {
+	rrl := NewResponseRateLimiter(&ResponseRateLimitConfig{ResponsesPerSecond: 1})
+	victim := net.ParseIP("192.0.2.1")
+	response := rrlResponse(t, "example.com", dns.RcodeSuccess)
+	rrl.check(victim, response)
+	for i := 0; i < RRLMaxBuckets+1000; i++ {
+		if i%1000 == 0 && rrl.check(victim, response) == RRLActionSend {
+			t.Fatalf("the limit was reset after %d other keys", i)
+		}
+		rrl.check(net.ParseIP("203.0.113.1"), rrlResponse(t, strconv.Itoa(i)+".example.com", dns.RcodeSuccess))
+	}
+	if rrl.buckets.Len() > RRLMaxBuckets {
+		t.Errorf("%d buckets, the limit is %d", rrl.buckets.Len(), RRLMaxBuckets)
+	}
+}
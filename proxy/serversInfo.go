@@ -1,15 +1,17 @@
-package main
+package proxy
 
 import (
 	crypto_rand "crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/bits"
-	"math/rand"
 	"net"
 	"net/url"
+	"os"
 	"sort"
 	"strings"
 	"sync"
@@ -43,6 +45,24 @@ type DOHClientCreds struct {
 	rootCA     string
 }
 
+// check verifies that the certificates can be loaded, before they are used to build the transport
+func (creds *DOHClientCreds) check() error {
+	if creds.rootCA != "" {
+		if certPool, err := x509.SystemCertPool(); certPool == nil {
+			return fmt.Errorf("Additional CAs not supported on this platform: %v", err)
+		}
+		if _, err := os.ReadFile(creds.rootCA); err != nil {
+			return err
+		}
+	}
+	if creds.clientCert != "" {
+		if _, err := tls.LoadX509KeyPair(creds.clientCert, creds.clientKey); err != nil {
+			return fmt.Errorf("Unable to use certificate [%v] (key: [%v]): %v", creds.clientCert, creds.clientKey, err)
+		}
+	}
+	return nil
+}
+
 type ServerInfo struct {
 	DOHClientCreds     DOHClientCreds
 	lastActionTS       time.Time
@@ -62,18 +82,25 @@ type ServerInfo struct {
 	knownBugs          ServerBugs
 	Proto              stamps.StampProtoType
 	useGet             bool
+	httpHeaders        map[string]string
+	requireDNSSEC      bool
 	odohTargetConfigs  []ODoHTargetConfig
+	ephemeralKeys      bool
+	ephemeralKeyCache  *ephemeralKeyCache
+	certExpiration     time.Time
+	certPinned         bool
+	provider           string
 }
 
 type LBStrategy interface {
-	getCandidate(serversCount int) int
+	getCandidate(random *lockedRand, serversCount int) int
 	getActiveCount(serversCount int) int
 }
 
 type LBStrategyP2 struct{}
 
-func (LBStrategyP2) getCandidate(serversCount int) int {
-	return rand.Intn(Min(serversCount, 2))
+func (LBStrategyP2) getCandidate(random *lockedRand, serversCount int) int {
+	return random.Intn(Min(serversCount, 2))
 }
 
 func (LBStrategyP2) getActiveCount(serversCount int) int {
@@ -82,8 +109,8 @@ func (LBStrategyP2) getActiveCount(serversCount int) int {
 
 type LBStrategyPN struct{ n int }
 
-func (s LBStrategyPN) getCandidate(serversCount int) int {
-	return rand.Intn(Min(serversCount, s.n))
+func (s LBStrategyPN) getCandidate(random *lockedRand, serversCount int) int {
+	return random.Intn(Min(serversCount, s.n))
 }
 
 func (s LBStrategyPN) getActiveCount(serversCount int) int {
@@ -92,8 +119,8 @@ func (s LBStrategyPN) getActiveCount(serversCount int) int {
 
 type LBStrategyPH struct{}
 
-func (LBStrategyPH) getCandidate(serversCount int) int {
-	return rand.Intn(Max(Min(serversCount, 2), serversCount/2))
+func (LBStrategyPH) getCandidate(random *lockedRand, serversCount int) int {
+	return random.Intn(Max(Min(serversCount, 2), serversCount/2))
 }
 
 func (LBStrategyPH) getActiveCount(serversCount int) int {
@@ -102,7 +129,7 @@ func (LBStrategyPH) getActiveCount(serversCount int) int {
 
 type LBStrategyFirst struct{}
 
-func (LBStrategyFirst) getCandidate(int) int {
+func (LBStrategyFirst) getCandidate(*lockedRand, int) int {
 	return 0
 }
 
@@ -112,8 +139,8 @@ func (LBStrategyFirst) getActiveCount(int) int {
 
 type LBStrategyRandom struct{}
 
-func (LBStrategyRandom) getCandidate(serversCount int) int {
-	return rand.Intn(serversCount)
+func (LBStrategyRandom) getCandidate(random *lockedRand, serversCount int) int {
+	return random.Intn(serversCount)
 }
 
 func (LBStrategyRandom) getActiveCount(serversCount int) int {
@@ -144,6 +171,9 @@ type ServersInfo struct {
 	registeredRelays  []RegisteredServer
 	lbStrategy        LBStrategy
 	lbEstimator       bool
+	lbMinProviders    int
+	deterministic     bool
+	random            *lockedRand
 }
 
 func NewServersInfo() ServersInfo {
@@ -198,6 +228,19 @@ func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp s
 	if name != newServer.Name {
 		dlog.Fatalf("[%s] != [%s]", name, newServer.Name)
 	}
+	proxy.setEphemeralKeys(&newServer)
+	newServer.provider = proxy.serverOptions[name].Provider
+	if len(newServer.provider) == 0 {
+		newServer.provider = serverProvider(stamp)
+	}
+	proxy.checkCertExpiration(&newServer)
+	if proxy.serverOptions[name].RequireDNSSEC {
+		newServer.requireDNSSEC = true
+		if err := proxy.probeDNSSEC(&newServer); err != nil {
+			dlog.Warn(err)
+			return err
+		}
+	}
 	newServer.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
 	newServer.rtt.Set(float64(newServer.initialRtt))
 	isNew = true
@@ -220,7 +263,9 @@ func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp s
 	return nil
 }
 
-func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
+// refresh fetches the certificates of all the registered servers. With a non-zero spread,
+// each fetch starts after a random delay within that duration, to avoid bursts of queries.
+func (serversInfo *ServersInfo) refresh(proxy *Proxy, spread time.Duration) (int, error) {
 	dlog.Debug("Refreshing certificates")
 	serversInfo.RLock()
 	// Appending registeredServers slice from sources may allocate new memory.
@@ -231,8 +276,11 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 	countChannel := make(chan struct{}, proxy.certRefreshConcurrency)
 	errorChannel := make(chan error, serversCount)
 	for i := range registeredServers {
-		countChannel <- struct{}{}
 		go func(registeredServer *RegisteredServer) {
+			if spread > 0 {
+				time.Sleep(time.Duration(proxy.random.Int63n(int64(spread))))
+			}
+			countChannel <- struct{}{}
 			err := serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp)
 			if err == nil {
 				proxy.xTransport.internalResolverReady = true
@@ -254,8 +302,16 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 	}
 	serversInfo.Lock()
 	sort.SliceStable(serversInfo.inner, func(i, j int) bool {
+		if serversInfo.deterministic {
+			// The order of servers shouldn't depend on the network
+			return serversInfo.inner[i].Name < serversInfo.inner[j].Name
+		}
 		return serversInfo.inner[i].initialRtt < serversInfo.inner[j].initialRtt
 	})
+	serversInfo.enforceProviderDiversity()
+	if activeProviders := serversInfo.activeProviders(); activeProviders > 0 && activeProviders < serversInfo.lbMinProviders {
+		dlog.Warnf("The active servers are only run by %d distinct providers, %d are required", activeProviders, serversInfo.lbMinProviders)
+	}
 	inner := serversInfo.inner
 	innerLen := len(inner)
 	if innerLen > 1 {
@@ -278,7 +334,7 @@ func (serversInfo *ServersInfo) estimatorUpdate(currentActive int) {
 	if activeCount == serversCount {
 		return
 	}
-	candidate := rand.Intn(serversCount-activeCount) + activeCount
+	candidate := serversInfo.random.Intn(serversCount-activeCount) + activeCount
 	candidateRtt, currentActiveRtt := serversInfo.inner[candidate].rtt.Value(), serversInfo.inner[currentActive].rtt.Value()
 	if currentActiveRtt < 0 {
 		currentActiveRtt = candidateRtt
@@ -314,6 +370,7 @@ func (serversInfo *ServersInfo) estimatorUpdate(currentActive int) {
 				serversInfo.inner[i-1], serversInfo.inner[i] = serversInfo.inner[i], serversInfo.inner[i-1]
 			}
 		}
+		serversInfo.enforceProviderDiversity()
 	}
 }
 
@@ -324,7 +381,7 @@ func (serversInfo *ServersInfo) getOne() *ServerInfo {
 		serversInfo.Unlock()
 		return nil
 	}
-	candidate := serversInfo.lbStrategy.getCandidate(serversCount)
+	candidate := serversInfo.lbStrategy.getCandidate(serversInfo.random, serversCount)
 	if serversInfo.lbEstimator {
 		serversInfo.estimatorUpdate(candidate)
 	}
@@ -335,6 +392,31 @@ func (serversInfo *ServersInfo) getOne() *ServerInfo {
 	return serverInfo
 }
 
+// getOneMatching is getOne(), restricted to the servers accepted by a filter
+func (serversInfo *ServersInfo) getOneMatching(accepts func(*ServerInfo) bool) *ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	candidates := make([]*ServerInfo, 0, len(serversInfo.inner))
+	for _, serverInfo := range serversInfo.inner {
+		if accepts(serverInfo) {
+			candidates = append(candidates, serverInfo)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	serverInfo := candidates[serversInfo.lbStrategy.getCandidate(serversInfo.random, len(candidates))]
+	dlog.Debugf("Using candidate [%s] RTT: %d", serverInfo.Name, int(serverInfo.rtt.Value()))
+	return serverInfo
+}
+
+// count returns the number of live servers
+func (serversInfo *ServersInfo) count() int {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	return len(serversInfo.inner)
+}
+
 func fetchServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
 	if stamp.Proto == stamps.StampProtoTypeDNSCrypt {
 		return fetchDNSCryptServerInfo(proxy, name, stamp, isNew)
@@ -371,7 +453,7 @@ func findFarthestRoute(proxy *Proxy, name string, relayStamps []stamps.ServerSta
 			}
 			candidates = append(candidates, relayIdx)
 		}
-		return &relayStamps[candidates[rand.Intn(len(candidates))]]
+		return &relayStamps[candidates[proxy.random.Intn(len(candidates))]]
 	} else if server.stamp.Proto != stamps.StampProtoTypeDNSCrypt {
 		return nil
 	}
@@ -417,7 +499,7 @@ func findFarthestRoute(proxy *Proxy, name string, relayStamps []stamps.ServerSta
 			bestRelayIdxs = append(bestRelayIdxs, relayIdx)
 		}
 	}
-	return &relayStamps[bestRelayIdxs[rand.Intn(len(bestRelayIdxs))]]
+	return &relayStamps[bestRelayIdxs[proxy.random.Intn(len(bestRelayIdxs))]]
 }
 
 func relayProtoForServerProto(proto stamps.StampProtoType) (stamps.StampProtoType, error) {
@@ -488,7 +570,7 @@ func route(proxy *Proxy, name string, serverProto stamps.StampProtoType) (*Relay
 	}
 	var relayCandidateStamp *stamps.ServerStamp
 	if !wildcard || len(relayStamps) == 1 {
-		relayCandidateStamp = &relayStamps[rand.Intn(len(relayStamps))]
+		relayCandidateStamp = &relayStamps[proxy.random.Intn(len(relayStamps))]
 	} else {
 		relayCandidateStamp = findFarthestRoute(proxy, name, relayStamps)
 	}
@@ -621,6 +703,7 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 		Relay:              relay,
 		initialRtt:         rtt,
 		knownBugs:          knownBugs,
+		certExpiration:     certInfo.Expiration,
 	}, nil
 }
 
@@ -642,12 +725,12 @@ func dohTestPacket(msgID uint16) []byte {
 	return body
 }
 
-func dohNXTestPacket(msgID uint16) []byte {
+func dohNXTestPacket(random *lockedRand, msgID uint16) []byte {
 	msg := dns.Msg{}
 	qName := make([]byte, 16)
 	charset := "abcdefghijklmnopqrstuvwxyz"
 	for i := range qName {
-		qName[i] = charset[rand.Intn(len(charset))]
+		qName[i] = charset[random.Intn(len(charset))]
 	}
 	msg.SetQuestion(string(qName)+".test.dnscrypt.", dns.TypeNS)
 	msg.Id = msgID
@@ -682,17 +765,21 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 		Host:   stamp.ProviderName,
 		Path:   stamp.Path,
 	}
+	options := proxy.serverOptions[name]
+	headers := options.HTTPHeaders
 	body := dohTestPacket(0xcafe)
-	useGet := false
-	if _, _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
-		useGet = true
-		if _, _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
-			return ServerInfo{}, err
+	useGet := options.DoHMethod == "get"
+	if options.DoHMethod == "" || options.DoHMethod == "auto" {
+		if _, _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout, headers); err != nil {
+			useGet = true
+			if _, _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout, headers); err != nil {
+				return ServerInfo{}, err
+			}
+			dlog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
 		}
-		dlog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
 	}
-	body = dohNXTestPacket(0xcafe)
-	serverResponse, _, tls, rtt, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout)
+	body = dohNXTestPacket(proxy.random, 0xcafe)
+	serverResponse, _, tls, rtt, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout, headers)
 	if err != nil {
 		dlog.Infof("[%s] [%s]: %v", name, url, err)
 		return ServerInfo{}, err
@@ -719,6 +806,7 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 	showCerts := proxy.showCerts
 	found := false
 	var wantedHash [32]byte
+	var pinnedCertExpiration time.Time
 	for _, cert := range tls.PeerCertificates {
 		h := sha256.Sum256(cert.RawTBSCertificate)
 		if showCerts {
@@ -731,6 +819,7 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 				copy(wantedHash[:], hash)
 				if h == wantedHash {
 					found = true
+					pinnedCertExpiration = cert.NotAfter
 					break
 				}
 			}
@@ -755,13 +844,16 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 		dlog.Infof("[%s] OK (DoH) - rtt: %dms", name, xrtt)
 	}
 	return ServerInfo{
-		Proto:      stamps.StampProtoTypeDoH,
-		Name:       name,
-		Timeout:    proxy.timeout,
-		URL:        url,
-		HostName:   stamp.ProviderName,
-		initialRtt: xrtt,
-		useGet:     useGet,
+		Proto:          stamps.StampProtoTypeDoH,
+		Name:           name,
+		Timeout:        proxy.timeout,
+		URL:            url,
+		HostName:       stamp.ProviderName,
+		initialRtt:     xrtt,
+		useGet:         useGet,
+		httpHeaders:    headers,
+		certExpiration: pinnedCertExpiration,
+		certPinned:     found,
 	}, nil
 }
 
@@ -806,7 +898,7 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 	}
 
 	dlog.Debugf("Pausing after ODoH configuration retrieval")
-	delay := time.Duration(rand.Intn(5*1000)) * time.Millisecond
+	delay := time.Duration(proxy.random.Intn(5*1000)) * time.Millisecond
 	clocksmith.Sleep(time.Duration(delay))
 	dlog.Debugf("Pausing done")
 
@@ -817,7 +909,7 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 	}
 
 	workingConfigs := make([]ODoHTargetConfig, 0)
-	rand.Shuffle(len(odohTargetConfigs), func(i, j int) {
+	proxy.random.Shuffle(len(odohTargetConfigs), func(i, j int) {
 		odohTargetConfigs[i], odohTargetConfigs[j] = odohTargetConfigs[j], odohTargetConfigs[i]
 	})
 	for _, odohTargetConfig := range odohTargetConfigs {
@@ -838,7 +930,7 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 			dlog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
 		}
 
-		query = dohNXTestPacket(0xcafe)
+		query = dohNXTestPacket(proxy.random, 0xcafe)
 		odohQuery, err = odohTargetConfig.encryptQuery(query)
 		if err != nil {
 			continue
@@ -965,6 +1057,9 @@ func (serverInfo *ServerInfo) noticeFailure(proxy *Proxy) {
 	proxy.serversInfo.Lock()
 	serverInfo.rtt.Add(float64(proxy.timeout.Nanoseconds() / 1000000))
 	proxy.serversInfo.Unlock()
+	if proxy.captivePortalDetector != nil {
+		proxy.captivePortalDetector.noticeFailure()
+	}
 }
 
 func (serverInfo *ServerInfo) noticeBegin(proxy *Proxy) {
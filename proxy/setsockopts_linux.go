@@ -1,10 +1,15 @@
-package main
+package proxy
 
 import (
 	"net"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
+// udpReusePortSupported tells whether the kernel balances the queries over sockets sharing an address
+const udpReusePortSupported = true
+
 func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 	return &net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
@@ -20,6 +25,9 @@ func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 				)
 				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, 4096)
 				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUFFORCE, 4096)
+				if proxy.udpListenerSockets > 1 {
+					_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+				}
 			})
 			return nil
 		},
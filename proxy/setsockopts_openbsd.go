@@ -1,10 +1,12 @@
-package main
+package proxy
 
 import (
 	"net"
 	"syscall"
 )
 
+const udpReusePortSupported = false
+
 func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 	return &net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
@@ -1,12 +1,14 @@
 //go:build !freebsd && !openbsd && !windows && !darwin && !linux
 // +build !freebsd,!openbsd,!windows,!darwin,!linux
 
-package main
+package proxy
 
 import (
 	"net"
 )
 
+const udpReusePortSupported = false
+
 func (proxy *Proxy) udpListenerConfig() (*net.ListenConfig, error) {
 	return &net.ListenConfig{}, nil
 }
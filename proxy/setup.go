@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+const (
+	SetupMaxCandidates = 24
+	SetupServersCount  = 4
+	SetupProbeWorkers  = 8
+)
+
+var setupNetprobeAddresses = []string{"9.9.9.9:53", "1.1.1.1:53", "[2620:fe::fe]:53"}
+
+// setupAnswers are the choices made during the setup
+type setupAnswers struct {
+	ListenAddress string
+	IPv6          bool
+	RequireDNSSEC bool
+	BlockAds      bool
+	QueryLog      bool
+	BlockedLog    bool
+	ServerNames   []string
+}
+
+var setupConfigTemplate = template.Must(template.New("config").Funcs(template.FuncMap{"quote": setupTOMLStrings}).Parse(
+	`##############################################
+#                                            #
+#        dnscrypt-proxy configuration        #
+#                                            #
+##############################################
+
+## Generated by dnscrypt-proxy -setup
+## See example-dnscrypt-proxy.toml for all the available settings.
+
+listen_addresses = [{{quote .ListenAddress}}]
+{{if .ServerNames}}
+## Fastest servers found during the setup. Remove this line to let the proxy
+## choose automatically among all the servers matching the requirements below.
+
+server_names = [{{quote .ServerNames}}]
+{{end}}
+ipv4_servers = true
+ipv6_servers = {{.IPv6}}
+dnscrypt_servers = true
+doh_servers = true
+require_dnssec = {{.RequireDNSSEC}}
+require_nolog = true
+require_nofilter = true
+
+bootstrap_resolvers = ['9.9.9.11:53', '8.8.8.8:53']
+netprobe_address = '9.9.9.9:53'
+netprobe_timeout = 60
+
+cache = true
+{{if .QueryLog}}
+
+[query_log]
+
+  file = 'query.log'
+{{end}}{{if .BlockAds}}
+
+[blocked_names]
+{{if .BlockedLog}}
+  log_file = 'blocked-names.log'
+{{end}}
+
+[lists]
+
+  [lists.hagezi-light]
+    urls = ['https://raw.githubusercontent.com/hagezi/dns-blocklists/main/wildcard/light-onlydomains.txt']
+    category = 'ads'
+    refresh_delay = 24
+{{end}}
+
+[sources]
+
+  [sources.public-resolvers]
+    urls = ['https://raw.githubusercontent.com/DNSCrypt/dnscrypt-resolvers/master/v3/public-resolvers.md', 'https://download.dnscrypt.info/resolvers-list/v3/public-resolvers.md']
+    cache_file = 'public-resolvers.md'
+    minisign_key = 'RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3'
+    refresh_delay = 72
+    prefix = ''
+`))
+
+func setupTOMLStrings(value interface{}) string {
+	var strs []string
+	switch value := value.(type) {
+	case string:
+		strs = []string{value}
+	case []string:
+		strs = value
+	}
+	quoted := make([]string, len(strs))
+	for i, str := range strs {
+		quoted[i] = "'" + strings.ReplaceAll(str, "'", "") + "'"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func (answers *setupAnswers) config() (string, error) {
+	var config strings.Builder
+	if err := setupConfigTemplate.Execute(&config, answers); err != nil {
+		return "", err
+	}
+	return config.String(), nil
+}
+
+type setupPrompt struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+func (prompt *setupPrompt) ask(question string, defaultValue string) (string, error) {
+	fmt.Fprintf(prompt.out, "%s [%s]: ", question, defaultValue)
+	if !prompt.scanner.Scan() {
+		if err := prompt.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	answer := strings.TrimSpace(prompt.scanner.Text())
+	if len(answer) == 0 {
+		answer = defaultValue
+	}
+	return answer, nil
+}
+
+func (prompt *setupPrompt) askYesNo(question string, defaultValue bool) (bool, error) {
+	defaultStr := "y/N"
+	if defaultValue {
+		defaultStr = "Y/n"
+	}
+	for {
+		answer, err := prompt.ask(question, defaultStr)
+		if err != nil {
+			return false, err
+		}
+		if answer == defaultStr {
+			return defaultValue, nil
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+		fmt.Fprintln(prompt.out, "Please answer yes or no.")
+	}
+}
+
+func (prompt *setupPrompt) askAnswers() (*setupAnswers, error) {
+	answers := &setupAnswers{}
+	var err error
+	for {
+		if answers.ListenAddress, err = prompt.ask("Local address to listen to", "127.0.0.1:53"); err != nil {
+			return nil, err
+		}
+		if _, err = normalizeListenAddress(answers.ListenAddress); err == nil {
+			break
+		}
+		fmt.Fprintf(prompt.out, "Invalid address: %v\n", err)
+	}
+	if answers.IPv6, err = prompt.askYesNo("Does this network have IPv6 connectivity", false); err != nil {
+		return nil, err
+	}
+	if answers.RequireDNSSEC, err = prompt.askYesNo("Only use servers validating DNSSEC", false); err != nil {
+		return nil, err
+	}
+	for {
+		level, err := prompt.ask("Filtering level: 'none', or 'ads' to block ads and trackers", "none")
+		if err != nil {
+			return nil, err
+		}
+		if level = strings.ToLower(level); level == "none" || level == "ads" {
+			answers.BlockAds = level == "ads"
+			break
+		}
+		fmt.Fprintf(prompt.out, "Unsupported filtering level: [%s]\n", level)
+	}
+	if answers.QueryLog, err = prompt.askYesNo("Log all the queries to a file", false); err != nil {
+		return nil, err
+	}
+	if answers.BlockAds {
+		if answers.BlockedLog, err = prompt.askYesNo("Log the blocked queries to a file", false); err != nil {
+			return nil, err
+		}
+	}
+	return answers, nil
+}
+
+type setupProbeResult struct {
+	name string
+	rtt  int
+}
+
+// benchmarkServers probes a random set of the registered servers, using the same code as the
+// certificate refreshes, and returns the ones that responded, fastest first
+func (proxy *Proxy) benchmarkServers(maxCandidates int) []setupProbeResult {
+	candidates := make([]RegisteredServer, 0, len(proxy.registeredServers))
+	for _, registeredServer := range proxy.registeredServers {
+		if proto := registeredServer.stamp.Proto; proto == stamps.StampProtoTypeDNSCrypt || proto == stamps.StampProtoTypeDoH {
+			candidates = append(candidates, registeredServer)
+		}
+	}
+	proxy.random.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > maxCandidates {
+		candidates = candidates[:maxCandidates]
+	}
+	results := make([]setupProbeResult, 0, len(candidates))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, SetupProbeWorkers)
+	for _, candidate := range candidates {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(candidate RegisteredServer) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			serverInfo, err := fetchServerInfo(proxy, candidate.name, candidate.stamp, false)
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			results = append(results, setupProbeResult{name: candidate.name, rtt: serverInfo.initialRtt})
+			mutex.Unlock()
+		}(candidate)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].rtt < results[j].rtt })
+	return results
+}
+
+// Setup asks a few questions, checks the network connectivity, benchmarks a set of servers
+// and writes a complete configuration file
+func Setup(configFile string, in io.Reader, out io.Writer) error {
+	prompt := &setupPrompt{scanner: bufio.NewScanner(in), out: out}
+	fmt.Fprintln(out, "dnscrypt-proxy setup")
+	fmt.Fprintln(out)
+	if _, err := os.Stat(configFile); err == nil {
+		overwrite, err := prompt.askYesNo(fmt.Sprintf("[%s] already exists. Replace it", configFile), false)
+		if err != nil {
+			return err
+		}
+		if !overwrite {
+			return errors.New("Setup aborted")
+		}
+	}
+	answers, err := prompt.askAnswers()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprint(out, "Checking the network connectivity... ")
+	if !netprobeAny(setupNetprobeAddresses) {
+		fmt.Fprintln(out, "failed")
+		return errors.New("The network doesn't appear to be available - Setup aborted")
+	}
+	fmt.Fprintln(out, "ok")
+
+	configFile, err = filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	// Source caches are saved next to the configuration file, as when the proxy runs
+	if err := os.Chdir(filepath.Dir(configFile)); err != nil {
+		return err
+	}
+	configStr, err := answers.config()
+	if err != nil {
+		return err
+	}
+	config := newConfig()
+	if _, err := toml.Decode(configStr, &config); err != nil {
+		return err
+	}
+	// Only the servers are needed for the benchmark
+	config.ListenAddresses = nil
+	config.BlockLists = nil
+	config.QueryLog.File = ""
+	fmt.Fprintln(out, "Downloading the list of servers...")
+	proxy, err := New(config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Benchmarking up to %d servers among %d...\n", SetupMaxCandidates, len(proxy.registeredServers))
+	results := proxy.benchmarkServers(SetupMaxCandidates)
+	if len(results) == 0 {
+		fmt.Fprintln(out, "No servers responded - they will be chosen automatically when the proxy starts")
+	}
+	for i, result := range results {
+		marker := ""
+		if i < SetupServersCount {
+			answers.ServerNames = append(answers.ServerNames, result.name)
+			marker = " *"
+		}
+		fmt.Fprintf(out, "  %-32s %4d ms%s\n", result.name, result.rtt, marker)
+	}
+
+	if configStr, err = answers.config(); err != nil {
+		return err
+	}
+	if err := os.WriteFile(configFile, []byte(configStr), 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Configuration written to [%s]\n", configFile)
+	fmt.Fprintf(out, "Start the proxy with: dnscrypt-proxy -config %s\n", configFile)
+	return nil
+}
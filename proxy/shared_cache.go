@@ -0,0 +1,455 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	SharedCacheRedis     = "redis"
+	SharedCacheMemcached = "memcached"
+
+	DefaultSharedCacheTimeout   = 100 * time.Millisecond
+	DefaultSharedCacheKeyPrefix = "dnscrypt-proxy:"
+	SharedCacheMaxConns         = 16
+	SharedCacheWriteQueueSize   = 1024
+	SharedCacheMaxFailures      = 3
+	SharedCacheMinBackoff       = time.Second
+	SharedCacheMaxBackoff       = time.Minute
+)
+
+// SharedCache is a second level cache, shared by multiple proxy instances.
+// Responses are stored with their expiration time, so that all instances return the same TTLs.
+// After consecutive failures, the shared cache is not used for an increasing amount of time.
+type SharedCache struct {
+	sync.Mutex
+	backend    string
+	url        *url.URL
+	keyPrefix  string
+	key        []byte
+	timeout    time.Duration
+	conns      chan *sharedCacheConn
+	lookups    chan struct{}
+	writeQueue chan sharedCacheEntry
+	failures   int
+	retryAfter time.Time
+}
+
+type sharedCacheConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type sharedCacheEntry struct {
+	key        string
+	expiration time.Time
+	packet     []byte
+}
+
+func NewSharedCache(config *SharedCacheConfig) (*SharedCache, error) {
+	cacheURL, err := url.Parse(config.URL)
+	if err != nil || len(cacheURL.Host) == 0 {
+		return nil, fmt.Errorf("Shared cache: invalid URL [%s]", config.URL)
+	}
+	sharedCache := &SharedCache{
+		backend:    strings.ToLower(config.Type),
+		url:        cacheURL,
+		keyPrefix:  config.KeyPrefix,
+		timeout:    time.Duration(config.Timeout) * time.Millisecond,
+		conns:      make(chan *sharedCacheConn, SharedCacheMaxConns),
+		lookups:    make(chan struct{}, SharedCacheMaxConns),
+		writeQueue: make(chan sharedCacheEntry, SharedCacheWriteQueueSize),
+	}
+	if len(config.SharedKey) > 0 {
+		if len(config.SharedKey) < 16 {
+			return nil, errors.New("Shared cache: the shared key must be at least 16 characters long")
+		}
+		sharedCache.key = []byte(config.SharedKey)
+	}
+	switch sharedCache.backend {
+	case SharedCacheRedis:
+		if cacheURL.Scheme != "redis" && cacheURL.Scheme != "rediss" {
+			return nil, fmt.Errorf("Shared cache: unsupported URL scheme for Redis [%s]", cacheURL.Scheme)
+		}
+	case SharedCacheMemcached:
+		if cacheURL.Scheme != "memcached" {
+			return nil, fmt.Errorf("Shared cache: unsupported URL scheme for memcached [%s]", cacheURL.Scheme)
+		}
+	default:
+		return nil, fmt.Errorf("Shared cache: unsupported type [%s] - Use '%s' or '%s'", config.Type, SharedCacheRedis, SharedCacheMemcached)
+	}
+	if len(sharedCache.keyPrefix) == 0 {
+		sharedCache.keyPrefix = DefaultSharedCacheKeyPrefix
+	}
+	if sharedCache.timeout <= 0 {
+		sharedCache.timeout = DefaultSharedCacheTimeout
+	}
+	return sharedCache, nil
+}
+
+func (sharedCache *SharedCache) entryKey(cacheKey [32]byte) string {
+	return sharedCache.keyPrefix + hex.EncodeToString(cacheKey[:])
+}
+
+// sign computes the signature of an entry, bound to its key so that entries cannot be swapped
+func (sharedCache *SharedCache) sign(key string, value []byte) []byte {
+	mac := hmac.New(sha256.New, sharedCache.key)
+	mac.Write([]byte(key))
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// available tells whether the shared cache can be used, or is being skipped after failures
+func (sharedCache *SharedCache) available() bool {
+	sharedCache.Lock()
+	defer sharedCache.Unlock()
+	return time.Now().After(sharedCache.retryAfter)
+}
+
+func (sharedCache *SharedCache) recordResult(err error) {
+	sharedCache.Lock()
+	defer sharedCache.Unlock()
+	if err == nil {
+		if sharedCache.failures >= SharedCacheMaxFailures {
+			dlog.Notice("Shared cache: reachable again")
+		}
+		sharedCache.failures = 0
+		return
+	}
+	sharedCache.failures++
+	if sharedCache.failures < SharedCacheMaxFailures {
+		return
+	}
+	backoff := SharedCacheMaxBackoff
+	if shift := sharedCache.failures - SharedCacheMaxFailures; shift < 6 {
+		backoff = SharedCacheMinBackoff << shift
+	}
+	sharedCache.retryAfter = time.Now().Add(backoff)
+	if sharedCache.failures == SharedCacheMaxFailures {
+		dlog.Warnf("Shared cache: %v - Not used for %v", err, backoff)
+	}
+}
+
+// get returns a cached response, or nil if it isn't present or if it couldn't be retrieved in time.
+// Lookups are skipped if too many of them are already waiting for the shared cache.
+func (sharedCache *SharedCache) get(cacheKey [32]byte) *CachedResponse {
+	if !sharedCache.available() {
+		return nil
+	}
+	select {
+	case sharedCache.lookups <- struct{}{}:
+		defer func() { <-sharedCache.lookups }()
+	default:
+		return nil
+	}
+	key := sharedCache.entryKey(cacheKey)
+	value, err := sharedCache.command(func(c *sharedCacheConn) ([]byte, error) {
+		if sharedCache.backend == SharedCacheRedis {
+			return c.redisGet(key)
+		}
+		return c.memcachedGet(key)
+	})
+	if err != nil {
+		dlog.Debugf("Shared cache: %v", err)
+		return nil
+	}
+	if sharedCache.key != nil {
+		if len(value) < sha256.Size {
+			return nil
+		}
+		signature := value[len(value)-sha256.Size:]
+		value = value[:len(value)-sha256.Size]
+		if !hmac.Equal(signature, sharedCache.sign(key, value)) {
+			dlog.Debugf("Shared cache: invalid signature for [%s]", key)
+			return nil
+		}
+	}
+	if len(value) < 8 {
+		return nil
+	}
+	expiration := time.Unix(0, int64(binary.BigEndian.Uint64(value[0:8])))
+	if time.Now().After(expiration) {
+		return nil
+	}
+	cachedResponse := &CachedResponse{expiration: monotonicExpiration(expiration)}
+	if err := cachedResponse.msg.Unpack(value[8:]); err != nil {
+		return nil
+	}
+	return cachedResponse
+}
+
+// set stores a response in the background; responses are dropped if the cache can't keep up
+func (sharedCache *SharedCache) set(cacheKey [32]byte, cachedResponse *CachedResponse) {
+	packet, err := cachedResponse.msg.Pack()
+	if err != nil {
+		return
+	}
+	select {
+	case sharedCache.writeQueue <- sharedCacheEntry{
+		key:        sharedCache.entryKey(cacheKey),
+		expiration: cachedResponse.expiration,
+		packet:     packet,
+	}:
+	default:
+	}
+}
+
+func (sharedCache *SharedCache) writeLoop(quit chan struct{}) {
+	for {
+		var entry sharedCacheEntry
+		select {
+		case <-quit:
+			return
+		case entry = <-sharedCache.writeQueue:
+		}
+		ttl := int(time.Until(entry.expiration) / time.Second)
+		if ttl <= 0 {
+			continue
+		}
+		value := make([]byte, 8, 8+len(entry.packet))
+		binary.BigEndian.PutUint64(value, uint64(entry.expiration.UnixNano()))
+		value = append(value, entry.packet...)
+		if sharedCache.key != nil {
+			value = append(value, sharedCache.sign(entry.key, value)...)
+		}
+		if !sharedCache.available() {
+			continue
+		}
+		_, err := sharedCache.command(func(c *sharedCacheConn) ([]byte, error) {
+			if sharedCache.backend == SharedCacheRedis {
+				return nil, c.redisSet(entry.key, value, ttl)
+			}
+			return nil, c.memcachedSet(entry.key, value, ttl)
+		})
+		if err != nil {
+			dlog.Debugf("Shared cache: %v", err)
+		}
+	}
+}
+
+// command runs a command using an idle connection, or a new one
+func (sharedCache *SharedCache) command(run func(*sharedCacheConn) ([]byte, error)) ([]byte, error) {
+	var c *sharedCacheConn
+	select {
+	case c = <-sharedCache.conns:
+	default:
+		var err error
+		if c, err = sharedCache.connect(); err != nil {
+			sharedCache.recordResult(err)
+			return nil, err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(sharedCache.timeout))
+	value, err := run(c)
+	sharedCache.recordResult(err)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	select {
+	case sharedCache.conns <- c:
+	default:
+		c.conn.Close()
+	}
+	return value, nil
+}
+
+func (sharedCache *SharedCache) connect() (*sharedCacheConn, error) {
+	var conn net.Conn
+	var err error
+	host := sharedCache.url.Host
+	if _, _, splitErr := net.SplitHostPort(host); splitErr != nil {
+		port := "6379"
+		if sharedCache.backend == SharedCacheMemcached {
+			port = "11211"
+		}
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	dialer := &net.Dialer{Timeout: sharedCache.timeout}
+	if sharedCache.url.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: sharedCache.url.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &sharedCacheConn{conn: conn, reader: bufio.NewReader(conn)}
+	if sharedCache.backend == SharedCacheRedis {
+		conn.SetDeadline(time.Now().Add(sharedCache.timeout))
+		if err := c.redisSetup(sharedCache.url); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *sharedCacheConn) redisCommand(args ...[]byte) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *sharedCacheConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// redisReply reads a simple or bulk string reply
+func (c *sharedCacheConn) redisReply() ([]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("Unexpected reply from Redis")
+	}
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, errors.New("Redis: " + line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, value); err != nil {
+			return nil, err
+		}
+		return value[:length], nil
+	}
+	return nil, fmt.Errorf("Unexpected reply from Redis: [%s]", line)
+}
+
+func (c *sharedCacheConn) redisSetup(cacheURL *url.URL) error {
+	if user := cacheURL.User; user != nil {
+		args := [][]byte{[]byte("AUTH")}
+		if password, hasPassword := user.Password(); hasPassword {
+			if len(user.Username()) > 0 {
+				args = append(args, []byte(user.Username()))
+			}
+			args = append(args, []byte(password))
+		} else {
+			args = append(args, []byte(user.Username()))
+		}
+		if err := c.redisCommand(args...); err != nil {
+			return err
+		}
+		if _, err := c.redisReply(); err != nil {
+			return err
+		}
+	}
+	if db := strings.Trim(cacheURL.Path, "/"); len(db) > 0 {
+		if err := c.redisCommand([]byte("SELECT"), []byte(db)); err != nil {
+			return err
+		}
+		if _, err := c.redisReply(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *sharedCacheConn) redisGet(key string) ([]byte, error) {
+	if err := c.redisCommand([]byte("GET"), []byte(key)); err != nil {
+		return nil, err
+	}
+	return c.redisReply()
+}
+
+func (c *sharedCacheConn) redisSet(key string, value []byte, ttl int) error {
+	if err := c.redisCommand([]byte("SET"), []byte(key), value, []byte("EX"), []byte(strconv.Itoa(ttl))); err != nil {
+		return err
+	}
+	_, err := c.redisReply()
+	return err
+}
+
+func (c *sharedCacheConn) memcachedGet(key string) ([]byte, error) {
+	if _, err := c.conn.Write([]byte("get " + key + "\r\n")); err != nil {
+		return nil, err
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line == "END" {
+		return nil, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "VALUE" {
+		return nil, fmt.Errorf("Unexpected reply from memcached: [%s]", line)
+	}
+	length, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, length+2)
+	if _, err := io.ReadFull(c.reader, value); err != nil {
+		return nil, err
+	}
+	if line, err = c.readLine(); err != nil || line != "END" {
+		return nil, errors.New("Unexpected reply from memcached")
+	}
+	return value[:length], nil
+}
+
+func (c *sharedCacheConn) memcachedSet(key string, value []byte, ttl int) error {
+	header := fmt.Sprintf("set %s 0 %d %d\r\n", key, ttl, len(value))
+	if _, err := c.conn.Write(append(append([]byte(header), value...), '\r', '\n')); err != nil {
+		return err
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "STORED" {
+		return fmt.Errorf("Unexpected reply from memcached: [%s]", line)
+	}
+	return nil
+}
+
+// getShared looks up a response in the shared cache, and adds it to the local cache if it was found
+func getShared(cachedResponses *CachedResponses, sharedCache *SharedCache, cacheKey [32]byte, cacheSize int) (*dns.Msg, time.Time, bool) {
+	cachedResponse := sharedCache.get(cacheKey)
+	if cachedResponse == nil {
+		return nil, time.Time{}, false
+	}
+	cachedResponses.store(cacheKey, *cachedResponse, cacheSize)
+	return cachedResponse.msg.Copy(), cachedResponse.expiration, true
+}
@@ -1,13 +1,14 @@
-package main
+package proxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dchest/safefile"
@@ -26,6 +27,8 @@
 const (
 	DefaultPrefetchDelay    time.Duration = 24 * time.Hour
 	MinimumPrefetchInterval time.Duration = 10 * time.Minute
+	// SourceLoadTimeout is the maximum time to download a source at startup, before its cache file is used
+	SourceLoadTimeout time.Duration = 60 * time.Second
 )
 
 type Source struct {
@@ -38,8 +41,29 @@ type Source struct {
 	cacheTTL, prefetchDelay time.Duration
 	refresh                 time.Time
 	prefix                  string
+	health                  *sourceHealth
+	random                  *lockedRand
 }
 
+// SourceStatus describes the health of a source, as shown by `-list-sources`
+type SourceStatus struct {
+	Name       string    `json:"name"`
+	URLs       []string  `json:"urls"`
+	CacheFile  string    `json:"cache_file"`
+	LastUpdate time.Time `json:"last_update"`
+	Signature  string    `json:"signature"`
+	Entries    int       `json:"entries"`
+	Stale      bool      `json:"stale"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+const (
+	SourceSignatureValid   = "valid"
+	SourceSignatureInvalid = "invalid"
+	SourceSignatureUnknown = "unknown"
+	SourceSignatureNone    = "none"
+)
+
 // timeNow() is replaced by tests to provide a static value
 var timeNow = time.Now
 
@@ -61,6 +85,7 @@ func (source *Source) fetchFromCache(now time.Time) (time.Duration, error) {
 		return 0, err
 	}
 	if err = source.checkSignature(bin, sig); err != nil {
+		source.updateStatus(func(status *SourceStatus) { status.Signature = SourceSignatureInvalid })
 		return 0, err
 	}
 	source.bin = bin
@@ -68,6 +93,10 @@ func (source *Source) fetchFromCache(now time.Time) (time.Duration, error) {
 	if fi, err = os.Stat(source.cacheFile); err != nil {
 		return 0, err
 	}
+	source.updateStatus(func(status *SourceStatus) {
+		status.LastUpdate = fi.ModTime()
+		status.Signature = SourceSignatureValid
+	})
 	var ttl time.Duration = 0
 	if elapsed := now.Sub(fi.ModTime()); elapsed < source.cacheTTL {
 		ttl = source.prefetchDelay - elapsed
@@ -172,14 +201,21 @@ func (source *Source) fetchWithCache(xTransport *XTransport, now time.Time) (tim
 		}
 		if err = source.checkSignature(bin, sig); err != nil {
 			dlog.Debugf("Source [%s] failed signature check using URL [%s]", source.name, srcURL)
+			source.updateStatus(func(status *SourceStatus) { status.Signature = SourceSignatureInvalid })
 			continue
 		}
 		break // valid signature
 	}
 	if err != nil {
+		source.updateStatus(func(status *SourceStatus) { status.LastError = err.Error() })
 		return 0, err
 	}
 	source.updateCache(bin, sig, now)
+	source.updateStatus(func(status *SourceStatus) {
+		status.LastUpdate = now
+		status.Signature = SourceSignatureValid
+		status.LastError = ""
+	})
 	ttl = source.prefetchDelay
 	source.refresh = now.Add(ttl)
 	return ttl, nil
@@ -218,6 +254,7 @@ func NewSource(
 		return source, err
 	}
 	source.parseURLs(urls)
+	source.health = newSourceHealth(name, source.urls, cacheFile, 2*refreshDelay)
 	_, err := source.fetchWithCache(xTransport, timeNow())
 	if err == nil {
 		dlog.Noticef("Source [%s] loaded", name)
@@ -242,13 +279,173 @@ func PrefetchSources(xTransport *XTransport, sources []*Source) time.Duration {
 				interval = delay
 			}
 		}
+		source.health.checkStaleness(now)
 	}
 	return interval
 }
 
+// sourceHealth is the health record of a source or of a block list
+type sourceHealth struct {
+	sync.Mutex
+	status     SourceStatus
+	since      time.Time
+	staleAfter time.Duration
+}
+
+func newSourceHealth(name string, urls []*url.URL, cacheFile string, staleAfter time.Duration) *sourceHealth {
+	urlStrs := make([]string, 0, len(urls))
+	for _, srcURL := range urls {
+		urlStrs = append(urlStrs, srcURL.String())
+	}
+	return &sourceHealth{
+		status: SourceStatus{
+			Name:      name,
+			URLs:      urlStrs,
+			CacheFile: cacheFile,
+			Signature: SourceSignatureUnknown,
+		},
+		since:      timeNow(),
+		staleAfter: staleAfter,
+	}
+}
+
+func (health *sourceHealth) update(update func(status *SourceStatus)) {
+	if health == nil {
+		return
+	}
+	health.Lock()
+	update(&health.status)
+	health.Unlock()
+}
+
+func (health *sourceHealth) setURLs(urls []*url.URL) {
+	urlStrs := make([]string, 0, len(urls))
+	for _, srcURL := range urls {
+		urlStrs = append(urlStrs, srcURL.String())
+	}
+	health.update(func(status *SourceStatus) { status.URLs = urlStrs })
+}
+
+// setStaleAfter sets the delay after which a source that couldn't be updated is reported as stale
+func (health *sourceHealth) setStaleAfter(staleAfter time.Duration) {
+	if health == nil {
+		return
+	}
+	health.Lock()
+	health.staleAfter = staleAfter
+	health.Unlock()
+}
+
+func (health *sourceHealth) current(now time.Time) SourceStatus {
+	if health == nil {
+		return SourceStatus{Signature: SourceSignatureUnknown}
+	}
+	health.Lock()
+	defer health.Unlock()
+	status := health.status
+	status.Stale = health.isStale(now)
+	return status
+}
+
+// isStale returns whether the last update, or the first attempt if it never succeeded, is too old; health must be locked
+func (health *sourceHealth) isStale(now time.Time) bool {
+	lastUpdate := health.status.LastUpdate
+	if lastUpdate.IsZero() {
+		lastUpdate = health.since
+	}
+	return health.staleAfter > 0 && now.Sub(lastUpdate) > health.staleAfter
+}
+
+// checkStaleness warns once when a source hasn't been updated for too long, since
+// a list that silently stopped being updated can't be trusted any more
+func (health *sourceHealth) checkStaleness(now time.Time) {
+	if health == nil {
+		return
+	}
+	health.Lock()
+	defer health.Unlock()
+	stale := health.isStale(now)
+	if stale && !health.status.Stale {
+		if health.status.LastUpdate.IsZero() {
+			dlog.Warnf(
+				"Source [%s] has never been updated (last error: %s)",
+				health.status.Name,
+				health.status.LastError,
+			)
+		} else {
+			dlog.Warnf(
+				"Source [%s] hasn't been updated for %v (last error: %s)",
+				health.status.Name,
+				now.Sub(health.status.LastUpdate).Round(time.Minute),
+				health.status.LastError,
+			)
+		}
+	}
+	health.status.Stale = stale
+}
+
+func (source *Source) updateStatus(update func(status *SourceStatus)) {
+	source.health.update(update)
+}
+
+// Status returns the current health of the source
+func (source *Source) Status() SourceStatus {
+	return source.health.current(timeNow())
+}
+
+func (status SourceStatus) String() string {
+	var line string
+	if status.LastUpdate.IsZero() {
+		line = fmt.Sprintf("%s: never updated", status.Name)
+	} else {
+		line = fmt.Sprintf("%s: updated %v ago", status.Name, timeNow().Sub(status.LastUpdate).Round(time.Minute))
+	}
+	line += fmt.Sprintf(", %d entries, signature %s", status.Entries, status.Signature)
+	if status.Stale {
+		line += ", STALE"
+	}
+	if len(status.LastError) > 0 {
+		line += ", last error: " + status.LastError
+	}
+	return line
+}
+
+// sourcesStatus returns the health of the sources and of the block lists
+func (proxy *Proxy) sourcesStatus() []SourceStatus {
+	statuses := make([]SourceStatus, 0, len(proxy.sources))
+	for _, source := range proxy.sources {
+		statuses = append(statuses, source.Status())
+	}
+	if proxy.blockLists != nil {
+		statuses = append(statuses, proxy.blockLists.statuses()...)
+	}
+	return statuses
+}
+
+func (proxy *Proxy) printSources(jsonOutput bool) error {
+	if proxy.blockLists != nil {
+		proxy.blockLists.loadCachedQuietly()
+	}
+	statuses := proxy.sourcesStatus()
+	if !jsonOutput {
+		for _, status := range statuses {
+			fmt.Println(status.String())
+		}
+		return nil
+	}
+	jsonStr, err := json.MarshalIndent(statuses, "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(jsonStr))
+	return nil
+}
+
 func (source *Source) Parse() ([]RegisteredServer, error) {
 	if source.format == SourceFormatV2 {
-		return source.parseV2()
+		registeredServers, err := source.parseV2()
+		source.updateStatus(func(status *SourceStatus) { status.Entries = len(registeredServers) })
+		return registeredServers, err
 	}
 	dlog.Fatal("Unexpected source format")
 	return []RegisteredServer{}, nil
@@ -300,7 +497,7 @@ func (source *Source) parseV2() ([]RegisteredServer, error) {
 			appendStampErr("Missing stamp for server [%s]", name)
 			continue
 		} else if stampStrsLen > 1 {
-			rand.Shuffle(stampStrsLen, func(i, j int) { stampStrs[i], stampStrs[j] = stampStrs[j], stampStrs[i] })
+			source.random.Shuffle(stampStrsLen, func(i, j int) { stampStrs[i], stampStrs[j] = stampStrs[j], stampStrs[i] })
 		}
 		var stamp dnsstamps.ServerStamp
 		var err error
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"bytes"
@@ -395,6 +395,9 @@ func TestNewSource(t *testing.T) {
 		} else {
 			c.Nil(err, "Unexpected error")
 		}
+		if got != nil {
+			got.health = nil // the health record is checked by TestSourceHealth
+		}
 		c.DeepEqual(got, e.Source, "Unexpected return")
 		checkTestServer(c, d)
 		checkSourceCache(c, e)
@@ -488,4 +491,21 @@ func TestPrefetchSources(t *testing.T) {
 	}
 }
 
+func TestSourceHealth(t *testing.T) {
+	c := check.T(t)
+	start := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start }
+	health := newSourceHealth("test", nil, "test.md", time.Hour)
+	c.False(health.current(start).Stale, "A source that was just added is not stale")
+	c.True(health.current(start.Add(2*time.Hour)).Stale, "A source that was never updated becomes stale")
+	health.update(func(status *SourceStatus) { status.LastUpdate = start.Add(2 * time.Hour) })
+	c.False(health.current(start.Add(2*time.Hour)).Stale, "An updated source is not stale")
+	c.True(health.current(start.Add(4*time.Hour)).Stale, "A source that isn't updated any more becomes stale")
+	health.setStaleAfter(0)
+	c.False(health.current(start.Add(4*time.Hour)).Stale, "Staleness can be disabled")
+	var missing *sourceHealth
+	c.Equal(missing.current(start).Signature, SourceSignatureUnknown)
+}
+
 func TestMain(m *testing.M) { check.TestMain(m) }
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	SpoofProtectionAudit  = "audit"
+	SpoofProtectionStrict = "strict"
+
+	// SpoofConflictWindow is how long strict mode waits for a conflicting response after the first one
+	SpoofConflictWindow = 50 * time.Millisecond
+	// SpoofSuspicionPeriod is how long strict mode keeps waiting for conflicting responses from a
+	// server after unexpected responses to a query sent to it have been seen
+	SpoofSuspicionPeriod = 10 * time.Minute
+)
+
+var errSpoofingDetected = errors.New("Possible spoofing attempt")
+
+// SpoofAudit counts the responses that look like cache poisoning attempts on queries sent over UDP
+type SpoofAudit struct {
+	strict              bool
+	mismatchedIDs       atomic.Uint64
+	unexpectedSources   atomic.Uint64
+	mismatchedQuestions atomic.Uint64
+	conflictingAnswers  atomic.Uint64
+	suspects            struct {
+		sync.Mutex
+		until map[string]time.Time
+	}
+}
+
+func NewSpoofAudit(mode string) *SpoofAudit {
+	audit := &SpoofAudit{strict: mode == SpoofProtectionStrict}
+	audit.suspects.until = make(map[string]time.Time)
+	return audit
+}
+
+// suspected tells whether unexpected responses have recently been received from a server
+func (audit *SpoofAudit) suspected(server string) bool {
+	audit.suspects.Lock()
+	defer audit.suspects.Unlock()
+	until, found := audit.suspects.until[server]
+	if found && time.Now().After(until) {
+		delete(audit.suspects.until, server)
+		return false
+	}
+	return found
+}
+
+// exchangeUDP sends a query over UDP, and only accepts responses that come from the server address,
+// with the query identifier and question; in strict mode, if forged responses are seen, an error
+// is returned, so that the query can be retried over TCP
+func (audit *SpoofAudit) exchangeUDP(msg *dns.Msg, server string, timeout time.Duration) (*dns.Msg, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	query := msg.Copy()
+	query.Id = dns.Id()
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	pc.SetDeadline(deadline)
+	if _, err := pc.WriteToUDP(packet, serverAddr); err != nil {
+		return nil, err
+	}
+	var respMsg *dns.Msg
+	var respPacket []byte
+	forged := 0
+	buf := make([]byte, MaxDNSPacketSize)
+	for {
+		length, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if respMsg != nil {
+				break
+			}
+			if forged > 0 {
+				audit.report(msg, server, forged)
+			}
+			return nil, err
+		}
+		response := buf[:length]
+		if !from.IP.Equal(serverAddr.IP) || from.Port != serverAddr.Port {
+			audit.unexpectedSources.Add(1)
+			forged++
+			continue
+		}
+		if length < MinDNSPacketSize || TransactionID(response) != query.Id {
+			audit.mismatchedIDs.Add(1)
+			forged++
+			continue
+		}
+		candidate := new(dns.Msg)
+		if err := candidate.Unpack(response); err != nil || len(candidate.Question) != 1 ||
+			!strings.EqualFold(candidate.Question[0].Name, query.Question[0].Name) ||
+			candidate.Question[0].Qtype != query.Question[0].Qtype {
+			audit.mismatchedQuestions.Add(1)
+			forged++
+			continue
+		}
+		if respMsg == nil {
+			respMsg, respPacket = candidate, append([]byte{}, response...)
+			if !audit.strict || (forged == 0 && !audit.suspected(server)) {
+				break
+			}
+			// Wait a little bit for a different response to the same query
+			pc.SetReadDeadline(time.Now().Add(SpoofConflictWindow))
+			continue
+		}
+		if string(respPacket[2:]) != string(response[2:]) {
+			audit.conflictingAnswers.Add(1)
+			forged++
+		}
+	}
+	if forged > 0 {
+		audit.report(msg, server, forged)
+		if audit.strict {
+			return nil, errSpoofingDetected
+		}
+	}
+	respMsg.Id = msg.Id
+	return respMsg, nil
+}
+
+func (audit *SpoofAudit) report(msg *dns.Msg, server string, forged int) {
+	audit.suspects.Lock()
+	audit.suspects.until[server] = time.Now().Add(SpoofSuspicionPeriod)
+	audit.suspects.Unlock()
+	dlog.Warnf("Possible spoofing attempt: %d unexpected responses to a query for [%s] sent to [%s]",
+		forged, msg.Question[0].Name, server)
+}
+
+// Summary returns the counters, as a line for the stats command
+func (audit *SpoofAudit) Summary() string {
+	return fmt.Sprintf("spoofing mismatched_ids=%d unexpected_sources=%d mismatched_questions=%d conflicting_answers=%d",
+		audit.mismatchedIDs.Load(), audit.unexpectedSources.Load(),
+		audit.mismatchedQuestions.Load(), audit.conflictingAnswers.Load())
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const ListenerLabelNone = "-"
+
+type ListenerStats struct {
+	Queries     uint64
+	Cached      uint64
+	ReturnCodes map[string]uint64
+}
+
+// QueryStats aggregates the outcome of client queries by listener label
+type QueryStats struct {
+	sync.Mutex
+	byLabel      map[string]*ListenerStats
+	chromeProbes uint64
+}
+
+func NewQueryStats() *QueryStats {
+	return &QueryStats{byLabel: make(map[string]*ListenerStats)}
+}
+
+func (pluginsState *PluginsState) listenerLabel() string {
+	if options := pluginsState.listenerOptions; options != nil && len(options.Label) > 0 {
+		return options.Label
+	}
+	return ListenerLabelNone
+}
+
+func (queryStats *QueryStats) record(pluginsState *PluginsState) {
+	if queryStats == nil || pluginsState.clientProto == "trampoline" || pluginsState.clientProto == "priming" ||
+		pluginsState.clientProto == "refresh" {
+		return
+	}
+	label := pluginsState.listenerLabel()
+	queryStats.Lock()
+	defer queryStats.Unlock()
+	stats, found := queryStats.byLabel[label]
+	if !found {
+		stats = &ListenerStats{ReturnCodes: make(map[string]uint64)}
+		queryStats.byLabel[label] = stats
+	}
+	stats.Queries++
+	if pluginsState.cacheHit {
+		stats.Cached++
+	}
+	stats.ReturnCodes[PluginsReturnCodeToString[pluginsState.returnCode]]++
+}
+
+func (queryStats *QueryStats) recordChromeProbe() {
+	if queryStats == nil {
+		return
+	}
+	queryStats.Lock()
+	queryStats.chromeProbes++
+	queryStats.Unlock()
+}
+
+// Summary returns a line per listener label, with the number of queries for each return code
+func (queryStats *QueryStats) Summary() []string {
+	queryStats.Lock()
+	defer queryStats.Unlock()
+	labels := make([]string, 0, len(queryStats.byLabel))
+	for label := range queryStats.byLabel {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	lines := make([]string, 0, len(labels))
+	for _, label := range labels {
+		stats := queryStats.byLabel[label]
+		returnCodes := make([]string, 0, len(stats.ReturnCodes))
+		for returnCode, count := range stats.ReturnCodes {
+			returnCodes = append(returnCodes, fmt.Sprintf("%s=%d", strings.ToLower(returnCode), count))
+		}
+		sort.Strings(returnCodes)
+		lines = append(
+			lines,
+			fmt.Sprintf("%s queries=%d cached=%d %s", label, stats.Queries, stats.Cached, strings.Join(returnCodes, " ")),
+		)
+	}
+	if queryStats.chromeProbes > 0 {
+		lines = append(lines, fmt.Sprintf("chrome_probes=%d", queryStats.chromeProbes))
+	}
+	return lines
+}
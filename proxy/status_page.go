@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+)
+
+// StatusPage serves a read-only summary of the proxy health, without authentication.
+// It only exposes what is needed to tell whether DNS works: no client data, no configuration.
+type StatusPage struct {
+	listenAddress string
+}
+
+type StatusServer struct {
+	Name           string     `json:"name"`
+	RTTMs          float64    `json:"rtt_ms"`
+	CertExpiration *time.Time `json:"cert_expiration,omitempty"`
+	CertDaysLeft   *int       `json:"cert_days_left,omitempty"`
+}
+
+type StatusSource struct {
+	Name       string    `json:"name"`
+	LastUpdate time.Time `json:"last_update"`
+	Entries    int       `json:"entries"`
+	Stale      bool      `json:"stale"`
+}
+
+type Status struct {
+	Status            string         `json:"status"`
+	Version           string         `json:"version"`
+	Uptime            int64          `json:"uptime"`
+	LiveServers       int            `json:"live_servers"`
+	RegisteredServers int            `json:"registered_servers"`
+	Servers           []StatusServer `json:"servers"`
+	Sources           []StatusSource `json:"sources"`
+	Alerts            []BeaconAlert  `json:"alerts"`
+}
+
+func NewStatusPage(listenAddress string) *StatusPage {
+	return &StatusPage{listenAddress: listenAddress}
+}
+
+func (statusPage *StatusPage) status(proxy *Proxy) *Status {
+	status := &Status{
+		Status:  StatusOK,
+		Version: AppVersion,
+		Uptime:  int64(time.Since(proxy.startTime).Seconds()),
+		Servers: []StatusServer{},
+		Sources: []StatusSource{},
+		Alerts:  []BeaconAlert{},
+	}
+	proxy.serversInfo.RLock()
+	for _, serverInfo := range proxy.serversInfo.inner {
+		server := StatusServer{Name: serverInfo.Name, RTTMs: serverInfo.rtt.Value()}
+		if !serverInfo.certExpiration.IsZero() {
+			certExpiration := serverInfo.certExpiration
+			server.CertExpiration, server.CertDaysLeft = &certExpiration, certDaysLeft(certExpiration)
+		}
+		status.Servers = append(status.Servers, server)
+	}
+	status.RegisteredServers = len(proxy.serversInfo.registeredServers)
+	proxy.serversInfo.RUnlock()
+	sort.Slice(status.Servers, func(i, j int) bool { return status.Servers[i].RTTMs < status.Servers[j].RTTMs })
+	status.LiveServers = len(status.Servers)
+	if status.LiveServers == 0 {
+		status.Status = StatusDegraded
+	}
+	for _, sourceStatus := range proxy.sourcesStatus() {
+		status.Sources = append(status.Sources, StatusSource{
+			Name:       sourceStatus.Name,
+			LastUpdate: sourceStatus.LastUpdate,
+			Entries:    sourceStatus.Entries,
+			Stale:      sourceStatus.Stale,
+		})
+	}
+	if proxy.beacons != nil {
+		status.Alerts = proxy.beacons.currentAlerts()
+	}
+	return status
+}
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>DNS status</title>
+<style>body{font-family:sans-serif}.ok{color:#080}.degraded{color:#b00}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:2px 8px;text-align:left}</style>
+</head><body>
+<h1>DNS is <span class="{{.Status}}">{{if eq .Status "ok"}}OK{{else}}not working{{end}}</span></h1>
+<p>dnscrypt-proxy {{.Version}} &middot; up for {{.Uptime}}s &middot; {{.LiveServers}}/{{.RegisteredServers}} servers available</p>
+<h2>Servers</h2><table><tr><th>Server</th><th>RTT</th><th>Certificate expires</th></tr>
+{{range .Servers}}<tr><td>{{.Name}}</td><td>{{printf "%.0f" .RTTMs}} ms</td><td>{{if .CertExpiration}}{{.CertExpiration.Format "2006-01-02 15:04"}} ({{.CertDaysLeft}} days){{end}}</td></tr>{{end}}</table>
+<h2>Sources</h2><table><tr><th>Source</th><th>Last update</th><th>Entries</th></tr>
+{{range .Sources}}<tr><td>{{.Name}}</td><td>{{if .LastUpdate.IsZero}}never{{else}}{{.LastUpdate.Format "2006-01-02 15:04"}}{{end}}{{if .Stale}} (stale){{end}}</td><td>{{.Entries}}</td></tr>{{end}}</table>
+{{if .Alerts}}<h2>Alerts</h2><table><tr><th>Server</th><th>Beacon</th><th>Problem</th><th>Seen</th></tr>
+{{range .Alerts}}<tr><td>{{.Server}}</td><td>{{.Name}}</td><td>{{.Reason}}</td><td>{{.Time.Format "2006-01-02 15:04"}}</td></tr>{{end}}</table>{{end}}
+</body></html>
+`))
+
+func (statusPage *StatusPage) handle(proxy *Proxy, writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.Header().Set("Allow", "GET, HEAD")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	status := statusPage.status(proxy)
+	writer.Header().Set("Cache-Control", "no-store")
+	switch request.URL.Path {
+	case "/status.json":
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(status)
+	case "/":
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = statusPageTemplate.Execute(writer, status)
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (statusPage *StatusPage) start(proxy *Proxy) error {
+	listener, err := net.Listen("tcp", statusPage.listenAddress)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		statusPage.handle(proxy, writer, request)
+	})
+	server := &http.Server{Handler: proxy.httpAccessLog.wrap("status_page", mux), ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	go func() {
+		<-proxy.quit
+		server.Close()
+	}()
+	dlog.Noticef("Status page: listening on [%s]", statusPage.listenAddress)
+	return nil
+}
@@ -0,0 +1,88 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	SupervisorMinRestartDelay = 1 * time.Second
+	SupervisorMaxRestartDelay = 60 * time.Second
+	SupervisorStableUptime    = 60 * time.Second
+)
+
+// runChildSupervisor runs the unprivileged child process and restarts it with an exponential backoff
+// whenever it crashes. The listening sockets are kept open by the supervisor, so that they can
+// be handed over again to every new instance of the child. This function never returns.
+func (proxy *Proxy) runChildSupervisor(path string, args []string, uid int, gid int, fds []*os.File) {
+	extraFiles := make([]*os.File, int(InheritedDescriptorsBase)-3+len(fds))
+	for i, fd := range fds {
+		extraFiles[int(InheritedDescriptorsBase)-3+i] = fd
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	restartDelay := SupervisorMinRestartDelay
+	for {
+		cmd := exec.Command(path, args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		cmd.ExtraFiles = extraFiles
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}},
+		}
+		dlog.Notice("Starting the unprivileged child process")
+		startTS := time.Now()
+		if err := cmd.Start(); err != nil {
+			dlog.Fatalf("Unable to start [%s]: [%s]", path, err)
+		}
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+		stopping := false
+		var err error
+	wait:
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+					stopping = true
+				}
+				_ = cmd.Process.Signal(sig)
+			case err = <-exited:
+				break wait
+			}
+		}
+		if stopping {
+			dlog.Notice("Child process stopped")
+			os.Exit(0)
+		}
+		if err == nil {
+			dlog.Notice("Child process exited")
+			os.Exit(0)
+		}
+		if time.Since(startTS) >= SupervisorStableUptime {
+			restartDelay = SupervisorMinRestartDelay
+		}
+		dlog.Errorf("Child process terminated unexpectedly: [%s] - Restarting in %v", err, restartDelay)
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				os.Exit(0)
+			}
+		case <-time.After(restartDelay):
+		}
+		restartDelay *= 2
+		if restartDelay > SupervisorMaxRestartDelay {
+			restartDelay = SupervisorMaxRestartDelay
+		}
+	}
+}
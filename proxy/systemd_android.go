@@ -1,4 +1,4 @@
-package main
+package proxy
 
 func (proxy *Proxy) addSystemDListeners() error {
 	return nil
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const DefaultTCPPoolIdleTimeout = 30 * time.Second
+
+var errTCPPoolConnClosed = errors.New("Connection closed")
+
+// TCPPool keeps TCP connections to plain DNS resolvers open, and sends queries over them
+// without waiting for previous responses. Responses are matched with queries by ID.
+type TCPPool struct {
+	sync.Mutex
+	conns       map[string]*tcpPoolConn
+	dialLocks   map[string]*sync.Mutex
+	idleTimeout time.Duration
+}
+
+type tcpPoolConn struct {
+	sync.Mutex
+	pool    *TCPPool
+	addr    string
+	conn    *dns.Conn
+	reader  *countingConn
+	pending map[uint16]tcpPoolPending
+	closed  bool
+}
+
+type tcpPoolPending struct {
+	question dns.Question
+	ch       chan *dns.Msg
+}
+
+// countingConn counts the bytes read, so that a response that was only partially read can be detected
+type countingConn struct {
+	net.Conn
+	read int
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read += n
+	return n, err
+}
+
+func NewTCPPool(idleTimeout time.Duration) *TCPPool {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultTCPPoolIdleTimeout
+	}
+	return &TCPPool{
+		conns:       make(map[string]*tcpPoolConn),
+		dialLocks:   make(map[string]*sync.Mutex),
+		idleTimeout: idleTimeout,
+	}
+}
+
+func (pool *TCPPool) get(addr string, timeout time.Duration) (*tcpPoolConn, bool, error) {
+	pool.Lock()
+	pc, found := pool.conns[addr]
+	dialLock, dialing := pool.dialLocks[addr]
+	if !dialing {
+		dialLock = &sync.Mutex{}
+		pool.dialLocks[addr] = dialLock
+	}
+	pool.Unlock()
+	if found {
+		return pc, true, nil
+	}
+	// A single connection is opened at a time, even if many queries are sent simultaneously
+	dialLock.Lock()
+	defer dialLock.Unlock()
+	pool.Lock()
+	pc, found = pool.conns[addr]
+	pool.Unlock()
+	if found {
+		return pc, true, nil
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	pool.Lock()
+	defer pool.Unlock()
+	dlog.Debugf("New persistent TCP connection to [%s]", addr)
+	reader := &countingConn{Conn: conn}
+	pc = &tcpPoolConn{
+		pool:    pool,
+		addr:    addr,
+		conn:    &dns.Conn{Conn: reader},
+		reader:  reader,
+		pending: make(map[uint16]tcpPoolPending),
+	}
+	pool.conns[addr] = pc
+	go pc.readLoop()
+	return pc, false, nil
+}
+
+// Exchange sends a query using a persistent connection. If a connection that was reused
+// turns out to have been closed by the server, the query is retried over a new one.
+func (pool *TCPPool) Exchange(msg *dns.Msg, addr string, timeout time.Duration) (*dns.Msg, error) {
+	for {
+		pc, reused, err := pool.get(addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		respMsg, err := pc.exchange(msg, timeout)
+		if err == errTCPPoolConnClosed && reused {
+			continue
+		}
+		return respMsg, err
+	}
+}
+
+func (pc *tcpPoolConn) exchange(msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	if len(msg.Question) != 1 {
+		return nil, errors.New("Unexpected number of questions")
+	}
+	query := msg.Copy()
+	ch := make(chan *dns.Msg, 1)
+	pc.Lock()
+	if pc.closed {
+		pc.Unlock()
+		return nil, errTCPPoolConnClosed
+	}
+	// The ID is replaced, so that concurrent queries from different clients don't collide
+	for {
+		query.Id = dns.Id()
+		if _, found := pc.pending[query.Id]; !found {
+			break
+		}
+	}
+	pc.pending[query.Id] = tcpPoolPending{question: query.Question[0], ch: ch}
+	pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := pc.conn.WriteMsg(query)
+	pc.Unlock()
+	if err != nil {
+		pc.close()
+		return nil, errTCPPoolConnClosed
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case respMsg, ok := <-ch:
+		if !ok {
+			return nil, errTCPPoolConnClosed
+		}
+		respMsg.Id = msg.Id
+		return respMsg, nil
+	case <-timer.C:
+		pc.Lock()
+		delete(pc.pending, query.Id)
+		pc.Unlock()
+		return nil, errors.New("Timeout")
+	}
+}
+
+func (pc *tcpPoolConn) readLoop() {
+	defer pc.close()
+	for {
+		pc.conn.SetReadDeadline(time.Now().Add(pc.pool.idleTimeout))
+		pc.reader.read = 0
+		respMsg, err := pc.conn.ReadMsg()
+		if err != nil {
+			// After a partial read, the stream can't be resynchronized
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && pc.reader.read == 0 {
+				pc.Lock()
+				idle := len(pc.pending) == 0
+				pc.Unlock()
+				if !idle {
+					continue
+				}
+			}
+			return
+		}
+		pc.Lock()
+		pending, found := pc.pending[respMsg.Id]
+		if found {
+			delete(pc.pending, respMsg.Id)
+		}
+		pc.Unlock()
+		if !found {
+			continue
+		}
+		if len(respMsg.Question) != 1 || !sameQuestion(respMsg.Question[0], pending.question) {
+			dlog.Debugf("Unexpected question in a response from [%s], closing the connection", pc.addr)
+			close(pending.ch)
+			return
+		}
+		pending.ch <- respMsg
+	}
+}
+
+// closeAll closes all the connections, for example after a network change
+func (pool *TCPPool) closeAll() {
+	pool.Lock()
+	conns := make([]*tcpPoolConn, 0, len(pool.conns))
+	for _, pc := range pool.conns {
+		conns = append(conns, pc)
+	}
+	pool.Unlock()
+	for _, pc := range conns {
+		pc.close()
+	}
+}
+
+func (pc *tcpPoolConn) close() {
+	pc.pool.Lock()
+	if pc.pool.conns[pc.addr] == pc {
+		delete(pc.pool.conns, pc.addr)
+	}
+	pc.pool.Unlock()
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	pc.conn.Close()
+	for id, pending := range pc.pending {
+		close(pending.ch)
+		delete(pc.pending, id)
+	}
+}
+
+func sameQuestion(a, b dns.Question) bool {
+	return a.Qtype == b.Qtype && a.Qclass == b.Qclass && strings.EqualFold(a.Name, b.Name)
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type queryTraceStep struct {
+	at     time.Duration
+	stage  string
+	detail string
+}
+
+// queryTrace records what happens to a single query while it goes through the pipeline
+type queryTrace struct {
+	sync.Mutex
+	start time.Time
+	steps []queryTraceStep
+}
+
+func newQueryTrace() *queryTrace {
+	return &queryTrace{start: time.Now()}
+}
+
+// add records a step; it does nothing if the query is not being traced
+func (trace *queryTrace) add(stage string, format string, args ...interface{}) {
+	if trace == nil {
+		return
+	}
+	trace.Lock()
+	trace.steps = append(trace.steps, queryTraceStep{
+		at:     time.Since(trace.start),
+		stage:  stage,
+		detail: fmt.Sprintf(format, args...),
+	})
+	trace.Unlock()
+}
+
+func (trace *queryTrace) lines() []string {
+	trace.Lock()
+	defer trace.Unlock()
+	lines := make([]string, 0, len(trace.steps))
+	for _, step := range trace.steps {
+		lines = append(lines, fmt.Sprintf("%10s  %-16s %s", step.at.Round(time.Microsecond), step.stage, step.detail))
+	}
+	return lines
+}
+
+func pluginsActionToString(action PluginsAction) string {
+	switch action {
+	case PluginsActionNone, PluginsActionContinue:
+		return "continue"
+	case PluginsActionDrop:
+		return "drop"
+	case PluginsActionReject:
+		return "reject"
+	case PluginsActionSynth:
+		return "synthesize a response"
+	}
+	return "unknown"
+}
+
+// Trace resolves a name through the plugins and the servers, as a local client would,
+// and returns a description of every step, followed by the response
+func (proxy *Proxy) Trace(qName string, qType uint16) ([]string, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(qName), qType)
+	query.SetEdns0(uint16(MaxDNSPacketSize), false)
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if !proxy.clientsCountInc() {
+		return nil, errors.New("Too many concurrent queries")
+	}
+	defer proxy.clientsCountDec()
+	trace := newQueryTrace()
+	trace.add("query", "%s %s", query.Question[0].Name, dns.TypeToString[qType])
+	responsePacket := proxy.processQuery("trampoline", proxy.mainProto, packet, nil, nil, trace.start, false, nil, trace, nil)
+	lines := trace.lines()
+	if len(responsePacket) == 0 {
+		return append(lines, "", "No response"), nil
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(responsePacket); err != nil {
+		return lines, err
+	}
+	lines = append(lines, "")
+	return append(lines, strings.Split(strings.TrimSpace(response.String()), "\n")...), nil
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VividCortex/ewma"
+	"github.com/miekg/dns"
+)
+
+const (
+	UpstreamRecordingModeRecord = "record"
+	UpstreamRecordingModeReplay = "replay"
+	UpstreamReplayServerName    = "replay"
+)
+
+// UpstreamRecording is a question/answer pair exchanged with a server, saved as a JSON line
+type UpstreamRecording struct {
+	Time     int64  `json:"time"`
+	Server   string `json:"server"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Query    []byte `json:"query"`
+	Response []byte `json:"response"`
+}
+
+// UpstreamRecorder either saves the responses received from the servers to a file, or serves
+// the responses previously saved instead of sending the queries, so that a run can be
+// reproduced without network access, with the complete set of plugins.
+type UpstreamRecorder struct {
+	sync.Mutex
+	mode         string
+	file         *os.File
+	responses    map[string][][]byte
+	replayed     map[string]int
+	replayServer *ServerInfo
+}
+
+func upstreamRecordingKey(msg *dns.Msg) (string, error) {
+	if len(msg.Question) != 1 {
+		return "", errors.New("Unexpected number of questions")
+	}
+	question := msg.Question[0]
+	return fmt.Sprintf("%s\t%d\t%d", strings.ToLower(question.Name), question.Qtype, question.Qclass), nil
+}
+
+func NewUpstreamRecorder(mode string, fileName string) (*UpstreamRecorder, error) {
+	recorder := &UpstreamRecorder{mode: mode}
+	switch mode {
+	case UpstreamRecordingModeRecord:
+		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		// Recordings reveal the names that have been resolved
+		_ = file.Chmod(0o600)
+		recorder.file = file
+	case UpstreamRecordingModeReplay:
+		content, err := ReadTextFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		if err := recorder.load(content); err != nil {
+			return nil, fmt.Errorf("[%s]: %v", fileName, err)
+		}
+		recorder.replayServer = &ServerInfo{Name: UpstreamReplayServerName, rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+	default:
+		return nil, fmt.Errorf("Unsupported upstream recording mode: [%s]", mode)
+	}
+	return recorder, nil
+}
+
+func (recorder *UpstreamRecorder) load(content string) error {
+	recorder.responses = make(map[string][][]byte)
+	recorder.replayed = make(map[string]int)
+	for lineNo, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var recording UpstreamRecording
+		if err := json.Unmarshal([]byte(line), &recording); err != nil {
+			return fmt.Errorf("Invalid recording at line %d: %v", 1+lineNo, err)
+		}
+		msg := dns.Msg{}
+		if err := msg.Unpack(recording.Query); err != nil {
+			return fmt.Errorf("Invalid query at line %d: %v", 1+lineNo, err)
+		}
+		key, err := upstreamRecordingKey(&msg)
+		if err != nil {
+			return fmt.Errorf("Invalid query at line %d: %v", 1+lineNo, err)
+		}
+		if len(recording.Response) < MinDNSPacketSize {
+			return fmt.Errorf("Invalid response at line %d", 1+lineNo)
+		}
+		recorder.responses[key] = append(recorder.responses[key], recording.Response)
+	}
+	return nil
+}
+
+func (recorder *UpstreamRecorder) replaying() bool {
+	return recorder != nil && recorder.mode == UpstreamRecordingModeReplay
+}
+
+func (recorder *UpstreamRecorder) recording() bool {
+	return recorder != nil && recorder.mode == UpstreamRecordingModeRecord
+}
+
+// record appends a question/answer pair to the recording file
+func (recorder *UpstreamRecorder) record(serverName string, query []byte, response []byte) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		return
+	}
+	line, err := json.Marshal(UpstreamRecording{
+		Time:     time.Now().Unix(),
+		Server:   serverName,
+		Name:     msg.Question[0].Name,
+		Type:     dns.TypeToString[msg.Question[0].Qtype],
+		Query:    query,
+		Response: response,
+	})
+	if err != nil {
+		return
+	}
+	recorder.Lock()
+	_, _ = recorder.file.Write(append(line, '\n'))
+	recorder.Unlock()
+}
+
+// replay returns a copy of the next recorded response for a query, with the query's
+// transaction ID. Recorded responses are served in order, and the last one is then repeated.
+func (recorder *UpstreamRecorder) replay(query []byte) []byte {
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+	key, err := upstreamRecordingKey(&msg)
+	if err != nil {
+		return nil
+	}
+	recorder.Lock()
+	responses := recorder.responses[key]
+	if len(responses) == 0 {
+		recorder.Unlock()
+		return nil
+	}
+	i := recorder.replayed[key]
+	if i < len(responses)-1 {
+		recorder.replayed[key] = i + 1
+	}
+	response := append([]byte{}, responses[i]...)
+	recorder.Unlock()
+	SetTransactionID(response, TransactionID(query))
+	return response
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const WaitForInterfaceInterval = 1 * time.Second
+
+// interfaceReady tells whether an interface is up, has an address that is not link-local,
+// and, where this can be checked, is used by a default route
+func interfaceReady(name string) (bool, string) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false, "not found"
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return false, "down"
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false, err.Error()
+	}
+	hasAddress := false
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() && !ipNet.IP.IsLoopback() {
+			hasAddress = true
+			break
+		}
+	}
+	if !hasAddress {
+		return false, "no address"
+	}
+	if !hasDefaultRoute(name) {
+		return false, "no default route"
+	}
+	return true, ""
+}
+
+// waitForInterface delays the startup until an interface, typically the WAN interface of a router,
+// is ready. It gives up after `timeout` seconds.
+func waitForInterface(name string, timeout int) {
+	if timeout <= 0 {
+		timeout = MaxTimeout
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	lastReason := ""
+	for {
+		ready, reason := interfaceReady(name)
+		if ready {
+			if len(lastReason) > 0 {
+				dlog.Noticef("Interface [%s] is ready", name)
+			}
+			return
+		}
+		if reason != lastReason {
+			dlog.Noticef("Waiting for interface [%s] (%s)", name, reason)
+			lastReason = reason
+		}
+		if time.Now().After(deadline) {
+			dlog.Errorf("Timeout while waiting for interface [%s]", name)
+			return
+		}
+		time.Sleep(WaitForInterfaceInterval)
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hasDefaultRoute checks the IPv4 and IPv6 routing tables for a default route through an interface
+func hasDefaultRoute(name string) bool {
+	if content, err := os.ReadFile("/proc/net/route"); err == nil {
+		for _, line := range strings.Split(string(content), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) >= 8 && fields[0] == name && fields[1] == "00000000" && fields[7] == "00000000" {
+				return true
+			}
+		}
+	}
+	if content, err := os.ReadFile("/proc/net/ipv6_route"); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[9] != name || fields[1] != "00" ||
+				strings.Trim(fields[0], "0") != "" {
+				continue
+			}
+			// Skip unreachable routes (RTF_REJECT)
+			if flags, err := strconv.ParseUint(fields[8], 16, 32); err != nil || flags&0x0200 != 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+// hasDefaultRoute is not implemented on this platform; the interface only has to be up with an address
+func hasDefaultRoute(name string) bool {
+	return true
+}
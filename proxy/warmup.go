@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	WarmupConcurrency   = 4
+	WarmupQueryTimeout  = 5 * time.Second
+	WarmupRetryInterval = 10 * time.Second
+)
+
+type warmupQuery struct {
+	name  string
+	qType uint16
+}
+
+// Warmup resolves a list of names after startup, and optionally on a schedule, so that
+// the responses for the most frequently used names are already in the cache
+type Warmup struct {
+	file     string
+	interval time.Duration
+}
+
+func NewWarmup(file string, interval time.Duration) *Warmup {
+	return &Warmup{file: file, interval: interval}
+}
+
+// parseWarmupQueries parses lines made of a name, optionally followed by record types.
+// Names without record types are resolved for A and AAAA records.
+func parseWarmupQueries(content string) ([]warmupQuery, error) {
+	var queries []warmupQuery
+	for lineNo, line := range strings.Split(content, "\n") {
+		line = TrimAndStripInlineComments(line)
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.Fields(line)
+		name, err := NormalizeQName(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid name at line %d: [%s]", 1+lineNo, parts[0])
+		}
+		if len(parts) == 1 {
+			parts = append(parts, "A", "AAAA")
+		}
+		for _, qTypeStr := range parts[1:] {
+			qType, found := dns.StringToType[strings.ToUpper(qTypeStr)]
+			if !found {
+				return nil, fmt.Errorf("Unsupported record type at line %d: [%s]", 1+lineNo, qTypeStr)
+			}
+			queries = append(queries, warmupQuery{name: name, qType: qType})
+		}
+	}
+	return queries, nil
+}
+
+func (warmup *Warmup) load() ([]warmupQuery, error) {
+	content, err := ReadTextFile(warmup.file)
+	if err != nil {
+		return nil, err
+	}
+	return parseWarmupQueries(content)
+}
+
+// resolve sends the queries through the plugins, returning the number of successful responses
+func (warmup *Warmup) resolve(proxy *Proxy, queries []warmupQuery) int {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	resolved := 0
+	jobs := make(chan warmupQuery)
+	for i := 0; i < WarmupConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for query := range jobs {
+				msg := new(dns.Msg)
+				msg.SetQuestion(dns.Fqdn(query.name), query.qType)
+				ctx, cancel := context.WithTimeout(context.Background(), WarmupQueryTimeout)
+				response, err := proxy.Resolve(ctx, msg)
+				cancel()
+				if err != nil {
+					dlog.Debugf("Warmup: unable to resolve [%s] (%s): %v", query.name, dns.TypeToString[query.qType], err)
+					continue
+				}
+				if response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError {
+					lock.Lock()
+					resolved++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, query := range queries {
+		if proxy.stopped() {
+			break
+		}
+		jobs <- query
+	}
+	close(jobs)
+	wg.Wait()
+	return resolved
+}
+
+func (warmup *Warmup) run(proxy *Proxy) {
+	for proxy.serversInfo.count() == 0 {
+		select {
+		case <-proxy.quit:
+			return
+		case <-time.After(WarmupRetryInterval):
+		}
+	}
+	for {
+		queries, err := warmup.load()
+		if err != nil {
+			dlog.Errorf("Unable to load the warmup names from [%s]: %v", warmup.file, err)
+		} else {
+			start := time.Now()
+			resolved := warmup.resolve(proxy, queries)
+			dlog.Noticef("Warmup: %d/%d queries resolved in %v", resolved, len(queries), time.Since(start).Round(time.Millisecond))
+		}
+		if warmup.interval <= 0 {
+			return
+		}
+		select {
+		case <-proxy.quit:
+			return
+		case <-time.After(warmup.interval):
+		}
+		if !proxy.waitForMaintenanceWindow(MaintenanceTaskWarmup, time.Time{}) {
+			return
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"bytes"
@@ -10,8 +10,8 @@
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -55,7 +55,9 @@ type AltSupport struct {
 }
 
 type XTransport struct {
+	random                   *lockedRand
 	transport                *http.Transport
+	fdLimits                 *FDLimits
 	h3Transport              *http3.RoundTripper
 	keepAlive                time.Duration
 	timeout                  time.Duration
@@ -63,6 +65,7 @@ type XTransport struct {
 	altSupport               AltSupport
 	internalResolvers        []string
 	bootstrapResolvers       []string
+	secureBootstrapResolvers []string
 	mainProto                string
 	ignoreSystemDNS          bool
 	internalResolverReady    bool
@@ -75,6 +78,7 @@ type XTransport struct {
 	httpProxyFunction        func(*http.Request) (*url.URL, error)
 	tlsClientCreds           DOHClientCreds
 	keyLogWriter             io.Writer
+	tcpPool                  *TCPPool
 }
 
 func NewXTransport() *XTransport {
@@ -134,6 +138,20 @@ func (xTransport *XTransport) loadCachedIP(host string) (ip net.IP, expired bool
 	return
 }
 
+// expiringCachedHosts returns the cached names whose addresses expire within the given delay
+func (xTransport *XTransport) expiringCachedHosts(within time.Duration) []string {
+	var hosts []string
+	deadline := time.Now().Add(within)
+	xTransport.cachedIPs.RLock()
+	for host, item := range xTransport.cachedIPs.cache {
+		if item.expiration != nil && item.expiration.Before(deadline) {
+			hosts = append(hosts, host)
+		}
+	}
+	xTransport.cachedIPs.RUnlock()
+	return hosts
+}
+
 func (xTransport *XTransport) rebuildTransport() {
 	dlog.Debug("Rebuilding transport")
 	if xTransport.transport != nil {
@@ -166,9 +184,9 @@ func (xTransport *XTransport) rebuildTransport() {
 			addrStr = ipOnly + ":" + strconv.Itoa(port)
 			if xTransport.proxyDialer == nil {
 				dialer := &net.Dialer{Timeout: timeout, KeepAlive: timeout, DualStack: true}
-				return dialer.DialContext(ctx, network, addrStr)
+				return xTransport.fdLimits.countUpstream(dialer.DialContext(ctx, network, addrStr))
 			}
-			return (*xTransport.proxyDialer).Dial(network, addrStr)
+			return xTransport.fdLimits.countUpstream((*xTransport.proxyDialer).Dial(network, addrStr))
 		},
 	}
 	if xTransport.httpProxyFunction != nil {
@@ -321,7 +339,7 @@ func (xTransport *XTransport) resolveUsingSystem(host string) (ip net.IP, ttl ti
 		}
 	}
 	if len(ips) > 0 {
-		ip = ips[rand.Intn(len(ips))]
+		ip = ips[xTransport.random.Intn(len(ips))]
 	}
 	return
 }
@@ -331,12 +349,27 @@ func (xTransport *XTransport) resolveUsingResolver(
 	resolver string,
 ) (ip net.IP, ttl time.Duration, err error) {
 	dnsClient := dns.Client{Net: proto}
+	exchange := func(msg *dns.Msg) (*dns.Msg, error) {
+		if strings.HasPrefix(resolver, "https://") {
+			return xTransport.exchangeUsingDoH(msg, resolver)
+		}
+		if addr, isTLS := strings.CutPrefix(resolver, "tls://"); isTLS {
+			client := dns.Client{Net: "tcp-tls", Timeout: xTransport.timeout}
+			in, _, err := client.Exchange(msg, addr)
+			return in, err
+		}
+		if proto == "tcp" && xTransport.tcpPool != nil {
+			return xTransport.tcpPool.Exchange(msg, resolver, xTransport.timeout)
+		}
+		in, _, err := dnsClient.Exchange(msg, resolver)
+		return in, err
+	}
 	if xTransport.useIPv4 {
 		msg := dns.Msg{}
 		msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
 		msg.SetEdns0(uint16(MaxDNSPacketSize), true)
 		var in *dns.Msg
-		if in, _, err = dnsClient.Exchange(&msg, resolver); err == nil {
+		if in, err = exchange(&msg); err == nil {
 			answers := make([]dns.RR, 0)
 			for _, answer := range in.Answer {
 				if answer.Header().Rrtype == dns.TypeA {
@@ -344,7 +377,7 @@ func (xTransport *XTransport) resolveUsingResolver(
 				}
 			}
 			if len(answers) > 0 {
-				answer := answers[rand.Intn(len(answers))]
+				answer := answers[xTransport.random.Intn(len(answers))]
 				ip = answer.(*dns.A).A
 				ttl = time.Duration(answer.Header().Ttl) * time.Second
 				return
@@ -356,7 +389,7 @@ func (xTransport *XTransport) resolveUsingResolver(
 		msg.SetQuestion(dns.Fqdn(host), dns.TypeAAAA)
 		msg.SetEdns0(uint16(MaxDNSPacketSize), true)
 		var in *dns.Msg
-		if in, _, err = dnsClient.Exchange(&msg, resolver); err == nil {
+		if in, err = exchange(&msg); err == nil {
 			answers := make([]dns.RR, 0)
 			for _, answer := range in.Answer {
 				if answer.Header().Rrtype == dns.TypeAAAA {
@@ -364,7 +397,7 @@ func (xTransport *XTransport) resolveUsingResolver(
 				}
 			}
 			if len(answers) > 0 {
-				answer := answers[rand.Intn(len(answers))]
+				answer := answers[xTransport.random.Intn(len(answers))]
 				ip = answer.(*dns.AAAA).AAAA
 				ttl = time.Duration(answer.Header().Ttl) * time.Second
 				return
@@ -374,6 +407,26 @@ func (xTransport *XTransport) resolveUsingResolver(
 	return
 }
 
+func (xTransport *XTransport) exchangeUsingDoH(msg *dns.Msg, resolver string) (*dns.Msg, error) {
+	resolverURL, err := url.Parse(resolver)
+	if err != nil {
+		return nil, err
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	response, _, _, _, err := xTransport.DoHQuery(false, resolverURL, query, xTransport.timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	in := &dns.Msg{}
+	if err := in.Unpack(response); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
 func (xTransport *XTransport) resolveUsingResolvers(
 	proto, host string,
 	resolvers []string,
@@ -405,6 +458,12 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 	if cachedIP != nil && !expired {
 		return nil
 	}
+	return xTransport.resolveAndReplaceCachedIP(host, cachedIP)
+}
+
+// resolveAndReplaceCachedIP resolves a name and updates the cache, keeping the previous
+// address for a grace period if the name cannot be resolved
+func (xTransport *XTransport) resolveAndReplaceCachedIP(host string, cachedIP net.IP) error {
 	var foundIP net.IP
 	var ttl time.Duration
 	var err error
@@ -412,7 +471,13 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 	if xTransport.mainProto == "tcp" {
 		protos = []string{"tcp", "udp"}
 	}
-	if xTransport.ignoreSystemDNS {
+	// Encrypted bootstrap resolvers are tried first, so that names are only sent in plaintext as a fallback
+	err = errors.New("No encrypted bootstrap resolvers")
+	if len(xTransport.secureBootstrapResolvers) > 0 {
+		dlog.Debugf("Resolving server host [%s] using encrypted bootstrap resolvers", host)
+		foundIP, ttl, err = xTransport.resolveUsingResolvers("", host, xTransport.secureBootstrapResolvers)
+	}
+	if err != nil && xTransport.ignoreSystemDNS {
 		if xTransport.internalResolverReady {
 			for _, proto := range protos {
 				foundIP, ttl, err = xTransport.resolveUsingResolvers(proto, host, xTransport.internalResolvers)
@@ -424,14 +489,14 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 			err = errors.New("Service is not usable yet")
 			dlog.Notice(err)
 		}
-	} else {
+	} else if err != nil {
 		foundIP, ttl, err = xTransport.resolveUsingSystem(host)
 		if err != nil {
 			err = errors.New("System DNS is not usable yet")
 			dlog.Notice(err)
 		}
 	}
-	if err != nil {
+	if err != nil && len(xTransport.bootstrapResolvers) > 0 {
 		for _, proto := range protos {
 			if err != nil {
 				dlog.Noticef(
@@ -446,7 +511,8 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 			}
 		}
 	}
-	if err != nil && xTransport.ignoreSystemDNS {
+	// If all the bootstrap resolvers are encrypted, names are never sent in plaintext
+	if err != nil && xTransport.ignoreSystemDNS && len(xTransport.bootstrapResolvers) > 0 {
 		dlog.Noticef("Bootstrap resolvers didn't respond - Trying with the system resolver as a last resort")
 		foundIP, ttl, err = xTransport.resolveUsingSystem(host)
 	}
@@ -484,6 +550,20 @@ func (xTransport *XTransport) Fetch(
 	body *[]byte,
 	timeout time.Duration,
 	compress bool,
+) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	return xTransport.fetch(method, url, accept, contentType, body, timeout, compress, MaxHTTPBodyLength, nil)
+}
+
+func (xTransport *XTransport) fetch(
+	method string,
+	url *url.URL,
+	accept string,
+	contentType string,
+	body *[]byte,
+	timeout time.Duration,
+	compress bool,
+	maxBodyLength int64,
+	extraHeaders map[string]string,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
 	if timeout <= 0 {
 		timeout = xTransport.timeout
@@ -514,6 +594,9 @@ func (xTransport *XTransport) Fetch(
 		header["Content-Type"] = []string{contentType}
 	}
 	header["Cache-Control"] = []string{"max-stale"}
+	for key, value := range extraHeaders {
+		header[http.CanonicalHeaderKey(key)] = []string{value}
+	}
 	if body != nil {
 		h := sha512.Sum512(*body)
 		qs := url.Query()
@@ -532,7 +615,7 @@ func (xTransport *XTransport) Fetch(
 		)
 		return nil, 0, nil, 0, err
 	}
-	if compress && body == nil {
+	if compress {
 		header["Accept-Encoding"] = []string{"gzip"}
 	}
 	req := &http.Request{
@@ -603,15 +686,15 @@ func (xTransport *XTransport) Fetch(
 	tls := resp.TLS
 
 	var bodyReader io.ReadCloser = resp.Body
-	if compress && resp.Header.Get("Content-Encoding") == "gzip" {
-		bodyReader, err = gzip.NewReader(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	if compress && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		bodyReader, err = gzip.NewReader(io.LimitReader(resp.Body, maxBodyLength))
 		if err != nil {
 			return nil, statusCode, tls, rtt, err
 		}
 		defer bodyReader.Close()
 	}
 
-	bin, err := io.ReadAll(io.LimitReader(bodyReader, MaxHTTPBodyLength))
+	bin, err := io.ReadAll(io.LimitReader(bodyReader, maxBodyLength))
 	if err != nil {
 		return nil, statusCode, tls, rtt, err
 	}
@@ -627,6 +710,17 @@ func (xTransport *XTransport) GetWithCompression(
 	return xTransport.Fetch("GET", url, accept, "", nil, timeout, true)
 }
 
+// GetLargeWithCompression is like GetWithCompression, for documents that can be up to maxBodyLength bytes long;
+// longer documents are truncated
+func (xTransport *XTransport) GetLargeWithCompression(
+	url *url.URL,
+	accept string,
+	timeout time.Duration,
+	maxBodyLength int64,
+) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	return xTransport.fetch("GET", url, accept, "", nil, timeout, true, maxBodyLength, nil)
+}
+
 func (xTransport *XTransport) Get(
 	url *url.URL,
 	accept string,
@@ -651,25 +745,45 @@ func (xTransport *XTransport) dohLikeQuery(
 	url *url.URL,
 	body []byte,
 	timeout time.Duration,
+	headers map[string]string,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	method, contentType, bodyPtr := "POST", dataType, &body
 	if useGet {
 		qs := url.Query()
 		encBody := base64.RawURLEncoding.EncodeToString(body)
 		qs.Add("dns", encBody)
 		url2 := *url
 		url2.RawQuery = qs.Encode()
-		return xTransport.Get(&url2, dataType, timeout)
-	}
-	return xTransport.Post(url, dataType, dataType, &body, timeout)
+		url = &url2
+		method, contentType, bodyPtr = "GET", "", nil
+	}
+	// One more byte is read, so that oversized responses are rejected instead of being truncated
+	response, statusCode, tls, rtt, err := xTransport.fetch(
+		method,
+		url,
+		dataType,
+		contentType,
+		bodyPtr,
+		timeout,
+		true,
+		MaxDoHBodyLength+1,
+		headers,
+	)
+	if err == nil && len(response) > MaxDoHBodyLength {
+		return nil, statusCode, tls, rtt, fmt.Errorf("Response too large (more than %d bytes)", MaxDoHBodyLength)
+	}
+	return response, statusCode, tls, rtt, err
 }
 
+// DoHQuery sends a DNS query to a DoH server; headers are added to the HTTP request
 func (xTransport *XTransport) DoHQuery(
 	useGet bool,
 	url *url.URL,
 	body []byte,
 	timeout time.Duration,
+	headers map[string]string,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
-	return xTransport.dohLikeQuery("application/dns-message", useGet, url, body, timeout)
+	return xTransport.dohLikeQuery("application/dns-message", useGet, url, body, timeout, headers)
 }
 
 func (xTransport *XTransport) ObliviousDoHQuery(
@@ -678,5 +792,5 @@ func (xTransport *XTransport) ObliviousDoHQuery(
 	body []byte,
 	timeout time.Duration,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
-	return xTransport.dohLikeQuery("application/oblivious-dns-message", useGet, url, body, timeout)
+	return xTransport.dohLikeQuery("application/oblivious-dns-message", useGet, url, body, timeout, nil)
 }